@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+
+	"github.com/thyge/gonmos/pkg/nmos"
+)
+
+func main() {
+	port := flag.Int("port", 8891, "Authorization server port")
+	keyFile := flag.String("key", "auth.pem", "RSA signing key, generated if missing")
+	issuer := flag.String("issuer", "", "Issuer URL, defaults to http://localhost:<port>")
+	jwksOut := flag.String("jwks-out", "", "Write the JWKS to this file for servers validating offline")
+	token := flag.String("token", "", "Print a token with this scope, e.g. \"node connection\", and exit")
+	tlsCert := flag.String("tls-cert", "", "Serve HTTPS with these comma separated certificate files, e.g. RSA and ECDSA")
+	tlsKey := flag.String("tls-key", "", "Private keys of the -tls-cert certificates")
+	flag.Parse()
+
+	if *issuer == "" {
+		proto := "http"
+		if *tlsCert != "" {
+			proto = "https"
+		}
+		*issuer = fmt.Sprintf("%s://localhost:%d", proto, *port)
+	}
+	as, err := nmos.NewAuthServer(*issuer, *keyFile)
+	if err != nil {
+		log.Fatalln("failed to load key", err)
+	}
+	if *jwksOut != "" {
+		data, _ := json.MarshalIndent(as.JWKS(), "", "\t")
+		if err := ioutil.WriteFile(*jwksOut, data, 0644); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if *token != "" {
+		t, err := as.Token("gonmos-cli", *token)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		fmt.Println(t)
+		return
+	}
+
+	certs, err := nmos.ParseCertificates(*tlsCert, *tlsKey)
+	if err != nil {
+		log.Fatalln("tls", err)
+	}
+	nmosws := new(nmos.NMOSWebServer)
+	if len(certs) > 0 {
+		if err := nmosws.EnableTLS(certs...); err != nil {
+			log.Fatalln("tls", err)
+		}
+	}
+	nmosws.Start(*port)
+	nmosws.InitAuth(as)
+	defer nmosws.Stop()
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	oscall := <-c
+	log.Printf("system call:%+v", oscall)
+}
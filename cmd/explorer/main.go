@@ -3,60 +3,59 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"fmt"
-	"io"
+	"flag"
 	"log"
-	"net/http"
+	"os"
+	"os/signal"
 	"time"
 
-	"github.com/grandcat/zeroconf"
+	"github.com/thyge/gonmos/pkg/monitor"
 	"github.com/thyge/gonmos/pkg/nmos"
 )
 
-func GetResource(uri string) {
-	resp, err := http.Get(uri)
-	if err != nil {
-		panic(err)
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode == 200 {
-		body, err := io.ReadAll(resp.Body)
+func main() {
+	query := flag.String("query", "", "Query API base URL, found over mDNS if empty")
+	apiVersion := flag.String("api-version", "v1.3", "Query API version")
+	timeout := flag.Duration("timeout", 5*time.Second, "How long to browse for a Query API")
+	tui := flag.Bool("tui", false, "Watch the registry live")
+	table := flag.Bool("table", false, "Print a table instead of a tree")
+	asJSON := flag.Bool("json", false, "Print the topology as JSON")
+	var filter nmos.NMOSTopologyFilter
+	flag.StringVar(&filter.Label, "label", "", "Filter by sender, receiver, device or node label")
+	flag.StringVar(&filter.Format, "format", "", "Filter by format, e.g. video")
+	flag.StringVar(&filter.Transport, "transport", "", "Filter by transport, e.g. rtp")
+	flag.Parse()
+
+	base := *query
+	if base == "" {
+		var err error
+		base, err = nmos.BrowseQuery(*timeout)
 		if err != nil {
-			panic(err)
+			log.Fatalln("Failed to browse:", err.Error())
 		}
-		nodes := []nmos.NMOSNodeData{}
-		json.Unmarshal(body, &nodes)
-		stringStruct, _ := json.MarshalIndent(nodes, "", "\t")
-		fmt.Println(string(stringStruct))
-	} else {
-		log.Println("failed get on:", uri)
 	}
-}
-
-func GetNodesFromReg(results <-chan *zeroconf.ServiceEntry) {
-	for entry := range results {
-		// fmt.Println("Found registry service:", entry.AddrIPv4, entry.Domain, entry.Port, entry.Text)
-		apiVersion := "v1.3"
-		regAddress := fmt.Sprintf("%s:%d", entry.AddrIPv4[0], entry.Port)
-		queryuri := fmt.Sprintf("http://%s/x-nmos/query/%s/nodes", regAddress, apiVersion)
-
-		GetResource(queryuri)
+	client := &nmos.NMOSQueryClient{URL: base, Version: *apiVersion}
+	if *tui {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		if err := monitor.Run(ctx, client, ""); err != nil {
+			log.Fatalln(err)
+		}
+		return
 	}
-}
-
-func main() {
-	resolver, err := zeroconf.NewResolver(nil)
+	t, err := client.Topology()
 	if err != nil {
-		log.Fatalln("Failed to initialize resolver:", err.Error())
+		log.Fatalln("Failed to read the registry:", err.Error())
 	}
-	entries := make(chan *zeroconf.ServiceEntry)
-	go GetNodesFromReg(entries)
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
-	defer cancel()
-	err = resolver.Browse(ctx, "_nmos-register._tcp", "local", entries)
-	if err != nil {
-		log.Fatalln("Failed to browse:", err.Error())
+	t = t.Filter(filter)
+	switch {
+	case *asJSON:
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		enc.Encode(t)
+	case *table:
+		t.WriteTable(os.Stdout)
+	default:
+		t.WriteTree(os.Stdout)
 	}
-	<-ctx.Done()
-	time.Sleep(1 * time.Second)
 }
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/thyge/gonmos/pkg/nmos"
+)
+
+func runConnect(args []string) error {
+	var o output
+	fs := newFlags("connect", &o)
+	var b browser
+	b.flags(fs, "How long to browse for a Query API and to wait for the activation")
+	var connVersion string
+	connectionVersionFlag(fs, &connVersion)
+	sender := fs.String("sender", "", "Sender id or label, may also follow the flags")
+	receiver := fs.String("receiver", "", "Receiver id or label, may also follow the sender")
+	at := fs.String("at", "", "Activate at this TAI time, <seconds>:<nanoseconds>")
+	in := fs.Duration("in", 0, "Activate after this long instead of immediately")
+	enable := fs.Bool("enable", true, "master_enable of the receiver, false stages the sender but stops receiving")
+	if err := o.parse(fs, args); err != nil {
+		return err
+	}
+	rest := fs.Args()
+	if *sender == "" && len(rest) > 0 {
+		*sender, rest = rest[0], rest[1:]
+	}
+	if *receiver == "" && len(rest) > 0 {
+		*receiver = rest[0]
+	}
+	if *sender == "" || *receiver == "" {
+		return errors.New("a sender and a receiver are required")
+	}
+	if *at != "" && *in != 0 {
+		return errors.New("-at and -in can't be combined")
+	}
+	act, err := activation(*at, *in)
+	if err != nil {
+		return err
+	}
+	qc, err := b.client()
+	if err != nil {
+		return err
+	}
+	t, err := qc.Topology()
+	if err != nil {
+		return err
+	}
+	s, sd, err := t.FindSender(*sender)
+	if err != nil {
+		return err
+	}
+	r, rd, err := t.FindReceiver(*receiver)
+	if err != nil {
+		return err
+	}
+	control := "urn:x-nmos:control:sr-ctrl/" + connVersion
+	senderAPI, receiverAPI := sd.ControlHref(control), rd.ControlHref(control)
+	if senderAPI == "" {
+		return fmt.Errorf("device %s of sender %s has no %s control", sd.Id, s.Id, control)
+	}
+	if receiverAPI == "" {
+		return fmt.Errorf("device %s of receiver %s has no %s control", rd.Id, r.Id, control)
+	}
+
+	cc := &nmos.NMOSConnectionClient{HTTPClient: qc.HTTPClient}
+	patch := nmos.NMOSReceiverPatch{SenderId: &s.Id, MasterEnable: *enable, Activation: &act}
+	// only RTP senders have a transport file
+	if strings.HasPrefix(s.Transport, nmos.TransportRTP) {
+		sdp, err := cc.TransportFile(senderAPI, s.Id)
+		if err != nil {
+			return err
+		}
+		sdpType := "application/sdp"
+		patch.TransportFile = &nmos.NMOSTransportFile{Data: &sdp, Type: &sdpType}
+	}
+	staged, err := cc.StageReceiver(receiverAPI, r.Id, patch)
+	if err != nil {
+		return err
+	}
+	nmos.Infoln(fmt.Sprintf("staged sender %s on receiver %s, %s", s.Id, r.Id, *act.Mode))
+
+	// wait for a scheduled activation, then give the node until timeout
+	deadline := time.Now().Add(b.timeout)
+	if staged.Activation.ActivationTime != nil {
+		if when, err := nmos.ParseTAI(*staged.Activation.ActivationTime); err == nil && when.After(time.Now()) {
+			nmos.Infoln("waiting for the activation at", *staged.Activation.ActivationTime)
+			time.Sleep(time.Until(when))
+			deadline = when.Add(b.timeout)
+		}
+	}
+	var active nmos.NMOSReceiverParams
+	for {
+		active, err = cc.ActiveReceiver(receiverAPI, r.Id)
+		if err == nil && activated(active, staged, s.Id, *enable) {
+			break
+		}
+		if time.Now().After(deadline) {
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("receiver %s is not active with sender %s after %s", r.Id, s.Id, b.timeout)
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+
+	result := struct {
+		Sender_id       uuid.UUID `json:"sender_id"`
+		Receiver_id     uuid.UUID `json:"receiver_id"`
+		Master_enable   bool      `json:"master_enable"`
+		Mode            string    `json:"mode"`
+		Activation_time *string   `json:"activation_time"`
+	}{s.Id, r.Id, active.MasterEnable, *act.Mode, active.Activation.ActivationTime}
+	o.print(result, func(w io.Writer) {
+		at := "now"
+		if result.Activation_time != nil {
+			at = *result.Activation_time
+		}
+		fmt.Fprintf(w, "connected %s (%s) to %s (%s), master_enable %v, activated at %s\n",
+			s.Label, s.Id, r.Label, r.Id, result.Master_enable, at)
+	})
+	return nil
+}
+
+// activated is true once the receiver is active with sender, and with the
+// activation that staged announced rather than an earlier one
+func activated(active nmos.NMOSReceiverParams, staged nmos.NMOSReceiverParams, sender uuid.UUID, enable bool) bool {
+	if active.SenderId == nil || *active.SenderId != sender || active.MasterEnable != enable {
+		return false
+	}
+	want := staged.Activation.ActivationTime
+	return want == nil || (active.Activation.ActivationTime != nil && *active.Activation.ActivationTime == *want)
+}
+
+// activation returns an immediate activation, or one scheduled at a TAI
+// time or after a delay
+func activation(at string, in time.Duration) (nmos.NMOSActivation, error) {
+	var mode, requested string
+	switch {
+	case at != "":
+		if _, err := nmos.ParseTAI(at); err != nil {
+			return nmos.NMOSActivation{}, err
+		}
+		mode, requested = nmos.ActivateScheduledAbsolute, at
+	case in < 0:
+		return nmos.NMOSActivation{}, errors.New("-in must not be negative")
+	case in > 0:
+		mode = nmos.ActivateScheduledRelative
+		requested = fmt.Sprintf("%d:%d", in/time.Second, in%time.Second)
+	default:
+		mode = nmos.ActivateImmediate
+		return nmos.NMOSActivation{Mode: &mode}, nil
+	}
+	return nmos.NMOSActivation{Mode: &mode, RequestedTime: &requested}, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+
+	"github.com/thyge/gonmos/pkg/monitor"
+	"github.com/thyge/gonmos/pkg/nmos"
+)
+
+func runExplore(args []string) error {
+	var o output
+	fs := newFlags("explore", &o)
+	var b browser
+	b.flags(fs, "How long to browse for a Query API")
+	format := fs.String("output", "tree", "tree or table, ignored with -json")
+	tui := fs.Bool("tui", false, "Watch the registry live instead of printing it once")
+	registration := fs.String("registration", "", "Registration API base URL to read node heartbeats from with -tui, the query URL if empty")
+	var filter nmos.NMOSTopologyFilter
+	fs.StringVar(&filter.Label, "label", "", "Only show senders and receivers whose label, or device or node label, contains this")
+	fs.StringVar(&filter.Format, "format", "", "Only show this format, e.g. video or urn:x-nmos:format:audio")
+	fs.StringVar(&filter.Transport, "transport", "", "Only show this transport, e.g. rtp, rtp.mcast or websocket")
+	if err := o.parse(fs, args); err != nil {
+		return err
+	}
+	if *format != "tree" && *format != "table" {
+		return fmt.Errorf("unknown output %q", *format)
+	}
+	qc, err := b.client()
+	if err != nil {
+		return err
+	}
+
+	if *tui {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		return monitor.Run(ctx, qc, *registration)
+	}
+	t, err := qc.Topology()
+	if err != nil {
+		return err
+	}
+	t = t.Filter(filter)
+	o.print(t, func(w io.Writer) {
+		if *format == "table" {
+			t.WriteTable(w)
+		} else {
+			t.WriteTree(w)
+		}
+	})
+	return nil
+}
@@ -0,0 +1,203 @@
+// Command gonmos runs NMOS nodes and registries and drives them from
+// scripts.
+//
+//	gonmos <command> [flags]
+//
+// Every command takes -log-level and -json. The other flags shared by
+// commands mean the same in each, and a command only takes those it uses:
+//
+//	-port -interface -tls-cert -tls-key   node, registry: the APIs served
+//	-query -interface -timeout            explore, connect: finding a registry
+//	-api-version                          node, explore, connect: the IS-04 version
+//	-connection-version                   connect, sdp: the IS-05 version
+//	-ca                                   node, explore, connect, sdp: verifying servers
+//	-config                               node, validate: the node config
+//
+// The registry serves every IS-04 version and has no config file, validate
+// only reads files and sdp asks the node given by -node, so these neither
+// listen nor browse. Run gonmos <command> -h for the flags of a command.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/thyge/gonmos/pkg/nmos"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+var commands = []command{
+	{"node", "run a node from a YAML or JSON config", runNode},
+	{"registry", "run a registration and query API", runRegistry},
+	{"explore", "print the topology of a registry", runExplore},
+	{"validate", "check node config files", runValidate},
+	{"sdp", "get the transport file of a sender", runSDP},
+	{"connect", "connect a receiver to a sender", runConnect},
+}
+
+// errFailed reports a failure the command has already printed
+var errFailed = errors.New("failed")
+
+func main() {
+	if len(os.Args) < 2 {
+		usage(os.Stderr)
+		os.Exit(2)
+	}
+	name := os.Args[1]
+	for _, c := range commands {
+		if c.name != name {
+			continue
+		}
+		if err := c.run(os.Args[2:]); err != nil {
+			if err != errFailed {
+				fmt.Fprintf(os.Stderr, "gonmos %s: %v\n", name, err)
+			}
+			os.Exit(1)
+		}
+		return
+	}
+	if name == "help" || name == "-h" || name == "--help" {
+		usage(os.Stdout)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "gonmos: unknown command %q\n", name)
+	usage(os.Stderr)
+	os.Exit(2)
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: gonmos <command> [flags]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-10s %s\n", c.name, c.usage)
+	}
+}
+
+// output holds the flags every command has
+type output struct {
+	logLevel string
+	json     bool
+}
+
+func newFlags(name string, o *output) *flag.FlagSet {
+	fs := flag.NewFlagSet("gonmos "+name, flag.ExitOnError)
+	fs.StringVar(&o.logLevel, "log-level", "info", "debug, info, error or none")
+	fs.BoolVar(&o.json, "json", false, "Machine readable JSON output")
+	return fs
+}
+
+// parse parses args and applies the log level
+func (o *output) parse(fs *flag.FlagSet, args []string) error {
+	fs.Parse(args)
+	level, err := nmos.ParseLogLevel(o.logLevel)
+	if err != nil {
+		return err
+	}
+	nmos.SetLogLevel(level)
+	return nil
+}
+
+// server holds the flags of the commands serving APIs
+type server struct {
+	port    int
+	iface   string
+	tlsCert string
+	tlsKey  string
+}
+
+func (s *server) flags(fs *flag.FlagSet, port int, portUsage string, ifaceUsage string) {
+	fs.IntVar(&s.port, "port", port, portUsage)
+	fs.StringVar(&s.iface, "interface", "", ifaceUsage)
+	fs.StringVar(&s.tlsCert, "tls-cert", "", "Serve HTTPS with these comma separated certificate files, e.g. RSA and ECDSA")
+	fs.StringVar(&s.tlsKey, "tls-key", "", "Private keys of the -tls-cert certificates")
+}
+
+func (s *server) certificates() ([]nmos.NMOSCertificate, error) {
+	return nmos.ParseCertificates(s.tlsCert, s.tlsKey)
+}
+
+// browser holds the flags of the commands reading a registry
+type browser struct {
+	iface      string
+	query      string
+	apiVersion string
+	timeout    time.Duration
+	caFile     string
+}
+
+func (b *browser) flags(fs *flag.FlagSet, timeoutUsage string) {
+	fs.StringVar(&b.iface, "interface", "", "Network interface to browse on, all if empty")
+	fs.StringVar(&b.query, "query", "", "Query API base URL, e.g. http://registry:8888, found over mDNS if empty")
+	fs.DurationVar(&b.timeout, "timeout", 5*time.Second, timeoutUsage)
+	apiVersionFlag(fs, &b.apiVersion)
+	caFlag(fs, &b.caFile)
+}
+
+// client returns a client of the Query API given by -query or found on
+// -interface
+func (b *browser) client() (*nmos.NMOSQueryClient, error) {
+	client, err := nmos.NewHTTPClient(b.caFile)
+	if err != nil {
+		return nil, err
+	}
+	base, err := queryURL(b.query, b.iface, b.timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &nmos.NMOSQueryClient{URL: base, Version: b.apiVersion, HTTPClient: client}, nil
+}
+
+// queryURL returns query, or the first Query API found on iface if empty
+func queryURL(query string, iface string, timeout time.Duration) (string, error) {
+	if query != "" {
+		return query, nil
+	}
+	var ifaces []net.Interface
+	if iface != "" {
+		intf, err := net.InterfaceByName(iface)
+		if err != nil {
+			return "", err
+		}
+		ifaces = append(ifaces, *intf)
+	}
+	return nmos.BrowseQuery(timeout, ifaces...)
+}
+
+func apiVersionFlag(fs *flag.FlagSet, v *string) {
+	fs.StringVar(v, "api-version", "v1.3", "IS-04 version of the registry")
+}
+
+func connectionVersionFlag(fs *flag.FlagSet, v *string) {
+	fs.StringVar(v, "connection-version", "v1.1", "IS-05 Connection API version")
+}
+
+func caFlag(fs *flag.FlagSet, file *string) {
+	fs.StringVar(file, "ca", "", "CA bundle to verify the registry and nodes with, system roots if empty")
+}
+
+func configFlag(fs *flag.FlagSet, file *string, usage string) {
+	fs.StringVar(file, "config", "", usage)
+}
+
+// print writes v as JSON with -json, or calls text otherwise
+func (o *output) print(v interface{}, text func(w io.Writer)) {
+	if o.json {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		enc.Encode(v)
+		return
+	}
+	text(os.Stdout)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/thyge/gonmos/pkg/node"
+)
+
+func runNode(args []string) error {
+	var o output
+	fs := newFlags("node", &o)
+	var srv server
+	srv.flags(fs, 0, "Node API port, from the config if 0", "Comma separated network interfaces to advertise, all if empty")
+	var config, apiVersion, caFile string
+	configFlag(fs, &config, "YAML or JSON node config, reloaded on SIGHUP or change")
+	apiVersionFlag(fs, &apiVersion)
+	caFlag(fs, &caFile)
+	registry := fs.String("registry", "", "Registration API base URL, found over mDNS if empty")
+	if err := o.parse(fs, args); err != nil {
+		return err
+	}
+	if config == "" {
+		return errors.New("-config is required")
+	}
+	cfg, err := node.LoadConfig(config)
+	if err != nil {
+		return err
+	}
+	app := new(node.NMOSNode)
+	certs, err := srv.certificates()
+	if err != nil {
+		return err
+	}
+	app.Certificates = certs
+	app.CAFile = caFile
+	cfg.Configure(app)
+	app.APIVersion = apiVersion
+	if srv.port != 0 {
+		cfg.Port = srv.port
+	}
+	if srv.iface != "" {
+		app.Interfaces = strings.Split(srv.iface, ",")
+	}
+	if *registry != "" {
+		app.Registry = *registry
+	}
+	devices, err := cfg.BuildDevices()
+	if err != nil {
+		return err
+	}
+	if err := cfg.SaveState(); err != nil {
+		return err
+	}
+
+	summary := struct {
+		Id      uuid.UUID `json:"id"`
+		Label   string    `json:"label"`
+		Port    int       `json:"port"`
+		Devices int       `json:"devices"`
+	}{cfg.Id, cfg.Label, cfg.Port, len(devices)}
+	o.print(summary, func(w io.Writer) {
+		fmt.Fprintf(w, "node %s %q on port %d with %d devices\n", summary.Id, summary.Label, summary.Port, summary.Devices)
+	})
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	app.Start(ctx, cfg.Port, devices...)
+	return nil
+}
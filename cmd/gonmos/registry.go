@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/thyge/gonmos/pkg/nmos"
+)
+
+func runRegistry(args []string) error {
+	var o output
+	fs := newFlags("registry", &o)
+	var srv server
+	srv.flags(fs, 8888, "Registration and Query API port", "Network interface to listen on, all if empty")
+	expiry := fs.Duration("expiry", 12*time.Second, "Remove nodes without a heartbeat for this long")
+	jwksFile := fs.String("jwks", "", "Require IS-10 tokens signed by keys in this JWKS file")
+	jwksURI := fs.String("jwks-uri", "", "Require IS-10 tokens signed by keys from this JWKS endpoint")
+	if err := o.parse(fs, args); err != nil {
+		return err
+	}
+
+	nmosws := new(nmos.NMOSWebServer)
+	if srv.iface != "" {
+		if nmosws.Host = nmos.InterfaceIP(srv.iface); nmosws.Host == "" {
+			return fmt.Errorf("interface %s has no IPv4 address", srv.iface)
+		}
+	}
+	certs, err := srv.certificates()
+	if err != nil {
+		return err
+	}
+	if len(certs) > 0 {
+		if err := nmosws.EnableTLS(certs...); err != nil {
+			return err
+		}
+	}
+	nmosws.Start(srv.port)
+	defer nmosws.Stop()
+	if *jwksFile != "" || *jwksURI != "" {
+		v, err := nmos.NewAuthValidator(nmos.NMOSAuthConfig{JWKSFile: *jwksFile, JWKSURI: *jwksURI})
+		if err != nil {
+			return err
+		}
+		nmosws.EnableAuth(v)
+	}
+	reg := nmos.NewRegistry()
+	reg.Expiry = *expiry
+	nmosws.InitRegistry(reg)
+
+	summary := struct {
+		Proto string `json:"api_proto"`
+		Port  int    `json:"port"`
+		Auth  bool   `json:"api_auth"`
+	}{nmosws.Proto(), srv.port, nmosws.Auth != nil}
+	o.print(summary, func(w io.Writer) {
+		fmt.Fprintf(w, "registry on %s port %d, auth %v\n", summary.Proto, summary.Port, summary.Auth)
+	})
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	reg.Run(ctx)
+	return nil
+}
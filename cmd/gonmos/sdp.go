@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/thyge/gonmos/pkg/nmos"
+)
+
+func runSDP(args []string) error {
+	var o output
+	fs := newFlags("sdp", &o)
+	nodeURL := fs.String("node", "http://127.0.0.1:8889", "Base URL of the node serving the sender")
+	sender := fs.String("sender", "", "Sender id, may also follow the flags")
+	var connVersion, caFile string
+	connectionVersionFlag(fs, &connVersion)
+	caFlag(fs, &caFile)
+	if err := o.parse(fs, args); err != nil {
+		return err
+	}
+	if *sender == "" && fs.NArg() > 0 {
+		*sender = fs.Arg(0)
+	}
+	id, err := uuid.Parse(*sender)
+	if err != nil {
+		return errors.New("a sender id is required")
+	}
+	client, err := nmos.NewHTTPClient(caFile)
+	if err != nil {
+		return err
+	}
+
+	uri := fmt.Sprintf("%s/x-nmos/connection/%s/single/senders/%s/transportfile", strings.TrimSuffix(*nodeURL, "/"), connVersion, id)
+	resp, err := client.Get(uri)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s %s", uri, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	result := struct {
+		Sender_id uuid.UUID `json:"sender_id"`
+		SDP       string    `json:"sdp"`
+	}{id, string(body)}
+	o.print(result, func(w io.Writer) {
+		w.Write(body)
+	})
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/thyge/gonmos/pkg/node"
+)
+
+type validation struct {
+	File   string                `json:"file"`
+	Valid  bool                  `json:"valid"`
+	Errors node.NMOSConfigErrors `json:"errors,omitempty"`
+}
+
+func runValidate(args []string) error {
+	var o output
+	fs := newFlags("validate", &o)
+	var config string
+	configFlag(fs, &config, "Node config to check, more can follow the flags")
+	if err := o.parse(fs, args); err != nil {
+		return err
+	}
+	files := fs.Args()
+	if config != "" {
+		files = append([]string{config}, files...)
+	}
+	if len(files) == 0 {
+		return errors.New("no config given")
+	}
+
+	var results []validation
+	valid := true
+	for _, file := range files {
+		v := validation{File: file, Valid: true}
+		if _, err := node.LoadConfig(file); err != nil {
+			v.Valid = false
+			if !errors.As(err, &v.Errors) {
+				v.Errors = node.NMOSConfigErrors{{File: file, Msg: err.Error()}}
+			}
+		}
+		valid = valid && v.Valid
+		results = append(results, v)
+	}
+	o.print(results, func(w io.Writer) {
+		for _, v := range results {
+			if v.Valid {
+				fmt.Fprintln(w, v.File+": ok")
+			}
+			for _, e := range v.Errors {
+				fmt.Fprintln(w, e)
+			}
+		}
+	})
+	if !valid {
+		return errFailed
+	}
+	return nil
+}
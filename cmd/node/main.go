@@ -2,12 +2,10 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"flag"
 	"log"
 	"os"
 	"os/signal"
-	"strconv"
-	"time"
 
 	"github.com/google/uuid"
 	"github.com/thyge/gonmos/pkg/nmos"
@@ -15,8 +13,19 @@ import (
 )
 
 func main() {
+	tlsCert := flag.String("tls-cert", "", "Serve HTTPS with these comma separated certificate files, e.g. RSA and ECDSA")
+	tlsKey := flag.String("tls-key", "", "Private keys of the -tls-cert certificates")
+	caFile := flag.String("ca", "", "CA bundle to verify the registry with, system roots if empty")
+	configFile := flag.String("config", "", "YAML or JSON node config, reloaded on SIGHUP or change. The built in example if empty")
+	flag.Parse()
 
 	app := new(node.NMOSNode)
+	certs, err := nmos.ParseCertificates(*tlsCert, *tlsKey)
+	if err != nil {
+		log.Fatalln("tls", err)
+	}
+	app.Certificates = certs
+	app.CAFile = *caFile
 	ctx, cancel := context.WithCancel(context.Background())
 
 	c := make(chan os.Signal, 1)
@@ -27,10 +36,33 @@ func main() {
 		cancel()
 	}()
 
-	// example config
+	if *configFile != "" {
+		cfg, err := node.LoadConfig(*configFile)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		cfg.Configure(app)
+		devices, err := cfg.BuildDevices()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if err := cfg.SaveState(); err != nil {
+			log.Fatalln(err)
+		}
+		app.Start(ctx, cfg.Port, devices...)
+		return
+	}
+
+	// example config, ids derived from the node key are kept across restarts
+	port := 8889
+	key, err := nmos.NodeKey(node.DefaultKeyFile(port))
+	if err != nil {
+		log.Fatalln("node key", err)
+	}
+	app.Id = nmos.StableID(key, "node")
 	d := &nmos.NMOSDevice{
-		Id:          uuid.New(),
-		Version:     fmt.Sprintf("%s:0", strconv.FormatInt(time.Now().Unix(), 10)),
+		Id:          nmos.StableID(key, app.Id.String(), "device", "Test"),
+		Version:     nmos.NewVersion(),
 		Description: "test",
 		Label:       "Test",
 		Type:        "urn:x-nmos:device:generic",
@@ -41,23 +73,128 @@ func main() {
 		Href: "",
 	})
 
+	d.Sources = append(d.Sources, nmos.NMOSSource{
+		Id:          nmos.StableID(key, d.Id.String(), "source", "Test Card"),
+		Version:     nmos.NewVersion(),
+		Description: "Test Card",
+		Label:       "Test Card",
+		Tags:        nmos.NMOSTags{},
+		Format:      nmos.FormatVideo,
+		Device_id:   d.Id,
+		Parents:     make([]uuid.UUID, 0),
+	})
+	d.Flows = append(d.Flows, nmos.NMOSFlow{
+		Id:                      nmos.StableID(key, d.Id.String(), "flow", "Test Card"),
+		Version:                 nmos.NewVersion(),
+		Description:             "Test Card",
+		Label:                   "Test Card",
+		Tags:                    nmos.NMOSTags{},
+		Format:                  nmos.FormatVideo,
+		Source_id:               d.Sources[0].Id,
+		Device_id:               d.Id,
+		Parents:                 make([]uuid.UUID, 0),
+		Grain_rate:              &nmos.NMOSRational{Numerator: 25, Denominator: 1},
+		Media_type:              "video/raw",
+		Frame_width:             1920,
+		Frame_height:            1080,
+		Interlace_mode:          "progressive",
+		Colorspace:              "BT709",
+		Transfer_characteristic: "SDR",
+		Components: []nmos.NMOSComponent{
+			{Name: "Y", Width: 1920, Height: 1080, Bit_depth: 10},
+			{Name: "Cb", Width: 960, Height: 1080, Bit_depth: 10},
+			{Name: "Cr", Width: 960, Height: 1080, Bit_depth: 10},
+		},
+	})
+
 	d.Senders = append(d.Senders, nmos.NMOSSender{
-		Id:                 uuid.New(),
-		Version:            fmt.Sprintf("%s:0", strconv.FormatInt(time.Now().Unix(), 10)),
+		Id:                 nmos.StableID(key, d.Id.String(), "sender", "Test Card"),
+		Version:            nmos.NewVersion(),
 		Description:        "Test Card",
 		Label:              "Test Card",
 		Tags:               nmos.NMOSTags{},
 		Manifest_href:      "",
-		Flow_id:            uuid.New(),
+		Flow_id:            d.Flows[0].Id,
 		Transport:          "urn:x-nmos:transport:rtp.mcast",
 		Device_id:          d.Id,
 		Interface_bindings: make([]string, 0),
-		Subscription: nmos.NMOSSubscription{
-			Receiver_id: uuid.New(),
+	})
+
+	d.Receivers = append(d.Receivers, nmos.NMOSReceiver{
+		Id:          nmos.StableID(key, d.Id.String(), "receiver", "Test Monitor"),
+		Version:     nmos.NewVersion(),
+		Description: "Test Monitor",
+		Label:       "Test Monitor",
+		Tags:        nmos.NMOSTags{},
+		Format:      nmos.FormatVideo,
+		Caps: nmos.NMOSCapabilities{
+			Media_types: []string{"video/raw"},
+			// 1080p25 or 1080p50, 8 or 10 bit 4:2:2
+			Constraint_sets: []nmos.NMOSConstraintSet{{
+				nmos.CapFormatFrameWidth:  map[string]interface{}{"enum": []interface{}{1920}},
+				nmos.CapFormatFrameHeight: map[string]interface{}{"enum": []interface{}{1080}},
+				nmos.CapFormatGrainRate: map[string]interface{}{"enum": []interface{}{
+					nmos.NMOSRational{Numerator: 25, Denominator: 1},
+					nmos.NMOSRational{Numerator: 50, Denominator: 1},
+				}},
+				nmos.CapFormatColorSampling:  map[string]interface{}{"enum": []interface{}{"YCbCr-4:2:2"}},
+				nmos.CapFormatComponentDepth: map[string]interface{}{"minimum": 8, "maximum": 10},
+			}},
 		},
+		Device_id:          d.Id,
+		Transport:          "urn:x-nmos:transport:rtp.mcast",
+		Interface_bindings: make([]string, 0),
+	})
+
+	// IS-07 tally on a device of its own, sent over websocket
+	t := &nmos.NMOSDevice{
+		Id:          nmos.StableID(key, app.Id.String(), "device", "Tally"),
+		Version:     nmos.NewVersion(),
+		Description: "Tally",
+		Label:       "Tally",
+		Type:        "urn:x-nmos:device:generic",
+		Tags:        nmos.NMOSTags{},
+	}
+	t.Sources = append(t.Sources, nmos.NMOSSource{
+		Id:          nmos.StableID(key, t.Id.String(), "source", "Tally"),
+		Version:     nmos.NewVersion(),
+		Description: "Tally",
+		Label:       "Tally",
+		Tags:        nmos.NMOSTags{},
+		Format:      nmos.FormatData,
+		Device_id:   t.Id,
+		Parents:     make([]uuid.UUID, 0),
+		Event_type:  nmos.EventTypeBoolean,
+	})
+	tally := &t.Sources[len(t.Sources)-1]
+	if err := tally.InitEvents(nmos.NMOSEventType{Type: nmos.EventTypeBoolean}, false); err != nil {
+		log.Fatalln(err)
+	}
+	t.Flows = append(t.Flows, nmos.NMOSFlow{
+		Id:          nmos.StableID(key, t.Id.String(), "flow", "Tally"),
+		Version:     nmos.NewVersion(),
+		Description: "Tally",
+		Label:       "Tally",
+		Tags:        nmos.NMOSTags{},
+		Format:      nmos.FormatData,
+		Source_id:   tally.Id,
+		Device_id:   t.Id,
+		Parents:     make([]uuid.UUID, 0),
+		Media_type:  "application/json",
+		Event_type:  nmos.EventTypeBoolean,
+	})
+	t.Senders = append(t.Senders, nmos.NMOSSender{
+		Id:                 nmos.StableID(key, t.Id.String(), "sender", "Tally"),
+		Version:            nmos.NewVersion(),
+		Description:        "Tally",
+		Label:              "Tally",
+		Tags:               nmos.NMOSTags{},
+		Flow_id:            t.Flows[len(t.Flows)-1].Id,
+		Transport:          nmos.TransportWebSocket,
+		Device_id:          t.Id,
+		Interface_bindings: make([]string, 0),
 	})
 
 	// Start node
-	port := 8889
-	app.Start(ctx, port, d)
+	app.Start(ctx, port, d, t)
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"os"
 	"os/signal"
@@ -9,8 +10,30 @@ import (
 )
 
 func main() {
+	jwksFile := flag.String("jwks", "", "Require IS-10 tokens signed by keys in this JWKS file")
+	jwksURI := flag.String("jwks-uri", "", "Require IS-10 tokens signed by keys from this JWKS endpoint")
+	tlsCert := flag.String("tls-cert", "", "Serve HTTPS with these comma separated certificate files, e.g. RSA and ECDSA")
+	tlsKey := flag.String("tls-key", "", "Private keys of the -tls-cert certificates")
+	flag.Parse()
+
+	certs, err := nmos.ParseCertificates(*tlsCert, *tlsKey)
+	if err != nil {
+		log.Fatalln("tls", err)
+	}
 	nmosws := new(nmos.NMOSWebServer)
+	if len(certs) > 0 {
+		if err := nmosws.EnableTLS(certs...); err != nil {
+			log.Fatalln("tls", err)
+		}
+	}
 	nmosws.Start(8888)
+	if *jwksFile != "" || *jwksURI != "" {
+		v, err := nmos.NewAuthValidator(nmos.NMOSAuthConfig{JWKSFile: *jwksFile, JWKSURI: *jwksURI})
+		if err != nil {
+			log.Fatalln("auth", err)
+		}
+		nmosws.EnableAuth(v)
+	}
 	nmosws.InitRegister()
 	defer nmosws.Stop()
 
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+
+	"github.com/thyge/gonmos/pkg/nmos"
+)
+
+func main() {
+	config := flag.String("config", "global.json", "IS-09 global configuration file")
+	port := flag.Int("port", 8890, "System API port")
+	tlsCert := flag.String("tls-cert", "", "Serve HTTPS with these comma separated certificate files, e.g. RSA and ECDSA")
+	tlsKey := flag.String("tls-key", "", "Private keys of the -tls-cert certificates")
+	flag.Parse()
+
+	global, err := nmos.LoadSystemGlobal(*config)
+	if err != nil {
+		log.Fatalln("failed to load", *config, err)
+	}
+
+	certs, err := nmos.ParseCertificates(*tlsCert, *tlsKey)
+	if err != nil {
+		log.Fatalln("tls", err)
+	}
+	nmosws := new(nmos.NMOSWebServer)
+	if len(certs) > 0 {
+		if err := nmosws.EnableTLS(certs...); err != nil {
+			log.Fatalln("tls", err)
+		}
+	}
+	nmosws.Start(*port)
+	nmosws.InitSystem(global)
+	defer nmosws.Stop()
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	oscall := <-c
+	log.Printf("system call:%+v", oscall)
+}
@@ -0,0 +1,497 @@
+// Package monitor shows the resources of an NMOS registry live in a
+// terminal, as they are registered, updated and expire.
+package monitor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/thyge/gonmos/pkg/nmos"
+)
+
+const (
+	// how long changed rows are highlighted, removed rows are kept as long
+	highlight         = 5 * time.Second
+	heartbeatInterval = 2 * time.Second
+	retryInterval     = 5 * time.Second
+	logLines          = 4
+)
+
+// resource types in the order they are listed under their parent
+var kinds = []string{"nodes", "devices", "sources", "flows", "senders", "receivers"}
+
+type entry struct {
+	kind    string
+	id      string
+	label   string
+	parent  string
+	data    json.RawMessage
+	change  string
+	changed time.Time
+}
+
+type row struct {
+	e     *entry
+	depth int
+}
+
+type monitor struct {
+	qc           *nmos.NMOSQueryClient
+	registration string
+	out          io.Writer
+	fd           int
+	dirty        chan struct{}
+
+	mu         sync.Mutex
+	entries    map[string]*entry
+	heartbeats map[string]time.Time
+	log        []string
+	selected   string
+	offset     int
+	page       int
+}
+
+// Run shows the resources of the Query API of qc until ctx is done or q is
+// pressed. Node heartbeat ages come from the Registration API at
+// registration, qc.URL if empty.
+func Run(ctx context.Context, qc *nmos.NMOSQueryClient, registration string) error {
+	restore, err := cbreak(int(os.Stdin.Fd()))
+	if err != nil {
+		return err
+	}
+	defer restore()
+	if registration == "" {
+		registration = qc.URL
+	}
+	m := &monitor{
+		qc:           qc,
+		registration: registration,
+		out:          os.Stdout,
+		fd:           int(os.Stdout.Fd()),
+		dirty:        make(chan struct{}, 1),
+		entries:      make(map[string]*entry),
+		heartbeats:   make(map[string]time.Time),
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for _, kind := range kinds {
+		go m.subscribe(ctx, kind)
+	}
+	go m.pollHeartbeats(ctx)
+	keys := make(chan string)
+	go readKeys(os.Stdin, keys)
+
+	// alternate screen, hidden cursor
+	fmt.Fprint(m.out, "\x1b[?1049h\x1b[?25l")
+	defer fmt.Fprint(m.out, "\x1b[?25h\x1b[?1049l")
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		m.draw()
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		case <-m.dirty:
+		case k, ok := <-keys:
+			if !ok || k == "quit" {
+				return nil
+			}
+			m.key(k)
+		}
+	}
+}
+
+// subscribe keeps a subscription to one resource type open. The resources
+// are dropped while it is down, the next sync brings them back.
+func (m *monitor) subscribe(ctx context.Context, kind string) {
+	for {
+		err := m.qc.Subscribe(ctx, "/"+kind, m.apply)
+		if ctx.Err() != nil {
+			return
+		}
+		m.mu.Lock()
+		for id, e := range m.entries {
+			if e.kind == kind {
+				delete(m.entries, id)
+			}
+		}
+		m.logf("%s subscription: %v, retrying in %s", kind, err, retryInterval)
+		m.mu.Unlock()
+		m.notify()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+func (m *monitor) apply(ev nmos.NMOSQueryEvent) {
+	data := ev.Post
+	if data == nil {
+		data = ev.Pre
+	}
+	var r struct {
+		Label     string `json:"label"`
+		Node_id   string `json:"node_id"`
+		Device_id string `json:"device_id"`
+	}
+	json.Unmarshal(data, &r)
+	e := &entry{
+		kind:    strings.Trim(ev.Topic, "/"),
+		id:      ev.Path,
+		label:   r.Label,
+		parent:  r.Node_id + r.Device_id,
+		data:    data,
+		change:  ev.Kind(),
+		changed: time.Now(),
+	}
+	m.mu.Lock()
+	m.entries[e.id] = e
+	if e.change != nmos.QueryEventSync {
+		m.logf("%s %s %s %s", e.change, singular(e.kind), e.label, e.id)
+	}
+	m.mu.Unlock()
+	m.notify()
+}
+
+func (m *monitor) pollHeartbeats(ctx context.Context) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		m.mu.Lock()
+		var nodes []string
+		for id, e := range m.entries {
+			if e.kind == "nodes" && e.change != nmos.QueryEventRemoved {
+				nodes = append(nodes, id)
+			}
+		}
+		m.mu.Unlock()
+		for _, id := range nodes {
+			nodeId, err := uuid.Parse(id)
+			if err != nil {
+				continue
+			}
+			t, err := m.qc.Heartbeat(m.registration, nodeId)
+			m.mu.Lock()
+			if err != nil {
+				delete(m.heartbeats, id)
+			} else {
+				m.heartbeats[id] = t
+			}
+			m.mu.Unlock()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// notify asks for a redraw
+func (m *monitor) notify() {
+	select {
+	case m.dirty <- struct{}{}:
+	default:
+	}
+}
+
+// logf adds a line to the event log, m.mu must be held
+func (m *monitor) logf(format string, args ...interface{}) {
+	m.log = append(m.log, time.Now().Format("15:04:05 ")+fmt.Sprintf(format, args...))
+	if len(m.log) > logLines {
+		m.log = m.log[len(m.log)-logLines:]
+	}
+}
+
+// rows lists nodes with their devices and the devices with their
+// resources, resources without a known parent come last. m.mu must be held.
+func (m *monitor) rows() []row {
+	children := make(map[string][]*entry)
+	var roots []*entry
+	for _, e := range m.entries {
+		if e.kind == "nodes" || m.entries[e.parent] == nil {
+			roots = append(roots, e)
+		} else {
+			children[e.parent] = append(children[e.parent], e)
+		}
+	}
+	var res []row
+	var walk func(list []*entry, depth int)
+	walk = func(list []*entry, depth int) {
+		sortEntries(list)
+		for _, e := range list {
+			res = append(res, row{e, depth})
+			walk(children[e.id], depth+1)
+		}
+	}
+	walk(roots, 0)
+	return res
+}
+
+func sortEntries(list []*entry) {
+	order := func(kind string) int {
+		for i, k := range kinds {
+			if k == kind {
+				return i
+			}
+		}
+		return len(kinds)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if a.kind != b.kind {
+			return order(a.kind) < order(b.kind)
+		}
+		if a.label != b.label {
+			return a.label < b.label
+		}
+		return a.id < b.id
+	})
+}
+
+func (m *monitor) key(k string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rows := m.rows()
+	if len(rows) == 0 {
+		return
+	}
+	sel := selectedRow(rows, m.selected)
+	switch k {
+	case "up":
+		sel--
+	case "down":
+		sel++
+	case "pgup":
+		sel -= m.page
+	case "pgdown":
+		sel += m.page
+	case "home":
+		sel = 0
+	case "end":
+		sel = len(rows) - 1
+	}
+	if sel < 0 {
+		sel = 0
+	}
+	if sel >= len(rows) {
+		sel = len(rows) - 1
+	}
+	m.selected = rows[sel].e.id
+	m.notify()
+}
+
+func selectedRow(rows []row, id string) int {
+	for i, r := range rows {
+		if r.e.id == id {
+			return i
+		}
+	}
+	return 0
+}
+
+func (m *monitor) draw() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	for id, e := range m.entries {
+		if e.change == nmos.QueryEventRemoved && now.Sub(e.changed) > highlight {
+			delete(m.entries, id)
+		}
+	}
+	width, height := size(m.fd)
+	rows := m.rows()
+	sel := selectedRow(rows, m.selected)
+	var current *entry
+	if len(rows) > 0 {
+		current = rows[sel].e
+		m.selected = current.id
+	}
+
+	// header, list, events title, events, detail title, detail
+	listHeight := (height - 3 - logLines) / 2
+	if listHeight < 1 {
+		listHeight = 1
+	}
+	detailHeight := height - 3 - logLines - listHeight
+	m.page = listHeight
+	if sel < m.offset {
+		m.offset = sel
+	}
+	if sel >= m.offset+listHeight {
+		m.offset = sel - listHeight + 1
+	}
+
+	var lines []string
+	counts := make(map[string]int)
+	for _, e := range m.entries {
+		if e.change != nmos.QueryEventRemoved {
+			counts[e.kind]++
+		}
+	}
+	header := m.qc.URL
+	for _, k := range kinds {
+		header += fmt.Sprintf("  %d %s", counts[k], k)
+	}
+	lines = append(lines, "\x1b[7m"+pad(header, width)+"\x1b[0m")
+	for i := m.offset; i < m.offset+listHeight; i++ {
+		if i >= len(rows) {
+			lines = append(lines, "")
+			continue
+		}
+		lines = append(lines, m.rowLine(rows[i], i == sel, width, now))
+	}
+	lines = append(lines, title("events   j/k move  q quit", width))
+	for i := 0; i < logLines; i++ {
+		if i < len(m.log) {
+			lines = append(lines, fit(m.log[i], width))
+		} else {
+			lines = append(lines, "")
+		}
+	}
+	if current == nil {
+		lines = append(lines, title("waiting for "+m.qc.URL, width))
+	} else {
+		t := singular(current.kind) + " " + current.id
+		if current.change == nmos.QueryEventRemoved {
+			t += " (removed)"
+		}
+		lines = append(lines, title(t, width))
+		var buf bytes.Buffer
+		json.Indent(&buf, current.data, "", "  ")
+		for i, l := range strings.Split(buf.String(), "\n") {
+			if i >= detailHeight {
+				break
+			}
+			lines = append(lines, fit(l, width))
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("\x1b[H")
+	for i, l := range lines {
+		if i > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString(l)
+		b.WriteString("\x1b[K")
+	}
+	b.WriteString("\x1b[J")
+	io.WriteString(m.out, b.String())
+}
+
+func (m *monitor) rowLine(r row, selected bool, width int, now time.Time) string {
+	e := r.e
+	marker, color := " ", ""
+	if now.Sub(e.changed) <= highlight || e.change == nmos.QueryEventRemoved {
+		switch e.change {
+		case nmos.QueryEventAdded:
+			marker, color = "+", "\x1b[32m"
+		case nmos.QueryEventModified:
+			marker, color = "*", "\x1b[33m"
+		case nmos.QueryEventRemoved:
+			marker, color = "-", "\x1b[31m"
+		}
+	}
+	id := e.id
+	if len(id) > 8 {
+		id = id[:8]
+	}
+	s := fmt.Sprintf("%s%s %-8s %s  %s", strings.Repeat("  ", r.depth), marker, singular(e.kind), e.label, id)
+	if e.kind == "nodes" && e.change != nmos.QueryEventRemoved {
+		if t, ok := m.heartbeats[e.id]; ok {
+			s += "  heartbeat " + now.Sub(t).Round(time.Second).String() + " ago"
+		} else {
+			s += "  heartbeat ?"
+		}
+	}
+	if selected {
+		return "\x1b[7m" + color + pad(s, width) + "\x1b[0m"
+	}
+	if color != "" {
+		return color + fit(s, width) + "\x1b[0m"
+	}
+	return fit(s, width)
+}
+
+func singular(kind string) string {
+	return strings.TrimSuffix(kind, "s")
+}
+
+func title(s string, width int) string {
+	return fit("── "+s+" "+strings.Repeat("─", width), width)
+}
+
+// fit cuts s to width runes
+func fit(s string, width int) string {
+	r := []rune(s)
+	if len(r) > width {
+		r = r[:width]
+	}
+	return string(r)
+}
+
+// pad cuts or fills s to width runes
+func pad(s string, width int) string {
+	s = fit(s, width)
+	return s + strings.Repeat(" ", width-len([]rune(s)))
+}
+
+// readKeys sends the keys read from r until it fails
+func readKeys(r io.Reader, keys chan<- string) {
+	defer close(keys)
+	buf := make([]byte, 16)
+	for {
+		n, err := r.Read(buf)
+		if err != nil {
+			return
+		}
+		in := string(buf[:n])
+		switch in {
+		case "\x1b[A", "\x1bOA":
+			keys <- "up"
+			continue
+		case "\x1b[B", "\x1bOB":
+			keys <- "down"
+			continue
+		case "\x1b[5~":
+			keys <- "pgup"
+			continue
+		case "\x1b[6~":
+			keys <- "pgdown"
+			continue
+		case "\x1b[H", "\x1b[1~":
+			keys <- "home"
+			continue
+		case "\x1b[F", "\x1b[4~":
+			keys <- "end"
+			continue
+		}
+		for _, c := range in {
+			switch c {
+			case 'k':
+				keys <- "up"
+			case 'j':
+				keys <- "down"
+			case 'g':
+				keys <- "home"
+			case 'G':
+				keys <- "end"
+			case 'q':
+				keys <- "quit"
+			}
+		}
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package monitor
+
+// cbreak leaves the terminal as it is, keys take effect on enter
+func cbreak(fd int) (restore func(), err error) {
+	return func() {}, nil
+}
+
+// size returns a default, the terminal size isn't known
+func size(fd int) (int, int) {
+	return 80, 24
+}
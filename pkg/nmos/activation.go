@@ -0,0 +1,147 @@
+package nmos
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	ActivateImmediate         = "activate_immediate"
+	ActivateScheduledAbsolute = "activate_scheduled_absolute"
+	ActivateScheduledRelative = "activate_scheduled_relative"
+)
+
+var ErrActivationPending = errors.New("a scheduled activation is pending")
+
+// ActivationError is returned when parameters could not be activated, Code
+// is the HTTP status sent back to the controller
+type ActivationError struct {
+	Code    int
+	Message string
+}
+
+func (e *ActivationError) Error() string {
+	return e.Message
+}
+
+type NMOSActivation struct {
+	Mode           *string `json:"mode"`
+	RequestedTime  *string `json:"requested_time"`
+	ActivationTime *string `json:"activation_time"`
+	// Error is why the last scheduled activation failed, shown on the
+	// staged endpoint until the next activation request
+	Error *string `json:"error,omitempty"`
+}
+
+// Activator runs staged activations either immediately or at a scheduled
+// time. It is shared by every API with staged/active endpoints.
+// All methods must be called with lock held, fire callbacks are also
+// invoked with lock held.
+type Activator struct {
+	lock    sync.Locker
+	timer   *time.Timer
+	seq     int
+	pending NMOSActivation
+	failed  error
+}
+
+func NewActivator(lock sync.Locker) *Activator {
+	return &Activator{lock: lock}
+}
+
+// Pending returns true while a scheduled activation is waiting to fire
+func (a *Activator) Pending() bool {
+	return a.timer != nil
+}
+
+// Staged returns the activation to show on the staged endpoint
+func (a *Activator) Staged() NMOSActivation {
+	if a.failed != nil {
+		msg := a.failed.Error()
+		return NMOSActivation{Error: &msg}
+	}
+	return a.pending
+}
+
+// Failed returns the error of the last scheduled activation, nil if it
+// succeeded or an activation was requested since
+func (a *Activator) Failed() error {
+	return a.failed
+}
+
+func (a *Activator) Cancel() {
+	if a.timer != nil {
+		a.timer.Stop()
+		a.timer = nil
+	}
+	a.seq++
+	a.pending = NMOSActivation{}
+	a.failed = nil
+}
+
+// Request handles the activation object of a PATCH. For immediate
+// activations fire is called before returning and its error is passed on,
+// scheduled activations call fire from a timer and keep its error for
+// Staged and Failed. The returned bool is true if the activation was
+// scheduled rather than run.
+func (a *Activator) Request(req NMOSActivation, fire func(NMOSActivation) error) (NMOSActivation, bool, error) {
+	a.failed = nil
+	if req.Mode == nil {
+		a.Cancel()
+		return NMOSActivation{}, false, nil
+	}
+	if a.Pending() {
+		return NMOSActivation{}, false, ErrActivationPending
+	}
+	now := time.Now()
+	switch *req.Mode {
+	case ActivateImmediate:
+		at := FormatTAI(now)
+		act := NMOSActivation{Mode: req.Mode, ActivationTime: &at}
+		if err := fire(act); err != nil {
+			return NMOSActivation{}, false, err
+		}
+		return act, false, nil
+	case ActivateScheduledAbsolute, ActivateScheduledRelative:
+		if req.RequestedTime == nil {
+			return NMOSActivation{}, false, errors.New("requested_time is required for scheduled activations")
+		}
+		var when time.Time
+		if *req.Mode == ActivateScheduledAbsolute {
+			t, err := ParseTAI(*req.RequestedTime)
+			if err != nil {
+				return NMOSActivation{}, false, err
+			}
+			when = t
+		} else {
+			d, err := ParseTAIDuration(*req.RequestedTime)
+			if err != nil {
+				return NMOSActivation{}, false, err
+			}
+			when = now.Add(d)
+		}
+		at := FormatTAI(when)
+		act := NMOSActivation{Mode: req.Mode, RequestedTime: req.RequestedTime, ActivationTime: &at}
+		a.seq++
+		seq := a.seq
+		a.pending = act
+		a.timer = time.AfterFunc(time.Until(when), func() {
+			a.lock.Lock()
+			defer a.lock.Unlock()
+			// cancelled or replaced while waiting for the lock
+			if seq != a.seq {
+				return
+			}
+			a.timer = nil
+			a.pending = NMOSActivation{}
+			if err := fire(act); err != nil {
+				a.failed = err
+				Errorln("scheduled activation failed:", err)
+			}
+		})
+		return act, true, nil
+	default:
+		return NMOSActivation{}, false, errors.New("unknown activation mode " + *req.Mode)
+	}
+}
@@ -0,0 +1,74 @@
+package nmos
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// waitActivation waits for the scheduled activation of c to fire
+func waitActivation(t *testing.T, c *NMOSReceiverConnection) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		c.mu.Lock()
+		pending := c.activator.Pending()
+		c.mu.Unlock()
+		if !pending {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the scheduled activation didn't fire")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestScheduledActivationFailure(t *testing.T) {
+	r := &NMOSReceiver{Id: uuid.New(), Transport: TransportRTPMulticast}
+	if err := r.InitConnection(TransportHost{InterfaceIPs: []string{"192.168.1.20"}}); err != nil {
+		t.Fatal(err)
+	}
+	r.Connection.OnActivate = func(NMOSReceiverParams) error {
+		return errors.New("no such multicast group")
+	}
+	before := r.Connection.Active()
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"master_enable": true,
+		"activation":    map[string]string{"mode": ActivateScheduledRelative, "requested_time": "0:1000000"},
+	})
+	if _, scheduled, err := r.Connection.Patch(body); err != nil || !scheduled {
+		t.Fatalf("scheduled %v, err %v", scheduled, err)
+	}
+	waitActivation(t, r.Connection)
+
+	staged := r.Connection.Staged()
+	if staged.Activation.Mode != nil || staged.Activation.ActivationTime != nil {
+		t.Errorf("staged activation %+v, want null", staged.Activation)
+	}
+	if staged.Activation.Error == nil || *staged.Activation.Error != "no such multicast group" {
+		t.Errorf("staged activation error %v", staged.Activation.Error)
+	}
+	if active := r.Connection.Active(); active.MasterEnable != before.MasterEnable {
+		t.Error("a failed activation changed the active parameters")
+	}
+
+	// the next activation request clears the failure
+	r.Connection.OnActivate = nil
+	body, _ = json.Marshal(map[string]interface{}{
+		"activation": map[string]string{"mode": ActivateImmediate},
+	})
+	if _, _, err := r.Connection.Patch(body); err != nil {
+		t.Fatal(err)
+	}
+	if staged := r.Connection.Staged(); staged.Activation.Error != nil {
+		t.Errorf("error %s kept after a successful activation", *staged.Activation.Error)
+	}
+	if !r.Connection.Active().MasterEnable {
+		t.Error("the staged parameters weren't activated")
+	}
+}
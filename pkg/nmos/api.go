@@ -2,17 +2,17 @@ package nmos
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
-	"fmt"
 	"io/ioutil"
-	"log"
+	"net"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/grandcat/zeroconf"
 )
@@ -20,7 +20,7 @@ import (
 func handleRegResource(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	version := vars["version"]
-	fmt.Println("post to register", version)
+	Debugln("post to register", version)
 }
 
 func handleGetResource(w http.ResponseWriter, r *http.Request) {
@@ -28,18 +28,18 @@ func handleGetResource(w http.ResponseWriter, r *http.Request) {
 	version := vars["version"]
 	resourceType := vars["resourceType"]
 	resourceId := vars["resourceId"]
-	fmt.Println("post to register", version, resourceType, resourceId)
+	Debugln("post to register", version, resourceType, resourceId)
 }
 
 func handleRegBase(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	version := vars["version"]
-	fmt.Println(version)
+	Debugln(version)
 	json.NewEncoder(w).Encode([]string{"resource/", "health/"})
 }
 
 func homeHandler(w http.ResponseWriter, r *http.Request) {
-	log.Println(r.Host, r.URL.Path)
+	Debugln(r.Host, r.URL.Path)
 }
 
 func handleNMOSBase(w http.ResponseWriter, r *http.Request) {
@@ -47,7 +47,7 @@ func handleNMOSBase(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleQueryAPI(w http.ResponseWriter, r *http.Request) {
-	fmt.Println(r.Method, r.URL)
+	Debugln(r.Method, r.URL)
 	vars := mux.Vars(r)
 	version := vars["version"]
 	if version == "" {
@@ -55,49 +55,9 @@ func handleQueryAPI(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	json.NewEncoder(w).Encode([]string{"devices/", "flows/", "nodes/", "receivers/", "senders/", "sources/", "subscriptions/"})
-	fmt.Println(r)
+	Debugln(r)
 	body, _ := ioutil.ReadAll(r.Body)
-	fmt.Printf("%s", body)
-}
-
-func (n *NMOSWebServer) handleSendersAPI(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
-	vars := mux.Vars(r)
-	// version := vars["version"]
-	mode := vars["mode"]
-	resource := vars["resource"]
-	id := vars["id"]
-	fmt.Println(vars)
-	if (mode == "bulk") || (mode == "single") {
-		if resource == "" {
-			json.NewEncoder(w).Encode([]string{"senders/", "recievers/"})
-		} else {
-			if id == "" {
-				// Get all uuids
-				var sender_uuids []uuid.UUID
-				for i := 0; i < len(n.Device.Senders); i++ {
-					sender_uuids = append(sender_uuids, n.Device.Senders[0].Device_id)
-				}
-				// Return all senders UUID
-				enc := json.NewEncoder(w)
-				enc.SetIndent("", "\t")
-				enc.Encode(sender_uuids)
-			} else {
-				// Match UUID with uuid in array
-				queryuuid, _ := uuid.Parse(id)
-				for i := 0; i < len(n.Device.Senders); i++ {
-					if queryuuid == n.Device.Senders[i].Device_id {
-						enc := json.NewEncoder(w)
-						enc.SetIndent("", "\t")
-						enc.Encode(n.Device.Senders[i])
-					}
-				}
-			}
-		}
-	} else {
-		json.NewEncoder(w).Encode([]string{"bulk/", "single/"})
-	}
+	Debugln(string(body))
 }
 
 func (n *NMOSWebServer) handleNodeAPI(w http.ResponseWriter, r *http.Request) {
@@ -114,55 +74,98 @@ func (n *NMOSWebServer) handleNodeAPI(w http.ResponseWriter, r *http.Request) {
 		enc.Encode([]string{"v1.0/", "v1.1/", "v1.2/", "v1.3/"})
 		return
 	}
+	node, d := n.snapshot()
 	switch rpath {
 	case "self":
-		enc.Encode(n.Node)
+		enc.Encode(node)
 	case "devices":
-		enc.Encode(n.Device)
+		enc.Encode(d)
 	case "senders":
-		enc.Encode(n.Device.Senders)
+		enc.Encode(d.Senders())
+	case "receivers":
+		enc.Encode(d.Receivers())
+	case "sources":
+		enc.Encode(d.Sources())
+	case "flows":
+		enc.Encode(d.Flows())
 	default:
 		enc.Encode([]string{"devices/", "flows/", "receivers/", "self/", "senders/", "sources/"})
 	}
 }
 
+// snapshot returns a consistent copy of the node's resources
+func (n *NMOSWebServer) snapshot() (NMOSNodeData, NMOSDevices) {
+	return n.Resources.Snapshot()
+}
+
 func handleRegHealth(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("Handling health")
+	Debugln("Handling health")
 }
 
 type NMOSWebServer struct {
-	Router           *mux.Router
-	Port             int
-	Node             *NMOSNodeData
-	Device           *NMOSDevice
+	Router *mux.Router
+	Port   int
+	// Address to listen on, all interfaces if empty. Set before Start.
+	Host string
+	// Read through snapshot, set by InitNode
+	Resources        *NMOSResources
 	srv              *http.Server
+	tlsConfig        *tls.Config
 	MDNSNode         *zeroconf.Server
 	MDNSQuery        *zeroconf.Server
 	MDNSRegister     *zeroconf.Server
 	MDNSRegistration *zeroconf.Server
+	MDNSSystem       *zeroconf.Server
+	MDNSAuth         *zeroconf.Server
+	// IS-10 token validation, set by EnableAuth
+	Auth *NMOSAuthValidator
+	// IS-07 websocket clients
+	eventMu    sync.Mutex
+	eventConns map[*eventConn]bool
 }
 
 func (n *NMOSWebServer) Start(port int) {
 	n.Port = port
 	n.Router = mux.NewRouter()
+	host := n.Host
+	if host == "" {
+		host = "0.0.0.0"
+	}
 	n.srv = &http.Server{
-		Addr: fmt.Sprintf("0.0.0.0:%d", port),
+		Addr: net.JoinHostPort(host, strconv.Itoa(port)),
 		// Good practice to set timeouts to avoid Slowloris attacks.
 		WriteTimeout: time.Second * 15,
 		ReadTimeout:  time.Second * 15,
 		IdleTimeout:  time.Second * 60,
 		Handler:      n.Router, // Pass our instance of gorilla/mux in.
+		TLSConfig:    n.tlsConfig,
 	}
 	go func() {
-		fmt.Println("Starting webserver:", n.srv.Addr)
-		if err := n.srv.ListenAndServe(); err != nil {
-			log.Println(err)
+		Infoln("Starting webserver:", n.Proto(), n.srv.Addr)
+		var err error
+		if n.tlsConfig != nil {
+			// certificates come from TLSConfig
+			err = n.srv.ListenAndServeTLS("", "")
+		} else {
+			err = n.srv.ListenAndServe()
+		}
+		if err != nil {
+			Errorln(err)
 		}
 	}()
 }
 
+// EnableAuth requires IS-10 bearer tokens on every /x-nmos API. It must be
+// called after Start and before the APIs are initialised so mDNS
+// advertises api_auth=true.
+func (n *NMOSWebServer) EnableAuth(v *NMOSAuthValidator) {
+	n.Auth = v
+	n.Router.Use(v.Middleware)
+}
+
 func (n *NMOSWebServer) Stop() {
-	log.Println("shutting down mdns")
+	n.notifyEventClients(EventMessageShutdown)
+	Debugln("shutting down mdns")
 	if n.MDNSNode != nil {
 		n.MDNSNode.Shutdown()
 	}
@@ -175,6 +178,12 @@ func (n *NMOSWebServer) Stop() {
 	if n.MDNSRegistration != nil {
 		n.MDNSRegistration.Shutdown()
 	}
+	if n.MDNSSystem != nil {
+		n.MDNSSystem.Shutdown()
+	}
+	if n.MDNSAuth != nil {
+		n.MDNSAuth.Shutdown()
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	// Doesn't block if no connections, but will otherwise wait
@@ -187,13 +196,12 @@ func (n *NMOSWebServer) Stop() {
 	n.srv.Close()
 }
 
-func (n *NMOSWebServer) InitNode(nodeptr *NMOSNodeData, deviceptr *NMOSDevice) {
-	n.Node = nodeptr
-	n.Device = deviceptr
+func (n *NMOSWebServer) InitNode(res *NMOSResources) {
+	n.Resources = res
 	// MDNS
 	hostName, _ := os.Hostname()
 	hostName = strings.Replace(hostName, ".local", "", -1)
-	txt := MdnsText(99, []string{"v1.0", "v1.1", "v1.2", "v1.3"}, "http", false)
+	txt := MdnsText(99, []string{"v1.0", "v1.1", "v1.2", "v1.3"}, n.Proto(), n.Auth != nil)
 	var err error
 	n.MDNSNode, err = zeroconf.Register(hostName, "_nmos-node._tcp", "local.", n.Port, txt, nil)
 	if err != nil {
@@ -209,23 +217,16 @@ func (n *NMOSWebServer) InitNode(nodeptr *NMOSNodeData, deviceptr *NMOSDevice) {
 	nodeSubRouter.HandleFunc("/{version}/{resourcePath}", n.handleNodeAPI)
 	// IS-05
 	conSubRouter := n.Router.PathPrefix("/x-nmos/connection").Subrouter()
-	conSubRouter.HandleFunc("", func(w http.ResponseWriter, r *http.Request) {
-		json.NewEncoder(w).Encode([]string{"v1.0/", "v1.1/", "v1.2/", "v1.3/"})
-	})
-	conSubRouter.HandleFunc("/{version}", func(w http.ResponseWriter, r *http.Request) {
-		json.NewEncoder(w).Encode([]string{"senders/", "recievers/", "sinks/"})
-	})
-
-	conSubRouter.HandleFunc("/{version}/single", n.handleSendersAPI)
-	conSubRouter.HandleFunc("/{version}/single/senders", n.handleSendersAPI)
-	conSubRouter.HandleFunc("/{version}/single/senders/{id}", n.handleSendersAPI)
-
-	conSubRouter.HandleFunc("/{version}/single/recievers", n.handleSendersAPI)
-	conSubRouter.HandleFunc("/{version}/single/recievers/{id}", n.handleSendersAPI)
+	n.initConnectionAPI(conSubRouter)
 	// IS-11
-	conSubRouter.HandleFunc("/{version}/single/sinks/{sinkId}", n.handleSendersAPI)
-	conSubRouter.HandleFunc("/{version}/single/sinks/{sinkId}/properties", n.handleSendersAPI)
-	conSubRouter.HandleFunc("/{version}/single/sinks/{sinkId}/edid", n.handleSendersAPI)
+	scSubRouter := n.Router.PathPrefix("/x-nmos/streamcompatibility").Subrouter()
+	n.initStreamCompatAPI(scSubRouter)
+	// IS-07
+	evSubRouter := n.Router.PathPrefix("/x-nmos/events").Subrouter()
+	n.initEventsAPI(evSubRouter)
+	// IS-08
+	cmSubRouter := n.Router.PathPrefix("/x-nmos/channelmapping").Subrouter()
+	n.initChannelMappingAPI(cmSubRouter)
 }
 
 func (n *NMOSWebServer) InitQuery() {
@@ -233,7 +234,7 @@ func (n *NMOSWebServer) InitQuery() {
 	hostNameDomain, _ := os.Hostname()
 	splitHostName := strings.Split(hostNameDomain, ".")
 	hostName := splitHostName[0]
-	txt := MdnsText(99, []string{"v1.0", "v1.1", "v1.2", "v1.3"}, "http", false)
+	txt := MdnsText(99, []string{"v1.0", "v1.1", "v1.2", "v1.3"}, n.Proto(), n.Auth != nil)
 	var err error
 	n.MDNSQuery, err = zeroconf.Register(hostName, "_nmos-query._tcp", "local", n.Port, txt, nil)
 	if err != nil {
@@ -251,7 +252,7 @@ func (n *NMOSWebServer) InitRegister() {
 	hostNameDomain, _ := os.Hostname()
 	splitHostName := strings.Split(hostNameDomain, ".")
 	hostName := splitHostName[0]
-	txt := MdnsText(99, []string{"v1.0", "v1.1", "v1.2", "v1.3"}, "http", false)
+	txt := MdnsText(99, []string{"v1.0", "v1.1", "v1.2", "v1.3"}, n.Proto(), n.Auth != nil)
 	var err error
 	n.MDNSRegistration, err = zeroconf.Register(hostName, "_nmos-registration._tcp", "local", n.Port, txt, nil)
 	if err != nil {
@@ -277,3 +278,14 @@ func MdnsText(priority int64, versions []string, protocol string, oauth_mode boo
 	returnString = append(returnString, "api_auth="+strconv.FormatBool(oauth_mode))
 	return returnString
 }
+
+// MdnsTextValue returns the value of key in a TXT record, or def if the
+// record doesn't have it
+func MdnsTextValue(txt []string, key string, def string) string {
+	for _, t := range txt {
+		if strings.HasPrefix(t, key+"=") {
+			return strings.TrimPrefix(t, key+"=")
+		}
+	}
+	return def
+}
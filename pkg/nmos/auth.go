@@ -0,0 +1,315 @@
+package nmos
+
+import (
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Leeway allowed on exp and nbf for clock differences
+const authLeeway = 30 * time.Second
+
+// NMOSAuthConfig configures IS-10 token validation on a resource server
+type NMOSAuthConfig struct {
+	// Local JWKS file, e.g. for testing without an authorization server
+	JWKSFile string
+	// JWKS endpoint of the authorization server, fetched again when a
+	// token is signed with an unknown key
+	JWKSURI string
+	// Required iss claim, not checked if empty
+	Issuer string
+	// Names this server is reached by, the aud claim must match one of
+	// them. Not checked if empty.
+	Audience []string
+	Realm    string
+}
+
+// authError is reported to the client, Code is 401 or 403
+type authError struct {
+	Code        int
+	Err         string
+	Description string
+}
+
+func (e *authError) Error() string {
+	return e.Description
+}
+
+func invalidToken(format string, a ...interface{}) error {
+	return &authError{Code: http.StatusUnauthorized, Err: "invalid_token", Description: fmt.Sprintf(format, a...)}
+}
+
+func insufficientScope(format string, a ...interface{}) error {
+	return &authError{Code: http.StatusForbidden, Err: "insufficient_scope", Description: fmt.Sprintf(format, a...)}
+}
+
+// NMOSAuthValidator validates IS-10 bearer tokens against the
+// authorization server's keys
+type NMOSAuthValidator struct {
+	cfg       NMOSAuthConfig
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	lastFetch time.Time
+}
+
+func NewAuthValidator(cfg NMOSAuthConfig) (*NMOSAuthValidator, error) {
+	if cfg.JWKSFile == "" && cfg.JWKSURI == "" {
+		return nil, errors.New("a JWKS file or URI is required")
+	}
+	if cfg.Realm == "" {
+		cfg.Realm = "nmos"
+	}
+	v := &NMOSAuthValidator{cfg: cfg}
+	var err error
+	if cfg.JWKSFile != "" {
+		data, err := ioutil.ReadFile(cfg.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		v.keys, err = parseJWKS(data)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		v.lastFetch = time.Now()
+		if v.keys, err = v.fetchKeys(); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+func parseJWKS(data []byte) (map[string]crypto.PublicKey, error) {
+	var set JWKS
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		pk, err := k.PublicKey()
+		if err != nil {
+			return nil, fmt.Errorf("jwk %s: %v", k.Kid, err)
+		}
+		keys[k.Kid] = pk
+	}
+	return keys, nil
+}
+
+// fetchKeys loads the JWKS from JWKSURI
+func (v *NMOSAuthValidator) fetchKeys() (map[string]crypto.PublicKey, error) {
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(v.cfg.JWKSURI)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("jwks endpoint returned " + resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return parseJWKS(data)
+}
+
+// key returns the key with kid, refetching the JWKS at most every 10
+// seconds to pick up rotated keys. The fetch runs without the lock so a
+// slow authorization server doesn't hold up tokens with known keys.
+func (v *NMOSAuthValidator) key(kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	if k, ok := v.keys[kid]; ok {
+		v.mu.Unlock()
+		return k, nil
+	}
+	// a single key without kid is used for any token
+	if k, ok := v.keys[""]; ok && len(v.keys) == 1 {
+		v.mu.Unlock()
+		return k, nil
+	}
+	refetch := v.cfg.JWKSURI != "" && time.Since(v.lastFetch) > 10*time.Second
+	if refetch {
+		v.lastFetch = time.Now()
+	}
+	v.mu.Unlock()
+	if refetch {
+		keys, err := v.fetchKeys()
+		if err != nil {
+			return nil, err
+		}
+		v.mu.Lock()
+		v.keys = keys
+		v.mu.Unlock()
+		if k, ok := keys[kid]; ok {
+			return k, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown key %s", kid)
+}
+
+// Validate verifies a token's signature, issuer, audience and lifetime and
+// returns its claims
+func (v *NMOSAuthValidator) Validate(token string) (map[string]interface{}, error) {
+	h, claims, signed, sig, err := parseJWT(token)
+	if err != nil {
+		return nil, invalidToken("%v", err)
+	}
+	key, err := v.key(h.Kid)
+	if err != nil {
+		return nil, invalidToken("%v", err)
+	}
+	if err := verifyJWT(h.Alg, key, signed, sig); err != nil {
+		return nil, invalidToken("%v", err)
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, invalidToken("token has no exp")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(authLeeway)) {
+		return nil, invalidToken("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(authLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, invalidToken("token not yet valid")
+	}
+	if v.cfg.Issuer != "" && claims["iss"] != v.cfg.Issuer {
+		return nil, invalidToken("unexpected issuer")
+	}
+	if len(v.cfg.Audience) > 0 && !audienceMatch(claims["aud"], v.cfg.Audience) {
+		return nil, invalidToken("token not intended for this server")
+	}
+	return claims, nil
+}
+
+// audienceMatch checks aud, a string or array of names that may contain
+// wildcards like *.example.com, against the server's names
+func audienceMatch(aud interface{}, names []string) bool {
+	var auds []string
+	switch a := aud.(type) {
+	case string:
+		auds = []string{a}
+	case []interface{}:
+		for _, x := range a {
+			if s, ok := x.(string); ok {
+				auds = append(auds, s)
+			}
+		}
+	}
+	for _, a := range auds {
+		for _, n := range names {
+			if wildcardMatch(a, n) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wildcardMatch matches s against a pattern where * matches any characters
+func wildcardMatch(pattern, s string) bool {
+	parts := strings.Split(pattern, "*")
+	for i := range parts {
+		parts[i] = regexp.QuoteMeta(parts[i])
+	}
+	re, err := regexp.Compile("^" + strings.Join(parts, ".*") + "$")
+	return err == nil && re.MatchString(s)
+}
+
+// Authorize checks that claims grant access to path of api. path is
+// relative to the API version root, e.g. single/senders/{id}/staged.
+// Methods other than GET, HEAD and OPTIONS need write access.
+func (v *NMOSAuthValidator) Authorize(claims map[string]interface{}, api string, path string, method string) error {
+	scope, _ := claims["scope"].(string)
+	found := false
+	for _, s := range strings.Fields(scope) {
+		if s == api {
+			found = true
+		}
+	}
+	if !found {
+		return insufficientScope("scope doesn't include %s", api)
+	}
+	// the version listing only needs the scope
+	if path == "" {
+		return nil
+	}
+	access := "write"
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		access = "read"
+	}
+	claim, ok := claims["x-nmos-"+api].(map[string]interface{})
+	if !ok {
+		return insufficientScope("token has no x-nmos-%s claim", api)
+	}
+	patterns, _ := claim[access].([]interface{})
+	// write access implies read
+	if access == "read" {
+		w, _ := claim["write"].([]interface{})
+		patterns = append(patterns, w...)
+	}
+	for _, p := range patterns {
+		if s, ok := p.(string); ok && wildcardMatch(s, path) {
+			return nil
+		}
+	}
+	return insufficientScope("no %s access to %s", access, path)
+}
+
+func bearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(h, "Bearer "))
+	}
+	// browser websocket clients can't set headers, other requests mustn't
+	// put tokens in URLs that end up in logs
+	if websocket.IsWebSocketUpgrade(r) {
+		return r.URL.Query().Get("access_token")
+	}
+	return ""
+}
+
+// Middleware protects every /x-nmos/{api}/ path
+func (v *NMOSAuthValidator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		segs := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(segs) < 2 || segs[0] != "x-nmos" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		api := segs[1]
+		path := ""
+		if len(segs) > 3 {
+			path = strings.Join(segs[3:], "/")
+		}
+		token := bearerToken(r)
+		if token == "" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf("Bearer realm=%q", v.cfg.Realm))
+			writeError(w, http.StatusUnauthorized, "missing bearer token")
+			return
+		}
+		claims, err := v.Validate(token)
+		if err == nil {
+			err = v.Authorize(claims, api, path, r.Method)
+		}
+		if err != nil {
+			ae, ok := err.(*authError)
+			if !ok {
+				ae = &authError{Code: http.StatusUnauthorized, Err: "invalid_token", Description: err.Error()}
+			}
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf("Bearer realm=%q, error=%q, error_description=%q", v.cfg.Realm, ae.Err, ae.Description))
+			writeError(w, ae.Code, ae.Description)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
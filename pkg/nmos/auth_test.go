@@ -0,0 +1,283 @@
+package nmos
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	authTestKeyOnce sync.Once
+	authTestKeys    [2]*rsa.PrivateKey
+)
+
+// authTestKey returns one of two RSA keys shared by the auth tests
+func authTestKey(t *testing.T, i int) *rsa.PrivateKey {
+	t.Helper()
+	authTestKeyOnce.Do(func() {
+		for k := range authTestKeys {
+			key, err := rsa.GenerateKey(rand.Reader, 2048)
+			if err != nil {
+				t.Fatal(err)
+			}
+			authTestKeys[k] = key
+		}
+	})
+	return authTestKeys[i]
+}
+
+func authTestJWKS(t *testing.T, keys map[string]*rsa.PrivateKey) []byte {
+	t.Helper()
+	var set JWKS
+	for kid, key := range keys {
+		set.Keys = append(set.Keys, RSAJWK(&key.PublicKey, kid))
+	}
+	data, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func authTestClaims(mod func(c map[string]interface{})) map[string]interface{} {
+	now := time.Now()
+	c := map[string]interface{}{
+		"iss":   "https://auth.example.com",
+		"aud":   []interface{}{"*.studio.example.com"},
+		"exp":   now.Add(time.Minute).Unix(),
+		"iat":   now.Unix(),
+		"scope": "connection",
+	}
+	if mod != nil {
+		mod(c)
+	}
+	return c
+}
+
+func TestAuthValidate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := ioutil.WriteFile(path, authTestJWKS(t, map[string]*rsa.PrivateKey{"a": authTestKey(t, 0)}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	v, err := NewAuthValidator(NMOSAuthConfig{
+		JWKSFile: path,
+		Issuer:   "https://auth.example.com",
+		Audience: []string{"node1.studio.example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	tests := []struct {
+		name    string
+		key     int
+		kid     string
+		claims  map[string]interface{}
+		wantErr bool
+	}{
+		{name: "valid", kid: "a", claims: authTestClaims(nil)},
+		{name: "audience string", kid: "a", claims: authTestClaims(func(c map[string]interface{}) { c["aud"] = "node1.studio.example.com" })},
+		{name: "expired within leeway", kid: "a", claims: authTestClaims(func(c map[string]interface{}) { c["exp"] = now.Add(-10 * time.Second).Unix() })},
+		{name: "expired", kid: "a", claims: authTestClaims(func(c map[string]interface{}) { c["exp"] = now.Add(-time.Minute).Unix() }), wantErr: true},
+		{name: "no exp", kid: "a", claims: authTestClaims(func(c map[string]interface{}) { delete(c, "exp") }), wantErr: true},
+		{name: "not yet valid", kid: "a", claims: authTestClaims(func(c map[string]interface{}) { c["nbf"] = now.Add(time.Minute).Unix() }), wantErr: true},
+		{name: "other issuer", kid: "a", claims: authTestClaims(func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" }), wantErr: true},
+		{name: "other audience", kid: "a", claims: authTestClaims(func(c map[string]interface{}) { c["aud"] = []interface{}{"*.other.example.com"} }), wantErr: true},
+		{name: "unknown key", kid: "b", claims: authTestClaims(nil), wantErr: true},
+		{name: "signed with another key", key: 1, kid: "a", claims: authTestClaims(nil), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := SignJWT(authTestKey(t, tt.key), tt.kid, tt.claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = v.Validate(token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err %v, wantErr %v", err, tt.wantErr)
+			}
+			if ae, ok := err.(*authError); err != nil && (!ok || ae.Code != http.StatusUnauthorized) {
+				t.Errorf("error %#v is not a 401", err)
+			}
+		})
+	}
+	if _, err := v.Validate("not.a.token"); err == nil {
+		t.Error("malformed token accepted")
+	}
+}
+
+func TestAuthValidateJWKSURI(t *testing.T) {
+	var mu sync.Mutex
+	keys := map[string]*rsa.PrivateKey{"a": authTestKey(t, 0)}
+	fetches := 0
+	block := make(chan struct{})
+	blocking := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetches++
+		data := authTestJWKS(t, keys)
+		b := blocking
+		mu.Unlock()
+		if b {
+			<-block
+		}
+		w.Write(data)
+	}))
+	defer srv.Close()
+	v, err := NewAuthValidator(NMOSAuthConfig{JWKSURI: srv.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sign := func(key int, kid string) string {
+		token, err := SignJWT(authTestKey(t, key), kid, authTestClaims(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	// a rotated key is fetched, but not again within 10 seconds
+	mu.Lock()
+	keys["b"] = authTestKey(t, 1)
+	mu.Unlock()
+	v.lastFetch = time.Now().Add(-time.Minute)
+	if _, err := v.Validate(sign(1, "b")); err != nil {
+		t.Fatal("rotated key:", err)
+	}
+	if _, err := v.Validate(sign(1, "c")); err == nil {
+		t.Error("unknown key accepted")
+	}
+	if fetches != 2 {
+		t.Errorf("%d fetches, want 2", fetches)
+	}
+
+	// known keys are validated while a fetch hangs
+	mu.Lock()
+	blocking = true
+	mu.Unlock()
+	v.mu.Lock()
+	v.lastFetch = time.Now().Add(-time.Minute)
+	v.mu.Unlock()
+	go v.Validate(sign(1, "d"))
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		mu.Lock()
+		n := fetches
+		mu.Unlock()
+		if n == 3 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	done := make(chan error)
+	go func() {
+		_, err := v.Validate(sign(0, "a"))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("validation waited for the JWKS fetch")
+	}
+	close(block)
+}
+
+func TestAuthorize(t *testing.T) {
+	v := &NMOSAuthValidator{}
+	claims := authTestClaims(func(c map[string]interface{}) {
+		c["scope"] = "connection events"
+		c["x-nmos-connection"] = map[string]interface{}{
+			"read":  []interface{}{"*"},
+			"write": []interface{}{"single/senders/*"},
+		}
+	})
+	tests := []struct {
+		name    string
+		api     string
+		path    string
+		method  string
+		wantErr bool
+	}{
+		{name: "version listing", api: "events", method: http.MethodGet},
+		{name: "read", api: "connection", path: "single/receivers/x/active", method: http.MethodGet},
+		{name: "write", api: "connection", path: "single/senders/x/staged", method: http.MethodPatch},
+		{name: "write outside the claim", api: "connection", path: "single/receivers/x/staged", method: http.MethodPatch, wantErr: true},
+		{name: "api not in scope", api: "channelmapping", method: http.MethodGet, wantErr: true},
+		{name: "no api claim", api: "events", path: "sources", method: http.MethodGet, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := v.Authorize(claims, tt.api, tt.path, tt.method)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err %v, wantErr %v", err, tt.wantErr)
+			}
+			if ae, ok := err.(*authError); err != nil && (!ok || ae.Code != http.StatusForbidden) {
+				t.Errorf("error %#v is not a 403", err)
+			}
+		})
+	}
+}
+
+func TestWildcardMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		s       string
+		want    bool
+	}{
+		{"*", "", true},
+		{"*", "single/senders", true},
+		{"single/senders/*", "single/senders/x/staged", true},
+		{"single/senders/*", "single/receivers/x", false},
+		{"*.example.com", "node.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", "nodeXexample.com", false},
+		{"a*c*e", "abcde", true},
+		{"node.(1)", "node.(1)", true},
+		{"exact", "exact.not", false},
+	}
+	for _, tt := range tests {
+		if got := wildcardMatch(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("wildcardMatch(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		url    string
+		header map[string]string
+		want   string
+	}{
+		{name: "header", url: "/x-nmos/node/v1.3/", header: map[string]string{"Authorization": "Bearer abc"}, want: "abc"},
+		{name: "query on a plain request", url: "/x-nmos/node/v1.3/?access_token=abc"},
+		{
+			name:   "query on a websocket upgrade",
+			url:    "/x-nmos/events/v1.0/ws?access_token=abc",
+			header: map[string]string{"Connection": "Upgrade", "Upgrade": "websocket"},
+			want:   "abc",
+		},
+		{name: "other scheme", url: "/", header: map[string]string{"Authorization": "Basic abc"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.url, nil)
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			if got := bearerToken(r); got != tt.want {
+				t.Errorf("token %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,196 @@
+package nmos
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NMOSAuthClient obtains IS-10 tokens with the client credentials grant for
+// calls to other NMOS APIs, e.g. the registry
+type NMOSAuthClient struct {
+	// Base URL of the authorization server, the metadata is fetched from
+	// its /.well-known/oauth-authorization-server
+	ServerURI string
+	// Preconfigured credentials. The client registers itself if ClientID
+	// is empty and the server supports dynamic registration.
+	ClientID     string
+	ClientSecret string
+	ClientName   string
+	// Space separated APIs to request access to, e.g. "registration"
+	Scope string
+	// Optional, e.g. to verify the server against a CA bundle
+	HTTPClient *http.Client
+
+	mu        sync.Mutex
+	meta      *authServerMetadata
+	token     string
+	refreshAt time.Time
+}
+
+func (c *NMOSAuthClient) httpClient() *http.Client {
+	if c.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return c.HTTPClient
+}
+
+type authClientRegistration struct {
+	Client_id                  string   `json:"client_id,omitempty"`
+	Client_secret              string   `json:"client_secret,omitempty"`
+	Client_name                string   `json:"client_name"`
+	Grant_types                []string `json:"grant_types"`
+	Scope                      string   `json:"scope"`
+	Token_endpoint_auth_method string   `json:"token_endpoint_auth_method"`
+}
+
+func (c *NMOSAuthClient) fetchMetadata() error {
+	resp, err := c.httpClient().Get(strings.TrimSuffix(c.ServerURI, "/") + "/.well-known/oauth-authorization-server")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("authorization server metadata returned " + resp.Status)
+	}
+	meta := new(authServerMetadata)
+	if err := json.NewDecoder(resp.Body).Decode(meta); err != nil {
+		return err
+	}
+	if meta.Token_endpoint == "" {
+		return errors.New("authorization server has no token endpoint")
+	}
+	c.meta = meta
+	return nil
+}
+
+// register uses dynamic client registration to get credentials
+func (c *NMOSAuthClient) register() error {
+	if c.meta.Registration_endpoint == "" {
+		return errors.New("no client credentials and the authorization server doesn't support registration")
+	}
+	data, _ := json.Marshal(authClientRegistration{
+		Client_name:                c.ClientName,
+		Grant_types:                []string{"client_credentials"},
+		Scope:                      c.Scope,
+		Token_endpoint_auth_method: "client_secret_basic",
+	})
+	resp, err := c.httpClient().Post(c.meta.Registration_endpoint, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return errors.New("client registration returned " + resp.Status)
+	}
+	var reg authClientRegistration
+	if err := json.NewDecoder(resp.Body).Decode(&reg); err != nil {
+		return err
+	}
+	c.ClientID = reg.Client_id
+	c.ClientSecret = reg.Client_secret
+	return nil
+}
+
+// fetchToken requests a new token, must be called with mu held
+func (c *NMOSAuthClient) fetchToken() error {
+	if c.meta == nil {
+		if err := c.fetchMetadata(); err != nil {
+			return err
+		}
+	}
+	if c.ClientID == "" {
+		if err := c.register(); err != nil {
+			return err
+		}
+	}
+	form := url.Values{"grant_type": {"client_credentials"}, "scope": {c.Scope}}
+	req, err := http.NewRequest(http.MethodPost, c.meta.Token_endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(c.ClientID), url.QueryEscape(c.ClientSecret))
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("token request returned " + resp.Status + ": " + string(body))
+	}
+	var tr authTokenResponse
+	if err := json.Unmarshal(body, &tr); err != nil {
+		return err
+	}
+	if tr.Access_token == "" {
+		return errors.New("token response has no access_token")
+	}
+	c.token = tr.Access_token
+	// refresh half way through the lifetime
+	lifetime := time.Duration(tr.Expires_in) * time.Second
+	if lifetime <= 0 {
+		lifetime = time.Minute
+	}
+	c.refreshAt = time.Now().Add(lifetime / 2)
+	return nil
+}
+
+// Token returns a valid token, requesting a new one when the current one
+// is half way to expiry
+func (c *NMOSAuthClient) Token() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token == "" || time.Now().After(c.refreshAt) {
+		if err := c.fetchToken(); err != nil {
+			return "", err
+		}
+	}
+	return c.token, nil
+}
+
+// Invalidate drops the current token so the next call gets a new one
+func (c *NMOSAuthClient) Invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.token = ""
+}
+
+// Do sends req with a bearer token using hc. On 401 it retries once with a
+// fresh token, req must have GetBody set if it has a body, as
+// http.NewRequest does for bytes and strings readers. A nil client sends
+// req as is.
+func (c *NMOSAuthClient) Do(hc *http.Client, req *http.Request) (*http.Response, error) {
+	if c == nil {
+		return hc.Do(req)
+	}
+	token, err := c.Token()
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := hc.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	resp.Body.Close()
+	c.Invalidate()
+	if token, err = c.Token(); err != nil {
+		return nil, err
+	}
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	retry.Header.Set("Authorization", "Bearer "+token)
+	return hc.Do(retry)
+}
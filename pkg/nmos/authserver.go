@@ -0,0 +1,186 @@
+package nmos
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/grandcat/zeroconf"
+)
+
+// APIs a token can be scoped to
+var authScopes = []string{"node", "connection", "registration", "query", "events", "channelmapping", "streamcompatibility", "system"}
+
+// NMOSAuthServer is a minimal IS-10 authorization server for testing and
+// small installations. It issues RS256 tokens to any client using the
+// client credentials grant and doesn't check client secrets, clients may
+// register dynamically.
+type NMOSAuthServer struct {
+	Issuer        string
+	TokenLifetime time.Duration
+	key           *rsa.PrivateKey
+	kid           string
+}
+
+// NewAuthServer loads the signing key from keyFile, a PEM encoded RSA key
+// that is generated if it doesn't exist
+func NewAuthServer(issuer string, keyFile string) (*NMOSAuthServer, error) {
+	as := &NMOSAuthServer{Issuer: issuer, TokenLifetime: time.Hour, kid: "gonmos-1"}
+	data, err := ioutil.ReadFile(keyFile)
+	if os.IsNotExist(err) {
+		as.key, err = rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		der := x509.MarshalPKCS1PrivateKey(as.key)
+		data = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: der})
+		return as, ioutil.WriteFile(keyFile, data, 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data in " + keyFile)
+	}
+	as.key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	return as, err
+}
+
+func (as *NMOSAuthServer) JWKS() JWKS {
+	return JWKS{Keys: []JWK{RSAJWK(&as.key.PublicKey, as.kid)}}
+}
+
+// Token issues a token for client with read and write access to every API
+// in scope
+func (as *NMOSAuthServer) Token(client string, scope string) (string, error) {
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss":       as.Issuer,
+		"sub":       client,
+		"aud":       []string{"*"},
+		"client_id": client,
+		"iat":       now.Unix(),
+		"exp":       now.Add(as.TokenLifetime).Unix(),
+	}
+	var granted []string
+	for _, s := range strings.Fields(scope) {
+		for _, known := range authScopes {
+			if s == known {
+				granted = append(granted, s)
+				claims["x-nmos-"+s] = map[string][]string{"read": {"*"}, "write": {"*"}}
+			}
+		}
+	}
+	claims["scope"] = strings.Join(granted, " ")
+	return SignJWT(as.key, as.kid, claims)
+}
+
+type authTokenResponse struct {
+	Access_token string `json:"access_token"`
+	Token_type   string `json:"token_type"`
+	Expires_in   int    `json:"expires_in"`
+	Scope        string `json:"scope"`
+}
+
+type authServerMetadata struct {
+	Issuer                                string   `json:"issuer"`
+	Token_endpoint                        string   `json:"token_endpoint"`
+	Jwks_uri                              string   `json:"jwks_uri"`
+	Registration_endpoint                 string   `json:"registration_endpoint,omitempty"`
+	Grant_types_supported                 []string `json:"grant_types_supported"`
+	Token_endpoint_auth_methods_supported []string `json:"token_endpoint_auth_methods_supported"`
+	Scopes_supported                      []string `json:"scopes_supported"`
+}
+
+// InitAuth serves the authorization server and advertises it with mDNS
+func (n *NMOSWebServer) InitAuth(as *NMOSAuthServer) {
+	// MDNS
+	hostNameDomain, _ := os.Hostname()
+	splitHostName := strings.Split(hostNameDomain, ".")
+	hostName := splitHostName[0]
+	txt := MdnsText(99, []string{"v1.0"}, n.Proto(), false)
+	var err error
+	n.MDNSAuth, err = zeroconf.Register(hostName, "_nmos-auth._tcp", "local", n.Port, txt, nil)
+	if err != nil {
+		panic(err)
+	}
+	base := strings.TrimSuffix(as.Issuer, "/") + "/x-nmos/auth/v1.0"
+	n.Router.HandleFunc("/.well-known/oauth-authorization-server", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, authServerMetadata{
+			Issuer:                                as.Issuer,
+			Token_endpoint:                        base + "/token",
+			Jwks_uri:                              base + "/jwks",
+			Registration_endpoint:                 base + "/register",
+			Grant_types_supported:                 []string{"client_credentials"},
+			Token_endpoint_auth_methods_supported: []string{"client_secret_basic", "client_secret_post"},
+			Scopes_supported:                      authScopes,
+		})
+	})
+	authSubRouter := n.Router.PathPrefix("/x-nmos/auth").Subrouter()
+	handleSlash(authSubRouter, "", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, []string{"v1.0/"})
+	})
+	authSubRouter.HandleFunc("/{version}/jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, as.JWKS())
+	})
+	authSubRouter.HandleFunc("/{version}/register", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		var reg authClientRegistration
+		if err := json.NewDecoder(r.Body).Decode(&reg); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_client_metadata"})
+			return
+		}
+		secret := make([]byte, 24)
+		rand.Read(secret)
+		reg.Client_id = uuid.New().String()
+		reg.Client_secret = b64.EncodeToString(secret)
+		writeJSON(w, http.StatusCreated, reg)
+	})
+	authSubRouter.HandleFunc("/{version}/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+			return
+		}
+		if r.PostForm.Get("grant_type") != "client_credentials" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+			return
+		}
+		client, _, ok := r.BasicAuth()
+		if !ok {
+			client = r.PostForm.Get("client_id")
+		}
+		if client == "" {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+			return
+		}
+		token, err := as.Token(client, r.PostForm.Get("scope"))
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+			return
+		}
+		_, claims, _, _, _ := parseJWT(token)
+		writeJSON(w, http.StatusOK, authTokenResponse{
+			Access_token: token,
+			Token_type:   "Bearer",
+			Expires_in:   int(as.TokenLifetime.Seconds()),
+			Scope:        claims["scope"].(string),
+		})
+	})
+}
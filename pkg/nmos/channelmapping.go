@@ -0,0 +1,321 @@
+package nmos
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// IS-08 input parent types
+const (
+	MapParentSource   = "source"
+	MapParentReceiver = "receiver"
+)
+
+type NMOSMapParent struct {
+	Id   *uuid.UUID `json:"id"`
+	Type *string    `json:"type"`
+}
+
+// NMOSMapInput is an IS-08 input, a block of channels that can be mapped to
+// outputs, e.g. the channels of a receiver
+type NMOSMapInput struct {
+	Id          string        `json:"-"`
+	Name        string        `json:"name"`
+	Description string        `json:"description"`
+	Parent      NMOSMapParent `json:"-"`
+	Channels    []NMOSChannel `json:"-"`
+	// Caps: whether channels may change order and the number of channels
+	// that must be routed together
+	Reordering bool `json:"-"`
+	Block_size int  `json:"-"`
+}
+
+// NMOSMapOutput is an IS-08 output, e.g. the channels of a source
+type NMOSMapOutput struct {
+	Id          string        `json:"-"`
+	Name        string        `json:"name"`
+	Description string        `json:"description"`
+	Source_id   *uuid.UUID    `json:"-"`
+	Channels    []NMOSChannel `json:"-"`
+	// Inputs this output can take channels from, nil for any
+	Routable_inputs []string `json:"-"`
+}
+
+// NMOSMapEntry routes one output channel, both fields are null for an
+// unrouted channel
+type NMOSMapEntry struct {
+	Input         *string `json:"input"`
+	Channel_index *int    `json:"channel_index"`
+}
+
+// NMOSChannelMap maps output id to output channel index (as a string) to
+// the input channel feeding it
+type NMOSChannelMap map[string]map[string]NMOSMapEntry
+
+func (m NMOSChannelMap) copy() NMOSChannelMap {
+	c := make(NMOSChannelMap, len(m))
+	for out, chans := range m {
+		c[out] = make(map[string]NMOSMapEntry, len(chans))
+		for k, v := range chans {
+			c[out][k] = v
+		}
+	}
+	return c
+}
+
+// NMOSMapActivation is a pending or completed activation of an action
+type NMOSMapActivation struct {
+	Activation NMOSActivation `json:"activation"`
+	Action     NMOSChannelMap `json:"action"`
+}
+
+type NMOSMapActive struct {
+	Activation NMOSActivation `json:"activation"`
+	Map        NMOSChannelMap `json:"map"`
+}
+
+type pendingMapActivation struct {
+	activator *Activator
+	request   NMOSMapActivation
+}
+
+// NMOSChannelMapping holds the IS-08 inputs, outputs and active map of a
+// device. Activations share the IS-05 Activator, each pending activation
+// locks the outputs it changes until it fires or is cancelled.
+type NMOSChannelMapping struct {
+	mu      sync.Mutex
+	Inputs  []NMOSMapInput
+	Outputs []NMOSMapOutput
+	active  NMOSMapActive
+	pending map[string]*pendingMapActivation
+	// Optional, called with the new map before it becomes active. Errors
+	// are handled as for IS-05 activations.
+	OnActivate func(NMOSChannelMap) error
+}
+
+// InitChannelMapping sets up IS-08 on the device with every output channel
+// unrouted
+func (d *NMOSDevice) InitChannelMapping(inputs []NMOSMapInput, outputs []NMOSMapOutput) error {
+	cm := &NMOSChannelMapping{
+		Inputs:  inputs,
+		Outputs: outputs,
+		active:  NMOSMapActive{Map: NMOSChannelMap{}},
+		pending: make(map[string]*pendingMapActivation),
+	}
+	for _, in := range inputs {
+		if in.Block_size < 1 || len(in.Channels)%in.Block_size != 0 {
+			return fmt.Errorf("input %s: channel count must be a multiple of block_size", in.Id)
+		}
+	}
+	for _, out := range outputs {
+		cm.active.Map[out.Id] = make(map[string]NMOSMapEntry)
+		for i := range out.Channels {
+			cm.active.Map[out.Id][strconv.Itoa(i)] = NMOSMapEntry{}
+		}
+	}
+	d.ChannelMapping = cm
+	return nil
+}
+
+func (cm *NMOSChannelMapping) FindInput(id string) *NMOSMapInput {
+	for i := range cm.Inputs {
+		if cm.Inputs[i].Id == id {
+			return &cm.Inputs[i]
+		}
+	}
+	return nil
+}
+
+func (cm *NMOSChannelMapping) FindOutput(id string) *NMOSMapOutput {
+	for i := range cm.Outputs {
+		if cm.Outputs[i].Id == id {
+			return &cm.Outputs[i]
+		}
+	}
+	return nil
+}
+
+func (cm *NMOSChannelMapping) Active() NMOSMapActive {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	return NMOSMapActive{Activation: cm.active.Activation, Map: cm.active.Map.copy()}
+}
+
+// Pending returns the scheduled activations by id
+func (cm *NMOSChannelMapping) Pending() map[string]NMOSMapActivation {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	res := make(map[string]NMOSMapActivation, len(cm.pending))
+	for id, p := range cm.pending {
+		res[id] = p.request
+	}
+	return res
+}
+
+// Cancel removes a scheduled activation, false if there is none with id
+func (cm *NMOSChannelMapping) Cancel(id string) bool {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	p, ok := cm.pending[id]
+	if !ok {
+		return false
+	}
+	p.activator.Cancel()
+	delete(cm.pending, id)
+	return true
+}
+
+// Activate validates and runs or schedules an activation. It returns the
+// activation id and true if the activation was scheduled.
+func (cm *NMOSChannelMapping) Activate(body []byte) (string, NMOSMapActivation, bool, error) {
+	var req NMOSMapActivation
+	if err := json.Unmarshal(body, &req); err != nil {
+		return "", NMOSMapActivation{}, false, err
+	}
+	if req.Activation.Mode == nil {
+		return "", NMOSMapActivation{}, false, errors.New("activation mode is required")
+	}
+	if len(req.Action) == 0 {
+		return "", NMOSMapActivation{}, false, errors.New("action is required")
+	}
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	for out := range req.Action {
+		for _, p := range cm.pending {
+			if _, ok := p.request.Action[out]; ok {
+				return "", NMOSMapActivation{}, false, ErrActivationPending
+			}
+		}
+	}
+	if err := cm.validate(cm.apply(cm.active.Map, req.Action), req.Action); err != nil {
+		return "", NMOSMapActivation{}, false, err
+	}
+
+	id := uuid.New().String()
+	a := NewActivator(&cm.mu)
+	act, scheduled, err := a.Request(req.Activation, func(act NMOSActivation) error {
+		delete(cm.pending, id)
+		return cm.activate(act, req.Action)
+	})
+	if err != nil {
+		return "", NMOSMapActivation{}, false, err
+	}
+	res := NMOSMapActivation{Activation: act, Action: req.Action}
+	if scheduled {
+		cm.pending[id] = &pendingMapActivation{activator: a, request: res}
+	}
+	return id, res, scheduled, nil
+}
+
+// apply returns m with action merged in
+func (cm *NMOSChannelMapping) apply(m NMOSChannelMap, action NMOSChannelMap) NMOSChannelMap {
+	res := m.copy()
+	for out, chans := range action {
+		if res[out] == nil {
+			res[out] = make(map[string]NMOSMapEntry)
+		}
+		for k, v := range chans {
+			res[out][k] = v
+		}
+	}
+	return res
+}
+
+func (cm *NMOSChannelMapping) activate(act NMOSActivation, action NMOSChannelMap) error {
+	m := cm.apply(cm.active.Map, action)
+	if cm.OnActivate != nil {
+		if err := cm.OnActivate(m.copy()); err != nil {
+			return activationError(err)
+		}
+	}
+	cm.active = NMOSMapActive{Activation: act, Map: m}
+	return nil
+}
+
+// validate checks the outputs touched by action in the resulting map m
+// against the output and input caps
+func (cm *NMOSChannelMapping) validate(m NMOSChannelMap, action NMOSChannelMap) error {
+	for outId, chans := range action {
+		out := cm.FindOutput(outId)
+		if out == nil {
+			return fmt.Errorf("unknown output %s", outId)
+		}
+		for k, e := range chans {
+			i, err := strconv.Atoi(k)
+			if err != nil || i < 0 || i >= len(out.Channels) {
+				return fmt.Errorf("output %s has no channel %s", outId, k)
+			}
+			if (e.Input == nil) != (e.Channel_index == nil) {
+				return fmt.Errorf("output %s channel %s: input and channel_index must both be set or null", outId, k)
+			}
+			if e.Input == nil {
+				continue
+			}
+			in := cm.FindInput(*e.Input)
+			if in == nil {
+				return fmt.Errorf("unknown input %s", *e.Input)
+			}
+			if *e.Channel_index < 0 || *e.Channel_index >= len(in.Channels) {
+				return fmt.Errorf("input %s has no channel %d", in.Id, *e.Channel_index)
+			}
+			if !out.routable(in.Id) {
+				return fmt.Errorf("input %s is not routable to output %s", in.Id, outId)
+			}
+		}
+		if err := cm.checkCaps(outId, m[outId]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (out *NMOSMapOutput) routable(input string) bool {
+	if out.Routable_inputs == nil {
+		return true
+	}
+	for _, r := range out.Routable_inputs {
+		if r == input {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCaps enforces block_size and reordering for every input used by an
+// output. Channels of a block have to be routed together and in order to
+// consecutive output channels, inputs that can't reorder keep their offset.
+func (cm *NMOSChannelMapping) checkCaps(outId string, chans map[string]NMOSMapEntry) error {
+	offsets := make(map[string]int)
+	for k, e := range chans {
+		if e.Input == nil {
+			continue
+		}
+		in := cm.FindInput(*e.Input)
+		if in == nil {
+			continue
+		}
+		o, _ := strconv.Atoi(k)
+		c := *e.Channel_index
+		if !in.Reordering {
+			if prev, ok := offsets[in.Id]; ok && prev != o-c {
+				return fmt.Errorf("input %s can't be reordered on output %s", in.Id, outId)
+			}
+			offsets[in.Id] = o - c
+		}
+		if in.Block_size > 1 {
+			start := o - c%in.Block_size
+			for j := 0; j < in.Block_size; j++ {
+				other, ok := chans[strconv.Itoa(start+j)]
+				if !ok || other.Input == nil || *other.Input != in.Id || *other.Channel_index != c-c%in.Block_size+j {
+					return fmt.Errorf("input %s must be routed to output %s in blocks of %d", in.Id, outId, in.Block_size)
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package nmos
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+type mapInputCaps struct {
+	Reordering bool `json:"reordering"`
+	Block_size int  `json:"block_size"`
+}
+
+type mapOutputCaps struct {
+	Routable_inputs []string `json:"routable_inputs"`
+}
+
+type mapInputIO struct {
+	Properties *NMOSMapInput `json:"properties"`
+	Parent     NMOSMapParent `json:"parent"`
+	Channels   []NMOSChannel `json:"channels"`
+	Caps       mapInputCaps  `json:"caps"`
+}
+
+type mapOutputIO struct {
+	Properties *NMOSMapOutput `json:"properties"`
+	Source_id  interface{}    `json:"source_id"`
+	Channels   []NMOSChannel  `json:"channels"`
+	Caps       mapOutputCaps  `json:"caps"`
+}
+
+func (n *NMOSWebServer) initChannelMappingAPI(cmSubRouter *mux.Router) {
+	handleSlash(cmSubRouter, "", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, []string{"v1.0/"})
+	})
+	handleSlash(cmSubRouter, "/{version}", n.withChannelMapping(func(w http.ResponseWriter, r *http.Request, cm *NMOSChannelMapping) {
+		writeJSON(w, http.StatusOK, []string{"inputs/", "io/", "map/", "outputs/"})
+	}))
+	// Inputs
+	handleSlash(cmSubRouter, "/{version}/inputs", n.withChannelMapping(func(w http.ResponseWriter, r *http.Request, cm *NMOSChannelMapping) {
+		ids := make([]string, 0)
+		for _, in := range cm.Inputs {
+			ids = append(ids, in.Id+"/")
+		}
+		writeJSON(w, http.StatusOK, ids)
+	}))
+	handleSlash(cmSubRouter, "/{version}/inputs/{id}", n.withMapInput(func(w http.ResponseWriter, r *http.Request, in *NMOSMapInput) {
+		writeJSON(w, http.StatusOK, []string{"caps/", "channels/", "parent/", "properties/"})
+	}))
+	handleSlash(cmSubRouter, "/{version}/inputs/{id}/properties", n.withMapInput(func(w http.ResponseWriter, r *http.Request, in *NMOSMapInput) {
+		writeJSON(w, http.StatusOK, in)
+	}))
+	handleSlash(cmSubRouter, "/{version}/inputs/{id}/parent", n.withMapInput(func(w http.ResponseWriter, r *http.Request, in *NMOSMapInput) {
+		writeJSON(w, http.StatusOK, in.Parent)
+	}))
+	handleSlash(cmSubRouter, "/{version}/inputs/{id}/channels", n.withMapInput(func(w http.ResponseWriter, r *http.Request, in *NMOSMapInput) {
+		writeJSON(w, http.StatusOK, in.Channels)
+	}))
+	handleSlash(cmSubRouter, "/{version}/inputs/{id}/caps", n.withMapInput(func(w http.ResponseWriter, r *http.Request, in *NMOSMapInput) {
+		writeJSON(w, http.StatusOK, mapInputCaps{Reordering: in.Reordering, Block_size: in.Block_size})
+	}))
+	// Outputs
+	handleSlash(cmSubRouter, "/{version}/outputs", n.withChannelMapping(func(w http.ResponseWriter, r *http.Request, cm *NMOSChannelMapping) {
+		ids := make([]string, 0)
+		for _, out := range cm.Outputs {
+			ids = append(ids, out.Id+"/")
+		}
+		writeJSON(w, http.StatusOK, ids)
+	}))
+	handleSlash(cmSubRouter, "/{version}/outputs/{id}", n.withMapOutput(func(w http.ResponseWriter, r *http.Request, out *NMOSMapOutput) {
+		writeJSON(w, http.StatusOK, []string{"caps/", "channels/", "properties/", "sourceid/"})
+	}))
+	handleSlash(cmSubRouter, "/{version}/outputs/{id}/properties", n.withMapOutput(func(w http.ResponseWriter, r *http.Request, out *NMOSMapOutput) {
+		writeJSON(w, http.StatusOK, out)
+	}))
+	handleSlash(cmSubRouter, "/{version}/outputs/{id}/sourceid", n.withMapOutput(func(w http.ResponseWriter, r *http.Request, out *NMOSMapOutput) {
+		writeJSON(w, http.StatusOK, out.Source_id)
+	}))
+	handleSlash(cmSubRouter, "/{version}/outputs/{id}/channels", n.withMapOutput(func(w http.ResponseWriter, r *http.Request, out *NMOSMapOutput) {
+		writeJSON(w, http.StatusOK, out.Channels)
+	}))
+	handleSlash(cmSubRouter, "/{version}/outputs/{id}/caps", n.withMapOutput(func(w http.ResponseWriter, r *http.Request, out *NMOSMapOutput) {
+		writeJSON(w, http.StatusOK, mapOutputCaps{Routable_inputs: out.Routable_inputs})
+	}))
+	// IO view of everything
+	handleSlash(cmSubRouter, "/{version}/io", n.withChannelMapping(func(w http.ResponseWriter, r *http.Request, cm *NMOSChannelMapping) {
+		io := struct {
+			Inputs  map[string]mapInputIO  `json:"inputs"`
+			Outputs map[string]mapOutputIO `json:"outputs"`
+		}{make(map[string]mapInputIO), make(map[string]mapOutputIO)}
+		for i := range cm.Inputs {
+			in := &cm.Inputs[i]
+			io.Inputs[in.Id] = mapInputIO{Properties: in, Parent: in.Parent, Channels: in.Channels,
+				Caps: mapInputCaps{Reordering: in.Reordering, Block_size: in.Block_size}}
+		}
+		for i := range cm.Outputs {
+			out := &cm.Outputs[i]
+			io.Outputs[out.Id] = mapOutputIO{Properties: out, Source_id: out.Source_id, Channels: out.Channels,
+				Caps: mapOutputCaps{Routable_inputs: out.Routable_inputs}}
+		}
+		writeJSON(w, http.StatusOK, io)
+	}))
+	// Map
+	handleSlash(cmSubRouter, "/{version}/map", n.withChannelMapping(func(w http.ResponseWriter, r *http.Request, cm *NMOSChannelMapping) {
+		writeJSON(w, http.StatusOK, []string{"activations/", "active/"})
+	}))
+	handleSlash(cmSubRouter, "/{version}/map/active", n.withChannelMapping(func(w http.ResponseWriter, r *http.Request, cm *NMOSChannelMapping) {
+		writeJSON(w, http.StatusOK, cm.Active())
+	}))
+	handleSlash(cmSubRouter, "/{version}/map/activations", n.withChannelMapping(handleMapActivations))
+	handleSlash(cmSubRouter, "/{version}/map/activations/{activationId}", n.withChannelMapping(func(w http.ResponseWriter, r *http.Request, cm *NMOSChannelMapping) {
+		id := mux.Vars(r)["activationId"]
+		switch r.Method {
+		case http.MethodGet:
+			act, ok := cm.Pending()[id]
+			if !ok {
+				writeError(w, http.StatusNotFound, "activation not found")
+				return
+			}
+			writeJSON(w, http.StatusOK, act)
+		case http.MethodDelete:
+			if !cm.Cancel(id) {
+				writeError(w, http.StatusNotFound, "activation not found")
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	}))
+}
+
+func handleMapActivations(w http.ResponseWriter, r *http.Request, cm *NMOSChannelMapping) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, cm.Pending())
+	case http.MethodPost:
+		body, _ := ioutil.ReadAll(r.Body)
+		id, act, scheduled, err := cm.Activate(body)
+		var ae *ActivationError
+		switch {
+		case err == ErrActivationPending:
+			writeError(w, http.StatusLocked, err.Error())
+		case errors.As(err, &ae):
+			writeError(w, ae.Code, ae.Message)
+		case err != nil:
+			writeError(w, http.StatusBadRequest, err.Error())
+		case scheduled:
+			writeJSON(w, http.StatusAccepted, map[string]NMOSMapActivation{id: act})
+		default:
+			writeJSON(w, http.StatusOK, map[string]NMOSMapActivation{id: act})
+		}
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// withChannelMapping 404s when no device has IS-08 state
+func (n *NMOSWebServer) withChannelMapping(f func(http.ResponseWriter, *http.Request, *NMOSChannelMapping)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, d := n.snapshot()
+		cm := d.ChannelMapping()
+		if cm == nil {
+			writeError(w, http.StatusNotFound, "channel mapping not supported")
+			return
+		}
+		f(w, r, cm)
+	}
+}
+
+func (n *NMOSWebServer) withMapInput(f func(http.ResponseWriter, *http.Request, *NMOSMapInput)) http.HandlerFunc {
+	return n.withChannelMapping(func(w http.ResponseWriter, r *http.Request, cm *NMOSChannelMapping) {
+		in := cm.FindInput(mux.Vars(r)["id"])
+		if in == nil {
+			writeError(w, http.StatusNotFound, "input not found")
+			return
+		}
+		f(w, r, in)
+	})
+}
+
+func (n *NMOSWebServer) withMapOutput(f func(http.ResponseWriter, *http.Request, *NMOSMapOutput)) http.HandlerFunc {
+	return n.withChannelMapping(func(w http.ResponseWriter, r *http.Request, cm *NMOSChannelMapping) {
+		out := cm.FindOutput(mux.Vars(r)["id"])
+		if out == nil {
+			writeError(w, http.StatusNotFound, "output not found")
+			return
+		}
+		f(w, r, out)
+	})
+}
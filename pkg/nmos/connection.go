@@ -0,0 +1,531 @@
+package nmos
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+type NMOSConstraint struct {
+	Enum        []interface{} `json:"enum,omitempty"`
+	Minimum     interface{}   `json:"minimum,omitempty"`
+	Maximum     interface{}   `json:"maximum,omitempty"`
+	Pattern     string        `json:"pattern,omitempty"`
+	Description string        `json:"description,omitempty"`
+}
+
+// NMOSConstraints holds the constraints of one leg, keyed by parameter name
+type NMOSConstraints map[string]NMOSConstraint
+
+// NMOSTransportParams holds the parameters of one leg. Values are kept as
+// decoded JSON so every transport type can share the same staging code.
+type NMOSTransportParams map[string]interface{}
+
+func (c NMOSConstraint) Check(v interface{}) error {
+	if len(c.Enum) > 0 {
+		found := false
+		for _, e := range c.Enum {
+			if fmt.Sprint(e) == fmt.Sprint(v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("value %v not in %v", v, c.Enum)
+		}
+	}
+	if f, ok := v.(float64); ok {
+		if min, ok := c.Minimum.(float64); ok && f < min {
+			return fmt.Errorf("value %v below minimum %v", v, min)
+		}
+		if max, ok := c.Maximum.(float64); ok && f > max {
+			return fmt.Errorf("value %v above maximum %v", v, max)
+		}
+	}
+	return nil
+}
+
+func (p NMOSTransportParams) copy() NMOSTransportParams {
+	c := make(NMOSTransportParams, len(p))
+	for k, v := range p {
+		c[k] = v
+	}
+	return c
+}
+
+func copyLegs(legs []NMOSTransportParams) []NMOSTransportParams {
+	c := make([]NMOSTransportParams, len(legs))
+	for i, l := range legs {
+		c[i] = l.copy()
+	}
+	return c
+}
+
+// String returns a parameter as a string, "" if missing or not a string
+func (p NMOSTransportParams) String(key string) string {
+	s, _ := p[key].(string)
+	return s
+}
+
+// Int returns a numeric parameter, def if missing or "auto"
+func (p NMOSTransportParams) Int(key string, def int) int {
+	if f, ok := p[key].(float64); ok {
+		return int(f)
+	}
+	if i, ok := p[key].(int); ok {
+		return i
+	}
+	return def
+}
+
+func (p NMOSTransportParams) Bool(key string) bool {
+	b, _ := p[key].(bool)
+	return b
+}
+
+// mergeLegs applies patched leg parameters after checking them against the
+// leg constraints
+func mergeLegs(staged []NMOSTransportParams, constraints []NMOSConstraints, patch []NMOSTransportParams) error {
+	if len(patch) > len(staged) {
+		return fmt.Errorf("%d legs given, %d supported", len(patch), len(staged))
+	}
+	for i, leg := range patch {
+		for k, v := range leg {
+			c, ok := constraints[i][k]
+			if !ok {
+				return fmt.Errorf("unsupported transport parameter %s", k)
+			}
+			if s, isString := v.(string); !(isString && s == "auto") && v != nil {
+				if err := c.Check(v); err != nil {
+					return fmt.Errorf("%s: %s", k, err)
+				}
+			}
+		}
+	}
+	for i, leg := range patch {
+		for k, v := range leg {
+			staged[i][k] = v
+		}
+	}
+	return nil
+}
+
+// ConfigureLeg replaces the constraints of a leg with configured ones and
+// sets configured initial parameters, then checks the staged values
+// against the constraints
+func ConfigureLeg(constraints NMOSConstraints, staged NMOSTransportParams, configured NMOSConstraints, params NMOSTransportParams) error {
+	for k, c := range configured {
+		if _, ok := constraints[k]; !ok {
+			return fmt.Errorf("unsupported transport parameter %s", k)
+		}
+		constraints[k] = c
+	}
+	for k, v := range params {
+		if _, ok := constraints[k]; !ok {
+			return fmt.Errorf("unsupported transport parameter %s", k)
+		}
+		staged[k] = v
+	}
+	for k, v := range staged {
+		if s, isString := v.(string); (isString && s == "auto") || v == nil {
+			continue
+		}
+		if err := constraints[k].Check(v); err != nil {
+			return fmt.Errorf("%s: %s", k, err)
+		}
+	}
+	return nil
+}
+
+// configureLegs applies ConfigureLeg to every configured leg
+func configureLegs(constraints []NMOSConstraints, staged []NMOSTransportParams, configured []NMOSConstraints, params []NMOSTransportParams) error {
+	if len(configured) > len(constraints) || len(params) > len(staged) {
+		return fmt.Errorf("transport has %d legs", len(staged))
+	}
+	for i := range staged {
+		var c NMOSConstraints
+		var p NMOSTransportParams
+		if i < len(configured) {
+			c = configured[i]
+		}
+		if i < len(params) {
+			p = params[i]
+		}
+		if err := ConfigureLeg(constraints[i], staged[i], c, p); err != nil {
+			return fmt.Errorf("leg %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+type NMOSSenderParams struct {
+	ReceiverId      *uuid.UUID            `json:"receiver_id"`
+	MasterEnable    bool                  `json:"master_enable"`
+	Activation      NMOSActivation        `json:"activation"`
+	TransportParams []NMOSTransportParams `json:"transport_params"`
+}
+
+func (p NMOSSenderParams) copy() NMOSSenderParams {
+	p.TransportParams = copyLegs(p.TransportParams)
+	return p
+}
+
+// NMOSSenderConnection is the IS-05 state of a sender
+type NMOSSenderConnection struct {
+	mu          sync.Mutex
+	senderId    uuid.UUID
+	transport   Transport
+	host        TransportHost
+	constraints []NMOSConstraints
+	staged      NMOSSenderParams
+	active      NMOSSenderParams
+	activator   *Activator
+	// OnActivate is called with the new active parameters before they are
+	// applied, while the connection is locked. An error rejects the
+	// activation and leaves the active parameters unchanged.
+	OnActivate func(active NMOSSenderParams) error
+}
+
+// InitConnection sets up IS-05 staged and active parameters for the
+// sender's transport and its configured legs
+func (ns *NMOSSender) InitConnection(host TransportHost) error {
+	t, err := TransportFor(ns.Transport)
+	if err != nil {
+		return err
+	}
+	c := &NMOSSenderConnection{
+		senderId:  ns.Id,
+		transport: t,
+		host:      host,
+	}
+	c.activator = NewActivator(&c.mu)
+	for i := 0; i < t.Legs(len(host.InterfaceIPs)); i++ {
+		constraints, params := t.SenderLeg(host, i)
+		c.constraints = append(c.constraints, constraints)
+		c.staged.TransportParams = append(c.staged.TransportParams, params)
+	}
+	if err := configureLegs(c.constraints, c.staged.TransportParams, ns.Constraints, ns.TransportParams); err != nil {
+		return err
+	}
+	c.active = c.staged.copy()
+	c.active.TransportParams = c.resolve(c.staged.TransportParams)
+	ns.Connection = c
+	return nil
+}
+
+func (c *NMOSSenderConnection) Transport() Transport {
+	return c.transport
+}
+
+func (c *NMOSSenderConnection) Constraints() []NMOSConstraints {
+	return c.constraints
+}
+
+func (c *NMOSSenderConnection) Staged() NMOSSenderParams {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.staged.copy()
+	s.Activation = c.activator.Staged()
+	return s
+}
+
+func (c *NMOSSenderConnection) Active() NMOSSenderParams {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.active.copy()
+}
+
+// resolve replaces "auto" values with the values the sender will actually use
+func (c *NMOSSenderConnection) resolve(legs []NMOSTransportParams) []NMOSTransportParams {
+	resolved := copyLegs(legs)
+	for i, leg := range resolved {
+		c.transport.ResolveSender(c.host, c.senderId, i, leg)
+	}
+	return resolved
+}
+
+// activationError makes sure a rejected activation carries a status code,
+// errors that don't pick one are treated as internal failures
+func activationError(err error) error {
+	var ae *ActivationError
+	if errors.As(err, &ae) {
+		return ae
+	}
+	return &ActivationError{Code: http.StatusInternalServerError, Message: err.Error()}
+}
+
+// Patch applies a PATCH body to the staged parameters. It returns the
+// staged parameters to respond with and true if an activation was
+// scheduled.
+func (c *NMOSSenderConnection) Patch(body []byte) (NMOSSenderParams, bool, error) {
+	var patch map[string]json.RawMessage
+	if err := json.Unmarshal(body, &patch); err != nil {
+		return NMOSSenderParams{}, false, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var act *NMOSActivation
+	if raw, ok := patch["activation"]; ok {
+		act = new(NMOSActivation)
+		if err := json.Unmarshal(raw, act); err != nil {
+			return NMOSSenderParams{}, false, err
+		}
+	}
+	// Only cancelling is allowed while an activation is scheduled
+	if c.activator.Pending() && !(len(patch) == 1 && act != nil && act.Mode == nil) {
+		return NMOSSenderParams{}, false, ErrActivationPending
+	}
+
+	staged := c.staged.copy()
+	for k, raw := range patch {
+		var err error
+		switch k {
+		case "receiver_id":
+			err = json.Unmarshal(raw, &staged.ReceiverId)
+		case "master_enable":
+			err = json.Unmarshal(raw, &staged.MasterEnable)
+		case "transport_params":
+			var legs []NMOSTransportParams
+			if err = json.Unmarshal(raw, &legs); err == nil {
+				err = mergeLegs(staged.TransportParams, c.constraints, legs)
+			}
+		case "activation":
+		default:
+			err = fmt.Errorf("unknown property %s", k)
+		}
+		if err != nil {
+			return NMOSSenderParams{}, false, err
+		}
+	}
+	prev := c.staged
+	c.staged = staged
+
+	resp := c.staged.copy()
+	if act == nil {
+		resp.Activation = c.activator.Staged()
+		return resp, false, nil
+	}
+	a, scheduled, err := c.activator.Request(*act, c.activate)
+	if err != nil {
+		// a rejected activation doesn't stage anything either
+		c.staged = prev
+		return NMOSSenderParams{}, false, err
+	}
+	resp.Activation = a
+	return resp, scheduled, nil
+}
+
+// activate copies the staged parameters to active, must hold c.mu
+func (c *NMOSSenderConnection) activate(act NMOSActivation) error {
+	active := c.staged.copy()
+	active.TransportParams = c.resolve(c.staged.TransportParams)
+	active.Activation = act
+	if c.OnActivate != nil {
+		if err := c.OnActivate(active.copy()); err != nil {
+			return activationError(err)
+		}
+	}
+	c.active = active
+	return nil
+}
+
+type NMOSTransportFile struct {
+	Data *string `json:"data"`
+	Type *string `json:"type"`
+}
+
+type NMOSReceiverParams struct {
+	SenderId        *uuid.UUID            `json:"sender_id"`
+	MasterEnable    bool                  `json:"master_enable"`
+	Activation      NMOSActivation        `json:"activation"`
+	TransportFile   NMOSTransportFile     `json:"transport_file"`
+	TransportParams []NMOSTransportParams `json:"transport_params"`
+}
+
+func (p NMOSReceiverParams) copy() NMOSReceiverParams {
+	p.TransportParams = copyLegs(p.TransportParams)
+	return p
+}
+
+// NMOSReceiverConnection is the IS-05 state of a receiver
+type NMOSReceiverConnection struct {
+	mu          sync.Mutex
+	receiverId  uuid.UUID
+	transport   Transport
+	host        TransportHost
+	constraints []NMOSConstraints
+	staged      NMOSReceiverParams
+	active      NMOSReceiverParams
+	activator   *Activator
+	// OnActivate is called with the new active parameters before they are
+	// applied, while the connection is locked. An error rejects the
+	// activation and leaves the active parameters unchanged.
+	OnActivate func(active NMOSReceiverParams) error
+}
+
+// InitConnection sets up IS-05 staged and active parameters for the
+// receiver's transport and its configured legs
+func (nr *NMOSReceiver) InitConnection(host TransportHost) error {
+	t, err := TransportFor(nr.Transport)
+	if err != nil {
+		return err
+	}
+	c := &NMOSReceiverConnection{
+		receiverId: nr.Id,
+		transport:  t,
+		host:       host,
+	}
+	c.activator = NewActivator(&c.mu)
+	for i := 0; i < t.Legs(len(host.InterfaceIPs)); i++ {
+		constraints, params := t.ReceiverLeg(host, i)
+		c.constraints = append(c.constraints, constraints)
+		c.staged.TransportParams = append(c.staged.TransportParams, params)
+	}
+	if err := configureLegs(c.constraints, c.staged.TransportParams, nr.Constraints, nr.TransportParams); err != nil {
+		return err
+	}
+	c.active = c.staged.copy()
+	c.active.TransportParams = c.resolve(c.staged.TransportParams)
+	nr.Connection = c
+	return nil
+}
+
+func (c *NMOSReceiverConnection) Transport() Transport {
+	return c.transport
+}
+
+func (c *NMOSReceiverConnection) Constraints() []NMOSConstraints {
+	return c.constraints
+}
+
+func (c *NMOSReceiverConnection) Staged() NMOSReceiverParams {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.staged.copy()
+	s.Activation = c.activator.Staged()
+	return s
+}
+
+func (c *NMOSReceiverConnection) Active() NMOSReceiverParams {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.active.copy()
+}
+
+func (c *NMOSReceiverConnection) resolve(legs []NMOSTransportParams) []NMOSTransportParams {
+	resolved := copyLegs(legs)
+	for i, leg := range resolved {
+		c.transport.ResolveReceiver(c.host, c.receiverId, i, leg)
+	}
+	return resolved
+}
+
+// Patch applies a PATCH body to the staged parameters. An SDP given in
+// transport_file is parsed into transport_params first and checked against
+// the leg constraints, so parameters in the same PATCH override it.
+func (c *NMOSReceiverConnection) Patch(body []byte) (NMOSReceiverParams, bool, error) {
+	var patch map[string]json.RawMessage
+	if err := json.Unmarshal(body, &patch); err != nil {
+		return NMOSReceiverParams{}, false, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var act *NMOSActivation
+	if raw, ok := patch["activation"]; ok {
+		act = new(NMOSActivation)
+		if err := json.Unmarshal(raw, act); err != nil {
+			return NMOSReceiverParams{}, false, err
+		}
+	}
+	if c.activator.Pending() && !(len(patch) == 1 && act != nil && act.Mode == nil) {
+		return NMOSReceiverParams{}, false, ErrActivationPending
+	}
+
+	staged := c.staged.copy()
+	if raw, ok := patch["transport_file"]; ok {
+		var tf NMOSTransportFile
+		if err := json.Unmarshal(raw, &tf); err != nil {
+			return NMOSReceiverParams{}, false, err
+		}
+		if tf.Data != nil {
+			// only RTP has a transport file
+			if c.transport.Type() != TransportRTP {
+				return NMOSReceiverParams{}, false, fmt.Errorf("transport_file is not supported by %s", c.transport.Type())
+			}
+			if tf.Type == nil || *tf.Type != "application/sdp" {
+				return NMOSReceiverParams{}, false, errors.New("transport_file type must be application/sdp")
+			}
+			sdp, err := ParseSDP(*tf.Data)
+			if err != nil {
+				return NMOSReceiverParams{}, false, err
+			}
+			legs := sdp.ReceiverTransportParams()
+			if len(legs) > len(staged.TransportParams) {
+				legs = legs[:len(staged.TransportParams)]
+			}
+			// legs the SDP doesn't describe are disabled
+			for len(legs) < len(staged.TransportParams) {
+				legs = append(legs, NMOSTransportParams{"rtp_enabled": false})
+			}
+			if err := mergeLegs(staged.TransportParams, c.constraints, legs); err != nil {
+				return NMOSReceiverParams{}, false, fmt.Errorf("transport_file: %s", err)
+			}
+		}
+		staged.TransportFile = tf
+	}
+	for k, raw := range patch {
+		var err error
+		switch k {
+		case "sender_id":
+			err = json.Unmarshal(raw, &staged.SenderId)
+		case "master_enable":
+			err = json.Unmarshal(raw, &staged.MasterEnable)
+		case "transport_params":
+			var legs []NMOSTransportParams
+			if err = json.Unmarshal(raw, &legs); err == nil {
+				err = mergeLegs(staged.TransportParams, c.constraints, legs)
+			}
+		case "activation", "transport_file":
+		default:
+			err = fmt.Errorf("unknown property %s", k)
+		}
+		if err != nil {
+			return NMOSReceiverParams{}, false, err
+		}
+	}
+	prev := c.staged
+	c.staged = staged
+
+	resp := c.staged.copy()
+	if act == nil {
+		resp.Activation = c.activator.Staged()
+		return resp, false, nil
+	}
+	a, scheduled, err := c.activator.Request(*act, c.activate)
+	if err != nil {
+		// a rejected activation doesn't stage anything either
+		c.staged = prev
+		return NMOSReceiverParams{}, false, err
+	}
+	resp.Activation = a
+	return resp, scheduled, nil
+}
+
+func (c *NMOSReceiverConnection) activate(act NMOSActivation) error {
+	active := c.staged.copy()
+	active.TransportParams = c.resolve(c.staged.TransportParams)
+	active.Activation = act
+	if c.OnActivate != nil {
+		if err := c.OnActivate(active.copy()); err != nil {
+			return activationError(err)
+		}
+	}
+	c.active = active
+	return nil
+}
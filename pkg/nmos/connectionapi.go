@@ -0,0 +1,280 @@
+package nmos
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+type NMOSError struct {
+	Code  int     `json:"code"`
+	Error string  `json:"error"`
+	Debug *string `json:"debug"`
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(NMOSError{Code: code, Error: msg})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	enc.Encode(v)
+}
+
+// handleSlash registers path both with and without a trailing slash
+func handleSlash(r *mux.Router, path string, f http.HandlerFunc) *mux.Route {
+	r.HandleFunc(path+"/", f)
+	return r.HandleFunc(path, f)
+}
+
+func (n *NMOSWebServer) initConnectionAPI(conSubRouter *mux.Router) {
+	handleSlash(conSubRouter, "", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, []string{"v1.0/", "v1.1/"})
+	})
+	handleSlash(conSubRouter, "/{version}", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, []string{"bulk/", "single/"})
+	})
+	handleSlash(conSubRouter, "/{version}/single", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, []string{"senders/", "receivers/"})
+	})
+	handleSlash(conSubRouter, "/{version}/bulk", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, []string{"senders/", "receivers/"})
+	})
+	handleSlash(conSubRouter, "/{version}/bulk/senders", n.handleBulkSenders)
+	handleSlash(conSubRouter, "/{version}/single/senders", n.handleConnectionSenders)
+	handleSlash(conSubRouter, "/{version}/single/senders/{id}", n.withSender(func(w http.ResponseWriter, r *http.Request, s *NMOSSender) {
+		writeJSON(w, http.StatusOK, []string{"constraints/", "staged/", "active/", "transportfile/", "transporttype/"})
+	}))
+	handleSlash(conSubRouter, "/{version}/single/senders/{id}/constraints", n.withSender(func(w http.ResponseWriter, r *http.Request, s *NMOSSender) {
+		writeJSON(w, http.StatusOK, s.Connection.Constraints())
+	}))
+	handleSlash(conSubRouter, "/{version}/single/senders/{id}/staged", n.withSender(n.handleSenderStaged))
+	handleSlash(conSubRouter, "/{version}/single/senders/{id}/active", n.withSender(func(w http.ResponseWriter, r *http.Request, s *NMOSSender) {
+		writeJSON(w, http.StatusOK, s.Connection.Active())
+	}))
+	handleSlash(conSubRouter, "/{version}/single/senders/{id}/transportfile", n.withSender(n.handleTransportFile))
+	handleSlash(conSubRouter, "/{version}/single/senders/{id}/transporttype", n.withSender(func(w http.ResponseWriter, r *http.Request, s *NMOSSender) {
+		writeJSON(w, http.StatusOK, s.Connection.Transport().Type())
+	}))
+	handleSlash(conSubRouter, "/{version}/bulk/receivers", n.handleBulkReceivers)
+	handleSlash(conSubRouter, "/{version}/single/receivers", n.handleConnectionReceivers)
+	handleSlash(conSubRouter, "/{version}/single/receivers/{id}", n.withReceiver(func(w http.ResponseWriter, r *http.Request, rc *NMOSReceiver) {
+		writeJSON(w, http.StatusOK, []string{"constraints/", "staged/", "active/", "transporttype/"})
+	}))
+	handleSlash(conSubRouter, "/{version}/single/receivers/{id}/constraints", n.withReceiver(func(w http.ResponseWriter, r *http.Request, rc *NMOSReceiver) {
+		writeJSON(w, http.StatusOK, rc.Connection.Constraints())
+	}))
+	handleSlash(conSubRouter, "/{version}/single/receivers/{id}/staged", n.withReceiver(n.handleReceiverStaged))
+	handleSlash(conSubRouter, "/{version}/single/receivers/{id}/active", n.withReceiver(func(w http.ResponseWriter, r *http.Request, rc *NMOSReceiver) {
+		writeJSON(w, http.StatusOK, rc.Connection.Active())
+	}))
+	handleSlash(conSubRouter, "/{version}/single/receivers/{id}/transporttype", n.withReceiver(func(w http.ResponseWriter, r *http.Request, rc *NMOSReceiver) {
+		writeJSON(w, http.StatusOK, rc.Connection.Transport().Type())
+	}))
+	// Manifest href advertised in IS-04
+	n.Router.HandleFunc("/x-manufacturer/senders/{id}/stream.sdp", n.withSender(n.handleTransportFile))
+}
+
+// withSender resolves the {id} route variable to a sender with IS-05 state
+func (n *NMOSWebServer) withSender(f func(http.ResponseWriter, *http.Request, *NMOSSender)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := uuid.Parse(mux.Vars(r)["id"])
+		if err != nil {
+			writeError(w, http.StatusNotFound, "invalid sender id")
+			return
+		}
+		_, d := n.snapshot()
+		s := d.FindSender(id)
+		if s == nil || s.Connection == nil {
+			writeError(w, http.StatusNotFound, "sender not found")
+			return
+		}
+		f(w, r, s)
+	}
+}
+
+func (n *NMOSWebServer) handleConnectionSenders(w http.ResponseWriter, r *http.Request) {
+	ids := make([]string, 0)
+	_, d := n.snapshot()
+	for _, s := range d.Senders() {
+		if s.Connection != nil {
+			ids = append(ids, s.Id.String()+"/")
+		}
+	}
+	writeJSON(w, http.StatusOK, ids)
+}
+
+func (n *NMOSWebServer) handleSenderStaged(w http.ResponseWriter, r *http.Request, s *NMOSSender) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.Connection.Staged())
+	case http.MethodPatch:
+		body, _ := ioutil.ReadAll(r.Body)
+		code, resp := n.patchSender(s, body)
+		writeJSON(w, code, resp)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// patchSender applies a staged PATCH and returns the status code and body
+func (n *NMOSWebServer) patchSender(s *NMOSSender, body []byte) (int, interface{}) {
+	staged, scheduled, err := s.Connection.Patch(body)
+	var ae *ActivationError
+	if err == ErrActivationPending {
+		return http.StatusLocked, NMOSError{Code: http.StatusLocked, Error: err.Error()}
+	}
+	if errors.As(err, &ae) {
+		return ae.Code, NMOSError{Code: ae.Code, Error: ae.Message}
+	}
+	if err != nil {
+		return http.StatusBadRequest, NMOSError{Code: http.StatusBadRequest, Error: err.Error()}
+	}
+	if scheduled {
+		return http.StatusAccepted, staged
+	}
+	return http.StatusOK, staged
+}
+
+type bulkResult struct {
+	Id    uuid.UUID `json:"id"`
+	Code  int       `json:"code"`
+	Error string    `json:"error,omitempty"`
+}
+
+// handleBulk runs patch for every {id, params} entry of a bulk request
+func handleBulk(w http.ResponseWriter, r *http.Request, patch func(uuid.UUID, []byte) (int, interface{})) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var reqs []struct {
+		Id     uuid.UUID       `json:"id"`
+		Params json.RawMessage `json:"params"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reqs); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	results := make([]bulkResult, 0)
+	for _, req := range reqs {
+		code, resp := patch(req.Id, req.Params)
+		res := bulkResult{Id: req.Id, Code: code}
+		if e, ok := resp.(NMOSError); ok {
+			res.Error = e.Error
+		}
+		results = append(results, res)
+	}
+	writeJSON(w, http.StatusOK, results)
+}
+
+func (n *NMOSWebServer) handleBulkSenders(w http.ResponseWriter, r *http.Request) {
+	handleBulk(w, r, func(id uuid.UUID, body []byte) (int, interface{}) {
+		_, d := n.snapshot()
+		s := d.FindSender(id)
+		if s == nil || s.Connection == nil {
+			return http.StatusNotFound, NMOSError{Code: http.StatusNotFound, Error: "sender not found"}
+		}
+		return n.patchSender(s, body)
+	})
+}
+
+func (n *NMOSWebServer) handleBulkReceivers(w http.ResponseWriter, r *http.Request) {
+	handleBulk(w, r, func(id uuid.UUID, body []byte) (int, interface{}) {
+		_, d := n.snapshot()
+		rc := d.FindReceiver(id)
+		if rc == nil || rc.Connection == nil {
+			return http.StatusNotFound, NMOSError{Code: http.StatusNotFound, Error: "receiver not found"}
+		}
+		return n.patchReceiver(rc, body)
+	})
+}
+
+func (n *NMOSWebServer) handleTransportFile(w http.ResponseWriter, r *http.Request, s *NMOSSender) {
+	if s.Connection.Transport().Type() != TransportRTP {
+		writeError(w, http.StatusNotFound, "transport has no transport file")
+		return
+	}
+	var source *NMOSSource
+	node, d := n.snapshot()
+	flow := d.FindFlow(s.Flow_id)
+	if flow != nil {
+		source = d.FindSource(flow.Source_id)
+	}
+	sdp, err := GenerateSDP(&node, s, flow, source, s.Connection.Active())
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Write([]byte(sdp))
+}
+
+// withReceiver resolves the {id} route variable to a receiver with IS-05 state
+func (n *NMOSWebServer) withReceiver(f func(http.ResponseWriter, *http.Request, *NMOSReceiver)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := uuid.Parse(mux.Vars(r)["id"])
+		if err != nil {
+			writeError(w, http.StatusNotFound, "invalid receiver id")
+			return
+		}
+		_, d := n.snapshot()
+		rc := d.FindReceiver(id)
+		if rc == nil || rc.Connection == nil {
+			writeError(w, http.StatusNotFound, "receiver not found")
+			return
+		}
+		f(w, r, rc)
+	}
+}
+
+func (n *NMOSWebServer) handleConnectionReceivers(w http.ResponseWriter, r *http.Request) {
+	ids := make([]string, 0)
+	_, d := n.snapshot()
+	for _, rc := range d.Receivers() {
+		if rc.Connection != nil {
+			ids = append(ids, rc.Id.String()+"/")
+		}
+	}
+	writeJSON(w, http.StatusOK, ids)
+}
+
+func (n *NMOSWebServer) handleReceiverStaged(w http.ResponseWriter, r *http.Request, rc *NMOSReceiver) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, rc.Connection.Staged())
+	case http.MethodPatch:
+		body, _ := ioutil.ReadAll(r.Body)
+		code, resp := n.patchReceiver(rc, body)
+		writeJSON(w, code, resp)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (n *NMOSWebServer) patchReceiver(rc *NMOSReceiver, body []byte) (int, interface{}) {
+	staged, scheduled, err := rc.Connection.Patch(body)
+	var ae *ActivationError
+	if err == ErrActivationPending {
+		return http.StatusLocked, NMOSError{Code: http.StatusLocked, Error: err.Error()}
+	}
+	if errors.As(err, &ae) {
+		return ae.Code, NMOSError{Code: ae.Code, Error: ae.Message}
+	}
+	if err != nil {
+		return http.StatusBadRequest, NMOSError{Code: http.StatusBadRequest, Error: err.Error()}
+	}
+	if scheduled {
+		return http.StatusAccepted, staged
+	}
+	return http.StatusOK, staged
+}
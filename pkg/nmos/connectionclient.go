@@ -0,0 +1,103 @@
+package nmos
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// NMOSConnectionClient drives IS-05 Connection APIs. The base URLs passed
+// to its methods are the sr-ctrl control hrefs of devices, e.g.
+// http://node:8889/x-nmos/connection/v1.1/
+type NMOSConnectionClient struct {
+	// Optional, http.DefaultClient if nil
+	HTTPClient *http.Client
+	// Optional, gets tokens for nodes requiring IS-10
+	Auth *NMOSAuthClient
+}
+
+// NMOSReceiverPatch is a PATCH to the staged parameters of a receiver
+type NMOSReceiverPatch struct {
+	SenderId      *uuid.UUID         `json:"sender_id"`
+	MasterEnable  bool               `json:"master_enable"`
+	Activation    *NMOSActivation    `json:"activation,omitempty"`
+	TransportFile *NMOSTransportFile `json:"transport_file,omitempty"`
+}
+
+func (c *NMOSConnectionClient) httpClient() *http.Client {
+	if c.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return c.HTTPClient
+}
+
+func (c *NMOSConnectionClient) do(method string, uri string, body interface{}, v interface{}) ([]byte, error) {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest(method, uri, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.Auth.Do(c.httpClient(), req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	res, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(res, &apiErr) == nil && apiErr.Error != "" {
+			return nil, fmt.Errorf("%s %s: %s: %s", method, uri, resp.Status, apiErr.Error)
+		}
+		return nil, fmt.Errorf("%s %s: %s", method, uri, resp.Status)
+	}
+	if v != nil {
+		if err := json.Unmarshal(res, v); err != nil {
+			return nil, fmt.Errorf("%s %s: %v", method, uri, err)
+		}
+	}
+	return res, nil
+}
+
+func connectionURL(base string, kind string, id uuid.UUID, endpoint string) string {
+	return fmt.Sprintf("%s/single/%s/%s/%s", strings.TrimSuffix(base, "/"), kind, id, endpoint)
+}
+
+// TransportFile returns the SDP of a sender
+func (c *NMOSConnectionClient) TransportFile(base string, sender uuid.UUID) (string, error) {
+	data, err := c.do(http.MethodGet, connectionURL(base, "senders", sender, "transportfile"), nil, nil)
+	return string(data), err
+}
+
+// StageReceiver PATCHes the staged parameters of a receiver and returns
+// the staged parameters the node answered with
+func (c *NMOSConnectionClient) StageReceiver(base string, receiver uuid.UUID, patch NMOSReceiverPatch) (NMOSReceiverParams, error) {
+	var staged NMOSReceiverParams
+	_, err := c.do(http.MethodPatch, connectionURL(base, "receivers", receiver, "staged"), patch, &staged)
+	return staged, err
+}
+
+// ActiveReceiver returns the active parameters of a receiver
+func (c *NMOSConnectionClient) ActiveReceiver(base string, receiver uuid.UUID) (NMOSReceiverParams, error) {
+	var active NMOSReceiverParams
+	_, err := c.do(http.MethodGet, connectionURL(base, "receivers", receiver, "active"), nil, &active)
+	return active, err
+}
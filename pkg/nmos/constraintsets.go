@@ -0,0 +1,473 @@
+package nmos
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+const (
+	CapFormatMediaType              = "urn:x-nmos:cap:format:media_type"
+	CapFormatGrainRate              = "urn:x-nmos:cap:format:grain_rate"
+	CapFormatFrameWidth             = "urn:x-nmos:cap:format:frame_width"
+	CapFormatFrameHeight            = "urn:x-nmos:cap:format:frame_height"
+	CapFormatInterlaceMode          = "urn:x-nmos:cap:format:interlace_mode"
+	CapFormatColorspace             = "urn:x-nmos:cap:format:colorspace"
+	CapFormatTransferCharacteristic = "urn:x-nmos:cap:format:transfer_characteristic"
+	CapFormatColorSampling          = "urn:x-nmos:cap:format:color_sampling"
+	CapFormatComponentDepth         = "urn:x-nmos:cap:format:component_depth"
+	CapFormatChannelCount           = "urn:x-nmos:cap:format:channel_count"
+	CapFormatSampleRate             = "urn:x-nmos:cap:format:sample_rate"
+	CapFormatSampleDepth            = "urn:x-nmos:cap:format:sample_depth"
+
+	CapTransportPacketTime             = "urn:x-nmos:cap:transport:packet_time"
+	CapTransportMaxPacketTime          = "urn:x-nmos:cap:transport:max_packet_time"
+	CapTransportST2110_21SenderType    = "urn:x-nmos:cap:transport:st2110_21_sender_type"
+	CapTransportPacketTransmissionMode = "urn:x-nmos:cap:transport:packet_transmission_mode"
+
+	CapMetaLabel      = "urn:x-nmos:cap:meta:label"
+	CapMetaPreference = "urn:x-nmos:cap:meta:preference"
+	CapMetaEnabled    = "urn:x-nmos:cap:meta:enabled"
+
+	capPrefix     = "urn:x-nmos:cap:"
+	capMetaPrefix = "urn:x-nmos:cap:meta:"
+)
+
+// NMOSConstraintSet maps capability parameter URNs to constraint objects
+// ({"enum", "minimum", "maximum"}) and meta URNs to plain values. Values are
+// kept as decoded JSON.
+type NMOSConstraintSet map[string]interface{}
+
+type NMOSConstraintSets struct {
+	Constraint_sets []NMOSConstraintSet `json:"constraint_sets"`
+}
+
+// Validate checks the structure of every constraint set
+func (c NMOSConstraintSets) Validate() error {
+	if c.Constraint_sets == nil {
+		return errors.New("constraint_sets is required")
+	}
+	for i, cs := range c.Constraint_sets {
+		for k, v := range cs {
+			if !strings.HasPrefix(k, capPrefix) {
+				return fmt.Errorf("constraint set %d: %s is not a capability parameter", i, k)
+			}
+			if strings.HasPrefix(k, capMetaPrefix) {
+				continue
+			}
+			obj, ok := v.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("constraint set %d: %s must be an object", i, k)
+			}
+			for ck, cv := range obj {
+				switch ck {
+				case "enum":
+					if e, ok := cv.([]interface{}); !ok || len(e) == 0 {
+						return fmt.Errorf("constraint set %d: %s enum must be a non-empty array", i, k)
+					}
+				case "minimum", "maximum":
+				default:
+					return fmt.Errorf("constraint set %d: %s has unknown keyword %s", i, k, ck)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Enabled is false for sets with urn:x-nmos:cap:meta:enabled set to false
+func (cs NMOSConstraintSet) Enabled() bool {
+	if e, ok := cs[CapMetaEnabled].(bool); ok {
+		return e
+	}
+	return true
+}
+
+// NMOSConstraintViolation describes one parameter that failed a constraint
+type NMOSConstraintViolation struct {
+	// Index of the constraint set in Constraint_sets, -1 for checks outside
+	// the constraint sets
+	Set        int
+	Param      string
+	Constraint interface{}
+	// nil if the parameter is missing
+	Value  interface{}
+	Reason string
+}
+
+func (v NMOSConstraintViolation) String() string {
+	if v.Set < 0 {
+		return fmt.Sprintf("%s: %s", v.Param, v.Reason)
+	}
+	return fmt.Sprintf("constraint set %d: %s: %s", v.Set, v.Param, v.Reason)
+}
+
+// Violations lists the parameter constraints of the set that params don't
+// satisfy, a constrained parameter missing from params is a violation
+func (cs NMOSConstraintSet) Violations(params map[string]interface{}) []NMOSConstraintViolation {
+	var vs []NMOSConstraintViolation
+	keys := make([]string, 0, len(cs))
+	for k := range cs {
+		if !strings.HasPrefix(k, capMetaPrefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v, ok := params[k]
+		if !ok {
+			vs = append(vs, NMOSConstraintViolation{Param: k, Constraint: cs[k], Reason: "parameter is not present"})
+			continue
+		}
+		if err := checkParamConstraint(cs[k], v); err != nil {
+			vs = append(vs, NMOSConstraintViolation{Param: k, Constraint: cs[k], Value: v, Reason: err.Error()})
+		}
+	}
+	return vs
+}
+
+// Match returns true if params satisfy every parameter constraint of the set
+func (cs NMOSConstraintSet) Match(params map[string]interface{}) bool {
+	return len(cs.Violations(params)) == 0
+}
+
+// Evaluate returns true if params satisfy at least one enabled set,
+// otherwise the violations of every enabled set are returned
+func (c NMOSConstraintSets) Evaluate(params map[string]interface{}) (bool, []NMOSConstraintViolation) {
+	var all []NMOSConstraintViolation
+	for i, cs := range c.Constraint_sets {
+		if !cs.Enabled() {
+			continue
+		}
+		vs := cs.Violations(params)
+		if len(vs) == 0 {
+			return true, nil
+		}
+		for _, v := range vs {
+			v.Set = i
+			all = append(all, v)
+		}
+	}
+	return false, all
+}
+
+// MatchAny returns true if params satisfy at least one enabled set
+func (c NMOSConstraintSets) MatchAny(params map[string]interface{}) bool {
+	ok, _ := c.Evaluate(params)
+	return ok
+}
+
+// Intersect returns the constraint sets describing params accepted by both
+// c and o. Every enabled set of c is intersected with every enabled set of
+// o, empty results are dropped.
+func (c NMOSConstraintSets) Intersect(o NMOSConstraintSets) NMOSConstraintSets {
+	res := NMOSConstraintSets{Constraint_sets: make([]NMOSConstraintSet, 0)}
+	for _, a := range c.Constraint_sets {
+		if !a.Enabled() {
+			continue
+		}
+		for _, b := range o.Constraint_sets {
+			if !b.Enabled() {
+				continue
+			}
+			if cs, ok := a.Intersect(b); ok {
+				res.Constraint_sets = append(res.Constraint_sets, cs)
+			}
+		}
+	}
+	return res
+}
+
+// Intersect combines two sets, ok is false if no params can satisfy both.
+// Meta values of cs take precedence.
+func (cs NMOSConstraintSet) Intersect(o NMOSConstraintSet) (NMOSConstraintSet, bool) {
+	res := NMOSConstraintSet{}
+	for k, v := range o {
+		res[k] = v
+	}
+	for k, v := range cs {
+		other, ok := o[k]
+		if strings.HasPrefix(k, capMetaPrefix) || !ok {
+			res[k] = v
+			continue
+		}
+		c, ok := intersectParamConstraint(v, other)
+		if !ok {
+			return nil, false
+		}
+		res[k] = c
+	}
+	return res, true
+}
+
+func intersectParamConstraint(a, b interface{}) (map[string]interface{}, bool) {
+	ao, _ := a.(map[string]interface{})
+	bo, _ := b.(map[string]interface{})
+	res := map[string]interface{}{}
+	// the larger minimum and smaller maximum
+	for _, k := range []string{"minimum", "maximum"} {
+		av, aok := ao[k]
+		bv, bok := bo[k]
+		switch {
+		case aok && bok:
+			less, ok := paramLess(av, bv)
+			if !ok {
+				return nil, false
+			}
+			if less == (k == "minimum") {
+				av = bv
+			}
+			res[k] = av
+		case aok:
+			res[k] = av
+		case bok:
+			res[k] = bv
+		}
+	}
+	if min, ok := res["minimum"]; ok {
+		if max, ok := res["maximum"]; ok {
+			if less, _ := paramLess(max, min); less {
+				return nil, false
+			}
+		}
+	}
+	ae, aok := ao["enum"].([]interface{})
+	be, bok := bo["enum"].([]interface{})
+	if !aok && !bok {
+		return res, true
+	}
+	var candidates []interface{}
+	switch {
+	case aok && bok:
+		for _, v := range ae {
+			for _, w := range be {
+				if paramEqual(v, w) {
+					candidates = append(candidates, v)
+					break
+				}
+			}
+		}
+	case aok:
+		candidates = ae
+	default:
+		candidates = be
+	}
+	// drop enum values outside the range
+	enum := make([]interface{}, 0)
+	for _, v := range candidates {
+		if checkParamConstraint(res, v) == nil {
+			enum = append(enum, v)
+		}
+	}
+	if len(enum) == 0 {
+		return nil, false
+	}
+	res["enum"] = enum
+	return res, true
+}
+
+func checkParamConstraint(c interface{}, v interface{}) error {
+	obj, _ := c.(map[string]interface{})
+	if enum, ok := obj["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			if paramEqual(e, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%v is not one of %v", paramString(v), paramList(enum))
+		}
+	}
+	if min, ok := obj["minimum"]; ok {
+		if less, ok := paramLess(v, min); !ok || less {
+			return fmt.Errorf("%v is less than minimum %v", paramString(v), paramString(min))
+		}
+	}
+	if max, ok := obj["maximum"]; ok {
+		if less, ok := paramLess(max, v); !ok || less {
+			return fmt.Errorf("%v is greater than maximum %v", paramString(v), paramString(max))
+		}
+	}
+	return nil
+}
+
+// paramNumber converts numbers and rationals to float64 for comparison
+func paramNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case NMOSRational:
+		return n.Float(), true
+	case map[string]interface{}:
+		num, ok := n["numerator"].(float64)
+		if !ok {
+			return 0, false
+		}
+		den, ok := n["denominator"].(float64)
+		if !ok {
+			den = 1
+		}
+		return num / den, true
+	}
+	return 0, false
+}
+
+func paramEqual(a, b interface{}) bool {
+	if an, ok := paramNumber(a); ok {
+		bn, ok := paramNumber(b)
+		return ok && an == bn
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// paramLess returns a < b, ok is false for values that can't be ordered
+func paramLess(a, b interface{}) (bool, bool) {
+	an, aok := paramNumber(a)
+	bn, bok := paramNumber(b)
+	if !aok || !bok {
+		return false, false
+	}
+	return an < bn, true
+}
+
+func paramString(v interface{}) string {
+	switch n := v.(type) {
+	case NMOSRational:
+		return sdpFrameRate(n)
+	case map[string]interface{}:
+		if r, ok := paramNumber(n); ok {
+			return fmt.Sprintf("%g", r)
+		}
+	}
+	return fmt.Sprint(v)
+}
+
+func paramList(vs []interface{}) string {
+	var s []string
+	for _, v := range vs {
+		s = append(s, paramString(v))
+	}
+	return "[" + strings.Join(s, ", ") + "]"
+}
+
+func (r NMOSRational) Float() float64 {
+	if r.Denominator == 0 {
+		return float64(r.Numerator)
+	}
+	return float64(r.Numerator) / float64(r.Denominator)
+}
+
+// FlowParams returns the capability parameters describing a flow
+func FlowParams(flow *NMOSFlow, source *NMOSSource) map[string]interface{} {
+	p := map[string]interface{}{
+		CapFormatMediaType: flow.Media_type,
+	}
+	if flow.Grain_rate != nil {
+		p[CapFormatGrainRate] = *flow.Grain_rate
+	}
+	switch flow.Format {
+	case FormatVideo:
+		p[CapFormatFrameWidth] = float64(flow.Frame_width)
+		p[CapFormatFrameHeight] = float64(flow.Frame_height)
+		if flow.Interlace_mode != "" {
+			p[CapFormatInterlaceMode] = flow.Interlace_mode
+		}
+		if flow.Colorspace != "" {
+			p[CapFormatColorspace] = flow.Colorspace
+		}
+		if flow.Transfer_characteristic != "" {
+			p[CapFormatTransferCharacteristic] = flow.Transfer_characteristic
+		}
+		if len(flow.Components) > 0 {
+			p[CapFormatColorSampling] = videoSampling(flow.Components)
+			p[CapFormatComponentDepth] = float64(flow.Components[0].Bit_depth)
+		}
+	case FormatAudio:
+		if flow.Sample_rate != nil {
+			p[CapFormatSampleRate] = *flow.Sample_rate
+		}
+		if flow.Bit_depth != 0 {
+			p[CapFormatSampleDepth] = float64(flow.Bit_depth)
+		}
+		if source != nil {
+			p[CapFormatChannelCount] = float64(len(source.Channels))
+		}
+	}
+	return p
+}
+
+// SenderParams returns the capability parameters of a sender, its flow
+// parameters plus the transport parameters of the streams it produces
+func SenderParams(sender *NMOSSender, flow *NMOSFlow, source *NMOSSource) map[string]interface{} {
+	p := FlowParams(flow, source)
+	t, err := TransportFor(sender.Transport)
+	if err != nil || t.Type() != TransportRTP {
+		return p
+	}
+	// match what GenerateSDP advertises
+	switch flow.Media_type {
+	case "video/raw":
+		p[CapTransportST2110_21SenderType] = sdpSenderType
+	case "audio/L16", "audio/L20", "audio/L24":
+		p[CapTransportPacketTime] = float64(sdpPacketTime)
+	}
+	return p
+}
+
+// CheckReceiverCaps tests a sender's flow against a receiver before they
+// are connected. Format, media types and transport are checked first, then
+// the receiver's constraint sets. No violations means they are compatible.
+func CheckReceiverCaps(receiver *NMOSReceiver, sender *NMOSSender, flow *NMOSFlow, source *NMOSSource) []NMOSConstraintViolation {
+	var vs []NMOSConstraintViolation
+	if receiver.Format != "" && receiver.Format != flow.Format {
+		vs = append(vs, NMOSConstraintViolation{Set: -1, Param: "format", Value: flow.Format,
+			Reason: fmt.Sprintf("receiver accepts %s", receiver.Format)})
+	}
+	if mt := receiver.Caps.Media_types; len(mt) > 0 {
+		found := false
+		for _, m := range mt {
+			if m == flow.Media_type {
+				found = true
+			}
+		}
+		if !found {
+			vs = append(vs, NMOSConstraintViolation{Set: -1, Param: "media_types", Value: flow.Media_type,
+				Reason: fmt.Sprintf("%s is not one of %v", flow.Media_type, mt)})
+		}
+	}
+	rt, rerr := TransportFor(receiver.Transport)
+	st, serr := TransportFor(sender.Transport)
+	if rerr != nil || serr != nil || rt.Type() != st.Type() {
+		vs = append(vs, NMOSConstraintViolation{Set: -1, Param: "transport", Value: sender.Transport,
+			Reason: fmt.Sprintf("receiver uses %s", receiver.Transport)})
+	}
+	if len(vs) > 0 || len(receiver.Caps.Constraint_sets) == 0 {
+		return vs
+	}
+	sets := NMOSConstraintSets{Constraint_sets: receiver.Caps.Constraint_sets}
+	ok, vs := sets.Evaluate(SenderParams(sender, flow, source))
+	if !ok && len(vs) == 0 {
+		vs = append(vs, NMOSConstraintViolation{Set: -1, Param: "constraint_sets", Reason: "no constraint set is enabled"})
+	}
+	return vs
+}
+
+// InitCaps validates the receiver's constraint sets and versions them
+func (nr *NMOSReceiver) InitCaps() error {
+	if nr.Caps.Constraint_sets == nil {
+		return nil
+	}
+	if err := (NMOSConstraintSets{Constraint_sets: nr.Caps.Constraint_sets}).Validate(); err != nil {
+		return err
+	}
+	if nr.Caps.Version == "" {
+		nr.Caps.Version = NewVersion()
+	}
+	return nil
+}
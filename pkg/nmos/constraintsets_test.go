@@ -0,0 +1,270 @@
+package nmos
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// constraintSets decodes constraint sets the way the IS-11 API receives them
+func constraintSets(t *testing.T, data string) NMOSConstraintSets {
+	t.Helper()
+	var sets NMOSConstraintSets
+	if err := json.Unmarshal([]byte(data), &sets); err != nil {
+		t.Fatal(err)
+	}
+	return sets
+}
+
+func TestConstraintSetsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr bool
+	}{
+		{"empty list", `{"constraint_sets": []}`, false},
+		{"enum and range", `{"constraint_sets": [{"urn:x-nmos:cap:format:frame_width": {"enum": [1920, 1280]}, "urn:x-nmos:cap:format:frame_height": {"minimum": 720, "maximum": 1080}}]}`, false},
+		{"meta values", `{"constraint_sets": [{"urn:x-nmos:cap:meta:label": "HD", "urn:x-nmos:cap:meta:enabled": false}]}`, false},
+		{"missing list", `{}`, true},
+		{"not a capability", `{"constraint_sets": [{"frame_width": {"enum": [1920]}}]}`, true},
+		{"not an object", `{"constraint_sets": [{"urn:x-nmos:cap:format:frame_width": 1920}]}`, true},
+		{"empty enum", `{"constraint_sets": [{"urn:x-nmos:cap:format:frame_width": {"enum": []}}]}`, true},
+		{"unknown keyword", `{"constraint_sets": [{"urn:x-nmos:cap:format:frame_width": {"exclusiveMinimum": 0}}]}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := constraintSets(t, tt.data).Validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConstraintSetMatch(t *testing.T) {
+	hd := map[string]interface{}{
+		CapFormatMediaType:   "video/raw",
+		CapFormatFrameWidth:  1920.0,
+		CapFormatFrameHeight: 1080.0,
+		CapFormatGrainRate:   NMOSRational{Numerator: 50, Denominator: 1},
+	}
+	tests := []struct {
+		name       string
+		set        string
+		params     map[string]interface{}
+		violations []string
+	}{
+		{"no constraints", `{}`, hd, nil},
+		{"enum", `{"urn:x-nmos:cap:format:media_type": {"enum": ["video/raw", "video/jxsv"]}}`, hd, nil},
+		{"enum mismatch", `{"urn:x-nmos:cap:format:frame_width": {"enum": [1280, 3840]}}`, hd, []string{CapFormatFrameWidth}},
+		{"range", `{"urn:x-nmos:cap:format:frame_height": {"minimum": 720, "maximum": 1080}}`, hd, nil},
+		{"below minimum", `{"urn:x-nmos:cap:format:frame_height": {"minimum": 2160}}`, hd, []string{CapFormatFrameHeight}},
+		{"above maximum", `{"urn:x-nmos:cap:format:frame_width": {"maximum": 1280}}`, hd, []string{CapFormatFrameWidth}},
+		{
+			name:   "rational enum",
+			set:    `{"urn:x-nmos:cap:format:grain_rate": {"enum": [{"numerator": 25}, {"numerator": 50, "denominator": 1}]}}`,
+			params: hd,
+		},
+		{
+			name:   "rational range",
+			set:    `{"urn:x-nmos:cap:format:grain_rate": {"minimum": {"numerator": 30000, "denominator": 1001}, "maximum": {"numerator": 60}}}`,
+			params: hd,
+		},
+		{
+			name:       "missing parameter",
+			set:        `{"urn:x-nmos:cap:format:sample_rate": {"enum": [{"numerator": 48000}]}}`,
+			params:     hd,
+			violations: []string{CapFormatSampleRate},
+		},
+		{
+			name:       "violations in parameter order",
+			set:        `{"urn:x-nmos:cap:format:frame_width": {"maximum": 1280}, "urn:x-nmos:cap:format:frame_height": {"maximum": 720}, "urn:x-nmos:cap:meta:label": "HD"}`,
+			params:     hd,
+			violations: []string{CapFormatFrameHeight, CapFormatFrameWidth},
+		},
+		{"string below minimum", `{"urn:x-nmos:cap:format:media_type": {"minimum": 1}}`, hd, []string{CapFormatMediaType}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cs NMOSConstraintSet
+			if err := json.Unmarshal([]byte(tt.set), &cs); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, v := range cs.Violations(tt.params) {
+				got = append(got, v.Param)
+			}
+			if !reflect.DeepEqual(got, tt.violations) {
+				t.Errorf("violations %v, want %v", got, tt.violations)
+			}
+			if cs.Match(tt.params) != (len(tt.violations) == 0) {
+				t.Error("Match disagrees with Violations")
+			}
+		})
+	}
+}
+
+func TestConstraintSetsEvaluate(t *testing.T) {
+	params := map[string]interface{}{CapFormatFrameWidth: 1920.0}
+	tests := []struct {
+		name string
+		data string
+		ok   bool
+		// constraint set index of each violation
+		sets []int
+	}{
+		{"second set matches", `{"constraint_sets": [{"urn:x-nmos:cap:format:frame_width": {"enum": [1280]}}, {"urn:x-nmos:cap:format:frame_width": {"enum": [1920]}}]}`, true, nil},
+		{"no set matches", `{"constraint_sets": [{"urn:x-nmos:cap:format:frame_width": {"enum": [1280]}}, {"urn:x-nmos:cap:format:frame_width": {"maximum": 720}}]}`, false, []int{0, 1}},
+		{"disabled set is skipped", `{"constraint_sets": [{"urn:x-nmos:cap:format:frame_width": {"enum": [1920]}, "urn:x-nmos:cap:meta:enabled": false}, {"urn:x-nmos:cap:format:frame_width": {"enum": [1280]}}]}`, false, []int{1}},
+		{"explicitly enabled", `{"constraint_sets": [{"urn:x-nmos:cap:format:frame_width": {"enum": [1920]}, "urn:x-nmos:cap:meta:enabled": true}]}`, true, nil},
+		{"no sets", `{"constraint_sets": []}`, false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sets := constraintSets(t, tt.data)
+			ok, vs := sets.Evaluate(params)
+			if ok != tt.ok {
+				t.Errorf("ok %v, want %v", ok, tt.ok)
+			}
+			var got []int
+			for _, v := range vs {
+				got = append(got, v.Set)
+			}
+			if !reflect.DeepEqual(got, tt.sets) {
+				t.Errorf("violations in sets %v, want %v", got, tt.sets)
+			}
+			if sets.MatchAny(params) != tt.ok {
+				t.Error("MatchAny disagrees with Evaluate")
+			}
+		})
+	}
+}
+
+func TestConstraintSetsIntersect(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want string
+	}{
+		{
+			name: "ranges narrow",
+			a:    `{"constraint_sets": [{"urn:x-nmos:cap:format:frame_width": {"minimum": 720, "maximum": 3840}}]}`,
+			b:    `{"constraint_sets": [{"urn:x-nmos:cap:format:frame_width": {"minimum": 1280, "maximum": 1920}}]}`,
+			want: `{"constraint_sets": [{"urn:x-nmos:cap:format:frame_width": {"minimum": 1280, "maximum": 1920}}]}`,
+		},
+		{
+			name: "enums keep common values in range",
+			a:    `{"constraint_sets": [{"urn:x-nmos:cap:format:frame_width": {"enum": [1280, 1920, 3840]}}]}`,
+			b:    `{"constraint_sets": [{"urn:x-nmos:cap:format:frame_width": {"enum": [1920, 3840], "maximum": 1920}}]}`,
+			want: `{"constraint_sets": [{"urn:x-nmos:cap:format:frame_width": {"enum": [1920], "maximum": 1920}}]}`,
+		},
+		{
+			name: "parameters of either side are kept",
+			a:    `{"constraint_sets": [{"urn:x-nmos:cap:format:frame_width": {"enum": [1920]}, "urn:x-nmos:cap:meta:label": "a"}]}`,
+			b:    `{"constraint_sets": [{"urn:x-nmos:cap:format:frame_height": {"enum": [1080]}, "urn:x-nmos:cap:meta:label": "b"}]}`,
+			want: `{"constraint_sets": [{"urn:x-nmos:cap:format:frame_width": {"enum": [1920]}, "urn:x-nmos:cap:format:frame_height": {"enum": [1080]}, "urn:x-nmos:cap:meta:label": "a"}]}`,
+		},
+		{
+			name: "disjoint sets are dropped",
+			a:    `{"constraint_sets": [{"urn:x-nmos:cap:format:frame_width": {"enum": [1280]}}, {"urn:x-nmos:cap:format:frame_width": {"minimum": 1920}}]}`,
+			b:    `{"constraint_sets": [{"urn:x-nmos:cap:format:frame_width": {"maximum": 1920}}]}`,
+			want: `{"constraint_sets": [{"urn:x-nmos:cap:format:frame_width": {"enum": [1280], "maximum": 1920}}, {"urn:x-nmos:cap:format:frame_width": {"minimum": 1920, "maximum": 1920}}]}`,
+		},
+		{
+			name: "empty range",
+			a:    `{"constraint_sets": [{"urn:x-nmos:cap:format:frame_width": {"minimum": 1921}}]}`,
+			b:    `{"constraint_sets": [{"urn:x-nmos:cap:format:frame_width": {"maximum": 1920}}]}`,
+			want: `{"constraint_sets": []}`,
+		},
+		{
+			name: "disabled sets are skipped",
+			a:    `{"constraint_sets": [{"urn:x-nmos:cap:format:frame_width": {"enum": [1920]}, "urn:x-nmos:cap:meta:enabled": false}]}`,
+			b:    `{"constraint_sets": [{}]}`,
+			want: `{"constraint_sets": []}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := constraintSets(t, tt.a).Intersect(constraintSets(t, tt.b))
+			want := constraintSets(t, tt.want)
+			if !reflect.DeepEqual(got, want) {
+				g, _ := json.Marshal(got)
+				t.Errorf("got %s\nwant %s", g, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckReceiverCaps(t *testing.T) {
+	sender, flow, source := compatTestVideo()
+	unicast := *sender
+	unicast.Transport = TransportRTPUnicast
+	websocket := *sender
+	websocket.Transport = TransportWebSocket
+	set := func(data string) NMOSConstraintSet {
+		var cs NMOSConstraintSet
+		if err := json.Unmarshal([]byte(data), &cs); err != nil {
+			t.Fatal(err)
+		}
+		return cs
+	}
+	audio := compatTestReceiver()
+	audio.Format = FormatAudio
+
+	tests := []struct {
+		name       string
+		receiver   *NMOSReceiver
+		sender     *NMOSSender
+		violations []string
+	}{
+		{"compatible", compatTestReceiver(), sender, nil},
+		{"rtp subclasses are compatible", compatTestReceiver(), &unicast, nil},
+		{"format mismatch", audio, sender, []string{"format"}},
+		{
+			name:       "media type not accepted",
+			receiver:   &NMOSReceiver{Format: FormatVideo, Transport: TransportRTP, Caps: NMOSCapabilities{Media_types: []string{"video/jxsv"}}},
+			sender:     sender,
+			violations: []string{"media_types"},
+		},
+		{"transport mismatch", compatTestReceiver(), &websocket, []string{"transport"}},
+		{
+			name:     "matching constraint set",
+			receiver: compatTestReceiver(set(`{"urn:x-nmos:cap:format:frame_width": {"enum": [1920]}, "urn:x-nmos:cap:format:color_sampling": {"enum": ["YCbCr-4:2:2"]}}`)),
+			sender:   sender,
+		},
+		{
+			name:     "sender type from the transport",
+			receiver: compatTestReceiver(set(`{"urn:x-nmos:cap:transport:st2110_21_sender_type": {"enum": ["2110TPN"]}}`)),
+			sender:   sender,
+		},
+		{
+			name:       "constraint set violated",
+			receiver:   compatTestReceiver(set(`{"urn:x-nmos:cap:format:component_depth": {"maximum": 8}}`)),
+			sender:     sender,
+			violations: []string{CapFormatComponentDepth},
+		},
+		{
+			name:       "no enabled constraint set",
+			receiver:   compatTestReceiver(set(`{"urn:x-nmos:cap:format:frame_width": {"enum": [1920]}, "urn:x-nmos:cap:meta:enabled": false}`)),
+			sender:     sender,
+			violations: []string{"constraint_sets"},
+		},
+		{
+			name:       "constraint sets are skipped when the format is wrong",
+			receiver:   &NMOSReceiver{Format: FormatAudio, Transport: TransportRTP, Caps: NMOSCapabilities{Constraint_sets: []NMOSConstraintSet{set(`{"urn:x-nmos:cap:format:frame_width": {"maximum": 8}}`)}}},
+			sender:     sender,
+			violations: []string{"format"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, v := range CheckReceiverCaps(tt.receiver, tt.sender, flow, source) {
+				got = append(got, v.Param)
+			}
+			if !reflect.DeepEqual(got, tt.violations) {
+				t.Errorf("violations %v, want %v", got, tt.violations)
+			}
+		})
+	}
+}
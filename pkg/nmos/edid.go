@@ -0,0 +1,446 @@
+package nmos
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const edidBlockSize = 128
+
+var edidHeader = []byte{0x00, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00}
+
+type EDIDTiming struct {
+	Width      int          `json:"width"`
+	Height     int          `json:"height"`
+	Frame_rate NMOSRational `json:"frame_rate"`
+	Interlaced bool         `json:"interlaced"`
+	Native     bool         `json:"native,omitempty"`
+}
+
+type EDIDAudioFormat struct {
+	Format       string `json:"format"`
+	Channels     int    `json:"channels"`
+	Sample_rates []int  `json:"sample_rates"`
+	Bit_depths   []int  `json:"bit_depths,omitempty"`
+}
+
+// EDID holds the sink capabilities decoded from an EDID 1.4 base block and
+// its CTA-861 extensions
+type EDID struct {
+	Manufacturer  string            `json:"manufacturer"`
+	Product_code  int               `json:"product_code"`
+	Serial        uint32            `json:"serial"`
+	Name          string            `json:"name,omitempty"`
+	Year          int               `json:"year"`
+	Version       string            `json:"version"`
+	Digital       bool              `json:"digital"`
+	Bit_depths    []int             `json:"bit_depths"`
+	Color_formats []string          `json:"color_formats"`
+	Timings       []EDIDTiming      `json:"timings"`
+	Audio         []EDIDAudioFormat `json:"audio"`
+	Transfer      []string          `json:"transfer_characteristics,omitempty"`
+}
+
+// ParseEDID decodes a raw EDID binary
+func ParseEDID(raw []byte) (*EDID, error) {
+	if len(raw) < edidBlockSize || len(raw)%edidBlockSize != 0 {
+		return nil, fmt.Errorf("edid length %d is not a multiple of %d", len(raw), edidBlockSize)
+	}
+	if !bytes.Equal(raw[:8], edidHeader) {
+		return nil, errors.New("invalid edid header")
+	}
+	for b := 0; b < len(raw)/edidBlockSize; b++ {
+		var sum byte
+		for _, v := range raw[b*edidBlockSize : (b+1)*edidBlockSize] {
+			sum += v
+		}
+		if sum != 0 {
+			return nil, fmt.Errorf("edid block %d checksum mismatch", b)
+		}
+	}
+	e := &EDID{
+		Bit_depths:    make([]int, 0),
+		Color_formats: []string{"RGB"},
+		Timings:       make([]EDIDTiming, 0),
+		Audio:         make([]EDIDAudioFormat, 0),
+	}
+	// Manufacturer id is three 5 bit letters, 'A' = 1
+	m := uint16(raw[8])<<8 | uint16(raw[9])
+	e.Manufacturer = string([]byte{byte(m>>10&0x1f) + '@', byte(m>>5&0x1f) + '@', byte(m&0x1f) + '@'})
+	e.Product_code = int(raw[10]) | int(raw[11])<<8
+	e.Serial = uint32(raw[12]) | uint32(raw[13])<<8 | uint32(raw[14])<<16 | uint32(raw[15])<<24
+	e.Year = 1990 + int(raw[17])
+	e.Version = fmt.Sprintf("%d.%d", raw[18], raw[19])
+
+	e.Digital = raw[20]&0x80 != 0
+	if e.Digital {
+		// bits 6-4: 1=6, 2=8 ... 6=16 bits per colour
+		if d := int(raw[20]>>4) & 0x07; d >= 1 && d <= 6 {
+			e.Bit_depths = append(e.Bit_depths, 4+2*d)
+		}
+		switch raw[24] >> 3 & 0x03 {
+		case 1:
+			e.addColorFormat("YCbCr-4:4:4")
+		case 2:
+			e.addColorFormat("YCbCr-4:2:2")
+		case 3:
+			e.addColorFormat("YCbCr-4:4:4")
+			e.addColorFormat("YCbCr-4:2:2")
+		}
+	}
+	e.parseEstablishedTimings(raw[35:38])
+	for i := 38; i < 54; i += 2 {
+		e.parseStandardTiming(raw[i], raw[i+1])
+	}
+	for i := 54; i < 126; i += 18 {
+		e.parseDescriptor(raw[i : i+18])
+	}
+	// Extension blocks, only CTA-861 is decoded
+	for b := 1; b < len(raw)/edidBlockSize; b++ {
+		block := raw[b*edidBlockSize : (b+1)*edidBlockSize]
+		if block[0] == 0x02 {
+			e.parseCTA(block)
+		}
+	}
+	sort.Ints(e.Bit_depths)
+	return e, nil
+}
+
+func (e *EDID) addColorFormat(f string) {
+	for _, c := range e.Color_formats {
+		if c == f {
+			return
+		}
+	}
+	e.Color_formats = append(e.Color_formats, f)
+}
+
+func (e *EDID) addBitDepth(d int) {
+	for _, b := range e.Bit_depths {
+		if b == d {
+			return
+		}
+	}
+	e.Bit_depths = append(e.Bit_depths, d)
+}
+
+func (e *EDID) addTiming(t EDIDTiming) {
+	for i, o := range e.Timings {
+		if o.Width == t.Width && o.Height == t.Height && o.Frame_rate == t.Frame_rate && o.Interlaced == t.Interlaced {
+			e.Timings[i].Native = o.Native || t.Native
+			return
+		}
+	}
+	e.Timings = append(e.Timings, t)
+}
+
+// edidRate converts a measured refresh rate to an NMOS rational, picking
+// the 1000/1001 variant for NTSC rates
+func edidRate(hz float64) NMOSRational {
+	n := math.Round(hz)
+	if math.Abs(hz-n) < 0.005 {
+		return NMOSRational{Numerator: int(n), Denominator: 1}
+	}
+	if ntsc := n * 1000 / 1001; math.Abs(hz-ntsc) < 0.01 {
+		return NMOSRational{Numerator: int(n) * 1000, Denominator: 1001}
+	}
+	return NMOSRational{Numerator: int(math.Round(hz * 1000)), Denominator: 1000}
+}
+
+var edidEstablishedTimings = []EDIDTiming{
+	// byte 35, bit 7 first
+	{Width: 720, Height: 400, Frame_rate: NMOSRational{70, 1}},
+	{Width: 720, Height: 400, Frame_rate: NMOSRational{88, 1}},
+	{Width: 640, Height: 480, Frame_rate: NMOSRational{60, 1}},
+	{Width: 640, Height: 480, Frame_rate: NMOSRational{67, 1}},
+	{Width: 640, Height: 480, Frame_rate: NMOSRational{72, 1}},
+	{Width: 640, Height: 480, Frame_rate: NMOSRational{75, 1}},
+	{Width: 800, Height: 600, Frame_rate: NMOSRational{56, 1}},
+	{Width: 800, Height: 600, Frame_rate: NMOSRational{60, 1}},
+	// byte 36
+	{Width: 800, Height: 600, Frame_rate: NMOSRational{72, 1}},
+	{Width: 800, Height: 600, Frame_rate: NMOSRational{75, 1}},
+	{Width: 832, Height: 624, Frame_rate: NMOSRational{75, 1}},
+	{Width: 1024, Height: 768, Frame_rate: NMOSRational{87, 1}, Interlaced: true},
+	{Width: 1024, Height: 768, Frame_rate: NMOSRational{60, 1}},
+	{Width: 1024, Height: 768, Frame_rate: NMOSRational{70, 1}},
+	{Width: 1024, Height: 768, Frame_rate: NMOSRational{75, 1}},
+	{Width: 1280, Height: 1024, Frame_rate: NMOSRational{75, 1}},
+	// byte 37 bit 7
+	{Width: 1152, Height: 870, Frame_rate: NMOSRational{75, 1}},
+}
+
+func (e *EDID) parseEstablishedTimings(b []byte) {
+	for i, t := range edidEstablishedTimings {
+		if b[i/8]&(0x80>>uint(i%8)) != 0 {
+			e.addTiming(t)
+		}
+	}
+}
+
+func (e *EDID) parseStandardTiming(b1, b2 byte) {
+	if (b1 == 0x01 && b2 == 0x01) || b1 == 0x00 {
+		return
+	}
+	w := (int(b1) + 31) * 8
+	var h int
+	switch b2 >> 6 {
+	case 0:
+		h = w * 10 / 16
+	case 1:
+		h = w * 3 / 4
+	case 2:
+		h = w * 4 / 5
+	case 3:
+		h = w * 9 / 16
+	}
+	e.addTiming(EDIDTiming{Width: w, Height: h, Frame_rate: NMOSRational{int(b2&0x3f) + 60, 1}})
+}
+
+// parseDescriptor handles an 18 byte detailed timing or display descriptor
+func (e *EDID) parseDescriptor(d []byte) {
+	pclk := int(d[0]) | int(d[1])<<8
+	if pclk == 0 {
+		// display descriptor
+		if d[3] == 0xfc {
+			e.Name = strings.TrimSpace(strings.SplitN(string(d[5:18]), "\n", 2)[0])
+		}
+		return
+	}
+	hActive := int(d[2]) | int(d[4]&0xf0)<<4
+	hBlank := int(d[3]) | int(d[4]&0x0f)<<8
+	vActive := int(d[5]) | int(d[7]&0xf0)<<4
+	vBlank := int(d[6]) | int(d[7]&0x0f)<<8
+	interlaced := d[17]&0x80 != 0
+	lines := vActive + vBlank
+	height := vActive
+	if interlaced {
+		// descriptor holds field lines, report frame size and rate. A
+		// frame has two fields and the half line between them.
+		lines = 2*lines + 1
+		height *= 2
+	}
+	hz := float64(pclk) * 10000 / float64((hActive+hBlank)*lines)
+	// first detailed timing is the preferred one
+	e.addTiming(EDIDTiming{Width: hActive, Height: height, Frame_rate: edidRate(hz), Interlaced: interlaced, Native: !e.hasNative()})
+}
+
+func (e *EDID) hasNative() bool {
+	for _, t := range e.Timings {
+		if t.Native {
+			return true
+		}
+	}
+	return false
+}
+
+// cta861VICs holds the commonly used CTA-861 video identification codes
+var cta861VICs = map[int]EDIDTiming{
+	1:   {Width: 640, Height: 480, Frame_rate: NMOSRational{60, 1}},
+	2:   {Width: 720, Height: 480, Frame_rate: NMOSRational{60000, 1001}},
+	3:   {Width: 720, Height: 480, Frame_rate: NMOSRational{60000, 1001}},
+	4:   {Width: 1280, Height: 720, Frame_rate: NMOSRational{60, 1}},
+	5:   {Width: 1920, Height: 1080, Frame_rate: NMOSRational{30, 1}, Interlaced: true},
+	6:   {Width: 720, Height: 480, Frame_rate: NMOSRational{30000, 1001}, Interlaced: true},
+	7:   {Width: 720, Height: 480, Frame_rate: NMOSRational{30000, 1001}, Interlaced: true},
+	16:  {Width: 1920, Height: 1080, Frame_rate: NMOSRational{60, 1}},
+	17:  {Width: 720, Height: 576, Frame_rate: NMOSRational{50, 1}},
+	18:  {Width: 720, Height: 576, Frame_rate: NMOSRational{50, 1}},
+	19:  {Width: 1280, Height: 720, Frame_rate: NMOSRational{50, 1}},
+	20:  {Width: 1920, Height: 1080, Frame_rate: NMOSRational{25, 1}, Interlaced: true},
+	21:  {Width: 720, Height: 576, Frame_rate: NMOSRational{25, 1}, Interlaced: true},
+	22:  {Width: 720, Height: 576, Frame_rate: NMOSRational{25, 1}, Interlaced: true},
+	31:  {Width: 1920, Height: 1080, Frame_rate: NMOSRational{50, 1}},
+	32:  {Width: 1920, Height: 1080, Frame_rate: NMOSRational{24, 1}},
+	33:  {Width: 1920, Height: 1080, Frame_rate: NMOSRational{25, 1}},
+	34:  {Width: 1920, Height: 1080, Frame_rate: NMOSRational{30, 1}},
+	60:  {Width: 1280, Height: 720, Frame_rate: NMOSRational{24, 1}},
+	61:  {Width: 1280, Height: 720, Frame_rate: NMOSRational{25, 1}},
+	62:  {Width: 1280, Height: 720, Frame_rate: NMOSRational{30, 1}},
+	63:  {Width: 1920, Height: 1080, Frame_rate: NMOSRational{120, 1}},
+	64:  {Width: 1920, Height: 1080, Frame_rate: NMOSRational{100, 1}},
+	93:  {Width: 3840, Height: 2160, Frame_rate: NMOSRational{24, 1}},
+	94:  {Width: 3840, Height: 2160, Frame_rate: NMOSRational{25, 1}},
+	95:  {Width: 3840, Height: 2160, Frame_rate: NMOSRational{30, 1}},
+	96:  {Width: 3840, Height: 2160, Frame_rate: NMOSRational{50, 1}},
+	97:  {Width: 3840, Height: 2160, Frame_rate: NMOSRational{60, 1}},
+	98:  {Width: 4096, Height: 2160, Frame_rate: NMOSRational{24, 1}},
+	99:  {Width: 4096, Height: 2160, Frame_rate: NMOSRational{25, 1}},
+	100: {Width: 4096, Height: 2160, Frame_rate: NMOSRational{30, 1}},
+	101: {Width: 4096, Height: 2160, Frame_rate: NMOSRational{50, 1}},
+	102: {Width: 4096, Height: 2160, Frame_rate: NMOSRational{60, 1}},
+}
+
+var ctaSampleRates = []int{32000, 44100, 48000, 88200, 96000, 176400, 192000}
+
+func (e *EDID) parseCTA(b []byte) {
+	dtdOffset := int(b[2])
+	if b[1] >= 2 {
+		if b[3]&0x20 != 0 {
+			e.addColorFormat("YCbCr-4:4:4")
+		}
+		if b[3]&0x10 != 0 {
+			e.addColorFormat("YCbCr-4:2:2")
+		}
+	}
+	// Data block collection
+	for i := 4; i < dtdOffset && i < edidBlockSize; {
+		tag := int(b[i] >> 5)
+		length := int(b[i] & 0x1f)
+		if i+1+length > edidBlockSize {
+			break
+		}
+		data := b[i+1 : i+1+length]
+		switch tag {
+		case 1:
+			e.parseCTAAudio(data)
+		case 2:
+			for _, svd := range data {
+				vic, native := int(svd), false
+				// 129-192 are VICs 1-64 flagged as native
+				if svd >= 129 && svd <= 192 {
+					vic, native = int(svd&0x7f), true
+				}
+				if t, ok := cta861VICs[vic]; ok {
+					t.Native = native
+					e.addTiming(t)
+				}
+			}
+		case 3:
+			// HDMI vendor specific block carries deep colour support
+			if len(data) >= 6 && data[0] == 0x03 && data[1] == 0x0c && data[2] == 0x00 {
+				e.addBitDepth(8)
+				if data[5]&0x10 != 0 {
+					e.addBitDepth(10)
+				}
+				if data[5]&0x20 != 0 {
+					e.addBitDepth(12)
+				}
+				if data[5]&0x40 != 0 {
+					e.addBitDepth(16)
+				}
+			}
+		case 7:
+			if len(data) < 2 {
+				break
+			}
+			switch data[0] {
+			case 6:
+				// HDR static metadata
+				eotfs := []string{"SDR", "", "PQ", "HLG"}
+				for bit, name := range eotfs {
+					if name != "" && data[1]&(1<<uint(bit)) != 0 {
+						e.Transfer = append(e.Transfer, name)
+					}
+				}
+			case 14, 15:
+				// YCbCr 4:2:0 video / capability map
+				e.addColorFormat("YCbCr-4:2:0")
+			}
+		}
+		i += 1 + length
+	}
+	// Detailed timings follow the data blocks
+	if dtdOffset >= 4 {
+		for i := dtdOffset; i+18 <= edidBlockSize-1; i += 18 {
+			if b[i] == 0 && b[i+1] == 0 {
+				break
+			}
+			e.parseDescriptor(b[i : i+18])
+		}
+	}
+}
+
+func (e *EDID) parseCTAAudio(data []byte) {
+	for i := 0; i+3 <= len(data); i += 3 {
+		code := int(data[i]>>3) & 0x0f
+		f := EDIDAudioFormat{
+			Channels:     int(data[i]&0x07) + 1,
+			Sample_rates: make([]int, 0),
+		}
+		switch code {
+		case 1:
+			f.Format = "LPCM"
+			for bit, depth := range []int{16, 20, 24} {
+				if data[i+2]&(1<<uint(bit)) != 0 {
+					f.Bit_depths = append(f.Bit_depths, depth)
+				}
+			}
+		case 2:
+			f.Format = "AC-3"
+		case 7:
+			f.Format = "DTS"
+		case 10:
+			f.Format = "E-AC-3"
+		default:
+			f.Format = fmt.Sprintf("audio-format-%d", code)
+		}
+		for bit, rate := range ctaSampleRates {
+			if data[i+1]&(1<<uint(bit)) != 0 {
+				f.Sample_rates = append(f.Sample_rates, rate)
+			}
+		}
+		e.Audio = append(e.Audio, f)
+	}
+}
+
+// EDIDStore holds a raw EDID together with its decoded capabilities, it
+// marshals to the decoded form
+type EDIDStore struct {
+	mu      sync.Mutex
+	raw     []byte
+	decoded *EDID
+}
+
+// Set validates and stores a raw EDID
+func (s *EDIDStore) Set(raw []byte) error {
+	e, err := ParseEDID(raw)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.raw = append([]byte(nil), raw...)
+	s.decoded = e
+	return nil
+}
+
+// Load reads an EDID binary from a file
+func (s *EDIDStore) Load(path string) error {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return s.Set(raw)
+}
+
+func (s *EDIDStore) Clear() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.raw = nil
+	s.decoded = nil
+}
+
+// Raw returns the stored binary, nil if none is set
+func (s *EDIDStore) Raw() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.raw
+}
+
+func (s *EDIDStore) Decoded() *EDID {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.decoded
+}
+
+func (s *EDIDStore) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.Decoded())
+}
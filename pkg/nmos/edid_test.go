@@ -0,0 +1,219 @@
+package nmos
+
+import (
+	"reflect"
+	"testing"
+)
+
+// edidChecksum sets the last byte of each block so the block sums to 0
+func edidChecksum(raw []byte) []byte {
+	for b := 0; b < len(raw)/edidBlockSize; b++ {
+		block := raw[b*edidBlockSize : (b+1)*edidBlockSize]
+		var sum byte
+		for _, v := range block[:edidBlockSize-1] {
+			sum += v
+		}
+		block[edidBlockSize-1] = -sum
+	}
+	return raw
+}
+
+// edidDTD encodes a detailed timing descriptor, pclk in 10 kHz units
+func edidDTD(pclk int, hActive int, hBlank int, vActive int, vBlank int, interlaced bool) []byte {
+	d := make([]byte, 18)
+	d[0], d[1] = byte(pclk), byte(pclk>>8)
+	d[2], d[3] = byte(hActive), byte(hBlank)
+	d[4] = byte(hActive>>8)<<4 | byte(hBlank>>8)
+	d[5], d[6] = byte(vActive), byte(vBlank)
+	d[7] = byte(vActive>>8)<<4 | byte(vBlank>>8)
+	if interlaced {
+		d[17] = 0x80
+	}
+	return d
+}
+
+// edidTestBase is a 10 bit digital 4:2:2 display, "DEL" product 0x1234,
+// made in 2020, preferring 1080p60
+func edidTestBase(extensions int, dtd []byte) []byte {
+	raw := make([]byte, edidBlockSize)
+	copy(raw, edidHeader)
+	// D=4 E=5 L=12
+	m := uint16(4)<<10 | uint16(5)<<5 | uint16(12)
+	raw[8], raw[9] = byte(m>>8), byte(m)
+	raw[10], raw[11] = 0x34, 0x12
+	raw[12], raw[13], raw[14], raw[15] = 0x78, 0x56, 0x34, 0x12
+	raw[17] = 30
+	raw[18], raw[19] = 1, 4
+	raw[20] = 0x80 | 3<<4
+	raw[24] = 2 << 3
+	// 640x480@60 established, 1280x720@60 standard
+	raw[35] = 0x20
+	for i := 38; i < 54; i++ {
+		raw[i] = 0x01
+	}
+	raw[38], raw[39] = 1280/8-31, 3<<6
+	copy(raw[54:], dtd)
+	name := []byte{0, 0, 0, 0xfc, 0}
+	name = append(name, []byte("Monitor\n     ")...)
+	copy(raw[72:], name)
+	raw[126] = byte(extensions)
+	return raw
+}
+
+// edidTestCTA is a CTA-861 extension with LPCM audio, 1080p60 (native) and
+// 1080p50, HDMI deep colour, HDR and 4:2:0 support
+func edidTestCTA() []byte {
+	b := make([]byte, edidBlockSize)
+	b[0], b[1] = 0x02, 3
+	b[3] = 0x30
+	blocks := []byte{
+		// audio: LPCM 2 channels, 44.1 and 48 kHz, 16 and 24 bit
+		1<<5 | 3, 0x09, 0x06, 0x05,
+		// video: VIC 16 native, VIC 31
+		2<<5 | 2, 0x90, 31,
+		// HDMI vendor specific: 10 and 12 bit
+		3<<5 | 6, 0x03, 0x0c, 0x00, 0x10, 0x00, 0x30,
+		// HDR static metadata: SDR and PQ
+		7<<5 | 2, 6, 0x05,
+		// YCbCr 4:2:0 capability map
+		7<<5 | 2, 15, 0x00,
+	}
+	copy(b[4:], blocks)
+	b[2] = byte(4 + len(blocks))
+	return b
+}
+
+func TestParseEDID(t *testing.T) {
+	p1080 := edidDTD(14850, 1920, 280, 1080, 45, false)
+	i1080 := edidDTD(7425, 1920, 720, 540, 22, true)
+	tests := []struct {
+		name  string
+		raw   []byte
+		check func(t *testing.T, e *EDID)
+	}{
+		{
+			name: "base block",
+			raw:  edidChecksum(edidTestBase(0, p1080)),
+			check: func(t *testing.T, e *EDID) {
+				if e.Manufacturer != "DEL" || e.Product_code != 0x1234 || e.Serial != 0x12345678 {
+					t.Errorf("identity %s %x %x", e.Manufacturer, e.Product_code, e.Serial)
+				}
+				if e.Name != "Monitor" || e.Year != 2020 || e.Version != "1.4" || !e.Digital {
+					t.Errorf("name %q, year %d, version %s, digital %v", e.Name, e.Year, e.Version, e.Digital)
+				}
+				if !reflect.DeepEqual(e.Bit_depths, []int{10}) {
+					t.Errorf("bit depths %v", e.Bit_depths)
+				}
+				if !reflect.DeepEqual(e.Color_formats, []string{"RGB", "YCbCr-4:2:2"}) {
+					t.Errorf("color formats %v", e.Color_formats)
+				}
+				want := []EDIDTiming{
+					{Width: 640, Height: 480, Frame_rate: NMOSRational{60, 1}},
+					{Width: 1280, Height: 720, Frame_rate: NMOSRational{60, 1}},
+					{Width: 1920, Height: 1080, Frame_rate: NMOSRational{60, 1}, Native: true},
+				}
+				if !reflect.DeepEqual(e.Timings, want) {
+					t.Errorf("timings %+v", e.Timings)
+				}
+				if len(e.Audio) != 0 {
+					t.Errorf("audio %+v", e.Audio)
+				}
+			},
+		},
+		{
+			name: "interlaced preferred timing",
+			raw:  edidChecksum(edidTestBase(0, i1080)),
+			check: func(t *testing.T, e *EDID) {
+				native := EDIDTiming{Width: 1920, Height: 1080, Frame_rate: NMOSRational{25, 1}, Interlaced: true, Native: true}
+				if e.Timings[len(e.Timings)-1] != native {
+					t.Errorf("preferred timing %+v", e.Timings[len(e.Timings)-1])
+				}
+			},
+		},
+		{
+			name: "CTA-861 extension",
+			raw:  edidChecksum(append(edidTestBase(1, p1080), edidTestCTA()...)),
+			check: func(t *testing.T, e *EDID) {
+				if !reflect.DeepEqual(e.Bit_depths, []int{8, 10, 12}) {
+					t.Errorf("bit depths %v", e.Bit_depths)
+				}
+				if !reflect.DeepEqual(e.Color_formats, []string{"RGB", "YCbCr-4:2:2", "YCbCr-4:4:4", "YCbCr-4:2:0"}) {
+					t.Errorf("color formats %v", e.Color_formats)
+				}
+				if !reflect.DeepEqual(e.Transfer, []string{"SDR", "PQ"}) {
+					t.Errorf("transfer characteristics %v", e.Transfer)
+				}
+				audio := []EDIDAudioFormat{{Format: "LPCM", Channels: 2, Sample_rates: []int{44100, 48000}, Bit_depths: []int{16, 24}}}
+				if !reflect.DeepEqual(e.Audio, audio) {
+					t.Errorf("audio %+v", e.Audio)
+				}
+				// VIC 16 is the DTD timing again, VIC 31 is new
+				want := []EDIDTiming{
+					{Width: 640, Height: 480, Frame_rate: NMOSRational{60, 1}},
+					{Width: 1280, Height: 720, Frame_rate: NMOSRational{60, 1}},
+					{Width: 1920, Height: 1080, Frame_rate: NMOSRational{60, 1}, Native: true},
+					{Width: 1920, Height: 1080, Frame_rate: NMOSRational{50, 1}},
+				}
+				if !reflect.DeepEqual(e.Timings, want) {
+					t.Errorf("timings %+v", e.Timings)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := ParseEDID(tt.raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, e)
+		})
+	}
+}
+
+func TestParseEDIDErrors(t *testing.T) {
+	valid := edidChecksum(edidTestBase(0, edidDTD(14850, 1920, 280, 1080, 45, false)))
+	badHeader := append([]byte(nil), valid...)
+	badHeader[0] = 0xff
+	badChecksum := append([]byte(nil), valid...)
+	badChecksum[127]++
+	badExtension := append(append([]byte(nil), valid...), edidTestCTA()...)
+
+	tests := []struct {
+		name string
+		raw  []byte
+	}{
+		{"empty", nil},
+		{"short", valid[:100]},
+		{"not whole blocks", append(append([]byte(nil), valid...), 0)},
+		{"bad header", badHeader},
+		{"bad checksum", badChecksum},
+		{"bad extension checksum", badExtension},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ParseEDID(tt.raw); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestEDIDRate(t *testing.T) {
+	tests := []struct {
+		hz   float64
+		want NMOSRational
+	}{
+		{60, NMOSRational{60, 1}},
+		{50.001, NMOSRational{50, 1}},
+		{59.94, NMOSRational{60000, 1001}},
+		{23.976, NMOSRational{24000, 1001}},
+		{29.97, NMOSRational{30000, 1001}},
+		{75.5, NMOSRational{75500, 1000}},
+	}
+	for _, tt := range tests {
+		if got := edidRate(tt.hz); got != tt.want {
+			t.Errorf("edidRate(%g) = %v, want %v", tt.hz, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package nmos
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// IS-07 base event types, measurements and enums extend them, e.g.
+// number/temperature/C or boolean/enum/tally
+const (
+	EventTypeBoolean = "boolean"
+	EventTypeString  = "string"
+	EventTypeNumber  = "number"
+)
+
+// IS-07 websocket message types
+const (
+	EventMessageState    = "state"
+	EventMessageHealth   = "health"
+	EventMessageReboot   = "reboot"
+	EventMessageShutdown = "shutdown"
+)
+
+// NMOSEventNumber is a scaled number, the real value is Value / Scale
+type NMOSEventNumber struct {
+	Value float64 `json:"value"`
+	Scale int     `json:"scale,omitempty"`
+}
+
+func (n NMOSEventNumber) Float() float64 {
+	if n.Scale == 0 {
+		return n.Value
+	}
+	return n.Value / float64(n.Scale)
+}
+
+type NMOSEventEnumValue struct {
+	Value       interface{} `json:"value"`
+	Label       string      `json:"label"`
+	Description string      `json:"description"`
+}
+
+// NMOSEventType is served on the type endpoint and describes the values a
+// source can take
+type NMOSEventType struct {
+	Type string `json:"type"`
+	// number
+	Min  *NMOSEventNumber `json:"min,omitempty"`
+	Max  *NMOSEventNumber `json:"max,omitempty"`
+	Step *NMOSEventNumber `json:"step,omitempty"`
+	Unit string           `json:"unit,omitempty"`
+	// string
+	Min_length *int   `json:"min_length,omitempty"`
+	Max_length *int   `json:"max_length,omitempty"`
+	Pattern    string `json:"pattern,omitempty"`
+	// enum of any base type
+	Values []NMOSEventEnumValue `json:"values,omitempty"`
+}
+
+type NMOSEventIdentity struct {
+	Source_id uuid.UUID  `json:"source_id"`
+	Flow_id   *uuid.UUID `json:"flow_id,omitempty"`
+}
+
+type NMOSEventTiming struct {
+	Creation_timestamp string `json:"creation_timestamp"`
+	Origin_timestamp   string `json:"origin_timestamp,omitempty"`
+}
+
+type NMOSEventPayload struct {
+	Value interface{} `json:"value"`
+	Scale int         `json:"scale,omitempty"`
+}
+
+// NMOSEventMessage is a state, health, reboot or shutdown message
+type NMOSEventMessage struct {
+	Message_type string             `json:"message_type"`
+	Identity     *NMOSEventIdentity `json:"identity,omitempty"`
+	Event_type   string             `json:"event_type,omitempty"`
+	Timing       NMOSEventTiming    `json:"timing"`
+	Payload      *NMOSEventPayload  `json:"payload,omitempty"`
+}
+
+// NMOSEventState holds the type and current state of an IS-07 source and
+// notifies subscribers of changes
+type NMOSEventState struct {
+	mu        sync.Mutex
+	typ       NMOSEventType
+	state     NMOSEventMessage
+	pattern   *regexp.Regexp
+	listeners map[int]func(NMOSEventMessage)
+	next      int
+}
+
+// InitEvents sets up the IS-07 state of a source with Event_type set. The
+// initial value must be valid for t.
+func (ns *NMOSSource) InitEvents(t NMOSEventType, initial interface{}) error {
+	if ns.Event_type == "" {
+		return errors.New("source has no event_type")
+	}
+	es := &NMOSEventState{
+		typ:       t,
+		listeners: make(map[int]func(NMOSEventMessage)),
+	}
+	if t.Pattern != "" {
+		p, err := regexp.Compile(t.Pattern)
+		if err != nil {
+			return err
+		}
+		es.pattern = p
+	}
+	es.state = NMOSEventMessage{
+		Message_type: EventMessageState,
+		Identity:     &NMOSEventIdentity{Source_id: ns.Id},
+		Event_type:   ns.Event_type,
+	}
+	if _, err := es.set(NMOSEventPayload{Value: initial}); err != nil {
+		return err
+	}
+	ns.Events = es
+	return nil
+}
+
+func (es *NMOSEventState) Type() NMOSEventType {
+	return es.typ
+}
+
+func (es *NMOSEventState) State() NMOSEventMessage {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	return es.state
+}
+
+// SetState validates and publishes a new value, numbers may pass a scale
+func (es *NMOSEventState) SetState(value interface{}, scale int) error {
+	msg, err := es.set(NMOSEventPayload{Value: value, Scale: scale})
+	if err != nil {
+		return err
+	}
+	es.mu.Lock()
+	listeners := make([]func(NMOSEventMessage), 0, len(es.listeners))
+	for _, l := range es.listeners {
+		listeners = append(listeners, l)
+	}
+	es.mu.Unlock()
+	for _, l := range listeners {
+		l(msg)
+	}
+	return nil
+}
+
+func (es *NMOSEventState) set(p NMOSEventPayload) (NMOSEventMessage, error) {
+	if n, ok := p.Value.(int); ok {
+		p.Value = float64(n)
+	}
+	if err := es.check(p); err != nil {
+		return NMOSEventMessage{}, err
+	}
+	now := FormatTAI(time.Now())
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	es.state.Payload = &p
+	es.state.Timing = NMOSEventTiming{Creation_timestamp: now, Origin_timestamp: now}
+	return es.state, nil
+}
+
+// check validates a payload against the event type
+func (es *NMOSEventState) check(p NMOSEventPayload) error {
+	t := es.typ
+	if len(t.Values) > 0 {
+		for _, v := range t.Values {
+			if paramEqual(v.Value, p.Value) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%v is not one of the enum values", p.Value)
+	}
+	switch t.Type {
+	case EventTypeBoolean:
+		if _, ok := p.Value.(bool); !ok {
+			return errors.New("value must be a boolean")
+		}
+	case EventTypeString:
+		s, ok := p.Value.(string)
+		if !ok {
+			return errors.New("value must be a string")
+		}
+		if t.Min_length != nil && len(s) < *t.Min_length {
+			return fmt.Errorf("value is shorter than %d", *t.Min_length)
+		}
+		if t.Max_length != nil && len(s) > *t.Max_length {
+			return fmt.Errorf("value is longer than %d", *t.Max_length)
+		}
+		if es.pattern != nil && !es.pattern.MatchString(s) {
+			return fmt.Errorf("value doesn't match %s", t.Pattern)
+		}
+	case EventTypeNumber:
+		f, ok := p.Value.(float64)
+		if !ok {
+			return errors.New("value must be a number")
+		}
+		v := NMOSEventNumber{Value: f, Scale: p.Scale}.Float()
+		if t.Min != nil && v < t.Min.Float() {
+			return fmt.Errorf("value is less than %g", t.Min.Float())
+		}
+		if t.Max != nil && v > t.Max.Float() {
+			return fmt.Errorf("value is greater than %g", t.Max.Float())
+		}
+		if t.Step != nil && t.Step.Float() > 0 {
+			base := 0.0
+			if t.Min != nil {
+				base = t.Min.Float()
+			}
+			steps := (v - base) / t.Step.Float()
+			if math.Abs(steps-math.Round(steps)) > 1e-9 {
+				return fmt.Errorf("value is not a multiple of step %g", t.Step.Float())
+			}
+		}
+	default:
+		return fmt.Errorf("unknown event type %s", t.Type)
+	}
+	return nil
+}
+
+// Subscribe registers f for state changes, the returned func removes it.
+// f is called from the goroutine calling SetState and must not block.
+func (es *NMOSEventState) Subscribe(f func(NMOSEventMessage)) func() {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	id := es.next
+	es.next++
+	es.listeners[id] = f
+	return func() {
+		es.mu.Lock()
+		defer es.mu.Unlock()
+		delete(es.listeners, id)
+	}
+}
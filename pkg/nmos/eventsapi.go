@@ -0,0 +1,200 @@
+package nmos
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// IS-07 clients send a health command at least every 5 seconds, connections
+// without one for 12 seconds are closed
+const eventHealthTimeout = 12 * time.Second
+
+var eventUpgrader = websocket.Upgrader{
+	// controllers and receivers connect from anywhere
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+type eventCommand struct {
+	Command   string      `json:"command"`
+	Sources   []uuid.UUID `json:"sources"`
+	Timestamp string      `json:"timestamp"`
+}
+
+// eventConn is one websocket client of the event server
+type eventConn struct {
+	ws     *websocket.Conn
+	mu     sync.Mutex
+	closed bool
+	send   chan interface{}
+	// unsubscribe funcs of the current subscription, only touched by the
+	// read loop
+	subs []func()
+}
+
+func (n *NMOSWebServer) initEventsAPI(evSubRouter *mux.Router) {
+	handleSlash(evSubRouter, "", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, []string{"v1.0/"})
+	})
+	handleSlash(evSubRouter, "/{version}", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, []string{"sources/"})
+	})
+	handleSlash(evSubRouter, "/{version}/sources", func(w http.ResponseWriter, r *http.Request) {
+		ids := make([]string, 0)
+		_, d := n.snapshot()
+		for _, s := range d.Sources() {
+			if s.Events != nil {
+				ids = append(ids, s.Id.String()+"/")
+			}
+		}
+		writeJSON(w, http.StatusOK, ids)
+	})
+	handleSlash(evSubRouter, "/{version}/sources/{id}", n.withEventSource(func(w http.ResponseWriter, r *http.Request, s *NMOSSource) {
+		writeJSON(w, http.StatusOK, []string{"state/", "type/"})
+	}))
+	handleSlash(evSubRouter, "/{version}/sources/{id}/type", n.withEventSource(func(w http.ResponseWriter, r *http.Request, s *NMOSSource) {
+		writeJSON(w, http.StatusOK, s.Events.Type())
+	}))
+	handleSlash(evSubRouter, "/{version}/sources/{id}/state", n.withEventSource(func(w http.ResponseWriter, r *http.Request, s *NMOSSource) {
+		writeJSON(w, http.StatusOK, s.Events.State())
+	}))
+	evSubRouter.HandleFunc("/{version}/ws", n.handleEventsWebSocket)
+}
+
+func (n *NMOSWebServer) withEventSource(f func(http.ResponseWriter, *http.Request, *NMOSSource)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := uuid.Parse(mux.Vars(r)["id"])
+		if err != nil {
+			writeError(w, http.StatusNotFound, "invalid source id")
+			return
+		}
+		_, d := n.snapshot()
+		s := d.FindSource(id)
+		if s == nil || s.Events == nil {
+			writeError(w, http.StatusNotFound, "source not found")
+			return
+		}
+		f(w, r, s)
+	}
+}
+
+func (n *NMOSWebServer) handleEventsWebSocket(w http.ResponseWriter, r *http.Request) {
+	ws, err := eventUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		Errorln("events websocket upgrade failed", err)
+		return
+	}
+	c := &eventConn{ws: ws, send: make(chan interface{}, 64)}
+	n.eventMu.Lock()
+	if n.eventConns == nil {
+		n.eventConns = make(map[*eventConn]bool)
+	}
+	n.eventConns[c] = true
+	n.eventMu.Unlock()
+
+	go c.writeLoop()
+	n.eventReadLoop(c)
+
+	n.eventMu.Lock()
+	delete(n.eventConns, c)
+	n.eventMu.Unlock()
+	c.unsubscribe()
+	c.close()
+}
+
+func (c *eventConn) writeLoop() {
+	for msg := range c.send {
+		c.ws.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		if err := c.ws.WriteJSON(msg); err != nil {
+			break
+		}
+	}
+	c.ws.Close()
+}
+
+// queue sends a message without blocking the publisher, slow clients lose
+// messages rather than holding up state changes
+func (c *eventConn) queue(msg interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return
+	}
+	select {
+	case c.send <- msg:
+	default:
+		Errorln("events websocket client too slow, dropping message")
+	}
+}
+
+// close stops the write loop, listeners still running are ignored
+func (c *eventConn) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	close(c.send)
+}
+
+func (c *eventConn) unsubscribe() {
+	for _, u := range c.subs {
+		u()
+	}
+	c.subs = nil
+}
+
+func (n *NMOSWebServer) eventReadLoop(c *eventConn) {
+	for {
+		c.ws.SetReadDeadline(time.Now().Add(eventHealthTimeout))
+		var cmd eventCommand
+		if err := c.ws.ReadJSON(&cmd); err != nil {
+			return
+		}
+		switch cmd.Command {
+		case "subscription":
+			c.unsubscribe()
+			for _, id := range cmd.Sources {
+				_, d := n.snapshot()
+				s := d.FindSource(id)
+				if s == nil || s.Events == nil {
+					continue
+				}
+				c.subs = append(c.subs, s.Events.Subscribe(func(msg NMOSEventMessage) {
+					c.queue(msg)
+				}))
+				// a new subscription gets the current state straight away
+				c.queue(s.Events.State())
+			}
+		case "health":
+			now := FormatTAI(time.Now())
+			origin := cmd.Timestamp
+			if origin == "" {
+				origin = now
+			}
+			c.queue(NMOSEventMessage{
+				Message_type: EventMessageHealth,
+				Timing:       NMOSEventTiming{Creation_timestamp: now, Origin_timestamp: origin},
+			})
+		default:
+			Errorln("unknown events websocket command", cmd.Command)
+		}
+	}
+}
+
+// notifyEventClients sends a reboot or shutdown message to every connected
+// websocket client
+func (n *NMOSWebServer) notifyEventClients(messageType string) {
+	now := FormatTAI(time.Now())
+	msg := NMOSEventMessage{
+		Message_type: messageType,
+		Timing:       NMOSEventTiming{Creation_timestamp: now, Origin_timestamp: now},
+	}
+	n.eventMu.Lock()
+	defer n.eventMu.Unlock()
+	for c := range n.eventConns {
+		c.queue(msg)
+	}
+}
@@ -0,0 +1,99 @@
+package nmos
+
+import (
+	"crypto/tls"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+const eventHealthInterval = 5 * time.Second
+
+// NMOSEventClient is an IS-07 websocket client as used by event receivers.
+// It subscribes to sources, keeps the connection alive with health commands
+// and passes state messages on.
+type NMOSEventClient struct {
+	ws   *websocket.Conn
+	mu   sync.Mutex
+	done chan struct{}
+	once sync.Once
+}
+
+// DialEvents connects to the connection_uri of a websocket sender and
+// subscribes to sources. handler is called from the client's goroutine for
+// every state message, and with a shutdown or reboot message before the
+// client closes. tlsConfig is used for wss and may be nil.
+func DialEvents(uri string, sources []uuid.UUID, tlsConfig *tls.Config, handler func(NMOSEventMessage)) (*NMOSEventClient, error) {
+	dialer := *websocket.DefaultDialer
+	if tlsConfig != nil {
+		dialer.TLSClientConfig = tlsConfig.Clone()
+	}
+	ws, _, err := dialer.Dial(uri, nil)
+	if err != nil {
+		return nil, err
+	}
+	c := &NMOSEventClient{ws: ws, done: make(chan struct{})}
+	if err := c.write(eventCommand{Command: "subscription", Sources: sources}); err != nil {
+		ws.Close()
+		return nil, err
+	}
+	go c.healthLoop()
+	go c.readLoop(handler)
+	return c, nil
+}
+
+func (c *NMOSEventClient) write(v interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ws.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	return c.ws.WriteJSON(v)
+}
+
+func (c *NMOSEventClient) healthLoop() {
+	t := time.NewTicker(eventHealthInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-t.C:
+			if err := c.write(eventCommand{Command: "health", Timestamp: FormatTAI(time.Now())}); err != nil {
+				Errorln("events health failed", err)
+				c.Close()
+				return
+			}
+		}
+	}
+}
+
+func (c *NMOSEventClient) readLoop(handler func(NMOSEventMessage)) {
+	defer c.Close()
+	for {
+		var msg NMOSEventMessage
+		if err := c.ws.ReadJSON(&msg); err != nil {
+			select {
+			case <-c.done:
+			default:
+				Errorln("events websocket closed", err)
+			}
+			return
+		}
+		switch msg.Message_type {
+		case EventMessageState:
+			handler(msg)
+		case EventMessageShutdown, EventMessageReboot:
+			handler(msg)
+			return
+		}
+	}
+}
+
+// Close disconnects, it is safe to call more than once
+func (c *NMOSEventClient) Close() {
+	c.once.Do(func() {
+		close(c.done)
+		c.ws.Close()
+	})
+}
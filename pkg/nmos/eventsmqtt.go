@@ -0,0 +1,160 @@
+package nmos
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+type mqttConnectionStatus struct {
+	Active bool `json:"active"`
+}
+
+// mqttClientID fits the id of a sender or receiver in the 23 characters
+// every MQTT 3.1.1 broker accepts
+func mqttClientID(id uuid.UUID) string {
+	return "gonmos-" + strings.ReplaceAll(id.String(), "-", "")[:16]
+}
+
+// NMOSMQTTEventClient receives the IS-07 state messages of an MQTT sender
+// as used by event receivers
+type NMOSMQTTEventClient struct {
+	conn *mqttConn
+}
+
+// DialMQTTEvents connects to the broker in the active parameters of an MQTT
+// receiver and subscribes to its broker_topic. handler is called from the
+// client's goroutine for every state message, starting with the retained
+// current state. tlsConfig is used for secure-mqtt and may be nil.
+func DialMQTTEvents(p NMOSTransportParams, receiver uuid.UUID, tlsConfig *tls.Config, handler func(NMOSEventMessage)) (*NMOSMQTTEventClient, error) {
+	topic := p.String("broker_topic")
+	if topic == "" {
+		return nil, errors.New("no broker_topic")
+	}
+	addr, tlsConfig, err := mqttBrokerAddr(p, "source_host", "source_port", tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dialMQTT(addr, tlsConfig, mqttClientID(receiver), nil, []string{topic}, func(m mqttMessage) {
+		var msg NMOSEventMessage
+		if err := json.Unmarshal(m.Payload, &msg); err != nil {
+			Errorln("invalid event message on", m.Topic, err)
+			return
+		}
+		if msg.Message_type == EventMessageState {
+			handler(msg)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &NMOSMQTTEventClient{conn: conn}, nil
+}
+
+// Close disconnects, it is safe to call more than once
+func (c *NMOSMQTTEventClient) Close() {
+	c.conn.Close()
+}
+
+// NMOSMQTTEventPublisher publishes the state of an IS-07 source for an MQTT
+// sender. The state is retained on broker_topic and the sender's
+// connection status on connection_status_broker_topic.
+type NMOSMQTTEventPublisher struct {
+	conn        *mqttConn
+	topic       string
+	status      string
+	unsubscribe func()
+	mu          sync.Mutex
+	closed      bool
+	send        chan NMOSEventMessage
+}
+
+// PublishMQTTEvents connects to the broker in the active parameters of an
+// MQTT sender and publishes the current state of events and every change
+// until closed. tlsConfig is used for secure-mqtt and may be nil.
+func PublishMQTTEvents(p NMOSTransportParams, sender uuid.UUID, tlsConfig *tls.Config, events *NMOSEventState) (*NMOSMQTTEventPublisher, error) {
+	topic := p.String("broker_topic")
+	if topic == "" {
+		return nil, errors.New("no broker_topic")
+	}
+	addr, tlsConfig, err := mqttBrokerAddr(p, "destination_host", "destination_port", tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	pub := &NMOSMQTTEventPublisher{
+		topic:  topic,
+		status: p.String("connection_status_broker_topic"),
+		send:   make(chan NMOSEventMessage, 64),
+	}
+	var will *mqttMessage
+	if pub.status != "" {
+		m := pub.statusMessage(false)
+		will = &m
+	}
+	if pub.conn, err = dialMQTT(addr, tlsConfig, mqttClientID(sender), will, nil, nil); err != nil {
+		return nil, err
+	}
+	if pub.status != "" {
+		if err := pub.conn.publish(pub.statusMessage(true)); err != nil {
+			pub.conn.Close()
+			return nil, err
+		}
+	}
+	pub.unsubscribe = events.Subscribe(pub.queue)
+	pub.queue(events.State())
+	go pub.writeLoop()
+	return pub, nil
+}
+
+func (pub *NMOSMQTTEventPublisher) statusMessage(active bool) mqttMessage {
+	payload, _ := json.Marshal(mqttConnectionStatus{Active: active})
+	return mqttMessage{Topic: pub.status, Payload: payload, Retain: true}
+}
+
+// queue hands a state change to the write loop without blocking SetState
+func (pub *NMOSMQTTEventPublisher) queue(msg NMOSEventMessage) {
+	pub.mu.Lock()
+	defer pub.mu.Unlock()
+	if pub.closed {
+		return
+	}
+	select {
+	case pub.send <- msg:
+	default:
+		Errorln("mqtt broker too slow, dropping event message")
+	}
+}
+
+func (pub *NMOSMQTTEventPublisher) writeLoop() {
+	for msg := range pub.send {
+		payload, err := json.Marshal(msg)
+		if err != nil {
+			Errorln("event message", err)
+			continue
+		}
+		if err := pub.conn.publish(mqttMessage{Topic: pub.topic, Payload: payload, Retain: true}); err != nil {
+			Errorln("mqtt publish failed", err)
+		}
+	}
+	if pub.status != "" {
+		pub.conn.publish(pub.statusMessage(false))
+	}
+	pub.conn.Close()
+}
+
+// Close stops publishing and marks the sender inactive, it is safe to call
+// more than once
+func (pub *NMOSMQTTEventPublisher) Close() {
+	pub.mu.Lock()
+	defer pub.mu.Unlock()
+	if pub.closed {
+		return
+	}
+	pub.closed = true
+	pub.unsubscribe()
+	close(pub.send)
+}
@@ -0,0 +1,211 @@
+package nmos
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// JWK is a JSON Web Key, only RSA and EC public keys are used
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// EC
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+var b64 = base64.RawURLEncoding
+
+func b64Int(s string) (*big.Int, error) {
+	b, err := b64.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// PublicKey decodes the key material
+func (k JWK) PublicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := b64Int(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64Int(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := b64Int(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b64Int(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+// RSAJWK returns the public JWK of an RSA key
+func RSAJWK(key *rsa.PublicKey, kid string) JWK {
+	return JWK{
+		Kty: "RSA",
+		Kid: kid,
+		Use: "sig",
+		Alg: "RS256",
+		N:   b64.EncodeToString(key.N.Bytes()),
+		E:   b64.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Typ string `json:"typ,omitempty"`
+}
+
+func jwtHash(alg string) (crypto.Hash, error) {
+	switch alg[2:] {
+	case "256":
+		return crypto.SHA256, nil
+	case "384":
+		return crypto.SHA384, nil
+	case "512":
+		return crypto.SHA512, nil
+	}
+	return 0, fmt.Errorf("unsupported alg %s", alg)
+}
+
+func digest(h crypto.Hash, data []byte) []byte {
+	switch h {
+	case crypto.SHA384:
+		d := sha512.Sum384(data)
+		return d[:]
+	case crypto.SHA512:
+		d := sha512.Sum512(data)
+		return d[:]
+	}
+	d := sha256.Sum256(data)
+	return d[:]
+}
+
+// parseJWT splits a compact JWS and decodes its header and claims without
+// verifying it
+func parseJWT(token string) (jwtHeader, map[string]interface{}, []byte, []byte, error) {
+	var h jwtHeader
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return h, nil, nil, nil, errors.New("malformed token")
+	}
+	hb, err := b64.DecodeString(parts[0])
+	if err != nil {
+		return h, nil, nil, nil, errors.New("malformed token header")
+	}
+	if err := json.Unmarshal(hb, &h); err != nil {
+		return h, nil, nil, nil, errors.New("malformed token header")
+	}
+	cb, err := b64.DecodeString(parts[1])
+	if err != nil {
+		return h, nil, nil, nil, errors.New("malformed token claims")
+	}
+	claims := make(map[string]interface{})
+	if err := json.Unmarshal(cb, &claims); err != nil {
+		return h, nil, nil, nil, errors.New("malformed token claims")
+	}
+	sig, err := b64.DecodeString(parts[2])
+	if err != nil {
+		return h, nil, nil, nil, errors.New("malformed token signature")
+	}
+	return h, claims, []byte(parts[0] + "." + parts[1]), sig, nil
+}
+
+// verifyJWT checks the signature of signed with key, alg comes from the
+// token header and must fit the key type
+func verifyJWT(alg string, key crypto.PublicKey, signed, sig []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported alg %s", alg)
+	}
+	h, err := jwtHash(alg)
+	if err != nil {
+		return err
+	}
+	d := digest(h, signed)
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return fmt.Errorf("alg %s doesn't match RSA key", alg)
+		}
+		return rsa.VerifyPKCS1v15(k, h, d, sig)
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(alg, "ES") {
+			return fmt.Errorf("alg %s doesn't match EC key", alg)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("invalid signature length")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, d, r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+	return errors.New("unsupported key")
+}
+
+// SignJWT issues an RS256 token, used by the stand-in authorization server
+func SignJWT(key *rsa.PrivateKey, kid string, claims interface{}) (string, error) {
+	hb, err := json.Marshal(jwtHeader{Alg: "RS256", Kid: kid, Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	cb, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := b64.EncodeToString(hb) + "." + b64.EncodeToString(cb)
+	d := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, d[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + b64.EncodeToString(sig), nil
+}
@@ -0,0 +1,64 @@
+package nmos
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+// LogLevel filters what the nmos and node packages log
+type LogLevel int32
+
+const (
+	// every registry call and API request
+	LogDebug LogLevel = iota
+	// discovery, registration and reloads
+	LogInfo
+	// failures
+	LogError
+	// only fatal errors
+	LogNone
+)
+
+var logLevel = int32(LogInfo)
+
+// SetLogLevel drops log messages below level, LogInfo by default
+func SetLogLevel(level LogLevel) {
+	atomic.StoreInt32(&logLevel, int32(level))
+}
+
+// ParseLogLevel parses debug, info, error or none
+func ParseLogLevel(s string) (LogLevel, error) {
+	switch s {
+	case "debug":
+		return LogDebug, nil
+	case "", "info":
+		return LogInfo, nil
+	case "error":
+		return LogError, nil
+	case "none":
+		return LogNone, nil
+	}
+	return LogInfo, fmt.Errorf("unknown log level %q", s)
+}
+
+func logAt(level LogLevel, v []interface{}) {
+	if LogLevel(atomic.LoadInt32(&logLevel)) <= level {
+		log.Output(3, fmt.Sprintln(v...))
+	}
+}
+
+// Debugln logs at LogDebug, as log.Println does
+func Debugln(v ...interface{}) {
+	logAt(LogDebug, v)
+}
+
+// Infoln logs at LogInfo
+func Infoln(v ...interface{}) {
+	logAt(LogInfo, v)
+}
+
+// Errorln logs at LogError
+func Errorln(v ...interface{}) {
+	logAt(LogError, v)
+}
@@ -0,0 +1,50 @@
+package nmos
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestLogLevel(t *testing.T) {
+	var buf bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&buf)
+	defer SetLogLevel(LogInfo)
+	tests := []struct {
+		level string
+		want  []string
+	}{
+		{"debug", []string{"debug", "info", "error"}},
+		{"info", []string{"info", "error"}},
+		{"", []string{"info", "error"}},
+		{"error", []string{"error"}},
+		{"none", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.level, func(t *testing.T) {
+			level, err := ParseLogLevel(tt.level)
+			if err != nil {
+				t.Fatal(err)
+			}
+			SetLogLevel(level)
+			buf.Reset()
+			Debugln("debug")
+			Infoln("info")
+			Errorln("error")
+			var got []string
+			for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+				if f := strings.Fields(line); len(f) > 0 {
+					got = append(got, f[len(f)-1])
+				}
+			}
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("logged %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if _, err := ParseLogLevel("verbose"); err == nil {
+		t.Error("unknown level accepted")
+	}
+}
@@ -0,0 +1,330 @@
+package nmos
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A minimal MQTT 3.1.1 client for the IS-07 MQTT transport. Messages are
+// sent with QoS 0, state messages and the connection status are retained so
+// receivers get the current state when they subscribe.
+
+const (
+	mqttConnect    = 1
+	mqttConnack    = 2
+	mqttPublish    = 3
+	mqttPuback     = 4
+	mqttSubscribe  = 8
+	mqttSuback     = 9
+	mqttPingreq    = 12
+	mqttDisconnect = 14
+)
+
+const mqttKeepAlive = 30 * time.Second
+
+type mqttMessage struct {
+	Topic   string
+	Payload []byte
+	Retain  bool
+}
+
+// mqttConn is a connection to a broker, publish may be called from any
+// goroutine
+type mqttConn struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	mu      sync.Mutex
+	handler func(mqttMessage)
+	done    chan struct{}
+	once    sync.Once
+}
+
+// dialMQTT connects to the broker at addr and subscribes to topics. handler
+// is called from the connection's goroutine for every message on them. The
+// will is published by the broker if the connection drops without a
+// disconnect.
+func dialMQTT(addr string, tlsConfig *tls.Config, clientID string, will *mqttMessage, topics []string, handler func(mqttMessage)) (*mqttConn, error) {
+	d := &net.Dialer{Timeout: 5 * time.Second}
+	var conn net.Conn
+	var err error
+	if tlsConfig != nil {
+		conn, err = tls.DialWithDialer(d, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = d.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &mqttConn{conn: conn, r: bufio.NewReader(conn), handler: handler, done: make(chan struct{})}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	early, err := c.handshake(clientID, will, topics)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("mqtt %s: %v", addr, err)
+	}
+	conn.SetDeadline(time.Time{})
+	go c.readLoop(early)
+	go c.pingLoop()
+	return c, nil
+}
+
+// handshake connects and subscribes, returning the messages that arrived
+// before the subscription was acknowledged
+func (c *mqttConn) handshake(clientID string, will *mqttMessage, topics []string) ([]mqttMessage, error) {
+	// protocol name and level, then the flags, clean session
+	body := appendMQTTString(nil, "MQTT")
+	flags := byte(0x02)
+	if will != nil {
+		flags |= 0x04
+		if will.Retain {
+			flags |= 0x20
+		}
+	}
+	body = append(body, 4, flags)
+	keepAlive := int(mqttKeepAlive / time.Second)
+	body = append(body, byte(keepAlive>>8), byte(keepAlive))
+	body = appendMQTTString(body, clientID)
+	if will != nil {
+		body = appendMQTTString(body, will.Topic)
+		body = appendMQTTString(body, string(will.Payload))
+	}
+	if err := c.write(mqttConnect<<4, body); err != nil {
+		return nil, err
+	}
+	typ, ack, err := readMQTTPacket(c.r)
+	if err != nil {
+		return nil, err
+	}
+	if typ>>4 != mqttConnack || len(ack) != 2 {
+		return nil, errors.New("no connack")
+	}
+	if ack[1] != 0 {
+		return nil, fmt.Errorf("connection refused, code %d", ack[1])
+	}
+	if len(topics) == 0 {
+		return nil, nil
+	}
+
+	// packet id 1, then each topic filter with QoS 0
+	body = []byte{0, 1}
+	for _, t := range topics {
+		body = append(appendMQTTString(body, t), 0)
+	}
+	if err := c.write(mqttSubscribe<<4|0x02, body); err != nil {
+		return nil, err
+	}
+	var early []mqttMessage
+	for {
+		typ, p, err := readMQTTPacket(c.r)
+		if err != nil {
+			return nil, err
+		}
+		switch typ >> 4 {
+		case mqttPublish:
+			msg, err := c.received(typ, p)
+			if err != nil {
+				return nil, err
+			}
+			early = append(early, msg)
+		case mqttSuback:
+			if len(p) < 2 {
+				return nil, errors.New("short suback")
+			}
+			for _, code := range p[2:] {
+				if code == 0x80 {
+					return nil, errors.New("subscription refused")
+				}
+			}
+			return early, nil
+		}
+	}
+}
+
+// received parses a PUBLISH packet, acknowledging it if the broker sent it
+// with QoS 1
+func (c *mqttConn) received(typ byte, p []byte) (mqttMessage, error) {
+	if len(p) < 2 {
+		return mqttMessage{}, errors.New("short publish")
+	}
+	n := int(binary.BigEndian.Uint16(p))
+	if len(p) < 2+n {
+		return mqttMessage{}, errors.New("short publish")
+	}
+	msg := mqttMessage{Topic: string(p[2 : 2+n]), Retain: typ&0x01 != 0}
+	p = p[2+n:]
+	if qos := (typ >> 1) & 0x03; qos > 0 {
+		if len(p) < 2 {
+			return mqttMessage{}, errors.New("short publish")
+		}
+		if qos == 1 {
+			if err := c.write(mqttPuback<<4, p[:2]); err != nil {
+				return mqttMessage{}, err
+			}
+		}
+		p = p[2:]
+	}
+	msg.Payload = p
+	return msg, nil
+}
+
+func (c *mqttConn) readLoop(early []mqttMessage) {
+	defer c.closeConn()
+	for _, msg := range early {
+		c.handler(msg)
+	}
+	for {
+		// the broker answers pings, so a silent connection is a dead one
+		c.conn.SetReadDeadline(time.Now().Add(mqttKeepAlive * 3 / 2))
+		typ, p, err := readMQTTPacket(c.r)
+		if err != nil {
+			select {
+			case <-c.done:
+			default:
+				Errorln("mqtt connection closed", err)
+			}
+			return
+		}
+		if typ>>4 != mqttPublish {
+			continue
+		}
+		msg, err := c.received(typ, p)
+		if err != nil {
+			Errorln("mqtt", err)
+			return
+		}
+		if c.handler != nil {
+			c.handler(msg)
+		}
+	}
+}
+
+func (c *mqttConn) pingLoop() {
+	t := time.NewTicker(mqttKeepAlive / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-t.C:
+			if err := c.write(mqttPingreq<<4, nil); err != nil {
+				c.closeConn()
+				return
+			}
+		}
+	}
+}
+
+func (c *mqttConn) publish(msg mqttMessage) error {
+	header := byte(mqttPublish << 4)
+	if msg.Retain {
+		header |= 0x01
+	}
+	return c.write(header, append(appendMQTTString(nil, msg.Topic), msg.Payload...))
+}
+
+func (c *mqttConn) write(header byte, body []byte) error {
+	p := appendMQTTLength([]byte{header}, len(body))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, err := c.conn.Write(append(p, body...))
+	return err
+}
+
+// Close disconnects cleanly, so the broker drops the will. It is safe to
+// call more than once.
+func (c *mqttConn) Close() {
+	c.write(mqttDisconnect<<4, nil)
+	c.closeConn()
+}
+
+func (c *mqttConn) closeConn() {
+	c.once.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+func readMQTTPacket(r *bufio.Reader) (byte, []byte, error) {
+	typ, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, err := readMQTTLength(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	p := make([]byte, n)
+	if _, err := io.ReadFull(r, p); err != nil {
+		return 0, nil, err
+	}
+	return typ, p, nil
+}
+
+// readMQTTLength reads the variable length remaining length of a packet
+func readMQTTLength(r io.ByteReader) (int, error) {
+	n, shift := 0, 0
+	for i := 0; i < 4; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		n |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return n, nil
+		}
+		shift += 7
+	}
+	return 0, errors.New("malformed remaining length")
+}
+
+func appendMQTTLength(b []byte, n int) []byte {
+	for {
+		d := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			d |= 0x80
+		}
+		b = append(b, d)
+		if n == 0 {
+			return b
+		}
+	}
+}
+
+func appendMQTTString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+// mqttBrokerAddr returns the broker address and TLS config given by the
+// host, port and broker_protocol parameters of an MQTT leg
+func mqttBrokerAddr(p NMOSTransportParams, hostKey string, portKey string, tlsConfig *tls.Config) (string, *tls.Config, error) {
+	host := p.String(hostKey)
+	if host == "" {
+		return "", nil, fmt.Errorf("no %s", hostKey)
+	}
+	if p.Bool("broker_authorization") {
+		return "", nil, errors.New("broker_authorization is not supported")
+	}
+	if p.String("broker_protocol") != "secure-mqtt" {
+		return net.JoinHostPort(host, strconv.Itoa(p.Int(portKey, 1883))), nil, nil
+	}
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	} else {
+		tlsConfig = tlsConfig.Clone()
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = host
+	}
+	return net.JoinHostPort(host, strconv.Itoa(p.Int(portKey, 8883))), tlsConfig, nil
+}
@@ -0,0 +1,320 @@
+package nmos
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// fakeBroker is just enough of an MQTT broker for the client: retained
+// messages, exact topic subscriptions and wills
+type fakeBroker struct {
+	ln       net.Listener
+	mu       sync.Mutex
+	retained map[string][]byte
+	subs     map[string][]*fakeBrokerConn
+}
+
+type fakeBrokerConn struct {
+	conn net.Conn
+	mu   sync.Mutex
+}
+
+func (c *fakeBrokerConn) write(header byte, body []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.Write(append(appendMQTTLength([]byte{header}, len(body)), body...))
+}
+
+func newFakeBroker(t *testing.T) *fakeBroker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeBroker{ln: ln, retained: map[string][]byte{}, subs: map[string][]*fakeBrokerConn{}}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close() })
+	return b
+}
+
+func (b *fakeBroker) params() (string, int) {
+	addr := b.ln.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port
+}
+
+func mqttTestString(p []byte) (string, []byte) {
+	n := int(binary.BigEndian.Uint16(p))
+	return string(p[2 : 2+n]), p[2+n:]
+}
+
+func (b *fakeBroker) publish(topic string, payload []byte, retain bool) {
+	b.mu.Lock()
+	if retain {
+		b.retained[topic] = payload
+	}
+	subs := append([]*fakeBrokerConn(nil), b.subs[topic]...)
+	b.mu.Unlock()
+	for _, c := range subs {
+		c.write(mqttPublish<<4, append(appendMQTTString(nil, topic), payload...))
+	}
+}
+
+func (b *fakeBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	c := &fakeBrokerConn{conn: conn}
+	r := bufio.NewReader(conn)
+	var will *mqttMessage
+	clean := false
+	defer func() {
+		b.mu.Lock()
+		for topic, subs := range b.subs {
+			for i, s := range subs {
+				if s == c {
+					b.subs[topic] = append(subs[:i], subs[i+1:]...)
+					break
+				}
+			}
+		}
+		b.mu.Unlock()
+		if will != nil && !clean {
+			b.publish(will.Topic, will.Payload, will.Retain)
+		}
+	}()
+	for {
+		typ, p, err := readMQTTPacket(r)
+		if err != nil {
+			return
+		}
+		switch typ >> 4 {
+		case mqttConnect:
+			// protocol name, level, flags, keep alive, client id
+			_, rest := mqttTestString(p)
+			flags := rest[1]
+			_, rest = mqttTestString(rest[4:])
+			if flags&0x04 != 0 {
+				topic, rest := mqttTestString(rest)
+				payload, _ := mqttTestString(rest)
+				will = &mqttMessage{Topic: topic, Payload: []byte(payload), Retain: flags&0x20 != 0}
+			}
+			c.write(mqttConnack<<4, []byte{0, 0})
+		case mqttSubscribe:
+			id, rest := p[:2], p[2:]
+			var topics []string
+			for len(rest) > 0 {
+				var topic string
+				topic, rest = mqttTestString(rest)
+				rest = rest[1:]
+				topics = append(topics, topic)
+			}
+			c.write(mqttSuback<<4, append(id, make([]byte, len(topics))...))
+			for _, topic := range topics {
+				b.mu.Lock()
+				b.subs[topic] = append(b.subs[topic], c)
+				payload, ok := b.retained[topic]
+				b.mu.Unlock()
+				if ok {
+					c.write(mqttPublish<<4|0x01, append(appendMQTTString(nil, topic), payload...))
+				}
+			}
+		case mqttPublish:
+			topic, payload := mqttTestString(p)
+			b.publish(topic, payload, typ&0x01 != 0)
+		case mqttPingreq:
+			c.write(0xd0, nil)
+		case mqttDisconnect:
+			clean = true
+			return
+		}
+	}
+}
+
+func (b *fakeBroker) retainedMessage(topic string) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return string(b.retained[topic])
+}
+
+func TestMQTTLength(t *testing.T) {
+	tests := []struct {
+		n    int
+		size int
+	}{
+		{0, 1},
+		{127, 1},
+		{128, 2},
+		{16383, 2},
+		{16384, 3},
+		{2097151, 3},
+		{2097152, 4},
+		{268435455, 4},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.n), func(t *testing.T) {
+			b := appendMQTTLength(nil, tt.n)
+			if len(b) != tt.size {
+				t.Errorf("encoded in %d bytes, want %d", len(b), tt.size)
+			}
+			n, err := readMQTTLength(bytes.NewReader(b))
+			if err != nil || n != tt.n {
+				t.Errorf("decoded %d, %v", n, err)
+			}
+		})
+	}
+	if _, err := readMQTTLength(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff, 0x01})); err == nil {
+		t.Error("a five byte length was accepted")
+	}
+}
+
+func TestMQTTBrokerAddr(t *testing.T) {
+	tests := []struct {
+		name       string
+		params     NMOSTransportParams
+		want       string
+		tls        bool
+		serverName string
+		wantErr    bool
+	}{
+		{
+			name:   "mqtt",
+			params: NMOSTransportParams{"source_host": "broker", "source_port": float64(1884), "broker_protocol": "mqtt"},
+			want:   "broker:1884",
+		},
+		{
+			name:   "default port",
+			params: NMOSTransportParams{"source_host": "10.0.0.1", "source_port": "auto"},
+			want:   "10.0.0.1:1883",
+		},
+		{
+			name:       "secure-mqtt",
+			params:     NMOSTransportParams{"source_host": "broker.local", "broker_protocol": "secure-mqtt"},
+			want:       "broker.local:8883",
+			tls:        true,
+			serverName: "broker.local",
+		},
+		{name: "no host", params: NMOSTransportParams{"source_port": float64(1883)}, wantErr: true},
+		{
+			name:    "broker authorization",
+			params:  NMOSTransportParams{"source_host": "broker", "broker_authorization": true},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, cfg, err := mqttBrokerAddr(tt.params, "source_host", "source_port", nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err %v, wantErr %v", err, tt.wantErr)
+			}
+			if addr != tt.want {
+				t.Errorf("addr %q, want %q", addr, tt.want)
+			}
+			if (cfg != nil) != tt.tls {
+				t.Fatalf("tls config %v, want tls %v", cfg, tt.tls)
+			}
+			if cfg != nil && cfg.ServerName != tt.serverName {
+				t.Errorf("server name %q, want %q", cfg.ServerName, tt.serverName)
+			}
+		})
+	}
+}
+
+func TestMQTTEvents(t *testing.T) {
+	tests := []struct {
+		name string
+		// the receiver subscribes before the sender publishes
+		receiverFirst bool
+	}{
+		{"receiver joins a running sender", false},
+		{"sender starts after the receiver", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := newFakeBroker(t)
+			host, port := broker.params()
+			sender, receiver := uuid.New(), uuid.New()
+			topic := "x-nmos/events/1.0/" + sender.String()
+			status := topic + "/connection_status"
+
+			source := &NMOSSource{Id: uuid.New(), Event_type: "boolean"}
+			if err := source.InitEvents(NMOSEventType{Type: EventTypeBoolean}, false); err != nil {
+				t.Fatal(err)
+			}
+			got := make(chan interface{}, 8)
+			subscribe := func() *NMOSMQTTEventClient {
+				c, err := DialMQTTEvents(NMOSTransportParams{
+					"source_host": host, "source_port": float64(port), "broker_protocol": "mqtt", "broker_topic": topic,
+				}, receiver, nil, func(msg NMOSEventMessage) {
+					got <- msg.Payload.Value
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return c
+			}
+			var client *NMOSMQTTEventClient
+			if tt.receiverFirst {
+				client = subscribe()
+				defer client.Close()
+			}
+			pub, err := PublishMQTTEvents(NMOSTransportParams{
+				"destination_host": host, "destination_port": port, "broker_protocol": "mqtt",
+				"broker_topic": topic, "connection_status_broker_topic": status,
+			}, sender, nil, source.Events)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.receiverFirst {
+				// wait for the state to be retained
+				deadline := time.Now().Add(2 * time.Second)
+				for broker.retainedMessage(topic) == "" && time.Now().Before(deadline) {
+					time.Sleep(10 * time.Millisecond)
+				}
+				client = subscribe()
+				defer client.Close()
+			}
+
+			want := func(v interface{}) {
+				t.Helper()
+				select {
+				case value := <-got:
+					if value != v {
+						t.Errorf("got %v, want %v", value, v)
+					}
+				case <-time.After(2 * time.Second):
+					t.Fatalf("no event with %v", v)
+				}
+			}
+			want(false)
+			if err := source.Events.SetState(true, 0); err != nil {
+				t.Fatal(err)
+			}
+			want(true)
+			if s := broker.retainedMessage(status); s != `{"active":true}` {
+				t.Errorf("connection status %s while publishing", s)
+			}
+
+			pub.Close()
+			deadline := time.Now().Add(2 * time.Second)
+			for broker.retainedMessage(status) != `{"active":false}` && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if s := broker.retainedMessage(status); s != `{"active":false}` {
+				t.Errorf("connection status %s after close", s)
+			}
+		})
+	}
+}
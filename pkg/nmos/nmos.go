@@ -3,11 +3,11 @@ package nmos
 import (
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
-	"strconv"
+	"path/filepath"
 	"strings"
-	"time"
 
 	"github.com/google/uuid"
 )
@@ -25,6 +25,8 @@ type NMOSNodeData struct {
 	Id          uuid.UUID        `json:"id"`
 	Clocks      []NMOSClocks     `json:"clocks"`
 	Interfaces  []NMOSInterface  `json:"interfaces"`
+	// PTP domain used in SDP ts-refclk lines
+	PTPDomain int `json:"-"`
 }
 
 func GetPreferredNetworkAdapters() []net.Interface {
@@ -51,16 +53,90 @@ func GetPreferredNetworkAdapters() []net.Interface {
 	return retFaces
 }
 
-func (n *NMOSNodeData) Init(port int) {
+// fallbackAddresses returns the IPv4 addresses of all interfaces that are
+// up, for hosts without a preferred adapter. Loopback is used only if
+// there is nothing else.
+func fallbackAddresses() []string {
+	ifaces, _ := net.Interfaces()
+	var ips, loopback []string
+	for _, i := range ifaces {
+		if i.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, _ := i.Addrs()
+		for _, addr := range addrs {
+			ip, ok := addr.(*net.IPNet)
+			if !ok || ip.IP.To4() == nil {
+				continue
+			}
+			if i.Flags&net.FlagLoopback != 0 {
+				loopback = append(loopback, ip.IP.To4().String())
+			} else {
+				ips = append(ips, ip.IP.To4().String())
+			}
+		}
+	}
+	if len(ips) == 0 {
+		return loopback
+	}
+	return ips
+}
+
+// InterfaceIP returns the first IPv4 address of the named interface
+func InterfaceIP(name string) string {
+	intf, err := net.InterfaceByName(name)
+	if err != nil {
+		return ""
+	}
+	addrs, _ := intf.Addrs()
+	for _, addr := range addrs {
+		if ip, ok := addr.(*net.IPNet); ok && ip.IP.To4() != nil {
+			return ip.IP.To4().String()
+		}
+	}
+	return ""
+}
+
+// idNamespace scopes the UUIDv5 ids derived by StableID
+var idNamespace = uuid.MustParse("0e6d5a5c-4f3b-5d0a-9b7e-6e6d6f732d67")
+
+// StableID derives a UUIDv5 from key and path, so a resource keeps its id
+// across restarts. key identifies the node, see NodeKey, and path the
+// resource on it, e.g. the device id and "source", "Camera 1".
+func StableID(key string, path ...string) uuid.UUID {
+	return uuid.NewSHA1(idNamespace, []byte(strings.Join(append([]string{key}, path...), "/")))
+}
+
+// NodeKey returns the key kept in file, creating the file with a new
+// random key if it doesn't exist
+func NodeKey(file string) (string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err == nil {
+		if key := strings.TrimSpace(string(data)); key != "" {
+			return key, nil
+		}
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	key := uuid.New().String()
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return "", err
+	}
+	return key, ioutil.WriteFile(file, []byte(key+"\n"), 0o600)
+}
+
+// Init sets up a node serving its APIs on port. id should be derived
+// with StableID from the node key so the node keeps it across restarts.
+func (n *NMOSNodeData) Init(id uuid.UUID, port int) {
 
 	myIPAddresses := GetPreferredNetworkAdapters()
 	hostName, _ := os.Hostname()
 	splitHostName := strings.Split(hostName, ".")
 	n.Description = fmt.Sprintf("%s-node", splitHostName[0])
-	n.Version = fmt.Sprintf("%s:0", strconv.FormatInt(time.Now().Unix(), 10))
+	n.Version = NewVersion()
 	n.Hostname = hostName
 	n.Label = splitHostName[0]
-	n.Id = uuid.New()
+	n.Id = id
 
 	for _, intf := range myIPAddresses {
 		addr, _ := intf.Addrs()
@@ -83,12 +159,33 @@ func (n *NMOSNodeData) Init(port int) {
 			PortID:    localMac,
 		})
 	}
+	if len(n.API.Endpoints) == 0 {
+		for _, ip := range fallbackAddresses() {
+			n.API.Endpoints = append(n.API.Endpoints, NMOSEndpoint{Host: ip, Port: port, Protocol: "http"})
+		}
+		if len(n.API.Endpoints) > 0 {
+			n.Href = n.API.Endpoints[0].URL()
+		}
+	}
 	n.API.Versions = append(n.API.Versions, "v1.0")
 	n.API.Versions = append(n.API.Versions, "v1.1")
 	n.API.Versions = append(n.API.Versions, "v1.2")
 	n.API.Versions = append(n.API.Versions, "v1.3")
 	n.Services = make([]NMOSService, 0)
 	n.Clocks = make([]NMOSClocks, 0)
+	// SMPTE ST 2059-2 default domain
+	n.PTPDomain = 127
+}
+
+// SetProtocol switches the node's href and API endpoints to proto, http or
+// https
+func (n *NMOSNodeData) SetProtocol(proto string) {
+	for i := range n.API.Endpoints {
+		n.API.Endpoints[i].Protocol = proto
+	}
+	if len(n.API.Endpoints) > 0 {
+		n.Href = n.API.Endpoints[0].URL()
+	}
 }
 
 type NMOSTypeHolder struct {
@@ -99,7 +196,15 @@ type NMOSTypeHolder struct {
 type NMOSTags struct {
 }
 
+// NMOSCapabilities are the caps of an IS-04 resource. Receivers list the
+// media types they accept and BCP-004-01 constraint sets, Version must be
+// updated whenever the constraint sets change.
 type NMOSCapabilities struct {
+	Media_types     []string            `json:"media_types,omitempty"`
+	Constraint_sets []NMOSConstraintSet `json:"constraint_sets,omitempty"`
+	Version         string              `json:"version,omitempty"`
+	// IS-07 event receivers
+	Event_types []string `json:"event_types,omitempty"`
 }
 
 type NMOSAPI struct {
@@ -108,9 +213,14 @@ type NMOSAPI struct {
 }
 
 type NMOSEndpoint struct {
-	Host     string `json:"host"`
-	Port     int    `json:"port"`
-	Protocol string `json:"protocol"`
+	Host          string `json:"host"`
+	Port          int    `json:"port"`
+	Protocol      string `json:"protocol"`
+	Authorization bool   `json:"authorization"`
+}
+
+func (e NMOSEndpoint) URL() string {
+	return fmt.Sprintf("%s://%s:%d", e.Protocol, e.Host, e.Port)
 }
 
 type NMOSService struct {
@@ -134,7 +244,7 @@ type NMOSInterface struct {
 	// MAC ADDRESS
 	PortID string `json:"port_id"`
 	// Private for now
-	attNetDevice NMOSAttachedNetworkDevice `json:"attached_network_device"`
+	attNetDevice NMOSAttachedNetworkDevice
 }
 
 type NMOSAttachedNetworkDevice struct {
@@ -154,40 +264,134 @@ func MakeTransmission(d interface{}, name string) interface{} {
 }
 
 type NMOSSubscription struct {
-	Receiver_id uuid.UUID `json:"receiver_id"`
-	Active      bool      `json:"active"`
+	Receiver_id *uuid.UUID `json:"receiver_id"`
+	Active      bool       `json:"active"`
+}
+
+type NMOSReceiverSubscription struct {
+	Sender_id *uuid.UUID `json:"sender_id"`
+	Active    bool       `json:"active"`
 }
 
 type NMOSReceiver struct {
-	description        string
-	label              string
-	version            string
-	manifest_href      string
-	flow_id            uuid.UUID
-	Id                 uuid.UUID
-	transport          string
-	device_id          uuid.UUID
-	interface_bindings []string
-	tags               NMOSTags
+	Id                 uuid.UUID                `json:"id"`
+	Version            string                   `json:"version"`
+	Description        string                   `json:"description"`
+	Label              string                   `json:"label"`
+	Tags               NMOSTags                 `json:"tags"`
+	Format             string                   `json:"format"`
+	Caps               NMOSCapabilities         `json:"caps"`
+	Device_id          uuid.UUID                `json:"device_id"`
+	Transport          string                   `json:"transport"`
+	Interface_bindings []string                 `json:"interface_bindings"`
+	Subscription       NMOSReceiverSubscription `json:"subscription"`
+	// Optional IS-05 constraints and initial parameters of each leg, they
+	// replace the transport's in InitConnection
+	Constraints     []NMOSConstraints     `json:"-"`
+	TransportParams []NMOSTransportParams `json:"-"`
+	// IS-05 state, set up by InitConnection
+	Connection *NMOSReceiverConnection `json:"-"`
 }
 
 type NMOSSender struct {
-	Id                 uuid.UUID        `json:"id"`
-	Version            string           `json:"version"`
-	Description        string           `json:"description"`
-	Label              string           `json:"label"`
-	Tags               NMOSTags         `json:"tags"`
-	Manifest_href      string           `json:"manifest_href"`
-	Flow_id            uuid.UUID        `json:"flow_id"`
-	Transport          string           `json:"transport"`
-	Device_id          uuid.UUID        `json:"device_id"`
-	caps               NMOSCapabilities `json:"caps"`
+	Id                 uuid.UUID `json:"id"`
+	Version            string    `json:"version"`
+	Description        string    `json:"description"`
+	Label              string    `json:"label"`
+	Tags               NMOSTags  `json:"tags"`
+	Manifest_href      string    `json:"manifest_href"`
+	Flow_id            uuid.UUID `json:"flow_id"`
+	Transport          string    `json:"transport"`
+	Device_id          uuid.UUID `json:"device_id"`
+	caps               NMOSCapabilities
 	Interface_bindings []string         `json:"interface_bindings"`
 	Subscription       NMOSSubscription `json:"subscription"`
+	// Optional IS-05 constraints and initial parameters of each leg, they
+	// replace the transport's in InitConnection
+	Constraints     []NMOSConstraints     `json:"-"`
+	TransportParams []NMOSTransportParams `json:"-"`
+	// IS-05 state, set up by InitConnection
+	Connection *NMOSSenderConnection `json:"-"`
+	// IS-11 state, set up by InitCompatibility
+	Compatibility *NMOSSenderCompatibility `json:"-"`
+}
+
+// InitHREF points the manifest at the SDP served by this node, base is an
+// API endpoint URL such as http://host:port
+func (ns *NMOSSender) InitHREF(base string) {
+	ns.Manifest_href = fmt.Sprintf("%s/x-manufacturer/senders/%s/stream.sdp", base, ns.Id)
 }
 
-func (ns *NMOSSender) InitHREF(ip string) {
-	ns.Manifest_href = fmt.Sprintf("http://%s/x-manufacturer/senders/%s/stream.sdp", ip, ns.Id)
+const (
+	FormatVideo = "urn:x-nmos:format:video"
+	FormatAudio = "urn:x-nmos:format:audio"
+	FormatData  = "urn:x-nmos:format:data"
+	FormatMux   = "urn:x-nmos:format:mux"
+)
+
+type NMOSRational struct {
+	Numerator   int `json:"numerator"`
+	Denominator int `json:"denominator,omitempty"`
+}
+
+type NMOSChannel struct {
+	Label  string `json:"label"`
+	Symbol string `json:"symbol,omitempty"`
+}
+
+type NMOSSource struct {
+	Id          uuid.UUID        `json:"id"`
+	Version     string           `json:"version"`
+	Description string           `json:"description"`
+	Label       string           `json:"label"`
+	Tags        NMOSTags         `json:"tags"`
+	Format      string           `json:"format"`
+	Caps        NMOSCapabilities `json:"caps"`
+	Device_id   uuid.UUID        `json:"device_id"`
+	Parents     []uuid.UUID      `json:"parents"`
+	Clock_name  *string          `json:"clock_name"`
+	Grain_rate  *NMOSRational    `json:"grain_rate,omitempty"`
+	// Audio sources only
+	Channels []NMOSChannel `json:"channels,omitempty"`
+	// IS-07 event sources only
+	Event_type string `json:"event_type,omitempty"`
+	// IS-07 state, set up by InitEvents
+	Events *NMOSEventState `json:"-"`
+}
+
+type NMOSComponent struct {
+	Name      string `json:"name"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	Bit_depth int    `json:"bit_depth"`
+}
+
+// NMOSFlow covers the video, audio and data flow types, format specific
+// fields are left empty for the others
+type NMOSFlow struct {
+	Id          uuid.UUID     `json:"id"`
+	Version     string        `json:"version"`
+	Description string        `json:"description"`
+	Label       string        `json:"label"`
+	Tags        NMOSTags      `json:"tags"`
+	Format      string        `json:"format"`
+	Source_id   uuid.UUID     `json:"source_id"`
+	Device_id   uuid.UUID     `json:"device_id"`
+	Parents     []uuid.UUID   `json:"parents"`
+	Grain_rate  *NMOSRational `json:"grain_rate,omitempty"`
+	Media_type  string        `json:"media_type"`
+	// Raw video
+	Frame_width             int             `json:"frame_width,omitempty"`
+	Frame_height            int             `json:"frame_height,omitempty"`
+	Interlace_mode          string          `json:"interlace_mode,omitempty"`
+	Colorspace              string          `json:"colorspace,omitempty"`
+	Transfer_characteristic string          `json:"transfer_characteristic,omitempty"`
+	Components              []NMOSComponent `json:"components,omitempty"`
+	// Raw audio
+	Sample_rate *NMOSRational `json:"sample_rate,omitempty"`
+	Bit_depth   int           `json:"bit_depth,omitempty"`
+	// IS-07 event flows
+	Event_type string `json:"event_type,omitempty"`
 }
 
 type NMOSControl struct {
@@ -206,6 +410,65 @@ type NMOSDevice struct {
 	Senders     []NMOSSender   `json:"senders"`
 	Receivers   []NMOSReceiver `json:"receivers"`
 	Controls    []NMOSControl  `json:"controls"`
+	// Not part of the device resource, registered separately
+	Sources []NMOSSource `json:"-"`
+	Flows   []NMOSFlow   `json:"-"`
+	// IS-11 inputs and outputs
+	Inputs  []NMOSInput  `json:"-"`
+	Outputs []NMOSOutput `json:"-"`
+	// IS-08 state, set up by InitChannelMapping
+	ChannelMapping *NMOSChannelMapping `json:"-"`
+}
+
+// FindFlow returns the flow with id or nil
+func (d *NMOSDevice) FindFlow(id uuid.UUID) *NMOSFlow {
+	for i := range d.Flows {
+		if d.Flows[i].Id == id {
+			return &d.Flows[i]
+		}
+	}
+	return nil
+}
+
+// FindSource returns the source with id or nil
+func (d *NMOSDevice) FindSource(id uuid.UUID) *NMOSSource {
+	for i := range d.Sources {
+		if d.Sources[i].Id == id {
+			return &d.Sources[i]
+		}
+	}
+	return nil
+}
+
+// FindReceiver returns the receiver with id or nil
+func (d *NMOSDevice) FindReceiver(id uuid.UUID) *NMOSReceiver {
+	for i := range d.Receivers {
+		if d.Receivers[i].Id == id {
+			return &d.Receivers[i]
+		}
+	}
+	return nil
+}
+
+// FindSender returns the sender with id or nil
+func (d *NMOSDevice) FindSender(id uuid.UUID) *NMOSSender {
+	for i := range d.Senders {
+		if d.Senders[i].Id == id {
+			return &d.Senders[i]
+		}
+	}
+	return nil
+}
+
+// ControlHref returns the href of the first control of type controlType on
+// d, e.g. urn:x-nmos:control:sr-ctrl/v1.1, or "" if it has none
+func (d *NMOSDevice) ControlHref(controlType string) string {
+	for _, c := range d.Controls {
+		if c.Type == controlType {
+			return c.Href
+		}
+	}
+	return ""
 }
 
 func (d NMOSDevice) MarshalJSON() ([]byte, error) {
@@ -0,0 +1,49 @@
+package nmos
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestNodeKey(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name string
+		// content of the key file, nil if there is none
+		data []byte
+		want string
+	}{
+		{name: "missing file"},
+		{name: "empty file", data: []byte("\n")},
+		{name: "existing key", data: []byte("studio-a\n"), want: "studio-a"},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// NodeKey creates the directory of a new key file
+			file := filepath.Join(dir, strconv.Itoa(i), "node.key")
+			if tt.data != nil {
+				os.Mkdir(filepath.Dir(file), 0o755)
+				if err := ioutil.WriteFile(file, tt.data, 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			key, err := NodeKey(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if key == "" || tt.want != "" && key != tt.want {
+				t.Errorf("key %q, want %q", key, tt.want)
+			}
+			again, err := NodeKey(file)
+			if err != nil || again != key {
+				t.Errorf("key %q read back as %q, %v", key, again, err)
+			}
+		})
+	}
+	if StableID("a", "node") == StableID("b", "node") || StableID("a", "node") != StableID("a", "node") {
+		t.Error("StableID doesn't depend on the key alone")
+	}
+}
@@ -1,9 +1,170 @@
 package nmos
 
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
 type QuerySubscription struct {
-	MaxUpdateRateMs int           `json:"max_update_rate_ms"`
-	ResourcePath    string        `json:"resource_path"`
-	Params          []interface{} `json:"params"`
-	Persist         bool          `json:"persist"`
-	Secure          bool          `json:"secure"`
+	MaxUpdateRateMs int                    `json:"max_update_rate_ms"`
+	ResourcePath    string                 `json:"resource_path"`
+	Params          map[string]interface{} `json:"params"`
+	Persist         bool                   `json:"persist"`
+	Secure          bool                   `json:"secure"`
+	Authorization   bool                   `json:"authorization,omitempty"`
+	// Set by the registry
+	Id      string `json:"id,omitempty"`
+	Ws_href string `json:"ws_href,omitempty"`
+}
+
+// Query API change kinds, a subscription starts with a sync of every
+// resource
+const (
+	QueryEventSync     = "sync"
+	QueryEventAdded    = "added"
+	QueryEventModified = "modified"
+	QueryEventRemoved  = "removed"
+)
+
+// NMOSQueryEvent is one resource change from a Query API subscription
+type NMOSQueryEvent struct {
+	// Resource path of the subscription, e.g. /nodes/
+	Topic string          `json:"-"`
+	Path  string          `json:"path"`
+	Pre   json.RawMessage `json:"pre,omitempty"`
+	Post  json.RawMessage `json:"post,omitempty"`
+}
+
+// Kind returns one of the QueryEvent* constants
+func (e *NMOSQueryEvent) Kind() string {
+	switch {
+	case e.Pre == nil:
+		return QueryEventAdded
+	case e.Post == nil:
+		return QueryEventRemoved
+	case bytes.Equal(e.Pre, e.Post):
+		return QueryEventSync
+	}
+	return QueryEventModified
+}
+
+type queryGrain struct {
+	Grain struct {
+		Topic string           `json:"topic"`
+		Data  []NMOSQueryEvent `json:"data"`
+	} `json:"grain"`
+}
+
+// Subscribe creates a websocket subscription to resourcePath, e.g.
+// "/senders", and calls handler for every change until ctx is done or the
+// connection drops
+func (c *NMOSQueryClient) Subscribe(ctx context.Context, resourcePath string, handler func(NMOSQueryEvent)) error {
+	sub := QuerySubscription{
+		MaxUpdateRateMs: 100,
+		ResourcePath:    resourcePath,
+		Params:          map[string]interface{}{},
+		Secure:          strings.HasPrefix(c.URL, "https:"),
+		Authorization:   c.Auth != nil,
+	}
+	body, err := json.Marshal(sub)
+	if err != nil {
+		return err
+	}
+	uri := fmt.Sprintf("%s/x-nmos/query/%s/subscriptions", strings.TrimSuffix(c.URL, "/"), c.version())
+	req, err := http.NewRequest(http.MethodPost, uri, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.Auth.Do(c.httpClient(), req)
+	if err != nil {
+		return err
+	}
+	err = json.NewDecoder(resp.Body).Decode(&sub)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("POST %s: %s", uri, resp.Status)
+	}
+	if err != nil {
+		return fmt.Errorf("POST %s: %v", uri, err)
+	}
+	if sub.Ws_href == "" {
+		return fmt.Errorf("POST %s: no ws_href", uri)
+	}
+
+	dialer := *websocket.DefaultDialer
+	if t, ok := c.httpClient().Transport.(*http.Transport); ok && t.TLSClientConfig != nil {
+		dialer.TLSClientConfig = t.TLSClientConfig.Clone()
+	} else if sub.Secure {
+		dialer.TLSClientConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	header := http.Header{}
+	if c.Auth != nil {
+		token, err := c.Auth.Token()
+		if err != nil {
+			return err
+		}
+		header.Set("Authorization", "Bearer "+token)
+	}
+	ws, _, err := dialer.DialContext(ctx, sub.Ws_href, header)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		ws.Close()
+	}()
+	defer ws.Close()
+	for {
+		var g queryGrain
+		if err := ws.ReadJSON(&g); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		for _, e := range g.Grain.Data {
+			e.Topic = g.Grain.Topic
+			handler(e)
+		}
+	}
+}
+
+// Heartbeat returns when the node last sent a heartbeat to the Registration
+// API at registration, usually the same base URL as the Query API
+func (c *NMOSQueryClient) Heartbeat(registration string, id uuid.UUID) (time.Time, error) {
+	uri := fmt.Sprintf("%s/x-nmos/registration/%s/health/nodes/%s", strings.TrimSuffix(registration, "/"), c.version(), id)
+	req, err := http.NewRequest(http.MethodGet, uri, nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	resp, err := c.Auth.Do(c.httpClient(), req)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return time.Time{}, fmt.Errorf("GET %s: %s", uri, resp.Status)
+	}
+	var health struct {
+		Health json.Number `json:"health"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+		return time.Time{}, fmt.Errorf("GET %s: %v", uri, err)
+	}
+	secs, err := strconv.ParseInt(string(health.Health), 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("GET %s: health %q", uri, health.Health)
+	}
+	return time.Unix(secs, 0), nil
 }
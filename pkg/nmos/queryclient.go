@@ -0,0 +1,192 @@
+package nmos
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/grandcat/zeroconf"
+)
+
+// BrowseQuery returns the base URL of the first Query API found within
+// timeout, browsing on ifaces or all interfaces if none are given
+func BrowseQuery(timeout time.Duration, ifaces ...net.Interface) (string, error) {
+	var opts []zeroconf.ClientOption
+	if len(ifaces) > 0 {
+		opts = append(opts, zeroconf.SelectIfaces(ifaces))
+	}
+	resolver, err := zeroconf.NewResolver(opts...)
+	if err != nil {
+		return "", err
+	}
+	entries := make(chan *zeroconf.ServiceEntry)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := resolver.Browse(ctx, "_nmos-query._tcp", "local", entries); err != nil {
+		return "", err
+	}
+	for {
+		select {
+		case entry := <-entries:
+			if entry == nil || len(entry.AddrIPv4) == 0 {
+				continue
+			}
+			proto := MdnsTextValue(entry.Text, "api_proto", "http")
+			return fmt.Sprintf("%s://%s:%d", proto, entry.AddrIPv4[0], entry.Port), nil
+		case <-ctx.Done():
+			return "", fmt.Errorf("no query API found within %s", timeout)
+		}
+	}
+}
+
+// NMOSQueryClient reads resources from an IS-04 Query API
+type NMOSQueryClient struct {
+	// Base URL of the registry, e.g. http://registry:8888
+	URL string
+	// Query API version, v1.3 if empty
+	Version string
+	// Optional, http.DefaultClient if nil
+	HTTPClient *http.Client
+	// Optional, gets tokens for registries requiring IS-10
+	Auth *NMOSAuthClient
+}
+
+func (c *NMOSQueryClient) version() string {
+	if c.Version == "" {
+		return "v1.3"
+	}
+	return c.Version
+}
+
+func (c *NMOSQueryClient) httpClient() *http.Client {
+	if c.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return c.HTTPClient
+}
+
+var nextLink = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+// Get reads all resources of a type, e.g. "senders", into v which must be
+// a pointer to a slice. Pages are followed through their next links.
+func (c *NMOSQueryClient) Get(resource string, v interface{}) error {
+	uri := fmt.Sprintf("%s/x-nmos/query/%s/%s", strings.TrimSuffix(c.URL, "/"), c.version(), resource)
+	var all []json.RawMessage
+	for uri != "" {
+		req, err := http.NewRequest(http.MethodGet, uri, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := c.Auth.Do(c.httpClient(), req)
+		if err != nil {
+			return err
+		}
+		var page []json.RawMessage
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return fmt.Errorf("GET %s: %s", uri, resp.Status)
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("GET %s: %v", uri, err)
+		}
+		all = append(all, page...)
+		uri = ""
+		// an empty page ends paging even if a next link is given
+		if m := nextLink.FindStringSubmatch(resp.Header.Get("Link")); m != nil && len(page) > 0 {
+			uri = m[1]
+		}
+	}
+	if all == nil {
+		all = make([]json.RawMessage, 0)
+	}
+	data, err := json.Marshal(all)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// queryDevice is a device as the Query API serves it, listing its senders
+// and receivers by id
+type queryDevice struct {
+	NMOSDevice
+	Senders   []uuid.UUID `json:"senders"`
+	Receivers []uuid.UUID `json:"receivers"`
+}
+
+// Topology reads nodes, devices, sources, flows, senders and receivers and
+// nests them. Resources whose parent is missing are left out.
+func (c *NMOSQueryClient) Topology() (*NMOSTopology, error) {
+	var nodes []NMOSNodeData
+	var devices []queryDevice
+	var sources []NMOSSource
+	var flows []NMOSFlow
+	var senders []NMOSSender
+	var receivers []NMOSReceiver
+	for _, r := range []struct {
+		name string
+		v    interface{}
+	}{
+		{"nodes", &nodes},
+		{"devices", &devices},
+		{"sources", &sources},
+		{"flows", &flows},
+		{"senders", &senders},
+		{"receivers", &receivers},
+	} {
+		if err := c.Get(r.name, r.v); err != nil {
+			return nil, err
+		}
+	}
+
+	byId := make(map[uuid.UUID]*NMOSDevice)
+	t := &NMOSTopology{Nodes: make([]NMOSTopologyNode, 0)}
+	for _, n := range nodes {
+		t.Nodes = append(t.Nodes, NMOSTopologyNode{NMOSNodeData: n, Devices: make(NMOSDevices, 0)})
+	}
+	for _, qd := range devices {
+		tn := t.findNode(qd.Node_id)
+		if tn == nil {
+			continue
+		}
+		d := qd.NMOSDevice
+		d.Senders = make([]NMOSSender, 0)
+		d.Receivers = make([]NMOSReceiver, 0)
+		tn.Devices = append(tn.Devices, d)
+	}
+	for i := range t.Nodes {
+		for j := range t.Nodes[i].Devices {
+			d := &t.Nodes[i].Devices[j]
+			byId[d.Id] = d
+		}
+	}
+	for _, s := range sources {
+		if d := byId[s.Device_id]; d != nil {
+			d.Sources = append(d.Sources, s)
+		}
+	}
+	for _, f := range flows {
+		if d := byId[f.Device_id]; d != nil {
+			d.Flows = append(d.Flows, f)
+		}
+	}
+	for _, s := range senders {
+		if d := byId[s.Device_id]; d != nil {
+			d.Senders = append(d.Senders, s)
+		}
+	}
+	for _, r := range receivers {
+		if d := byId[r.Device_id]; d != nil {
+			d.Receivers = append(d.Receivers, r)
+		}
+	}
+	return t, nil
+}
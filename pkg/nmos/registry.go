@@ -0,0 +1,411 @@
+package nmos
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/grandcat/zeroconf"
+)
+
+// registryTypes are the IS-04 resource types, parents first
+var registryTypes = []string{"node", "device", "source", "flow", "sender", "receiver"}
+
+// registryParent is the field holding the id of a resource's parent
+var registryParent = map[string]string{
+	"device":   "node_id",
+	"source":   "device_id",
+	"flow":     "device_id",
+	"sender":   "device_id",
+	"receiver": "device_id",
+}
+
+var registryVersions = []string{"v1.0", "v1.1", "v1.2", "v1.3"}
+
+// NMOSRegistry keeps the resources registered through the IS-04
+// Registration API in memory and serves them on the Query API. Nodes
+// without a heartbeat for Expiry are removed with their resources.
+type NMOSRegistry struct {
+	// 12 seconds if zero
+	Expiry time.Duration
+
+	mu sync.Mutex
+	// by type, then id
+	resources map[string]map[uuid.UUID]registryResource
+	// last heartbeat of each node
+	health map[uuid.UUID]time.Time
+}
+
+type registryResource struct {
+	data   json.RawMessage
+	parent uuid.UUID
+}
+
+func NewRegistry() *NMOSRegistry {
+	r := &NMOSRegistry{
+		resources: make(map[string]map[uuid.UUID]registryResource),
+		health:    make(map[uuid.UUID]time.Time),
+	}
+	for _, t := range registryTypes {
+		r.resources[t] = make(map[uuid.UUID]registryResource)
+	}
+	return r
+}
+
+func (r *NMOSRegistry) expiry() time.Duration {
+	if r.Expiry == 0 {
+		return 12 * time.Second
+	}
+	return r.Expiry
+}
+
+// Register adds or updates a resource of type typ, e.g. "sender". Its
+// parent must be registered. created is false for an update.
+func (r *NMOSRegistry) Register(typ string, data json.RawMessage) (created bool, err error) {
+	resources, ok := r.resources[typ]
+	if !ok {
+		return false, fmt.Errorf("unknown resource type %q", typ)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return false, err
+	}
+	var id uuid.UUID
+	if err := json.Unmarshal(fields["id"], &id); err != nil || id == uuid.Nil {
+		return false, fmt.Errorf("%s without a valid id", typ)
+	}
+	var parent uuid.UUID
+	if field := registryParent[typ]; field != "" {
+		if err := json.Unmarshal(fields[field], &parent); err != nil {
+			return false, fmt.Errorf("%s %s without a valid %s", typ, id, field)
+		}
+	}
+	if typ == "device" {
+		// the Query API lists a device's senders and receivers by id
+		for _, field := range []string{"senders", "receivers"} {
+			if fields[field], err = resourceIds(fields[field]); err != nil {
+				return false, fmt.Errorf("device %s %s: %v", id, field, err)
+			}
+		}
+		if data, err = json.Marshal(fields); err != nil {
+			return false, err
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if parent != uuid.Nil {
+		parentType := "device"
+		if typ == "device" {
+			parentType = "node"
+		}
+		if _, ok := r.resources[parentType][parent]; !ok {
+			return false, fmt.Errorf("%s %s: parent %s %s is not registered", typ, id, parentType, parent)
+		}
+	}
+	_, exists := resources[id]
+	resources[id] = registryResource{data: data, parent: parent}
+	if typ == "node" && !exists {
+		r.health[id] = time.Now()
+	}
+	return !exists, nil
+}
+
+// resourceIds turns a list of resources or ids into a list of ids
+func resourceIds(list json.RawMessage) (json.RawMessage, error) {
+	if len(list) == 0 || string(list) == "null" {
+		return json.RawMessage("[]"), nil
+	}
+	var items []json.RawMessage
+	if err := json.Unmarshal(list, &items); err != nil {
+		return nil, err
+	}
+	ids := make([]uuid.UUID, 0, len(items))
+	for _, item := range items {
+		var id uuid.UUID
+		if err := json.Unmarshal(item, &id); err != nil {
+			var res struct {
+				Id uuid.UUID `json:"id"`
+			}
+			if err := json.Unmarshal(item, &res); err != nil {
+				return nil, err
+			}
+			id = res.Id
+		}
+		ids = append(ids, id)
+	}
+	return json.Marshal(ids)
+}
+
+// Delete removes a resource and the resources under it, false if it isn't
+// registered
+func (r *NMOSRegistry) Delete(typ string, id uuid.UUID) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.resources[typ][id]; !ok {
+		return false
+	}
+	r.delete(typ, id)
+	return true
+}
+
+func (r *NMOSRegistry) delete(typ string, id uuid.UUID) {
+	delete(r.resources[typ], id)
+	switch typ {
+	case "node":
+		delete(r.health, id)
+		for did, d := range r.resources["device"] {
+			if d.parent == id {
+				r.delete("device", did)
+			}
+		}
+	case "device":
+		for _, t := range registryTypes[2:] {
+			for cid, c := range r.resources[t] {
+				if c.parent == id {
+					delete(r.resources[t], cid)
+				}
+			}
+		}
+	}
+}
+
+// Get returns a resource, nil if it isn't registered
+func (r *NMOSRegistry) Get(typ string, id uuid.UUID) json.RawMessage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.resources[typ][id].data
+}
+
+// List returns the resources of a type ordered by id
+func (r *NMOSRegistry) List(typ string) []json.RawMessage {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ids := make([]uuid.UUID, 0, len(r.resources[typ]))
+	for id := range r.resources[typ] {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].String() < ids[j].String() })
+	list := make([]json.RawMessage, len(ids))
+	for i, id := range ids {
+		list[i] = r.resources[typ][id].data
+	}
+	return list
+}
+
+// Heartbeat records a heartbeat of node id, false if it isn't registered
+func (r *NMOSRegistry) Heartbeat(id uuid.UUID) (time.Time, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.resources["node"][id]; !ok {
+		return time.Time{}, false
+	}
+	now := time.Now()
+	r.health[id] = now
+	return now, true
+}
+
+// Health returns the last heartbeat of node id
+func (r *NMOSRegistry) Health(id uuid.UUID) (time.Time, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t, ok := r.health[id]
+	return t, ok
+}
+
+// Expire removes the nodes whose last heartbeat is older than Expiry at now
+func (r *NMOSRegistry) Expire(now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, t := range r.health {
+		if now.Sub(t) > r.expiry() {
+			Infoln("node", id, "expired")
+			r.delete("node", id)
+		}
+	}
+}
+
+// Run expires nodes until ctx is done
+func (r *NMOSRegistry) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			r.Expire(now)
+		}
+	}
+}
+
+// registryType maps the plural of a resource type in a path to the type
+func registryType(plural string) (string, bool) {
+	typ := strings.TrimSuffix(plural, "s")
+	_, ok := registryParent[typ]
+	return typ, typ != plural && (ok || typ == "node")
+}
+
+func registryVersion(w http.ResponseWriter, r *http.Request) bool {
+	version := mux.Vars(r)["version"]
+	for _, v := range registryVersions {
+		if v == version {
+			return true
+		}
+	}
+	writeError(w, http.StatusNotFound, "unknown version "+version)
+	return false
+}
+
+// InitRegistry serves the Registration and Query APIs of reg and
+// advertises them over mDNS. Query API subscriptions are not supported.
+func (n *NMOSWebServer) InitRegistry(reg *NMOSRegistry) {
+	hostNameDomain, _ := os.Hostname()
+	hostName := strings.Split(hostNameDomain, ".")[0]
+	txt := MdnsText(99, registryVersions, n.Proto(), n.Auth != nil)
+	var err error
+	if n.MDNSRegistration, err = zeroconf.Register(hostName, "_nmos-registration._tcp", "local", n.Port, txt, nil); err != nil {
+		panic(err)
+	}
+	if n.MDNSRegister, err = zeroconf.Register(hostName, "_nmos-register._tcp", "local", n.Port, txt, nil); err != nil {
+		panic(err)
+	}
+	if n.MDNSQuery, err = zeroconf.Register(hostName, "_nmos-query._tcp", "local", n.Port, txt, nil); err != nil {
+		panic(err)
+	}
+	reg.handle(n.Router)
+}
+
+// handle adds the Registration and Query API routes to router
+func (reg *NMOSRegistry) handle(router *mux.Router) {
+	versions := func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, []string{"v1.0/", "v1.1/", "v1.2/", "v1.3/"})
+	}
+
+	// REGISTRATION API
+	regSubRouter := router.PathPrefix("/x-nmos/registration").Subrouter()
+	handleSlash(regSubRouter, "", versions)
+	handleSlash(regSubRouter, "/{version}", func(w http.ResponseWriter, r *http.Request) {
+		if registryVersion(w, r) {
+			writeJSON(w, http.StatusOK, []string{"health/", "resource/"})
+		}
+	})
+	handleSlash(regSubRouter, "/{version}/resource", func(w http.ResponseWriter, r *http.Request) {
+		if !registryVersion(w, r) {
+			return
+		}
+		var body struct {
+			Type string          `json:"type"`
+			Data json.RawMessage `json:"data"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		created, err := reg.Register(body.Type, body.Data)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		var res struct {
+			Id uuid.UUID `json:"id"`
+		}
+		json.Unmarshal(body.Data, &res)
+		code := http.StatusOK
+		if created {
+			code = http.StatusCreated
+			Debugln("registered", body.Type, res.Id)
+		}
+		w.Header().Set("Location", fmt.Sprintf("/x-nmos/registration/%s/resource/%ss/%s", mux.Vars(r)["version"], body.Type, res.Id))
+		writeJSON(w, code, reg.Get(body.Type, res.Id))
+	}).Methods(http.MethodPost)
+	handleSlash(regSubRouter, "/{version}/resource/{resourceType}/{resourceId}", func(w http.ResponseWriter, r *http.Request) {
+		if !registryVersion(w, r) {
+			return
+		}
+		typ, ok := registryType(mux.Vars(r)["resourceType"])
+		id, err := uuid.Parse(mux.Vars(r)["resourceId"])
+		if !ok || err != nil {
+			writeError(w, http.StatusNotFound, "no such resource")
+			return
+		}
+		if r.Method == http.MethodDelete {
+			if !reg.Delete(typ, id) {
+				writeError(w, http.StatusNotFound, "no such resource")
+				return
+			}
+			Debugln("deleted", typ, id)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if data := reg.Get(typ, id); data != nil {
+			writeJSON(w, http.StatusOK, data)
+			return
+		}
+		writeError(w, http.StatusNotFound, "no such resource")
+	}).Methods(http.MethodGet, http.MethodDelete)
+	handleSlash(regSubRouter, "/{version}/health/nodes/{nodeId}", func(w http.ResponseWriter, r *http.Request) {
+		if !registryVersion(w, r) {
+			return
+		}
+		id, err := uuid.Parse(mux.Vars(r)["nodeId"])
+		if err != nil {
+			writeError(w, http.StatusNotFound, "no such node")
+			return
+		}
+		var t time.Time
+		var ok bool
+		if r.Method == http.MethodPost {
+			t, ok = reg.Heartbeat(id)
+		} else {
+			t, ok = reg.Health(id)
+		}
+		if !ok {
+			writeError(w, http.StatusNotFound, "node "+id.String()+" is not registered")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"health": fmt.Sprint(t.Unix())})
+	}).Methods(http.MethodGet, http.MethodPost)
+
+	// QUERY API
+	querySubRouter := router.PathPrefix("/x-nmos/query").Subrouter()
+	handleSlash(querySubRouter, "", versions)
+	handleSlash(querySubRouter, "/{version}", func(w http.ResponseWriter, r *http.Request) {
+		if registryVersion(w, r) {
+			writeJSON(w, http.StatusOK, []string{"devices/", "flows/", "nodes/", "receivers/", "senders/", "sources/"})
+		}
+	})
+	handleSlash(querySubRouter, "/{version}/{resourceType}", func(w http.ResponseWriter, r *http.Request) {
+		if !registryVersion(w, r) {
+			return
+		}
+		typ, ok := registryType(mux.Vars(r)["resourceType"])
+		if !ok {
+			writeError(w, http.StatusNotFound, "no such resource type")
+			return
+		}
+		writeJSON(w, http.StatusOK, reg.List(typ))
+	}).Methods(http.MethodGet)
+	handleSlash(querySubRouter, "/{version}/{resourceType}/{resourceId}", func(w http.ResponseWriter, r *http.Request) {
+		if !registryVersion(w, r) {
+			return
+		}
+		typ, ok := registryType(mux.Vars(r)["resourceType"])
+		id, err := uuid.Parse(mux.Vars(r)["resourceId"])
+		if ok && err == nil {
+			if data := reg.Get(typ, id); data != nil {
+				writeJSON(w, http.StatusOK, data)
+				return
+			}
+		}
+		writeError(w, http.StatusNotFound, "no such resource")
+	}).Methods(http.MethodGet)
+}
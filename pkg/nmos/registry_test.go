@@ -0,0 +1,124 @@
+package nmos
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+func TestRegistryAPI(t *testing.T) {
+	node, device, sender := uuid.New(), uuid.New(), uuid.New()
+	resource := func(typ string, v interface{}) string {
+		data, _ := json.Marshal(MakeTransmission(v, typ))
+		return string(data)
+	}
+	nodeData := NMOSNodeData{Id: node, Version: "1:0"}
+	deviceData := NMOSDevice{Id: device, Version: "1:0", Node_id: node,
+		Senders: []NMOSSender{{Id: sender}}, Receivers: []NMOSReceiver{}}
+	senderData := NMOSSender{Id: sender, Version: "1:0", Device_id: device}
+
+	type call struct {
+		method, path, body string
+		code               int
+		// the reply contains this
+		want string
+	}
+	tests := []struct {
+		name  string
+		calls []call
+	}{
+		{
+			name: "register, update and query",
+			calls: []call{
+				{"POST", "/x-nmos/registration/v1.3/resource", resource("node", nodeData), 201, node.String()},
+				{"POST", "/x-nmos/registration/v1.3/resource", resource("device", deviceData), 201, ""},
+				{"POST", "/x-nmos/registration/v1.3/resource", resource("sender", senderData), 201, ""},
+				{"POST", "/x-nmos/registration/v1.3/resource", resource("sender", senderData), 200, ""},
+				{"GET", "/x-nmos/query/v1.3/senders", "", 200, sender.String()},
+				{"GET", "/x-nmos/query/v1.3/devices/" + device.String(), "", 200, `"senders": [` + "\n\t\t\"" + sender.String()},
+				{"GET", "/x-nmos/registration/v1.3/resource/nodes/" + node.String(), "", 200, node.String()},
+			},
+		},
+		{
+			name: "parents are required",
+			calls: []call{
+				{"POST", "/x-nmos/registration/v1.3/resource", resource("device", deviceData), 400, "not registered"},
+				{"POST", "/x-nmos/registration/v1.3/resource", `{"type": "widget", "data": {"id": "` + node.String() + `"}}`, 400, "unknown"},
+			},
+		},
+		{
+			name: "deleting a node deletes its resources",
+			calls: []call{
+				{"POST", "/x-nmos/registration/v1.3/resource", resource("node", nodeData), 201, ""},
+				{"POST", "/x-nmos/registration/v1.3/resource", resource("device", deviceData), 201, ""},
+				{"POST", "/x-nmos/registration/v1.3/resource", resource("sender", senderData), 201, ""},
+				{"DELETE", "/x-nmos/registration/v1.3/resource/nodes/" + node.String(), "", 204, ""},
+				{"GET", "/x-nmos/query/v1.3/senders", "", 200, "[]"},
+				{"DELETE", "/x-nmos/registration/v1.3/resource/nodes/" + node.String(), "", 404, ""},
+			},
+		},
+		{
+			name: "heartbeats",
+			calls: []call{
+				{"POST", "/x-nmos/registration/v1.3/health/nodes/" + node.String(), "", 404, ""},
+				{"POST", "/x-nmos/registration/v1.3/resource", resource("node", nodeData), 201, ""},
+				{"POST", "/x-nmos/registration/v1.3/health/nodes/" + node.String(), "", 200, "health"},
+				{"GET", "/x-nmos/registration/v1.3/health/nodes/" + node.String(), "", 200, "health"},
+			},
+		},
+		{
+			name: "unknown version",
+			calls: []call{
+				{"GET", "/x-nmos/query/v2.0/nodes", "", 404, ""},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := mux.NewRouter()
+			NewRegistry().handle(router)
+			for _, c := range tt.calls {
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, httptest.NewRequest(c.method, c.path, strings.NewReader(c.body)))
+				if w.Code != c.code || !strings.Contains(w.Body.String(), c.want) {
+					t.Errorf("%s %s: %d %s, want %d with %s", c.method, c.path, w.Code, w.Body, c.code, c.want)
+				}
+			}
+		})
+	}
+}
+
+func TestRegistryExpire(t *testing.T) {
+	reg := NewRegistry()
+	reg.Expiry = time.Second
+	node, device := uuid.New(), uuid.New()
+	register := func(typ string, v interface{}) {
+		data, _ := json.Marshal(v)
+		if _, err := reg.Register(typ, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	register("node", NMOSNodeData{Id: node})
+	register("device", NMOSDevice{Id: device, Node_id: node})
+	tests := []struct {
+		after time.Duration
+		alive bool
+	}{
+		{500 * time.Millisecond, true},
+		{2 * time.Second, false},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.after), func(t *testing.T) {
+			reg.Expire(time.Now().Add(tt.after))
+			if alive := reg.Get("device", device) != nil; alive != tt.alive {
+				t.Errorf("device registered %v, want %v", alive, tt.alive)
+			}
+		})
+	}
+}
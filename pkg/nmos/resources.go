@@ -0,0 +1,161 @@
+package nmos
+
+import (
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// NMOSDevices are the devices of a node, lookups search all of them
+type NMOSDevices []NMOSDevice
+
+// FindDevice returns the device with id or nil
+func (ds NMOSDevices) FindDevice(id uuid.UUID) *NMOSDevice {
+	for i := range ds {
+		if ds[i].Id == id {
+			return &ds[i]
+		}
+	}
+	return nil
+}
+
+func (ds NMOSDevices) FindSource(id uuid.UUID) *NMOSSource {
+	for i := range ds {
+		if s := ds[i].FindSource(id); s != nil {
+			return s
+		}
+	}
+	return nil
+}
+
+func (ds NMOSDevices) FindFlow(id uuid.UUID) *NMOSFlow {
+	for i := range ds {
+		if f := ds[i].FindFlow(id); f != nil {
+			return f
+		}
+	}
+	return nil
+}
+
+func (ds NMOSDevices) FindSender(id uuid.UUID) *NMOSSender {
+	for i := range ds {
+		if s := ds[i].FindSender(id); s != nil {
+			return s
+		}
+	}
+	return nil
+}
+
+func (ds NMOSDevices) FindReceiver(id uuid.UUID) *NMOSReceiver {
+	for i := range ds {
+		if r := ds[i].FindReceiver(id); r != nil {
+			return r
+		}
+	}
+	return nil
+}
+
+func (ds NMOSDevices) Sources() []NMOSSource {
+	res := make([]NMOSSource, 0)
+	for _, d := range ds {
+		res = append(res, d.Sources...)
+	}
+	return res
+}
+
+func (ds NMOSDevices) Flows() []NMOSFlow {
+	res := make([]NMOSFlow, 0)
+	for _, d := range ds {
+		res = append(res, d.Flows...)
+	}
+	return res
+}
+
+func (ds NMOSDevices) Senders() []NMOSSender {
+	res := make([]NMOSSender, 0)
+	for _, d := range ds {
+		res = append(res, d.Senders...)
+	}
+	return res
+}
+
+func (ds NMOSDevices) Receivers() []NMOSReceiver {
+	res := make([]NMOSReceiver, 0)
+	for _, d := range ds {
+		res = append(res, d.Receivers...)
+	}
+	return res
+}
+
+func (ds NMOSDevices) Inputs() []NMOSInput {
+	res := make([]NMOSInput, 0)
+	for _, d := range ds {
+		res = append(res, d.Inputs...)
+	}
+	return res
+}
+
+func (ds NMOSDevices) Outputs() []NMOSOutput {
+	res := make([]NMOSOutput, 0)
+	for _, d := range ds {
+		res = append(res, d.Outputs...)
+	}
+	return res
+}
+
+// ChannelMapping returns the IS-08 state of the node. Only one device per
+// node may have it as the API isn't split by device.
+func (ds NMOSDevices) ChannelMapping() *NMOSChannelMapping {
+	for _, d := range ds {
+		if d.ChannelMapping != nil {
+			return d.ChannelMapping
+		}
+	}
+	return nil
+}
+
+// NMOSResources guards the IS-04 resources of a node. API handlers read
+// snapshots, changes go through Update.
+type NMOSResources struct {
+	mu      sync.RWMutex
+	node    NMOSNodeData
+	devices NMOSDevices
+}
+
+func NewResources(node NMOSNodeData, devices NMOSDevices) *NMOSResources {
+	return &NMOSResources{node: node, devices: devices}
+}
+
+// Snapshot returns consistent copies of the node and devices. The resource
+// slices are copied keeping empty ones non-nil, runtime state such as a
+// sender's Connection is shared and has its own locking.
+func (r *NMOSResources) Snapshot() (NMOSNodeData, NMOSDevices) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	node := r.node
+	node.API.Endpoints = append(r.node.API.Endpoints[:0:0], r.node.API.Endpoints...)
+	node.Interfaces = append(r.node.Interfaces[:0:0], r.node.Interfaces...)
+	node.Clocks = append(r.node.Clocks[:0:0], r.node.Clocks...)
+	node.Services = append(r.node.Services[:0:0], r.node.Services...)
+	devices := make(NMOSDevices, len(r.devices))
+	for i, src := range r.devices {
+		d := src
+		d.Senders = append(src.Senders[:0:0], src.Senders...)
+		d.Receivers = append(src.Receivers[:0:0], src.Receivers...)
+		d.Controls = append(src.Controls[:0:0], src.Controls...)
+		d.Sources = append(src.Sources[:0:0], src.Sources...)
+		d.Flows = append(src.Flows[:0:0], src.Flows...)
+		d.Inputs = append(src.Inputs[:0:0], src.Inputs...)
+		d.Outputs = append(src.Outputs[:0:0], src.Outputs...)
+		devices[i] = d
+	}
+	return node, devices
+}
+
+// Update runs f with the resources locked for writing. f must not block on
+// a Connection, activations take the resource lock while holding theirs.
+func (r *NMOSResources) Update(f func(node *NMOSNodeData, devices *NMOSDevices)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f(&r.node, &r.devices)
+}
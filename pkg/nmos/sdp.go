@@ -0,0 +1,501 @@
+package nmos
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	rtpPayloadVideo = 96
+	rtpPayloadAudio = 97
+	rtpPayloadData  = 100
+)
+
+const (
+	// audio packet time in ms
+	sdpPacketTime = 1
+	// ST 2110-21 sender type of video senders
+	sdpSenderType = "2110TPN"
+)
+
+var sdpLegNames = []string{"primary", "secondary"}
+
+// GenerateSDP builds an RFC 4566 / SMPTE ST 2110 session description for
+// the active parameters of a sender
+func GenerateSDP(node *NMOSNodeData, sender *NMOSSender, flow *NMOSFlow, source *NMOSSource, active NMOSSenderParams) (string, error) {
+	if flow == nil || source == nil {
+		return "", errors.New("sender has no flow or source")
+	}
+	var legs []NMOSTransportParams
+	for _, leg := range active.TransportParams {
+		if leg.Bool("rtp_enabled") {
+			legs = append(legs, leg)
+		}
+	}
+	if len(legs) == 0 {
+		return "", errors.New("sender has no enabled legs")
+	}
+	media, err := sdpMedia(flow, source)
+	if err != nil {
+		return "", err
+	}
+	refclk := sdpRefClock(node, source)
+
+	sessVersion := sdpSessionVersion(sender, active)
+
+	var b strings.Builder
+	line := func(format string, a ...interface{}) {
+		fmt.Fprintf(&b, format+"\r\n", a...)
+	}
+	line("v=0")
+	line("o=- %d %d IN IP4 %s", binary.BigEndian.Uint32(sender.Id[0:4]), sessVersion, legs[0].String("source_ip"))
+	line("s=%s", sender.Label)
+	if sender.Description != "" {
+		line("i=%s", sender.Description)
+	}
+	line("t=0 0")
+	if len(legs) > 1 {
+		line("a=group:DUP %s", strings.Join(sdpLegNames[:len(legs)], " "))
+	}
+	for i, leg := range legs {
+		dest := leg.String("destination_ip")
+		line("m=%s %d RTP/AVP %d", media.kind, leg.Int("destination_port", DefaultRTPPort), media.payload)
+		if ip := net.ParseIP(dest); ip != nil && ip.IsMulticast() {
+			line("c=IN IP4 %s/64", dest)
+			line("a=source-filter: incl IN IP4 %s %s", dest, leg.String("source_ip"))
+		} else {
+			line("c=IN IP4 %s", dest)
+		}
+		for _, l := range media.attributes {
+			line("%s", l)
+		}
+		line("%s", refclk)
+		line("a=mediaclk:direct=0")
+		if len(legs) > 1 {
+			line("a=mid:%s", sdpLegNames[i])
+		}
+	}
+	return b.String(), nil
+}
+
+// sdpSessionVersion follows the activation time in nanoseconds so receivers
+// notice every change, and the sender's version before the first activation.
+// It is never 0, which some receivers take as no version.
+func sdpSessionVersion(sender *NMOSSender, active NMOSSenderParams) int64 {
+	version := sender.Version
+	if active.Activation.ActivationTime != nil {
+		version = *active.Activation.ActivationTime
+	}
+	d, err := ParseTAIDuration(version)
+	if err != nil || d <= 0 {
+		return 1
+	}
+	return int64(d)
+}
+
+type sdpMediaDescription struct {
+	kind       string
+	payload    int
+	attributes []string
+}
+
+func sdpMedia(flow *NMOSFlow, source *NMOSSource) (sdpMediaDescription, error) {
+	switch flow.Media_type {
+	case "video/raw":
+		m := sdpMediaDescription{kind: "video", payload: rtpPayloadVideo}
+		m.attributes = append(m.attributes,
+			fmt.Sprintf("a=rtpmap:%d raw/90000", m.payload),
+			fmt.Sprintf("a=fmtp:%d %s", m.payload, videoFmtp(flow)))
+		return m, nil
+	case "audio/L16", "audio/L20", "audio/L24":
+		m := sdpMediaDescription{kind: "audio", payload: rtpPayloadAudio}
+		rate := 48000
+		if flow.Sample_rate != nil {
+			rate = flow.Sample_rate.Numerator
+		}
+		channels := len(source.Channels)
+		if channels == 0 {
+			channels = 1
+		}
+		m.attributes = append(m.attributes,
+			fmt.Sprintf("a=rtpmap:%d %s/%d/%d", m.payload, strings.TrimPrefix(flow.Media_type, "audio/"), rate, channels),
+			fmt.Sprintf("a=ptime:%d", sdpPacketTime))
+		return m, nil
+	case "video/smpte291":
+		m := sdpMediaDescription{kind: "video", payload: rtpPayloadData}
+		m.attributes = append(m.attributes, fmt.Sprintf("a=rtpmap:%d smpte291/90000", m.payload))
+		if flow.Grain_rate != nil {
+			m.attributes = append(m.attributes, fmt.Sprintf("a=fmtp:%d exactframerate=%s", m.payload, sdpFrameRate(*flow.Grain_rate)))
+		}
+		return m, nil
+	}
+	return sdpMediaDescription{}, fmt.Errorf("unsupported media type %s", flow.Media_type)
+}
+
+func videoFmtp(flow *NMOSFlow) string {
+	params := []string{
+		"sampling=" + videoSampling(flow.Components),
+		fmt.Sprintf("width=%d", flow.Frame_width),
+		fmt.Sprintf("height=%d", flow.Frame_height),
+	}
+	if flow.Grain_rate != nil {
+		params = append(params, "exactframerate="+sdpFrameRate(*flow.Grain_rate))
+	}
+	depth := 10
+	if len(flow.Components) > 0 {
+		depth = flow.Components[0].Bit_depth
+	}
+	params = append(params, fmt.Sprintf("depth=%d", depth))
+	tcs := flow.Transfer_characteristic
+	if tcs == "" {
+		tcs = "SDR"
+	}
+	params = append(params, "TCS="+tcs)
+	colorimetry := flow.Colorspace
+	if colorimetry == "" {
+		colorimetry = "BT709"
+	}
+	params = append(params, "colorimetry="+colorimetry, "PM=2110GPM", "SSN=ST2110-20:2017", "TP="+sdpSenderType)
+	if flow.Interlace_mode != "" && flow.Interlace_mode != "progressive" {
+		params = append(params, "interlace")
+	}
+	return strings.Join(params, "; ") + ";"
+}
+
+func videoSampling(components []NMOSComponent) string {
+	if len(components) != 3 {
+		return "YCbCr-4:2:2"
+	}
+	if components[0].Name == "R" {
+		return "RGB"
+	}
+	y, cb := components[0], components[1]
+	switch {
+	case cb.Width == y.Width:
+		return "YCbCr-4:4:4"
+	case cb.Height < y.Height:
+		return "YCbCr-4:2:0"
+	}
+	return "YCbCr-4:2:2"
+}
+
+func sdpFrameRate(r NMOSRational) string {
+	if r.Denominator == 0 || r.Denominator == 1 {
+		return fmt.Sprintf("%d", r.Numerator)
+	}
+	return fmt.Sprintf("%d/%d", r.Numerator, r.Denominator)
+}
+
+// sdpRefClock uses the source's PTP clock if it has one, otherwise the
+// node's first interface MAC
+func sdpRefClock(node *NMOSNodeData, source *NMOSSource) string {
+	if source.Clock_name != nil {
+		for _, c := range node.Clocks {
+			if c.Name == *source.Clock_name && c.Ref_type == "ptp" {
+				return fmt.Sprintf("a=ts-refclk:ptp=IEEE1588-2008:%s:%d", strings.ToUpper(c.Gmid), node.PTPDomain)
+			}
+		}
+	}
+	mac := "00-00-00-00-00-00"
+	if len(node.Interfaces) > 0 && node.Interfaces[0].ChassisID != "" {
+		mac = node.Interfaces[0].ChassisID
+	}
+	return "a=ts-refclk:localmac=" + strings.ToUpper(mac)
+}
+
+// SDPMedia is one m= section of a parsed session description
+type SDPMedia struct {
+	Media      string
+	Port       int
+	Proto      string
+	Payload    int
+	Connection string
+	TTL        int
+	// Source specific multicast filter addresses
+	Sources    []string
+	Mid        string
+	Encoding   string
+	ClockRate  int
+	Channels   int
+	Fmtp       map[string]string
+	RefClock   string
+	MediaClock string
+}
+
+// SDPDescription holds what a receiver needs from an SDP transport file
+type SDPDescription struct {
+	OriginAddress string
+	SessionName   string
+	Connection    string
+	// Media ids of an a=group:DUP line, in leg order
+	DUP   []string
+	Media []SDPMedia
+}
+
+// ParseSDP parses an RFC 4566 session description
+func ParseSDP(data string) (*SDPDescription, error) {
+	sdp := &SDPDescription{}
+	var sessionSources []string
+	var sessionRefClock string
+	var m *SDPMedia
+	for i, raw := range strings.Split(data, "\n") {
+		l := strings.TrimRight(raw, "\r")
+		if l == "" {
+			continue
+		}
+		if len(l) < 2 || l[1] != '=' {
+			return nil, fmt.Errorf("sdp line %d: invalid line %q", i+1, l)
+		}
+		value := l[2:]
+		switch l[0] {
+		case 'o':
+			f := strings.Fields(value)
+			if len(f) != 6 {
+				return nil, fmt.Errorf("sdp line %d: invalid origin", i+1)
+			}
+			sdp.OriginAddress = f[5]
+		case 's':
+			sdp.SessionName = value
+		case 'm':
+			f := strings.Fields(value)
+			if len(f) < 4 {
+				return nil, fmt.Errorf("sdp line %d: invalid media", i+1)
+			}
+			sdp.Media = append(sdp.Media, SDPMedia{Media: f[0], Proto: f[2], Fmtp: map[string]string{}})
+			m = &sdp.Media[len(sdp.Media)-1]
+			// port may be given as <port>/<number of ports>
+			if _, err := fmt.Sscanf(f[1], "%d", &m.Port); err != nil {
+				return nil, fmt.Errorf("sdp line %d: invalid port %q", i+1, f[1])
+			}
+			if _, err := fmt.Sscanf(f[3], "%d", &m.Payload); err != nil {
+				return nil, fmt.Errorf("sdp line %d: invalid payload type %q", i+1, f[3])
+			}
+		case 'c':
+			f := strings.Fields(value)
+			if len(f) != 3 || f[0] != "IN" {
+				return nil, fmt.Errorf("sdp line %d: invalid connection", i+1)
+			}
+			addr := strings.Split(f[2], "/")
+			if m == nil {
+				sdp.Connection = addr[0]
+				continue
+			}
+			m.Connection = addr[0]
+			if len(addr) > 1 {
+				fmt.Sscanf(addr[1], "%d", &m.TTL)
+			}
+		case 'a':
+			name, attr := value, ""
+			if idx := strings.Index(value, ":"); idx >= 0 {
+				name, attr = value[:idx], strings.TrimSpace(value[idx+1:])
+			}
+			switch name {
+			case "group":
+				f := strings.Fields(attr)
+				if len(f) > 1 && f[0] == "DUP" {
+					sdp.DUP = f[1:]
+				}
+			case "source-filter":
+				// incl IN IP4 <dest> <src>...
+				f := strings.Fields(attr)
+				if len(f) < 5 || f[0] != "incl" {
+					continue
+				}
+				if m == nil {
+					sessionSources = f[4:]
+				} else {
+					m.Sources = f[4:]
+				}
+			case "ts-refclk":
+				if m == nil {
+					sessionRefClock = attr
+				} else {
+					m.RefClock = attr
+				}
+			}
+			if m == nil {
+				continue
+			}
+			switch name {
+			case "mid":
+				m.Mid = attr
+			case "mediaclk":
+				m.MediaClock = attr
+			case "rtpmap":
+				// <payload> <encoding>/<clock rate>[/<channels>]
+				f := strings.Fields(attr)
+				if len(f) != 2 {
+					return nil, fmt.Errorf("sdp line %d: invalid rtpmap", i+1)
+				}
+				enc := strings.Split(f[1], "/")
+				m.Encoding = enc[0]
+				if len(enc) > 1 {
+					fmt.Sscanf(enc[1], "%d", &m.ClockRate)
+				}
+				if len(enc) > 2 {
+					fmt.Sscanf(enc[2], "%d", &m.Channels)
+				}
+			case "fmtp":
+				f := strings.SplitN(attr, " ", 2)
+				if len(f) != 2 {
+					continue
+				}
+				for _, p := range strings.Split(f[1], ";") {
+					p = strings.TrimSpace(p)
+					if p == "" {
+						continue
+					}
+					kv := strings.SplitN(p, "=", 2)
+					if len(kv) == 2 {
+						m.Fmtp[kv[0]] = kv[1]
+					} else {
+						m.Fmtp[kv[0]] = ""
+					}
+				}
+			}
+		}
+	}
+	if len(sdp.Media) == 0 {
+		return nil, errors.New("sdp has no media descriptions")
+	}
+	// every leg of a DUP group must be a media section, or Legs would drop it
+	for _, mid := range sdp.DUP {
+		if sdp.media(mid) == nil {
+			return nil, fmt.Errorf("sdp group DUP names media %q, which has no a=mid", mid)
+		}
+	}
+	// Session level attributes apply to media that don't override them
+	for i := range sdp.Media {
+		if sdp.Media[i].Connection == "" {
+			sdp.Media[i].Connection = sdp.Connection
+		}
+		if sdp.Media[i].Sources == nil {
+			sdp.Media[i].Sources = sessionSources
+		}
+		if sdp.Media[i].RefClock == "" {
+			sdp.Media[i].RefClock = sessionRefClock
+		}
+	}
+	return sdp, nil
+}
+
+// Legs returns the media sections in leg order. With a DUP group the order
+// of the group is used, otherwise only the first section is a leg.
+func (s *SDPDescription) Legs() []SDPMedia {
+	if len(s.DUP) == 0 {
+		return s.Media[:1]
+	}
+	var legs []SDPMedia
+	for _, mid := range s.DUP {
+		if m := s.media(mid); m != nil {
+			legs = append(legs, *m)
+		}
+	}
+	return legs
+}
+
+func (s *SDPDescription) media(mid string) *SDPMedia {
+	for i := range s.Media {
+		if s.Media[i].Mid == mid {
+			return &s.Media[i]
+		}
+	}
+	return nil
+}
+
+// ReceiverTransportParams derives RTP receiver parameters for each leg
+func (s *SDPDescription) ReceiverTransportParams() []NMOSTransportParams {
+	var params []NMOSTransportParams
+	for _, m := range s.Legs() {
+		p := NMOSTransportParams{
+			"destination_port": float64(m.Port),
+			"rtp_enabled":      true,
+			"multicast_ip":     nil,
+			"source_ip":        nil,
+		}
+		if ip := net.ParseIP(m.Connection); ip != nil && ip.IsMulticast() {
+			p["multicast_ip"] = m.Connection
+			if len(m.Sources) > 0 {
+				p["source_ip"] = m.Sources[0]
+			}
+		} else if m.Connection != "" {
+			// unicast streams are addressed to the receiving interface
+			p["interface_ip"] = m.Connection
+			p["source_ip"] = s.OriginAddress
+		}
+		params = append(params, p)
+	}
+	return params
+}
+
+// Flow describes the flow of the first leg as far as the session
+// description tells, nil for media GenerateSDP doesn't produce. The source
+// only carries the audio channels.
+func (s *SDPDescription) Flow() (*NMOSFlow, *NMOSSource) {
+	m := s.Legs()[0]
+	fmtpInt := func(key string) int {
+		var v int
+		fmt.Sscanf(m.Fmtp[key], "%d", &v)
+		return v
+	}
+	flow := &NMOSFlow{}
+	source := &NMOSSource{}
+	if rate, ok := m.Fmtp["exactframerate"]; ok {
+		var r NMOSRational
+		if n, _ := fmt.Sscanf(rate, "%d/%d", &r.Numerator, &r.Denominator); n > 0 {
+			flow.Grain_rate = &r
+		}
+	}
+	switch m.Encoding {
+	case "raw":
+		flow.Format, flow.Media_type = FormatVideo, "video/raw"
+		flow.Frame_width, flow.Frame_height = fmtpInt("width"), fmtpInt("height")
+		flow.Colorspace = m.Fmtp["colorimetry"]
+		flow.Transfer_characteristic = m.Fmtp["TCS"]
+		flow.Interlace_mode = "progressive"
+		if _, ok := m.Fmtp["interlace"]; ok {
+			flow.Interlace_mode = "interlaced_tff"
+		}
+		flow.Components = sdpComponents(m.Fmtp["sampling"], flow.Frame_width, flow.Frame_height, fmtpInt("depth"))
+	case "L16", "L20", "L24":
+		flow.Format, flow.Media_type = FormatAudio, "audio/"+m.Encoding
+		flow.Sample_rate = &NMOSRational{Numerator: m.ClockRate, Denominator: 1}
+		fmt.Sscanf(m.Encoding, "L%d", &flow.Bit_depth)
+		channels := m.Channels
+		if channels == 0 {
+			channels = 1
+		}
+		source.Channels = make([]NMOSChannel, channels)
+	case "smpte291":
+		flow.Format, flow.Media_type = FormatData, "video/smpte291"
+	default:
+		return nil, nil
+	}
+	return flow, source
+}
+
+// sdpComponents builds the components of a raw video flow from the
+// sampling of its SDP, the reverse of videoSampling
+func sdpComponents(sampling string, width int, height int, depth int) []NMOSComponent {
+	names := []string{"Y", "Cb", "Cr"}
+	cw, ch := width, height
+	switch sampling {
+	case "YCbCr-4:4:4":
+	case "YCbCr-4:2:2":
+		cw = width / 2
+	case "YCbCr-4:2:0":
+		cw, ch = width/2, height/2
+	case "RGB":
+		names = []string{"R", "G", "B"}
+	default:
+		return nil
+	}
+	return []NMOSComponent{
+		{Name: names[0], Width: width, Height: height, Bit_depth: depth},
+		{Name: names[1], Width: cw, Height: ch, Bit_depth: depth},
+		{Name: names[2], Width: cw, Height: ch, Bit_depth: depth},
+	}
+}
@@ -0,0 +1,433 @@
+package nmos
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func sdpTestSender(version string, activation *string, legs ...NMOSTransportParams) (*NMOSSender, NMOSSenderParams) {
+	sender := &NMOSSender{
+		Id:      uuid.MustParse("01020304-0000-4000-8000-000000000001"),
+		Version: version,
+		Label:   "cam 1",
+	}
+	active := NMOSSenderParams{
+		MasterEnable:    true,
+		Activation:      NMOSActivation{ActivationTime: activation},
+		TransportParams: legs,
+	}
+	return sender, active
+}
+
+func sdpTestLeg(dest string, port int) NMOSTransportParams {
+	return NMOSTransportParams{
+		"source_ip":        "192.168.1.10",
+		"destination_ip":   dest,
+		"destination_port": float64(port),
+		"rtp_enabled":      true,
+	}
+}
+
+func TestGenerateSDP(t *testing.T) {
+	node := &NMOSNodeData{
+		Interfaces: []NMOSInterface{{Name: "eth0", ChassisID: "aa-bb-cc-dd-ee-ff"}},
+	}
+	video := &NMOSFlow{
+		Media_type:   "video/raw",
+		Frame_width:  1920,
+		Frame_height: 1080,
+		Grain_rate:   &NMOSRational{Numerator: 50},
+		Components: []NMOSComponent{
+			{Name: "Y", Width: 1920, Height: 1080, Bit_depth: 10},
+			{Name: "Cb", Width: 960, Height: 1080, Bit_depth: 10},
+			{Name: "Cr", Width: 960, Height: 1080, Bit_depth: 10},
+		},
+	}
+	audio := &NMOSFlow{Media_type: "audio/L24", Sample_rate: &NMOSRational{Numerator: 48000}}
+	stereo := &NMOSSource{Channels: []NMOSChannel{{Label: "L"}, {Label: "R"}}}
+	activated := "1600000000:500"
+	disabled := sdpTestLeg("239.0.0.2", 5004)
+	disabled["rtp_enabled"] = false
+
+	tests := []struct {
+		name   string
+		flow   *NMOSFlow
+		legs   []NMOSTransportParams
+		want   []string
+		absent []string
+	}{
+		{
+			name: "multicast video",
+			flow: video,
+			legs: []NMOSTransportParams{sdpTestLeg("239.0.0.1", 5004)},
+			want: []string{
+				"o=- 16909060 1600000000000000500 IN IP4 192.168.1.10\r\n",
+				"s=cam 1\r\n",
+				"m=video 5004 RTP/AVP 96\r\n",
+				"c=IN IP4 239.0.0.1/64\r\n",
+				"a=source-filter: incl IN IP4 239.0.0.1 192.168.1.10\r\n",
+				"a=rtpmap:96 raw/90000\r\n",
+				"a=fmtp:96 sampling=YCbCr-4:2:2; width=1920; height=1080; exactframerate=50; depth=10;",
+				"a=ts-refclk:localmac=AA-BB-CC-DD-EE-FF\r\n",
+			},
+			absent: []string{"a=group:DUP", "a=mid:"},
+		},
+		{
+			name: "unicast audio",
+			flow: audio,
+			legs: []NMOSTransportParams{sdpTestLeg("192.168.1.20", 5006)},
+			want: []string{
+				"m=audio 5006 RTP/AVP 97\r\n",
+				"c=IN IP4 192.168.1.20\r\n",
+				"a=rtpmap:97 L24/48000/2\r\n",
+				"a=ptime:1\r\n",
+			},
+			absent: []string{"a=source-filter"},
+		},
+		{
+			name: "ST 2022-7 legs",
+			flow: video,
+			legs: []NMOSTransportParams{sdpTestLeg("239.0.0.1", 5004), sdpTestLeg("239.0.1.1", 5004)},
+			want: []string{
+				"a=group:DUP primary secondary\r\n",
+				"c=IN IP4 239.0.1.1/64\r\n",
+				"a=mid:primary\r\n",
+				"a=mid:secondary\r\n",
+			},
+		},
+		{
+			name:   "disabled leg is left out",
+			flow:   video,
+			legs:   []NMOSTransportParams{sdpTestLeg("239.0.0.1", 5004), disabled},
+			want:   []string{"c=IN IP4 239.0.0.1/64\r\n"},
+			absent: []string{"239.0.0.2", "a=group:DUP"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender, active := sdpTestSender("1:0", &activated, tt.legs...)
+			sdp, err := GenerateSDP(node, sender, tt.flow, stereo, active)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, w := range tt.want {
+				if !strings.Contains(sdp, w) {
+					t.Errorf("missing %q in\n%s", w, sdp)
+				}
+			}
+			for _, a := range tt.absent {
+				if strings.Contains(sdp, a) {
+					t.Errorf("unexpected %q in\n%s", a, sdp)
+				}
+			}
+		})
+	}
+}
+
+func TestGenerateSDPErrors(t *testing.T) {
+	node := &NMOSNodeData{}
+	video := &NMOSFlow{Media_type: "video/raw"}
+	disabled := sdpTestLeg("239.0.0.1", 5004)
+	disabled["rtp_enabled"] = false
+
+	tests := []struct {
+		name   string
+		flow   *NMOSFlow
+		source *NMOSSource
+		legs   []NMOSTransportParams
+	}{
+		{"no flow", nil, &NMOSSource{}, []NMOSTransportParams{sdpTestLeg("239.0.0.1", 5004)}},
+		{"no source", video, nil, []NMOSTransportParams{sdpTestLeg("239.0.0.1", 5004)}},
+		{"no enabled legs", video, &NMOSSource{}, []NMOSTransportParams{disabled}},
+		{"unsupported media type", &NMOSFlow{Media_type: "video/H264"}, &NMOSSource{}, []NMOSTransportParams{sdpTestLeg("239.0.0.1", 5004)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender, active := sdpTestSender("1:0", nil, tt.legs...)
+			if _, err := GenerateSDP(node, sender, tt.flow, tt.source, active); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestSDPSessionVersion(t *testing.T) {
+	first, second := "1600000000:100", "1600000000:200"
+	tests := []struct {
+		name       string
+		version    string
+		activation *string
+		want       int64
+	}{
+		{"activation time", "1:0", &first, 1600000000000000100},
+		{"activation in the same second", "1:0", &second, 1600000000000000200},
+		{"sender version before activation", "1500000000:7", nil, 1500000000000000007},
+		{"zero is avoided", "0:0", nil, 1},
+		{"invalid version", "now", nil, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender, active := sdpTestSender(tt.version, tt.activation)
+			if got := sdpSessionVersion(sender, active); got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+const sdpTestDUP = "v=0\r\n" +
+	"o=- 1 1 IN IP4 192.168.1.10\r\n" +
+	"s=cam 1\r\n" +
+	"t=0 0\r\n" +
+	"a=group:DUP primary secondary\r\n" +
+	"m=video 5004 RTP/AVP 96\r\n" +
+	"c=IN IP4 239.0.0.1/64\r\n" +
+	"a=source-filter: incl IN IP4 239.0.0.1 192.168.1.10\r\n" +
+	"a=rtpmap:96 raw/90000\r\n" +
+	"a=fmtp:96 sampling=YCbCr-4:2:2; width=1920; height=1080; interlace\r\n" +
+	"a=mid:primary\r\n" +
+	"m=video 5006 RTP/AVP 96\r\n" +
+	"c=IN IP4 239.0.1.1/64\r\n" +
+	"a=source-filter: incl IN IP4 239.0.1.1 192.168.2.10\r\n" +
+	"a=rtpmap:96 raw/90000\r\n" +
+	"a=mid:secondary\r\n"
+
+func TestParseSDP(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr bool
+		check   func(t *testing.T, sdp *SDPDescription)
+	}{
+		{
+			name: "ST 2022-7 video",
+			data: sdpTestDUP,
+			check: func(t *testing.T, sdp *SDPDescription) {
+				if sdp.OriginAddress != "192.168.1.10" || sdp.SessionName != "cam 1" {
+					t.Errorf("origin %q, session %q", sdp.OriginAddress, sdp.SessionName)
+				}
+				if len(sdp.Media) != 2 {
+					t.Fatalf("%d media, want 2", len(sdp.Media))
+				}
+				m := sdp.Media[0]
+				if m.Port != 5004 || m.Payload != 96 || m.Connection != "239.0.0.1" || m.TTL != 64 {
+					t.Errorf("media %+v", m)
+				}
+				if m.Encoding != "raw" || m.ClockRate != 90000 || m.Fmtp["width"] != "1920" {
+					t.Errorf("rtpmap/fmtp %+v", m)
+				}
+				if _, ok := m.Fmtp["interlace"]; !ok {
+					t.Error("fmtp flag interlace missing")
+				}
+				if len(m.Sources) != 1 || m.Sources[0] != "192.168.1.10" {
+					t.Errorf("sources %v", m.Sources)
+				}
+			},
+		},
+		{
+			name: "session level connection and audio channels",
+			data: "v=0\no=- 1 1 IN IP4 10.0.0.1\ns=mic\nc=IN IP4 10.0.0.2\nt=0 0\n" +
+				"m=audio 5004/2 RTP/AVP 97\na=rtpmap:97 L24/48000/8\n",
+			check: func(t *testing.T, sdp *SDPDescription) {
+				m := sdp.Media[0]
+				if m.Connection != "10.0.0.2" || m.Port != 5004 || m.Channels != 8 || m.ClockRate != 48000 {
+					t.Errorf("media %+v", m)
+				}
+			},
+		},
+		{name: "no media", data: "v=0\no=- 1 1 IN IP4 10.0.0.1\ns=x\n", wantErr: true},
+		{name: "invalid line", data: "v=0\nbogus\n", wantErr: true},
+		{name: "invalid origin", data: "v=0\no=- 1 1\nm=video 5004 RTP/AVP 96\n", wantErr: true},
+		{name: "invalid port", data: "v=0\nm=video port RTP/AVP 96\n", wantErr: true},
+		{name: "invalid rtpmap", data: "v=0\nm=video 5004 RTP/AVP 96\na=rtpmap:96\n", wantErr: true},
+		{
+			name:    "DUP without matching mids",
+			data:    strings.Replace(sdpTestDUP, "a=mid:secondary", "a=mid:backup", 1),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sdp, err := ParseSDP(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.check != nil {
+				tt.check(t, sdp)
+			}
+		})
+	}
+}
+
+func TestReceiverTransportParams(t *testing.T) {
+	swapped := strings.Replace(sdpTestDUP, "DUP primary secondary", "DUP secondary primary", 1)
+	tests := []struct {
+		name string
+		data string
+		want []NMOSTransportParams
+	}{
+		{
+			name: "DUP legs in group order",
+			data: swapped,
+			want: []NMOSTransportParams{
+				{"destination_port": float64(5006), "rtp_enabled": true, "multicast_ip": "239.0.1.1", "source_ip": "192.168.2.10"},
+				{"destination_port": float64(5004), "rtp_enabled": true, "multicast_ip": "239.0.0.1", "source_ip": "192.168.1.10"},
+			},
+		},
+		{
+			name: "without DUP only the first media is a leg",
+			data: strings.Replace(sdpTestDUP, "a=group:DUP primary secondary\r\n", "", 1),
+			want: []NMOSTransportParams{
+				{"destination_port": float64(5004), "rtp_enabled": true, "multicast_ip": "239.0.0.1", "source_ip": "192.168.1.10"},
+			},
+		},
+		{
+			name: "unicast",
+			data: "v=0\no=- 1 1 IN IP4 10.0.0.1\ns=x\nt=0 0\nm=audio 5008 RTP/AVP 97\nc=IN IP4 10.0.0.2\n",
+			want: []NMOSTransportParams{
+				{"destination_port": float64(5008), "rtp_enabled": true, "multicast_ip": nil, "source_ip": "10.0.0.1", "interface_ip": "10.0.0.2"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sdp, err := ParseSDP(tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := sdp.ReceiverTransportParams()
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v\nwant %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// sdpTestUnicast is a single leg of sdpTestDUP sent to addr
+func sdpTestUnicast(addr string) string {
+	sdp := strings.Replace(sdpTestDUP, "a=group:DUP primary secondary\r\n", "", 1)
+	return strings.Replace(sdp, "c=IN IP4 239.0.0.1/64", "c=IN IP4 "+addr, 1)
+}
+
+func TestReceiverPatchTransportFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		sdp     string
+		wantErr bool
+		enabled []bool
+	}{
+		{name: "both legs", sdp: sdpTestDUP, enabled: []bool{true, true}},
+		{
+			name:    "single leg disables the second",
+			sdp:     strings.Replace(sdpTestDUP, "a=group:DUP primary secondary\r\n", "", 1),
+			enabled: []bool{true, false},
+		},
+		{
+			name:    "unmatched DUP mids are rejected",
+			sdp:     strings.Replace(sdpTestDUP, "a=mid:primary", "a=mid:main", 1),
+			wantErr: true,
+		},
+		{
+			name:    "unicast to the receiving interface",
+			sdp:     sdpTestUnicast("192.168.1.20"),
+			enabled: []bool{true, false},
+		},
+		{
+			name:    "unicast to an interface of another host is rejected",
+			sdp:     sdpTestUnicast("10.0.0.5"),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &NMOSReceiver{Id: uuid.New(), Transport: TransportRTPMulticast}
+			if err := r.InitConnection(TransportHost{InterfaceIPs: []string{"192.168.1.20", "192.168.2.20"}}); err != nil {
+				t.Fatal(err)
+			}
+			before := r.Connection.Staged().TransportParams
+			body, _ := json.Marshal(map[string]interface{}{
+				"transport_file": map[string]string{"data": tt.sdp, "type": "application/sdp"},
+			})
+			staged, _, err := r.Connection.Patch(body)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if legs := r.Connection.Staged().TransportParams; !reflect.DeepEqual(legs, before) {
+					t.Errorf("a rejected transport file was staged: %v", legs)
+				}
+				return
+			}
+			for i, want := range tt.enabled {
+				if got := staged.TransportParams[i].Bool("rtp_enabled"); got != want {
+					t.Errorf("leg %d rtp_enabled %v, want %v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSDPFlow(t *testing.T) {
+	node := &NMOSNodeData{}
+	video := func(sampling []NMOSComponent, interlace string) *NMOSFlow {
+		return &NMOSFlow{
+			Format: FormatVideo, Media_type: "video/raw", Frame_width: 1920, Frame_height: 1080,
+			Grain_rate: &NMOSRational{Numerator: 30000, Denominator: 1001}, Interlace_mode: interlace,
+			Colorspace: "BT2020", Transfer_characteristic: "PQ", Components: sampling,
+		}
+	}
+	c422 := []NMOSComponent{{Name: "Y", Width: 1920, Height: 1080, Bit_depth: 10}, {Name: "Cb", Width: 960, Height: 1080, Bit_depth: 10}, {Name: "Cr", Width: 960, Height: 1080, Bit_depth: 10}}
+	c420 := []NMOSComponent{{Name: "Y", Width: 1920, Height: 1080, Bit_depth: 8}, {Name: "Cb", Width: 960, Height: 540, Bit_depth: 8}, {Name: "Cr", Width: 960, Height: 540, Bit_depth: 8}}
+	rgb := []NMOSComponent{{Name: "R", Width: 1920, Height: 1080, Bit_depth: 12}, {Name: "G", Width: 1920, Height: 1080, Bit_depth: 12}, {Name: "B", Width: 1920, Height: 1080, Bit_depth: 12}}
+	stereo := &NMOSSource{Channels: []NMOSChannel{{Label: "L"}, {Label: "R"}}}
+
+	tests := []struct {
+		name   string
+		flow   *NMOSFlow
+		source *NMOSSource
+	}{
+		{"4:2:2 progressive", video(c422, "progressive"), &NMOSSource{}},
+		{"4:2:0 interlaced", video(c420, "interlaced_tff"), &NMOSSource{}},
+		{"RGB", video(rgb, "progressive"), &NMOSSource{}},
+		{"audio", &NMOSFlow{Format: FormatAudio, Media_type: "audio/L24", Sample_rate: &NMOSRational{Numerator: 48000, Denominator: 1}, Bit_depth: 24}, stereo},
+		{"ancillary data", &NMOSFlow{Format: FormatData, Media_type: "video/smpte291", Grain_rate: &NMOSRational{Numerator: 50}}, &NMOSSource{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sender, active := sdpTestSender("1:0", nil, sdpTestLeg("239.0.0.1", 5004))
+			data, err := GenerateSDP(node, sender, tt.flow, tt.source, active)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sdp, err := ParseSDP(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			flow, source := sdp.Flow()
+			if flow == nil {
+				t.Fatal("no flow")
+			}
+			if flow.Format != tt.flow.Format {
+				t.Errorf("format %s, want %s", flow.Format, tt.flow.Format)
+			}
+			got, want := FlowParams(flow, source), FlowParams(tt.flow, tt.source)
+			for k, v := range want {
+				if !paramEqual(got[k], v) {
+					t.Errorf("%s: got %v, want %v", k, got[k], v)
+				}
+			}
+		})
+	}
+
+	sdp, err := ParseSDP("v=0\no=- 1 1 IN IP4 10.0.0.1\ns=x\nm=video 5004 RTP/AVP 98\na=rtpmap:98 jxsv/90000\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flow, _ := sdp.Flow(); flow != nil {
+		t.Errorf("flow %+v for an unsupported encoding", flow)
+	}
+}
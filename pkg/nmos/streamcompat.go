@@ -0,0 +1,175 @@
+package nmos
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// IS-11 sender states
+const (
+	StreamCompatUnconstrained              = "unconstrained"
+	StreamCompatConstrained                = "constrained"
+	StreamCompatActiveConstraintsViolation = "active_constraints_violation"
+	StreamCompatNoEssence                  = "no_essence"
+)
+
+// IS-11 receiver states
+const (
+	StreamCompatUnknown            = "unknown"
+	StreamCompatCompliantStream    = "compliant_stream"
+	StreamCompatNonCompliantStream = "non_compliant_stream"
+)
+
+type NMOSStreamCompatStatus struct {
+	State string  `json:"state"`
+	Debug *string `json:"debug,omitempty"`
+}
+
+// NMOSInput is an IS-11 input, e.g. the HDMI input feeding a sender
+type NMOSInput struct {
+	Id                string      `json:"id"`
+	Name              string      `json:"name"`
+	Description       string      `json:"description"`
+	Tags              NMOSTags    `json:"tags"`
+	Connected         bool        `json:"connected"`
+	Edid_support      bool        `json:"edid_support"`
+	Base_edid_support bool        `json:"base_edid_support"`
+	Adjust_to_caps    bool        `json:"adjust_to_caps"`
+	Senders           []uuid.UUID `json:"senders"`
+	// EDID presented when no base EDID is set, loaded from Edid_file
+	Edid_file string     `json:"-"`
+	Edid      *EDIDStore `json:"-"`
+	// Base EDID set by a controller
+	Base_edid *EDIDStore `json:"-"`
+}
+
+// NMOSOutput is an IS-11 output, e.g. the HDMI output of a receiver
+type NMOSOutput struct {
+	Id           string      `json:"id"`
+	Name         string      `json:"name"`
+	Description  string      `json:"description"`
+	Tags         NMOSTags    `json:"tags"`
+	Connected    bool        `json:"connected"`
+	Edid_support bool        `json:"edid_support"`
+	Receivers    []uuid.UUID `json:"receivers"`
+	// EDID of the connected sink, decoded capabilities are listed with the
+	// output properties
+	Edid_file string     `json:"-"`
+	Edid      *EDIDStore `json:"capabilities,omitempty"`
+}
+
+// InitEDID sets up EDID storage for inputs with EDID support and loads
+// Edid_file if given
+func (in *NMOSInput) InitEDID() error {
+	if !in.Edid_support {
+		return nil
+	}
+	in.Edid = &EDIDStore{}
+	if in.Base_edid_support {
+		in.Base_edid = &EDIDStore{}
+	}
+	if in.Edid_file != "" {
+		return in.Edid.Load(in.Edid_file)
+	}
+	return nil
+}
+
+// EffectiveEDID returns the EDID the input presents upstream, the base EDID
+// takes precedence when set
+func (in *NMOSInput) EffectiveEDID() []byte {
+	if in.Base_edid != nil {
+		if raw := in.Base_edid.Raw(); raw != nil {
+			return raw
+		}
+	}
+	if in.Edid != nil {
+		return in.Edid.Raw()
+	}
+	return nil
+}
+
+func (out *NMOSOutput) InitEDID() error {
+	if !out.Edid_support {
+		return nil
+	}
+	out.Edid = &EDIDStore{}
+	if out.Edid_file != "" {
+		return out.Edid.Load(out.Edid_file)
+	}
+	return nil
+}
+
+// NMOSSenderCompatibility holds the IS-11 active constraints of a sender
+type NMOSSenderCompatibility struct {
+	mu     sync.Mutex
+	active NMOSConstraintSets
+}
+
+func (ns *NMOSSender) InitCompatibility() {
+	ns.Compatibility = &NMOSSenderCompatibility{
+		active: NMOSConstraintSets{Constraint_sets: make([]NMOSConstraintSet, 0)},
+	}
+}
+
+func (c *NMOSSenderCompatibility) ActiveConstraints() NMOSConstraintSets {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.active
+}
+
+func (c *NMOSSenderCompatibility) SetActiveConstraints(sets NMOSConstraintSets) error {
+	if err := sets.Validate(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.active = sets
+	return nil
+}
+
+func (c *NMOSSenderCompatibility) ResetActiveConstraints() {
+	c.SetActiveConstraints(NMOSConstraintSets{Constraint_sets: make([]NMOSConstraintSet, 0)})
+}
+
+// Status evaluates the sender's flow against its active constraints, the
+// violated constraints are reported in Debug
+func (c *NMOSSenderCompatibility) Status(sender *NMOSSender, flow *NMOSFlow, source *NMOSSource) NMOSStreamCompatStatus {
+	active := c.ActiveConstraints()
+	switch {
+	case flow == nil:
+		return NMOSStreamCompatStatus{State: StreamCompatNoEssence}
+	case len(active.Constraint_sets) == 0:
+		return NMOSStreamCompatStatus{State: StreamCompatUnconstrained}
+	}
+	ok, violations := active.Evaluate(SenderParams(sender, flow, source))
+	if ok {
+		return NMOSStreamCompatStatus{State: StreamCompatConstrained}
+	}
+	var msgs []string
+	for _, v := range violations {
+		msgs = append(msgs, v.String())
+	}
+	debug := strings.Join(msgs, "; ")
+	return NMOSStreamCompatStatus{State: StreamCompatActiveConstraintsViolation, Debug: &debug}
+}
+
+// ReceiverCompatStatus evaluates the stream a receiver gets, given by the
+// connected sender and its flow, against the receiver's caps. The state is
+// unknown without a sender or flow.
+func ReceiverCompatStatus(receiver *NMOSReceiver, sender *NMOSSender, flow *NMOSFlow, source *NMOSSource) NMOSStreamCompatStatus {
+	if sender == nil || flow == nil {
+		return NMOSStreamCompatStatus{State: StreamCompatUnknown}
+	}
+	violations := CheckReceiverCaps(receiver, sender, flow, source)
+	if len(violations) == 0 {
+		return NMOSStreamCompatStatus{State: StreamCompatCompliantStream}
+	}
+	var msgs []string
+	for _, v := range violations {
+		msgs = append(msgs, v.String())
+	}
+	debug := strings.Join(msgs, "; ")
+	return NMOSStreamCompatStatus{State: StreamCompatNonCompliantStream, Debug: &debug}
+}
@@ -0,0 +1,232 @@
+package nmos
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func compatTestVideo() (*NMOSSender, *NMOSFlow, *NMOSSource) {
+	source := &NMOSSource{Id: uuid.New(), Format: FormatVideo}
+	flow := &NMOSFlow{
+		Id:           uuid.New(),
+		Source_id:    source.Id,
+		Format:       FormatVideo,
+		Media_type:   "video/raw",
+		Frame_width:  1920,
+		Frame_height: 1080,
+		Grain_rate:   &NMOSRational{Numerator: 50, Denominator: 1},
+		Components: []NMOSComponent{
+			{Name: "Y", Width: 1920, Height: 1080, Bit_depth: 10},
+			{Name: "Cb", Width: 960, Height: 1080, Bit_depth: 10},
+			{Name: "Cr", Width: 960, Height: 1080, Bit_depth: 10},
+		},
+	}
+	sender := &NMOSSender{Id: uuid.New(), Flow_id: flow.Id, Transport: TransportRTPMulticast}
+	return sender, flow, source
+}
+
+func compatTestReceiver(sets ...NMOSConstraintSet) *NMOSReceiver {
+	return &NMOSReceiver{
+		Id:        uuid.New(),
+		Format:    FormatVideo,
+		Transport: TransportRTPMulticast,
+		Caps:      NMOSCapabilities{Media_types: []string{"video/raw"}, Constraint_sets: sets},
+	}
+}
+
+func TestReceiverCompatStatus(t *testing.T) {
+	sender, flow, source := compatTestVideo()
+	tests := []struct {
+		name     string
+		receiver *NMOSReceiver
+		sender   *NMOSSender
+		flow     *NMOSFlow
+		want     string
+		debug    string
+	}{
+		{
+			name:     "no sender",
+			receiver: compatTestReceiver(),
+			want:     StreamCompatUnknown,
+		},
+		{
+			name:     "sender without a known flow",
+			receiver: compatTestReceiver(),
+			sender:   sender,
+			want:     StreamCompatUnknown,
+		},
+		{
+			name:     "no constraint sets",
+			receiver: compatTestReceiver(),
+			sender:   sender,
+			flow:     flow,
+			want:     StreamCompatCompliantStream,
+		},
+		{
+			name: "matching constraint set",
+			receiver: compatTestReceiver(NMOSConstraintSet{
+				CapFormatFrameWidth: map[string]interface{}{"enum": []interface{}{1920.0}},
+			}),
+			sender: sender,
+			flow:   flow,
+			want:   StreamCompatCompliantStream,
+		},
+		{
+			name: "frame size out of range",
+			receiver: compatTestReceiver(NMOSConstraintSet{
+				CapFormatFrameWidth: map[string]interface{}{"maximum": 1280.0},
+			}),
+			sender: sender,
+			flow:   flow,
+			want:   StreamCompatNonCompliantStream,
+			debug:  CapFormatFrameWidth,
+		},
+		{
+			name:     "wrong media type",
+			receiver: &NMOSReceiver{Format: FormatVideo, Transport: TransportRTP, Caps: NMOSCapabilities{Media_types: []string{"video/jxsv"}}},
+			sender:   sender,
+			flow:     flow,
+			want:     StreamCompatNonCompliantStream,
+			debug:    "media_types",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ReceiverCompatStatus(tt.receiver, tt.sender, tt.flow, source)
+			if got.State != tt.want {
+				t.Errorf("state %s, want %s", got.State, tt.want)
+			}
+			if tt.debug != "" && (got.Debug == nil || !strings.Contains(*got.Debug, tt.debug)) {
+				t.Errorf("debug %v doesn't mention %s", got.Debug, tt.debug)
+			}
+		})
+	}
+}
+
+func TestReceiverCompatStatusAPI(t *testing.T) {
+	local, flow, source := compatTestVideo()
+	node := NMOSNodeData{Id: uuid.New()}
+	active := NMOSSenderParams{TransportParams: []NMOSTransportParams{sdpTestLeg("239.0.0.1", 5004)}}
+	sdp, err := GenerateSDP(&node, local, flow, source, active)
+	if err != nil {
+		t.Fatal(err)
+	}
+	narrow := NMOSConstraintSet{CapFormatFrameWidth: map[string]interface{}{"maximum": 1280.0}}
+
+	tests := []struct {
+		name   string
+		sets   []NMOSConstraintSet
+		sender uuid.UUID
+		sdp    string
+		enable bool
+		want   string
+	}{
+		{name: "not receiving", sender: local.Id, want: StreamCompatUnknown},
+		{name: "sender of this node", sender: local.Id, enable: true, want: StreamCompatCompliantStream},
+		{name: "sender of this node outside the caps", sets: []NMOSConstraintSet{narrow}, sender: local.Id, enable: true, want: StreamCompatNonCompliantStream},
+		{name: "remote sender from the transport file", sender: uuid.New(), sdp: sdp, enable: true, want: StreamCompatCompliantStream},
+		{name: "remote sender outside the caps", sets: []NMOSConstraintSet{narrow}, sender: uuid.New(), sdp: sdp, enable: true, want: StreamCompatNonCompliantStream},
+		{name: "remote sender without a transport file", sender: uuid.New(), enable: true, want: StreamCompatUnknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rc := compatTestReceiver(tt.sets...)
+			if err := rc.InitConnection(TransportHost{InterfaceIPs: []string{"192.168.1.20"}}); err != nil {
+				t.Fatal(err)
+			}
+			patch := map[string]interface{}{
+				"sender_id":     tt.sender,
+				"master_enable": tt.enable,
+				"activation":    map[string]string{"mode": ActivateImmediate},
+			}
+			if tt.sdp != "" {
+				patch["transport_file"] = map[string]string{"data": tt.sdp, "type": "application/sdp"}
+			}
+			body, _ := json.Marshal(patch)
+			if _, _, err := rc.Connection.Patch(body); err != nil {
+				t.Fatal(err)
+			}
+			device := NMOSDevice{Id: uuid.New(), Sources: []NMOSSource{*source}, Flows: []NMOSFlow{*flow},
+				Senders: []NMOSSender{*local}, Receivers: []NMOSReceiver{*rc}}
+			n := &NMOSWebServer{Resources: NewResources(node, NMOSDevices{device})}
+			if got := n.receiverCompatStatus(rc); got.State != tt.want {
+				t.Errorf("state %s, want %s (%v)", got.State, tt.want, got.Debug)
+			}
+		})
+	}
+}
+
+func TestSenderCompatStatus(t *testing.T) {
+	_, flow, source := compatTestVideo()
+	hd := NMOSConstraintSet{CapFormatFrameWidth: map[string]interface{}{"enum": []interface{}{1920.0}}}
+	sd := NMOSConstraintSet{CapFormatFrameWidth: map[string]interface{}{"maximum": 720.0}}
+	tests := []struct {
+		name string
+		sets []NMOSConstraintSet
+		flow *NMOSFlow
+		want string
+	}{
+		{name: "no flow", flow: nil, want: StreamCompatNoEssence},
+		{name: "no active constraints", flow: flow, want: StreamCompatUnconstrained},
+		{name: "flow matches", sets: []NMOSConstraintSet{hd}, flow: flow, want: StreamCompatConstrained},
+		{name: "flow matches the second set", sets: []NMOSConstraintSet{sd, hd}, flow: flow, want: StreamCompatConstrained},
+		{name: "flow outside the constraints", sets: []NMOSConstraintSet{sd}, flow: flow, want: StreamCompatActiveConstraintsViolation},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s NMOSSender
+			s.InitCompatibility()
+			if tt.sets != nil {
+				if err := s.Compatibility.SetActiveConstraints(NMOSConstraintSets{Constraint_sets: tt.sets}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := s.Compatibility.Status(&s, tt.flow, source); got.State != tt.want {
+				t.Errorf("state %s, want %s", got.State, tt.want)
+			}
+		})
+	}
+}
+
+func TestActiveConstraintsAPI(t *testing.T) {
+	sender, _, _ := compatTestVideo()
+	sender.InitCompatibility()
+	n := &NMOSWebServer{}
+	do := func(method, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		n.handleActiveConstraints(w, httptest.NewRequest(method, "/", strings.NewReader(body)), sender)
+		return w
+	}
+
+	if w := do(http.MethodPut, `{"constraint_sets": [{"urn:x-nmos:cap:format:frame_width": {"enum": [1920]}}]}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT status %d: %s", w.Code, w.Body)
+	}
+	if got := len(sender.Compatibility.ActiveConstraints().Constraint_sets); got != 1 {
+		t.Errorf("%d active constraint sets after PUT, want 1", got)
+	}
+	if w := do(http.MethodPut, `{"constraint_sets": [{"frame_width": {"enum": [1920]}}]}`); w.Code != http.StatusBadRequest {
+		t.Errorf("PUT of an invalid set: status %d, want 400", w.Code)
+	}
+	if got := len(sender.Compatibility.ActiveConstraints().Constraint_sets); got != 1 {
+		t.Errorf("an invalid PUT changed the active constraints to %d sets", got)
+	}
+	if w := do(http.MethodDelete, ""); w.Code != http.StatusNoContent {
+		t.Errorf("DELETE status %d, want 204", w.Code)
+	}
+	w := do(http.MethodGet, "")
+	var got NMOSConstraintSets
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("GET after DELETE: %d %s", w.Code, w.Body)
+	}
+	if got.Constraint_sets == nil || len(got.Constraint_sets) != 0 {
+		t.Errorf("GET after DELETE: %s, want an empty list", w.Body)
+	}
+	if w := do(http.MethodPost, "{}"); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST status %d, want 405", w.Code)
+	}
+}
@@ -0,0 +1,303 @@
+package nmos
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+)
+
+func (n *NMOSWebServer) initStreamCompatAPI(scSubRouter *mux.Router) {
+	handleSlash(scSubRouter, "", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, []string{"v1.0/"})
+	})
+	handleSlash(scSubRouter, "/{version}", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, []string{"inputs/", "outputs/", "senders/", "receivers/"})
+	})
+	// Senders
+	handleSlash(scSubRouter, "/{version}/senders", func(w http.ResponseWriter, r *http.Request) {
+		ids := make([]string, 0)
+		_, d := n.snapshot()
+		for _, s := range d.Senders() {
+			if s.Compatibility != nil {
+				ids = append(ids, s.Id.String()+"/")
+			}
+		}
+		writeJSON(w, http.StatusOK, ids)
+	})
+	handleSlash(scSubRouter, "/{version}/senders/{id}", n.withCompatSender(func(w http.ResponseWriter, r *http.Request, s *NMOSSender) {
+		writeJSON(w, http.StatusOK, []string{"active_constraints/", "inputs/", "status/"})
+	}))
+	handleSlash(scSubRouter, "/{version}/senders/{id}/active_constraints", n.withCompatSender(n.handleActiveConstraints))
+	handleSlash(scSubRouter, "/{version}/senders/{id}/status", n.withCompatSender(func(w http.ResponseWriter, r *http.Request, s *NMOSSender) {
+		writeJSON(w, http.StatusOK, n.senderCompatStatus(s))
+	}))
+	handleSlash(scSubRouter, "/{version}/senders/{id}/inputs", n.withCompatSender(func(w http.ResponseWriter, r *http.Request, s *NMOSSender) {
+		ids := make([]string, 0)
+		_, d := n.snapshot()
+		for _, in := range d.Inputs() {
+			for _, sid := range in.Senders {
+				if sid == s.Id {
+					ids = append(ids, in.Id)
+				}
+			}
+		}
+		writeJSON(w, http.StatusOK, ids)
+	}))
+	// Receivers
+	handleSlash(scSubRouter, "/{version}/receivers", func(w http.ResponseWriter, r *http.Request) {
+		ids := make([]string, 0)
+		_, d := n.snapshot()
+		for _, rc := range d.Receivers() {
+			ids = append(ids, rc.Id.String()+"/")
+		}
+		writeJSON(w, http.StatusOK, ids)
+	})
+	handleSlash(scSubRouter, "/{version}/receivers/{id}", n.withCompatReceiver(func(w http.ResponseWriter, r *http.Request, rc *NMOSReceiver) {
+		writeJSON(w, http.StatusOK, []string{"outputs/", "status/"})
+	}))
+	handleSlash(scSubRouter, "/{version}/receivers/{id}/status", n.withCompatReceiver(func(w http.ResponseWriter, r *http.Request, rc *NMOSReceiver) {
+		writeJSON(w, http.StatusOK, n.receiverCompatStatus(rc))
+	}))
+	handleSlash(scSubRouter, "/{version}/receivers/{id}/outputs", n.withCompatReceiver(func(w http.ResponseWriter, r *http.Request, rc *NMOSReceiver) {
+		ids := make([]string, 0)
+		_, d := n.snapshot()
+		for _, out := range d.Outputs() {
+			for _, rid := range out.Receivers {
+				if rid == rc.Id {
+					ids = append(ids, out.Id)
+				}
+			}
+		}
+		writeJSON(w, http.StatusOK, ids)
+	}))
+	// Inputs
+	handleSlash(scSubRouter, "/{version}/inputs", func(w http.ResponseWriter, r *http.Request) {
+		ids := make([]string, 0)
+		_, d := n.snapshot()
+		for _, in := range d.Inputs() {
+			ids = append(ids, in.Id+"/")
+		}
+		writeJSON(w, http.StatusOK, ids)
+	})
+	handleSlash(scSubRouter, "/{version}/inputs/{id}", n.withInput(func(w http.ResponseWriter, r *http.Request, in *NMOSInput) {
+		writeJSON(w, http.StatusOK, []string{"edid/", "properties/"})
+	}))
+	handleSlash(scSubRouter, "/{version}/inputs/{id}/properties", n.withInput(func(w http.ResponseWriter, r *http.Request, in *NMOSInput) {
+		writeJSON(w, http.StatusOK, in)
+	}))
+	handleSlash(scSubRouter, "/{version}/inputs/{id}/edid", n.withInput(func(w http.ResponseWriter, r *http.Request, in *NMOSInput) {
+		if !in.Edid_support {
+			writeError(w, http.StatusNotFound, "input has no edid support")
+			return
+		}
+		writeJSON(w, http.StatusOK, []string{"base/", "effective/"})
+	}))
+	handleSlash(scSubRouter, "/{version}/inputs/{id}/edid/base", n.withInput(handleBaseEDID))
+	handleSlash(scSubRouter, "/{version}/inputs/{id}/edid/effective", n.withInput(func(w http.ResponseWriter, r *http.Request, in *NMOSInput) {
+		if !in.Edid_support {
+			writeError(w, http.StatusNotFound, "input has no edid support")
+			return
+		}
+		writeEDID(w, in.EffectiveEDID())
+	}))
+	// Outputs
+	handleSlash(scSubRouter, "/{version}/outputs", func(w http.ResponseWriter, r *http.Request) {
+		ids := make([]string, 0)
+		_, d := n.snapshot()
+		for _, out := range d.Outputs() {
+			ids = append(ids, out.Id+"/")
+		}
+		writeJSON(w, http.StatusOK, ids)
+	})
+	handleSlash(scSubRouter, "/{version}/outputs/{id}", n.withOutput(func(w http.ResponseWriter, r *http.Request, out *NMOSOutput) {
+		writeJSON(w, http.StatusOK, []string{"edid/", "properties/"})
+	}))
+	handleSlash(scSubRouter, "/{version}/outputs/{id}/properties", n.withOutput(func(w http.ResponseWriter, r *http.Request, out *NMOSOutput) {
+		writeJSON(w, http.StatusOK, out)
+	}))
+	handleSlash(scSubRouter, "/{version}/outputs/{id}/edid", n.withOutput(func(w http.ResponseWriter, r *http.Request, out *NMOSOutput) {
+		if out.Edid == nil {
+			writeError(w, http.StatusNotFound, "output has no edid support")
+			return
+		}
+		writeEDID(w, out.Edid.Raw())
+	}))
+}
+
+// writeEDID serves a raw EDID, 204 if none is available
+func writeEDID(w http.ResponseWriter, raw []byte) {
+	if raw == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.WriteHeader(http.StatusOK)
+	w.Write(raw)
+}
+
+func handleBaseEDID(w http.ResponseWriter, r *http.Request, in *NMOSInput) {
+	if in.Base_edid == nil {
+		writeError(w, http.StatusNotFound, "input has no base edid support")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeEDID(w, in.Base_edid.Raw())
+	case http.MethodPut:
+		// 256 blocks is the most an EDID can address
+		raw, err := ioutil.ReadAll(io.LimitReader(r.Body, 256*edidBlockSize+1))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if len(raw) > 256*edidBlockSize {
+			writeError(w, http.StatusRequestEntityTooLarge, "edid too large")
+			return
+		}
+		if err := in.Base_edid.Set(raw); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		in.Base_edid.Clear()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (n *NMOSWebServer) senderCompatStatus(s *NMOSSender) NMOSStreamCompatStatus {
+	var source *NMOSSource
+	_, d := n.snapshot()
+	flow := d.FindFlow(s.Flow_id)
+	if flow != nil {
+		source = d.FindSource(flow.Source_id)
+	}
+	return s.Compatibility.Status(s, flow, source)
+}
+
+// receiverCompatStatus checks the active sender of a receiver. Senders of
+// this node are looked up, for others the flow is taken from the active
+// transport file.
+func (n *NMOSWebServer) receiverCompatStatus(rc *NMOSReceiver) NMOSStreamCompatStatus {
+	if rc.Connection == nil {
+		return NMOSStreamCompatStatus{State: StreamCompatUnknown}
+	}
+	active := rc.Connection.Active()
+	if !active.MasterEnable || active.SenderId == nil {
+		return NMOSStreamCompatStatus{State: StreamCompatUnknown}
+	}
+	_, d := n.snapshot()
+	if s := d.FindSender(*active.SenderId); s != nil {
+		var source *NMOSSource
+		flow := d.FindFlow(s.Flow_id)
+		if flow != nil {
+			source = d.FindSource(flow.Source_id)
+		}
+		return ReceiverCompatStatus(rc, s, flow, source)
+	}
+	tf := active.TransportFile
+	if tf.Data == nil || *tf.Data == "" {
+		return NMOSStreamCompatStatus{State: StreamCompatUnknown}
+	}
+	sdp, err := ParseSDP(*tf.Data)
+	if err != nil {
+		return NMOSStreamCompatStatus{State: StreamCompatUnknown}
+	}
+	flow, source := sdp.Flow()
+	sender := &NMOSSender{Id: *active.SenderId, Transport: rc.Transport}
+	return ReceiverCompatStatus(rc, sender, flow, source)
+}
+
+func (n *NMOSWebServer) handleActiveConstraints(w http.ResponseWriter, r *http.Request, s *NMOSSender) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, s.Compatibility.ActiveConstraints())
+	case http.MethodPut:
+		var sets NMOSConstraintSets
+		if err := json.NewDecoder(r.Body).Decode(&sets); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := s.Compatibility.SetActiveConstraints(sets); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, s.Compatibility.ActiveConstraints())
+	case http.MethodDelete:
+		s.Compatibility.ResetActiveConstraints()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// withCompatSender resolves the {id} route variable to a sender with IS-11 state
+func (n *NMOSWebServer) withCompatSender(f func(http.ResponseWriter, *http.Request, *NMOSSender)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := uuid.Parse(mux.Vars(r)["id"])
+		if err != nil {
+			writeError(w, http.StatusNotFound, "invalid sender id")
+			return
+		}
+		_, d := n.snapshot()
+		s := d.FindSender(id)
+		if s == nil || s.Compatibility == nil {
+			writeError(w, http.StatusNotFound, "sender not found")
+			return
+		}
+		f(w, r, s)
+	}
+}
+
+func (n *NMOSWebServer) withCompatReceiver(f func(http.ResponseWriter, *http.Request, *NMOSReceiver)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := uuid.Parse(mux.Vars(r)["id"])
+		if err != nil {
+			writeError(w, http.StatusNotFound, "invalid receiver id")
+			return
+		}
+		_, d := n.snapshot()
+		rc := d.FindReceiver(id)
+		if rc == nil {
+			writeError(w, http.StatusNotFound, "receiver not found")
+			return
+		}
+		f(w, r, rc)
+	}
+}
+
+func (n *NMOSWebServer) withInput(f func(http.ResponseWriter, *http.Request, *NMOSInput)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		_, d := n.snapshot()
+		inputs := d.Inputs()
+		for i := range inputs {
+			if inputs[i].Id == id {
+				f(w, r, &inputs[i])
+				return
+			}
+		}
+		writeError(w, http.StatusNotFound, "input not found")
+	}
+}
+
+func (n *NMOSWebServer) withOutput(f func(http.ResponseWriter, *http.Request, *NMOSOutput)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		_, d := n.snapshot()
+		outputs := d.Outputs()
+		for i := range outputs {
+			if outputs[i].Id == id {
+				f(w, r, &outputs[i])
+				return
+			}
+		}
+		writeError(w, http.StatusNotFound, "output not found")
+	}
+}
@@ -0,0 +1,125 @@
+package nmos
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/grandcat/zeroconf"
+)
+
+const DefaultHeartbeatInterval = 5
+
+type NMOSSystemIS04 struct {
+	// Seconds between node heartbeats
+	Heartbeat_interval int `json:"heartbeat_interval"`
+}
+
+type NMOSSystemPTP struct {
+	Announce_receipt_timeout int `json:"announce_receipt_timeout"`
+	Domain_number            int `json:"domain_number"`
+}
+
+type NMOSSystemSyslog struct {
+	Hostname string `json:"hostname"`
+	Port     int    `json:"port"`
+}
+
+// NMOSSystemGlobal is the IS-09 global configuration resource
+type NMOSSystemGlobal struct {
+	Id          uuid.UUID         `json:"id"`
+	Version     string            `json:"version"`
+	Label       string            `json:"label"`
+	Description string            `json:"description"`
+	Tags        NMOSTags          `json:"tags"`
+	Is04        NMOSSystemIS04    `json:"is04"`
+	Ptp         NMOSSystemPTP     `json:"ptp"`
+	Syslog      *NMOSSystemSyslog `json:"syslog,omitempty"`
+	Syslogv2    *NMOSSystemSyslog `json:"syslogv2,omitempty"`
+}
+
+// LoadSystemGlobal reads the global configuration from a JSON file,
+// filling in the id, version and IS-04 defaults when missing. A missing id
+// is derived from the file's path so it's the same on every load.
+func LoadSystemGlobal(path string) (*NMOSSystemGlobal, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	g := &NMOSSystemGlobal{}
+	if err := json.Unmarshal(data, g); err != nil {
+		return nil, err
+	}
+	if g.Id == uuid.Nil {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		g.Id = StableID(abs, "system")
+	}
+	if g.Version == "" {
+		g.Version = NewVersion()
+	}
+	if g.Is04.Heartbeat_interval == 0 {
+		g.Is04.Heartbeat_interval = DefaultHeartbeatInterval
+	}
+	return g, g.Validate()
+}
+
+func (g *NMOSSystemGlobal) Validate() error {
+	if g.Is04.Heartbeat_interval < 1 || g.Is04.Heartbeat_interval > 1000 {
+		return errors.New("is04.heartbeat_interval must be between 1 and 1000")
+	}
+	if g.Ptp.Domain_number < 0 || g.Ptp.Domain_number > 127 {
+		return errors.New("ptp.domain_number must be between 0 and 127")
+	}
+	return nil
+}
+
+// InitSystem serves the IS-09 System API and advertises it with mDNS
+func (n *NMOSWebServer) InitSystem(global *NMOSSystemGlobal) {
+	// MDNS
+	hostNameDomain, _ := os.Hostname()
+	splitHostName := strings.Split(hostNameDomain, ".")
+	hostName := splitHostName[0]
+	txt := MdnsText(99, []string{"v1.0"}, n.Proto(), n.Auth != nil)
+	var err error
+	n.MDNSSystem, err = zeroconf.Register(hostName, "_nmos-system._tcp", "local", n.Port, txt, nil)
+	if err != nil {
+		panic(err)
+	}
+	// SYSTEM API
+	sysSubRouter := n.Router.PathPrefix("/x-nmos/system").Subrouter()
+	handleSlash(sysSubRouter, "", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, []string{"v1.0/"})
+	})
+	handleSlash(sysSubRouter, "/{version}", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, []string{"global/"})
+	})
+	handleSlash(sysSubRouter, "/{version}/global", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, global)
+	})
+}
+
+// GetSystemGlobal fetches the global configuration from a System API base
+// URL such as http://host:port/x-nmos/system/v1.0
+func GetSystemGlobal(client *http.Client, base string) (*NMOSSystemGlobal, error) {
+	resp, err := client.Get(strings.TrimSuffix(base, "/") + "/global")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("system api returned " + resp.Status)
+	}
+	g := &NMOSSystemGlobal{}
+	if err := json.NewDecoder(resp.Body).Decode(g); err != nil {
+		return nil, err
+	}
+	return g, g.Validate()
+}
@@ -0,0 +1,55 @@
+package nmos
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestLoadSystemGlobal(t *testing.T) {
+	dir := t.TempDir()
+	id := uuid.New()
+	tests := []struct {
+		name      string
+		data      string
+		id        uuid.UUID
+		heartbeat int
+		wantErr   bool
+	}{
+		{name: "defaults", data: `{"label": "studio"}`, heartbeat: DefaultHeartbeatInterval},
+		{name: "configured", data: `{"id": "` + id.String() + `", "is04": {"heartbeat_interval": 10}}`, id: id, heartbeat: 10},
+		{name: "heartbeat out of range", data: `{"is04": {"heartbeat_interval": 1001}}`, wantErr: true},
+		{name: "ptp domain out of range", data: `{"ptp": {"domain_number": 128}}`, wantErr: true},
+		{name: "not json", data: `label: studio`, wantErr: true},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, string(rune('a'+i))+".json")
+			if err := ioutil.WriteFile(path, []byte(tt.data), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			g, err := LoadSystemGlobal(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if g.Is04.Heartbeat_interval != tt.heartbeat {
+				t.Errorf("heartbeat interval %d, want %d", g.Is04.Heartbeat_interval, tt.heartbeat)
+			}
+			if tt.id != uuid.Nil && g.Id != tt.id {
+				t.Errorf("id %s, want %s", g.Id, tt.id)
+			}
+			again, err := LoadSystemGlobal(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if g.Id == uuid.Nil || again.Id != g.Id {
+				t.Errorf("id %s, then %s on the next load", g.Id, again.Id)
+			}
+		})
+	}
+}
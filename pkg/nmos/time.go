@@ -0,0 +1,73 @@
+package nmos
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TAIOffset is the current TAI-UTC difference (leap seconds since 2017-01-01)
+const TAIOffset = 37 * time.Second
+
+// FormatTAI returns an NMOS "<seconds>:<nanoseconds>" TAI timestamp for t
+func FormatTAI(t time.Time) string {
+	tai := t.Add(TAIOffset)
+	return fmt.Sprintf("%d:%d", tai.Unix(), tai.Nanosecond())
+}
+
+// ParseTAI converts an NMOS TAI timestamp back to a UTC time.Time
+func ParseTAI(s string) (time.Time, error) {
+	d, err := ParseTAIDuration(s)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, 0).Add(d).Add(-TAIOffset), nil
+}
+
+// ParseTAIDuration parses a "<seconds>:<nanoseconds>" string as a duration,
+// as used by relative activations
+func ParseTAIDuration(s string) (time.Duration, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+	sec, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || sec < 0 {
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+	nsec, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || nsec < 0 || nsec > 999999999 {
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+	return time.Duration(sec)*time.Second + time.Duration(nsec), nil
+}
+
+var (
+	versionMu   sync.Mutex
+	lastVersion time.Duration
+)
+
+// NewVersion returns the current TAI time as an IS-04 resource version.
+// Versions are unique within the process and increase even if the clock
+// steps back.
+func NewVersion() string {
+	return NextVersion("")
+}
+
+// NextVersion returns a version newer than prev, the current TAI time unless
+// prev is at or ahead of it
+func NextVersion(prev string) string {
+	now := time.Duration(time.Now().Add(TAIOffset).UnixNano())
+	versionMu.Lock()
+	defer versionMu.Unlock()
+	if now <= lastVersion {
+		now = lastVersion + 1
+	}
+	if p, err := ParseTAIDuration(prev); err == nil && now <= p {
+		now = p + 1
+	}
+	lastVersion = now
+	return fmt.Sprintf("%d:%d", now/time.Second, now%time.Second)
+}
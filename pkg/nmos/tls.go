@@ -0,0 +1,84 @@
+package nmos
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// NMOSCertificate is a PEM certificate chain and its private key. BCP-003-01
+// recommends serving both an RSA and an ECDSA certificate, the one used is
+// picked from what the client supports.
+type NMOSCertificate struct {
+	CertFile string
+	KeyFile  string
+}
+
+// ParseCertificates pairs comma separated certificate and key file lists as
+// given on the command line, e.g. "rsa.crt,ecdsa.crt" and "rsa.key,ecdsa.key"
+func ParseCertificates(certFiles string, keyFiles string) ([]NMOSCertificate, error) {
+	if certFiles == "" && keyFiles == "" {
+		return nil, nil
+	}
+	certs := strings.Split(certFiles, ",")
+	keys := strings.Split(keyFiles, ",")
+	if len(certs) != len(keys) {
+		return nil, errors.New("every certificate needs a key")
+	}
+	var res []NMOSCertificate
+	for i := range certs {
+		res = append(res, NMOSCertificate{CertFile: certs[i], KeyFile: keys[i]})
+	}
+	return res, nil
+}
+
+// EnableTLS makes Start serve HTTPS with certs. It must be called before
+// Start.
+func (n *NMOSWebServer) EnableTLS(certs ...NMOSCertificate) error {
+	if len(certs) == 0 {
+		return errors.New("at least one certificate is required")
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	for _, c := range certs {
+		pair, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return err
+		}
+		cfg.Certificates = append(cfg.Certificates, pair)
+	}
+	n.tlsConfig = cfg
+	return nil
+}
+
+// Proto is the protocol advertised for the server's APIs
+func (n *NMOSWebServer) Proto() string {
+	if n.tlsConfig != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// NewHTTPClient returns a client verifying servers against the PEM CA
+// bundle in caFile, or the system roots if caFile is empty
+func NewHTTPClient(caFile string) (*http.Client, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	if caFile == "" {
+		return client, nil
+	}
+	data, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("no certificates in " + caFile)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	client.Transport = transport
+	return client, nil
+}
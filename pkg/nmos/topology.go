@@ -0,0 +1,322 @@
+package nmos
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/google/uuid"
+)
+
+// NMOSTopology is the node, device, sender and receiver tree of a registry
+type NMOSTopology struct {
+	Nodes []NMOSTopologyNode `json:"nodes"`
+	// all devices before filtering, to name peers and flows
+	all NMOSDevices
+}
+
+// NMOSTopologyNode is a node with its devices, which hold their senders,
+// receivers, sources and flows
+type NMOSTopologyNode struct {
+	NMOSNodeData
+	Devices NMOSDevices `json:"devices"`
+}
+
+// topologyDevice is a device with its resources in full, rather than the
+// id lists of IS-04
+type topologyDevice struct {
+	pNMOSDevice
+	Sources   []NMOSSource   `json:"sources"`
+	Flows     []NMOSFlow     `json:"flows"`
+	Senders   []NMOSSender   `json:"senders"`
+	Receivers []NMOSReceiver `json:"receivers"`
+}
+
+func (n NMOSTopologyNode) MarshalJSON() ([]byte, error) {
+	devices := make([]topologyDevice, 0, len(n.Devices))
+	for _, d := range n.Devices {
+		td := topologyDevice{
+			pNMOSDevice: pNMOSDevice{
+				Id:          d.Id,
+				Version:     d.Version,
+				Description: d.Description,
+				Label:       d.Label,
+				Tags:        d.Tags,
+				Type:        d.Type,
+				Node_id:     d.Node_id,
+				Controls:    d.Controls,
+			},
+			Sources:   append(make([]NMOSSource, 0), d.Sources...),
+			Flows:     append(make([]NMOSFlow, 0), d.Flows...),
+			Senders:   append(make([]NMOSSender, 0), d.Senders...),
+			Receivers: append(make([]NMOSReceiver, 0), d.Receivers...),
+		}
+		devices = append(devices, td)
+	}
+	return json.Marshal(struct {
+		NMOSNodeData
+		Devices []topologyDevice `json:"devices"`
+	}{n.NMOSNodeData, devices})
+}
+
+func (t *NMOSTopology) findNode(id uuid.UUID) *NMOSTopologyNode {
+	for i := range t.Nodes {
+		if t.Nodes[i].Id == id {
+			return &t.Nodes[i]
+		}
+	}
+	return nil
+}
+
+// devices returns the devices of all nodes, for lookups across nodes
+func (t *NMOSTopology) devices() NMOSDevices {
+	if t.all != nil {
+		return t.all
+	}
+	var res NMOSDevices
+	for _, n := range t.Nodes {
+		res = append(res, n.Devices...)
+	}
+	return res
+}
+
+// FindSender returns the sender whose id or label is ref, and its device.
+// A label shared by several senders is an error.
+func (t *NMOSTopology) FindSender(ref string) (*NMOSSender, *NMOSDevice, error) {
+	var senders []*NMOSSender
+	var devices []*NMOSDevice
+	var ids []uuid.UUID
+	for i := range t.Nodes {
+		for j := range t.Nodes[i].Devices {
+			d := &t.Nodes[i].Devices[j]
+			for k := range d.Senders {
+				if s := &d.Senders[k]; matchRef(ref, s.Id, s.Label) {
+					senders, devices, ids = append(senders, s), append(devices, d), append(ids, s.Id)
+				}
+			}
+		}
+	}
+	if err := oneMatch("sender", ref, ids); err != nil {
+		return nil, nil, err
+	}
+	return senders[0], devices[0], nil
+}
+
+// FindReceiver returns the receiver whose id or label is ref, and its
+// device. A label shared by several receivers is an error.
+func (t *NMOSTopology) FindReceiver(ref string) (*NMOSReceiver, *NMOSDevice, error) {
+	var receivers []*NMOSReceiver
+	var devices []*NMOSDevice
+	var ids []uuid.UUID
+	for i := range t.Nodes {
+		for j := range t.Nodes[i].Devices {
+			d := &t.Nodes[i].Devices[j]
+			for k := range d.Receivers {
+				if r := &d.Receivers[k]; matchRef(ref, r.Id, r.Label) {
+					receivers, devices, ids = append(receivers, r), append(devices, d), append(ids, r.Id)
+				}
+			}
+		}
+	}
+	if err := oneMatch("receiver", ref, ids); err != nil {
+		return nil, nil, err
+	}
+	return receivers[0], devices[0], nil
+}
+
+func matchRef(ref string, id uuid.UUID, label string) bool {
+	return ref == id.String() || ref == label
+}
+
+func oneMatch(kind string, ref string, ids []uuid.UUID) error {
+	switch len(ids) {
+	case 0:
+		return fmt.Errorf("no %s with id or label %q", kind, ref)
+	case 1:
+		return nil
+	}
+	names := make([]string, len(ids))
+	for i, id := range ids {
+		names[i] = id.String()
+	}
+	return fmt.Errorf("%d %ss are labelled %q, use one of their ids: %s", len(ids), kind, ref, strings.Join(names, ", "))
+}
+
+// NMOSTopologyFilter selects senders and receivers, empty fields match
+// everything
+type NMOSTopologyFilter struct {
+	// Case insensitive part of the sender, receiver, device or node label
+	Label string
+	// Format URN or its last part, e.g. video
+	Format string
+	// Transport URN or its last part, e.g. rtp.mcast. rtp matches all RTP
+	// transports.
+	Transport string
+}
+
+func (f NMOSTopologyFilter) match(labels []string, format string, transport string) bool {
+	if f.Label != "" {
+		found := false
+		for _, l := range labels {
+			if strings.Contains(strings.ToLower(l), strings.ToLower(f.Label)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.Format != "" && f.Format != format && f.Format != shortFormat(format) {
+		return false
+	}
+	if f.Transport != "" {
+		short := shortTransport(transport)
+		if f.Transport != transport && f.Transport != short && !strings.HasPrefix(short, f.Transport+".") {
+			return false
+		}
+	}
+	return true
+}
+
+// Filter returns the senders and receivers of t matching f. Nodes and
+// devices left without any are dropped.
+func (t *NMOSTopology) Filter(f NMOSTopologyFilter) *NMOSTopology {
+	if f == (NMOSTopologyFilter{}) {
+		return t
+	}
+	all := t.devices()
+	res := &NMOSTopology{Nodes: make([]NMOSTopologyNode, 0), all: all}
+	for _, n := range t.Nodes {
+		node := NMOSTopologyNode{NMOSNodeData: n.NMOSNodeData, Devices: make(NMOSDevices, 0)}
+		for _, d := range n.Devices {
+			device := d
+			device.Senders = make([]NMOSSender, 0)
+			device.Receivers = make([]NMOSReceiver, 0)
+			for _, s := range d.Senders {
+				if f.match([]string{n.Label, d.Label, s.Label}, senderFormat(all, &s), s.Transport) {
+					device.Senders = append(device.Senders, s)
+				}
+			}
+			for _, r := range d.Receivers {
+				if f.match([]string{n.Label, d.Label, r.Label}, r.Format, r.Transport) {
+					device.Receivers = append(device.Receivers, r)
+				}
+			}
+			if len(device.Senders) > 0 || len(device.Receivers) > 0 {
+				node.Devices = append(node.Devices, device)
+			}
+		}
+		if len(node.Devices) > 0 {
+			res.Nodes = append(res.Nodes, node)
+		}
+	}
+	return res
+}
+
+// WriteTree prints t as a tree, with the active subscription of each sender
+// and receiver
+func (t *NMOSTopology) WriteTree(w io.Writer) {
+	all := t.devices()
+	for _, n := range t.Nodes {
+		fmt.Fprintf(w, "node %s  %s  %s\n", n.Label, n.Id, n.Href)
+		for i, d := range n.Devices {
+			branch, indent := "├── ", "│   "
+			if i == len(n.Devices)-1 {
+				branch, indent = "└── ", "    "
+			}
+			fmt.Fprintf(w, "%sdevice %s  %s\n", branch, d.Label, d.Id)
+			count := len(d.Senders) + len(d.Receivers)
+			line := func(j int, s string) {
+				if j == count-1 {
+					fmt.Fprintf(w, "%s└── %s\n", indent, s)
+				} else {
+					fmt.Fprintf(w, "%s├── %s\n", indent, s)
+				}
+			}
+			for j, s := range d.Senders {
+				line(j, fmt.Sprintf("sender %s  %s  %s %s  %s", s.Label, s.Id,
+					shortFormat(senderFormat(all, &s)), shortTransport(s.Transport), senderSubscription(all, &s)))
+			}
+			for j, r := range d.Receivers {
+				line(len(d.Senders)+j, fmt.Sprintf("receiver %s  %s  %s %s  %s", r.Label, r.Id,
+					shortFormat(r.Format), shortTransport(r.Transport), receiverSubscription(all, &r)))
+			}
+		}
+	}
+}
+
+// WriteTable prints one row per sender and receiver
+func (t *NMOSTopology) WriteTable(w io.Writer) {
+	all := t.devices()
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NODE\tDEVICE\tTYPE\tLABEL\tID\tFORMAT\tTRANSPORT\tSUBSCRIPTION")
+	for _, n := range t.Nodes {
+		for _, d := range n.Devices {
+			for _, s := range d.Senders {
+				fmt.Fprintf(tw, "%s\t%s\tsender\t%s\t%s\t%s\t%s\t%s\n", n.Label, d.Label, s.Label, s.Id,
+					shortFormat(senderFormat(all, &s)), shortTransport(s.Transport), senderSubscription(all, &s))
+			}
+			for _, r := range d.Receivers {
+				fmt.Fprintf(tw, "%s\t%s\treceiver\t%s\t%s\t%s\t%s\t%s\n", n.Label, d.Label, r.Label, r.Id,
+					shortFormat(r.Format), shortTransport(r.Transport), receiverSubscription(all, &r))
+			}
+		}
+	}
+	tw.Flush()
+}
+
+// senderFormat is the format of the sender's flow, empty if it isn't known
+func senderFormat(all NMOSDevices, s *NMOSSender) string {
+	if f := all.FindFlow(s.Flow_id); f != nil {
+		return f.Format
+	}
+	return ""
+}
+
+func senderSubscription(all NMOSDevices, s *NMOSSender) string {
+	if !s.Subscription.Active {
+		return "inactive"
+	}
+	if s.Subscription.Receiver_id == nil {
+		return "active"
+	}
+	return "active -> " + receiverName(all, *s.Subscription.Receiver_id)
+}
+
+func receiverSubscription(all NMOSDevices, r *NMOSReceiver) string {
+	if !r.Subscription.Active {
+		return "inactive"
+	}
+	if r.Subscription.Sender_id == nil {
+		return "active"
+	}
+	return "active <- " + senderName(all, *r.Subscription.Sender_id)
+}
+
+func senderName(all NMOSDevices, id uuid.UUID) string {
+	if s := all.FindSender(id); s != nil && s.Label != "" {
+		return s.Label
+	}
+	return id.String()
+}
+
+func receiverName(all NMOSDevices, id uuid.UUID) string {
+	if r := all.FindReceiver(id); r != nil && r.Label != "" {
+		return r.Label
+	}
+	return id.String()
+}
+
+func shortFormat(format string) string {
+	if format == "" {
+		return "-"
+	}
+	return strings.TrimPrefix(format, "urn:x-nmos:format:")
+}
+
+func shortTransport(transport string) string {
+	return strings.TrimPrefix(transport, "urn:x-nmos:transport:")
+}
@@ -0,0 +1,303 @@
+package nmos
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+const (
+	TransportRTP          = "urn:x-nmos:transport:rtp"
+	TransportRTPMulticast = "urn:x-nmos:transport:rtp.mcast"
+	TransportRTPUnicast   = "urn:x-nmos:transport:rtp.ucast"
+	TransportWebSocket    = "urn:x-nmos:transport:websocket"
+	TransportMQTT         = "urn:x-nmos:transport:mqtt"
+)
+
+const (
+	DefaultRTPPort    = 5004
+	DefaultMQTTBroker = "127.0.0.1:1883"
+)
+
+// TransportHost describes where a sender or receiver lives, transports use
+// it to pick their legs and resolve "auto" parameters
+type TransportHost struct {
+	// One per interface binding
+	InterfaceIPs []string
+	// Node API port, websocket senders are served from it
+	APIPort int
+	// host:port of the MQTT broker, DefaultMQTTBroker if empty
+	MQTTBroker string
+	// IS-07 source of event senders, advertised in the ext_is_07 params
+	EventSource *uuid.UUID
+	// The API is served over TLS, websocket senders use wss
+	Secure bool
+}
+
+func (h TransportHost) mqttBroker() (string, int) {
+	broker := h.MQTTBroker
+	if broker == "" {
+		broker = DefaultMQTTBroker
+	}
+	host, port, err := net.SplitHostPort(broker)
+	if err != nil {
+		return broker, 1883
+	}
+	p, _ := strconv.Atoi(port)
+	return host, p
+}
+
+// Transport implements the IS-05 behaviour of one transport type
+type Transport interface {
+	// Type is the transport URN reported on the transporttype endpoint
+	Type() string
+	// Legs returns the number of legs a resource bound to n interfaces has
+	Legs(n int) int
+	SenderLeg(host TransportHost, leg int) (NMOSConstraints, NMOSTransportParams)
+	ReceiverLeg(host TransportHost, leg int) (NMOSConstraints, NMOSTransportParams)
+	// Resolve* replace "auto" values of one leg in place
+	ResolveSender(host TransportHost, id uuid.UUID, leg int, p NMOSTransportParams)
+	ResolveReceiver(host TransportHost, id uuid.UUID, leg int, p NMOSTransportParams)
+}
+
+var transports = map[string]Transport{
+	TransportRTP:       rtpTransport{},
+	TransportWebSocket: websocketTransport{},
+	TransportMQTT:      mqttTransport{},
+}
+
+// TransportFor returns the transport of a sender or receiver transport URN.
+// Subclassifications like rtp.mcast use their base transport, an empty URN
+// is treated as RTP.
+func TransportFor(urn string) (Transport, error) {
+	if urn == "" {
+		urn = TransportRTP
+	}
+	if t, ok := transports[urn]; ok {
+		return t, nil
+	}
+	if i := strings.LastIndex(urn, "."); i > 0 {
+		if t, ok := transports[urn[:i]]; ok {
+			return t, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported transport %s", urn)
+}
+
+func resolveAuto(p NMOSTransportParams, key string, v interface{}) {
+	if p[key] == "auto" {
+		p[key] = v
+	}
+}
+
+// MulticastAddress derives a stable administratively scoped multicast group
+// from a resource id and leg index
+func MulticastAddress(id uuid.UUID, leg int) string {
+	n := binary.BigEndian.Uint16(id[14:16])
+	return net.IPv4(239, byte(leg+1), byte(n>>8), byte(n)).String()
+}
+
+type rtpTransport struct{}
+
+func (rtpTransport) Type() string { return TransportRTP }
+
+// Legs gives RTP one leg per interface for ST 2022-7 redundancy
+func (rtpTransport) Legs(n int) int { return n }
+
+func (rtpTransport) SenderLeg(host TransportHost, leg int) (NMOSConstraints, NMOSTransportParams) {
+	enum := make([]interface{}, 0)
+	for _, ip := range host.InterfaceIPs {
+		enum = append(enum, ip)
+	}
+	constraints := NMOSConstraints{
+		"source_ip":        {Enum: enum},
+		"destination_ip":   {},
+		"source_port":      {},
+		"destination_port": {},
+		"rtp_enabled":      {},
+	}
+	params := NMOSTransportParams{
+		"source_ip":        "auto",
+		"destination_ip":   "auto",
+		"source_port":      "auto",
+		"destination_port": "auto",
+		"rtp_enabled":      true,
+	}
+	return constraints, params
+}
+
+func (rtpTransport) ReceiverLeg(host TransportHost, leg int) (NMOSConstraints, NMOSTransportParams) {
+	constraints := NMOSConstraints{
+		"source_ip":        {},
+		"multicast_ip":     {},
+		"interface_ip":     {Enum: []interface{}{host.InterfaceIPs[leg]}},
+		"destination_port": {},
+		"rtp_enabled":      {},
+	}
+	params := NMOSTransportParams{
+		"source_ip":        nil,
+		"multicast_ip":     nil,
+		"interface_ip":     "auto",
+		"destination_port": "auto",
+		"rtp_enabled":      true,
+	}
+	return constraints, params
+}
+
+func (rtpTransport) ResolveSender(host TransportHost, id uuid.UUID, leg int, p NMOSTransportParams) {
+	resolveAuto(p, "source_ip", host.InterfaceIPs[leg])
+	resolveAuto(p, "destination_ip", MulticastAddress(id, leg))
+	resolveAuto(p, "source_port", DefaultRTPPort)
+	resolveAuto(p, "destination_port", DefaultRTPPort)
+}
+
+func (rtpTransport) ResolveReceiver(host TransportHost, id uuid.UUID, leg int, p NMOSTransportParams) {
+	resolveAuto(p, "interface_ip", host.InterfaceIPs[leg])
+	resolveAuto(p, "destination_port", DefaultRTPPort)
+}
+
+type websocketTransport struct{}
+
+func (websocketTransport) Type() string { return TransportWebSocket }
+
+func (websocketTransport) Legs(n int) int { return 1 }
+
+func (websocketTransport) SenderLeg(host TransportHost, leg int) (NMOSConstraints, NMOSTransportParams) {
+	constraints := NMOSConstraints{
+		"connection_uri":           {},
+		"connection_authorization": {},
+		"ext_is_07_source_id":      {},
+		"ext_is_07_rest_api_url":   {},
+	}
+	params := NMOSTransportParams{
+		"connection_uri":           "auto",
+		"connection_authorization": "auto",
+		"ext_is_07_source_id":      "auto",
+		"ext_is_07_rest_api_url":   "auto",
+	}
+	return constraints, params
+}
+
+func (websocketTransport) ReceiverLeg(host TransportHost, leg int) (NMOSConstraints, NMOSTransportParams) {
+	constraints := NMOSConstraints{
+		"connection_uri":           {},
+		"connection_authorization": {},
+		"ext_is_07_source_id":      {},
+		"ext_is_07_rest_api_url":   {},
+	}
+	params := NMOSTransportParams{
+		"connection_uri":           nil,
+		"connection_authorization": "auto",
+		"ext_is_07_source_id":      nil,
+		"ext_is_07_rest_api_url":   nil,
+	}
+	return constraints, params
+}
+
+// ResolveSender points the sender at the node's event websocket
+func (websocketTransport) ResolveSender(host TransportHost, id uuid.UUID, leg int, p NMOSTransportParams) {
+	base := fmt.Sprintf("%s:%d/x-nmos/events/v1.0", host.InterfaceIPs[leg], host.APIPort)
+	ws, rest := "ws://", "http://"
+	if host.Secure {
+		ws, rest = "wss://", "https://"
+	}
+	resolveAuto(p, "connection_uri", ws+base+"/ws")
+	resolveAuto(p, "connection_authorization", false)
+	if host.EventSource != nil {
+		resolveAuto(p, "ext_is_07_source_id", host.EventSource.String())
+		resolveAuto(p, "ext_is_07_rest_api_url", fmt.Sprintf("%s%s/sources/%s/", rest, base, host.EventSource))
+	} else {
+		resolveAuto(p, "ext_is_07_source_id", nil)
+		resolveAuto(p, "ext_is_07_rest_api_url", nil)
+	}
+}
+
+func (websocketTransport) ResolveReceiver(host TransportHost, id uuid.UUID, leg int, p NMOSTransportParams) {
+	resolveAuto(p, "connection_authorization", false)
+}
+
+type mqttTransport struct{}
+
+func (mqttTransport) Type() string { return TransportMQTT }
+
+func (mqttTransport) Legs(n int) int { return 1 }
+
+var mqttProtocols = []interface{}{"mqtt", "secure-mqtt"}
+
+func (mqttTransport) SenderLeg(host TransportHost, leg int) (NMOSConstraints, NMOSTransportParams) {
+	constraints := NMOSConstraints{
+		"source_host":                    {},
+		"source_port":                    {},
+		"destination_host":               {},
+		"destination_port":               {},
+		"broker_protocol":                {Enum: mqttProtocols},
+		"broker_authorization":           {},
+		"broker_topic":                   {},
+		"connection_status_broker_topic": {},
+	}
+	params := NMOSTransportParams{
+		"source_host":                    "auto",
+		"source_port":                    "auto",
+		"destination_host":               "auto",
+		"destination_port":               "auto",
+		"broker_protocol":                "auto",
+		"broker_authorization":           "auto",
+		"broker_topic":                   nil,
+		"connection_status_broker_topic": nil,
+	}
+	return constraints, params
+}
+
+func (mqttTransport) ReceiverLeg(host TransportHost, leg int) (NMOSConstraints, NMOSTransportParams) {
+	constraints := NMOSConstraints{
+		"source_host":                    {},
+		"source_port":                    {},
+		"interface_ip":                   {Enum: []interface{}{host.InterfaceIPs[leg]}},
+		"broker_protocol":                {Enum: mqttProtocols},
+		"broker_authorization":           {},
+		"broker_topic":                   {},
+		"connection_status_broker_topic": {},
+	}
+	params := NMOSTransportParams{
+		"source_host":                    "auto",
+		"source_port":                    "auto",
+		"interface_ip":                   "auto",
+		"broker_protocol":                "auto",
+		"broker_authorization":           "auto",
+		"broker_topic":                   nil,
+		"connection_status_broker_topic": nil,
+	}
+	return constraints, params
+}
+
+// ResolveSender publishes to the configured broker on a per sender topic
+// unless told otherwise
+func (mqttTransport) ResolveSender(host TransportHost, id uuid.UUID, leg int, p NMOSTransportParams) {
+	brokerHost, brokerPort := host.mqttBroker()
+	resolveAuto(p, "source_host", host.InterfaceIPs[leg])
+	// the client port is picked by the OS
+	resolveAuto(p, "source_port", 0)
+	resolveAuto(p, "destination_host", brokerHost)
+	resolveAuto(p, "destination_port", brokerPort)
+	resolveAuto(p, "broker_protocol", "mqtt")
+	resolveAuto(p, "broker_authorization", false)
+	if p["broker_topic"] == nil {
+		p["broker_topic"] = fmt.Sprintf("x-nmos/events/1.0/%s", id)
+	}
+	if p["connection_status_broker_topic"] == nil {
+		p["connection_status_broker_topic"] = fmt.Sprintf("x-nmos/events/1.0/%s/connection_status", id)
+	}
+}
+
+func (mqttTransport) ResolveReceiver(host TransportHost, id uuid.UUID, leg int, p NMOSTransportParams) {
+	brokerHost, brokerPort := host.mqttBroker()
+	resolveAuto(p, "source_host", brokerHost)
+	resolveAuto(p, "source_port", brokerPort)
+	resolveAuto(p, "interface_ip", host.InterfaceIPs[leg])
+	resolveAuto(p, "broker_protocol", "mqtt")
+	resolveAuto(p, "broker_authorization", false)
+}
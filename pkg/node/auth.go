@@ -0,0 +1,72 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+	"github.com/thyge/gonmos/pkg/nmos"
+)
+
+// DiscoverAuth browses for an IS-10 authorization server and returns its
+// base URL, empty if none is found within timeout
+func (a *NMOSNode) DiscoverAuth(timeout time.Duration) string {
+	resolver, err := zeroconf.NewResolver(nil)
+	if err != nil {
+		nmos.Errorln("Failed to initialize resolver:", err.Error())
+		return ""
+	}
+	entries := make(chan *zeroconf.ServiceEntry)
+	ctx, cancel := context.WithTimeout(a.Ctx, timeout)
+	defer cancel()
+	if err := resolver.Browse(ctx, "_nmos-auth._tcp", "local", entries); err != nil {
+		nmos.Errorln("Failed to browse:", err.Error())
+		return ""
+	}
+	for {
+		select {
+		case entry, ok := <-entries:
+			if !ok {
+				return ""
+			}
+			if len(entry.AddrIPv4) == 0 {
+				continue
+			}
+			proto := nmos.MdnsTextValue(entry.Text, "api_proto", "http")
+			return fmt.Sprintf("%s://%s:%d", proto, entry.AddrIPv4[0], entry.Port)
+		case <-ctx.Done():
+			return ""
+		}
+	}
+}
+
+// setupAuth prepares the token client when the registry requires auth. A
+// preconfigured AuthClient is used as is, apart from discovering the
+// server if it has no ServerURI. txt is the mDNS TXT record of the
+// registry.
+func (a *NMOSNode) setupAuth(txt []string) {
+	if a.AuthClient == nil {
+		if nmos.MdnsTextValue(txt, "api_auth", "false") != "true" {
+			return
+		}
+		node, _ := a.Snapshot()
+		a.AuthClient = &nmos.NMOSAuthClient{ClientName: node.Label}
+	}
+	if a.AuthClient.HTTPClient == nil {
+		a.AuthClient.HTTPClient = a.httpClient()
+	}
+	if a.AuthClient.Scope == "" {
+		a.AuthClient.Scope = "registration"
+	}
+	if a.AuthClient.ServerURI == "" {
+		a.AuthClient.ServerURI = a.DiscoverAuth(5 * time.Second)
+		if a.AuthClient.ServerURI == "" {
+			nmos.Errorln("registry requires auth but no authorization server was found")
+			return
+		}
+	}
+	if _, err := a.AuthClient.Token(); err != nil {
+		nmos.Errorln("failed to get token", err)
+	}
+}
@@ -0,0 +1,708 @@
+package node
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/thyge/gonmos/pkg/nmos"
+	"gopkg.in/yaml.v3"
+)
+
+const defaultPort = 8889
+
+// NMOSNodeConfig describes a node and its devices. It is read from YAML or
+// JSON by LoadConfig. Resources without an id get a stable one derived from
+// the node key and their label, and keep it when renamed, see SaveState.
+// Flows and senders refer to their source and flow by id or label, e.g.
+//
+//	label: studio-a
+//	port: 8889
+//	interfaces: [eth0]
+//	registry:
+//	  url: https://registry:8443
+//	devices:
+//	  - id: 0b7a5c2e-60f1-4e5b-8d43-7c5d1f7e9a10
+//	    label: Camera 1
+//	    sources:
+//	      - label: Camera 1
+//	        format: urn:x-nmos:format:video
+//	    flows:
+//	      - label: Camera 1
+//	        source: Camera 1
+//	        media_type: video/raw
+//	    senders:
+//	      - label: Camera 1
+//	        flow: Camera 1
+//	        transport: urn:x-nmos:transport:rtp.mcast
+//	        constraints:
+//	          - destination_port: {minimum: 5000, maximum: 5099}
+//	        transport_params:
+//	          - destination_port: 5004
+type NMOSNodeConfig struct {
+	Id uuid.UUID `yaml:"id"`
+	// Ids not set are derived from the key, a random key is kept in
+	// <config>.state if empty
+	Key         string `yaml:"key"`
+	Label       string `yaml:"label"`
+	Description string `yaml:"description"`
+	// Node API port, 8889 if not set
+	Port int `yaml:"port"`
+	// Network interfaces to advertise, all if empty
+	Interfaces []string           `yaml:"interfaces"`
+	Registry   NMOSRegistryConfig `yaml:"registry"`
+	// host:port of the broker of MQTT senders and receivers,
+	// 127.0.0.1:1883 if empty
+	MQTT_broker string             `yaml:"mqtt_broker"`
+	Devices     []NMOSDeviceConfig `yaml:"devices"`
+
+	file  string
+	root  *yaml.Node
+	state *configState
+}
+
+type NMOSRegistryConfig struct {
+	// Registration API base URL, found over mDNS if empty
+	URL string `yaml:"url"`
+	// The registry requires IS-10 tokens
+	Auth bool `yaml:"auth"`
+	// PEM CA bundle to verify the registry with
+	CA string `yaml:"ca"`
+}
+
+type NMOSDeviceConfig struct {
+	Id          uuid.UUID `yaml:"id"`
+	Label       string    `yaml:"label"`
+	Description string    `yaml:"description"`
+	// urn:x-nmos:device:generic if not set
+	Type string `yaml:"type"`
+	// Other control APIs of the device, the node's own are added
+	Controls  []nmos.NMOSControl   `yaml:"controls"`
+	Sources   []NMOSSourceConfig   `yaml:"sources"`
+	Flows     []NMOSFlowConfig     `yaml:"flows"`
+	Senders   []NMOSSenderConfig   `yaml:"senders"`
+	Receivers []NMOSReceiverConfig `yaml:"receivers"`
+}
+
+type NMOSSourceConfig struct {
+	Id          uuid.UUID          `yaml:"id"`
+	Label       string             `yaml:"label"`
+	Description string             `yaml:"description"`
+	Format      string             `yaml:"format"`
+	Grain_rate  *nmos.NMOSRational `yaml:"grain_rate"`
+	Channels    []nmos.NMOSChannel `yaml:"channels"`
+	Event_type  string             `yaml:"event_type"`
+	Events      *NMOSEventsConfig  `yaml:"events"`
+}
+
+// NMOSEventsConfig is the IS-07 type and initial state of an event source.
+// Sources with an event_type but no events config get the base type and its
+// zero value.
+type NMOSEventsConfig struct {
+	Type    nmos.NMOSEventType `yaml:"type"`
+	Initial interface{}        `yaml:"initial"`
+}
+
+// NMOSFlowConfig takes its format and event type from its source
+type NMOSFlowConfig struct {
+	Id          uuid.UUID `yaml:"id"`
+	Label       string    `yaml:"label"`
+	Description string    `yaml:"description"`
+	// Id or label of a source on the device
+	Source     string             `yaml:"source"`
+	Media_type string             `yaml:"media_type"`
+	Grain_rate *nmos.NMOSRational `yaml:"grain_rate"`
+	// Raw video
+	Frame_width             int                  `yaml:"frame_width"`
+	Frame_height            int                  `yaml:"frame_height"`
+	Interlace_mode          string               `yaml:"interlace_mode"`
+	Colorspace              string               `yaml:"colorspace"`
+	Transfer_characteristic string               `yaml:"transfer_characteristic"`
+	Components              []nmos.NMOSComponent `yaml:"components"`
+	// Raw audio
+	Sample_rate *nmos.NMOSRational `yaml:"sample_rate"`
+	Bit_depth   int                `yaml:"bit_depth"`
+
+	source uuid.UUID
+}
+
+type NMOSSenderConfig struct {
+	Id          uuid.UUID `yaml:"id"`
+	Label       string    `yaml:"label"`
+	Description string    `yaml:"description"`
+	// Id or label of a flow on the device
+	Flow      string `yaml:"flow"`
+	Transport string `yaml:"transport"`
+	// Interface bindings, one leg each
+	Interfaces []string `yaml:"interfaces"`
+
+	NMOSLegsConfig `yaml:",inline"`
+
+	flow uuid.UUID
+}
+
+type NMOSReceiverConfig struct {
+	Id          uuid.UUID `yaml:"id"`
+	Label       string    `yaml:"label"`
+	Description string    `yaml:"description"`
+	Format      string    `yaml:"format"`
+	Transport   string    `yaml:"transport"`
+	// Interface bindings, one leg each
+	Interfaces []string `yaml:"interfaces"`
+	// Media types and BCP-004-01 constraint sets the receiver accepts, as
+	// in the receiver resource
+	Caps map[string]interface{} `yaml:"caps"`
+
+	NMOSLegsConfig `yaml:",inline"`
+}
+
+// NMOSLegsConfig are the IS-05 constraints and initial transport
+// parameters of each leg of a sender or receiver, as in the Connection
+// API. They replace the transport's own.
+type NMOSLegsConfig struct {
+	Constraints      []map[string]interface{} `yaml:"constraints"`
+	Transport_params []map[string]interface{} `yaml:"transport_params"`
+}
+
+// NMOSLegs converts the legs to what the JSON APIs would have decoded
+func (lc NMOSLegsConfig) NMOSLegs() ([]nmos.NMOSConstraints, []nmos.NMOSTransportParams, error) {
+	var constraints []nmos.NMOSConstraints
+	var params []nmos.NMOSTransportParams
+	if err := jsonConvert(lc.Constraints, &constraints); err != nil {
+		return nil, nil, fmt.Errorf("constraints: %v", err)
+	}
+	if err := jsonConvert(lc.Transport_params, &params); err != nil {
+		return nil, nil, fmt.Errorf("transport_params: %v", err)
+	}
+	return constraints, params, nil
+}
+
+// jsonConvert decodes the JSON of v into out, rejecting unknown fields
+func jsonConvert(v interface{}, out interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(out)
+}
+
+// NMOSCaps converts the caps to what the JSON APIs would have decoded
+func (rc NMOSReceiverConfig) NMOSCaps() (nmos.NMOSCapabilities, error) {
+	var caps nmos.NMOSCapabilities
+	if rc.Caps == nil {
+		return caps, nil
+	}
+	data, err := json.Marshal(rc.Caps)
+	if err != nil {
+		return caps, err
+	}
+	err = json.Unmarshal(data, &caps)
+	return caps, err
+}
+
+// NMOSConfigError is a problem at a line of a config file, Line is 0 if it
+// isn't known
+type NMOSConfigError struct {
+	File string `json:"file"`
+	Line int    `json:"line,omitempty"`
+	Msg  string `json:"message"`
+}
+
+func (e *NMOSConfigError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("%s: %s", e.File, e.Msg)
+	}
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
+}
+
+// NMOSConfigErrors are all problems found in a config file
+type NMOSConfigErrors []*NMOSConfigError
+
+func (es NMOSConfigErrors) Error() string {
+	msgs := make([]string, len(es))
+	for i, e := range es {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// LoadConfig reads and validates a YAML or JSON node config. Errors in the
+// file are returned as NMOSConfigErrors.
+func LoadConfig(file string) (*NMOSNodeConfig, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(file, data)
+}
+
+// ParseConfig is LoadConfig for data read from file
+func ParseConfig(file string, data []byte) (*NMOSNodeConfig, error) {
+	state, err := loadConfigState(file)
+	if err != nil {
+		return nil, err
+	}
+	c := &NMOSNodeConfig{file: file, root: &yaml.Node{}, state: state}
+	if err := yaml.Unmarshal(data, c.root); err != nil {
+		return nil, c.yamlError(err)
+	}
+	if errs := c.checkIds(c.root); len(errs) > 0 {
+		return nil, errs
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil {
+		return nil, c.yamlError(err)
+	}
+	if c.Port == 0 {
+		c.Port = defaultPort
+	}
+	if errs := c.validate(); len(errs) > 0 {
+		return nil, errs
+	}
+	return c, nil
+}
+
+// SaveState keeps the node key and the ids derived for the config in
+// <config>.state, call it once the config is in use so renamed resources
+// keep their ids
+func (c *NMOSNodeConfig) SaveState() error {
+	return c.state.save()
+}
+
+var yamlLine = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// yamlError turns the line prefixed messages of the yaml package into
+// NMOSConfigErrors
+func (c *NMOSNodeConfig) yamlError(err error) error {
+	var msgs []string
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		msgs = typeErr.Errors
+	} else {
+		msgs = []string{err.Error()}
+	}
+	var errs NMOSConfigErrors
+	for _, msg := range msgs {
+		e := &NMOSConfigError{File: c.file, Msg: strings.TrimPrefix(msg, "yaml: ")}
+		if m := yamlLine.FindStringSubmatch(msg); m != nil {
+			e.Line, _ = strconv.Atoi(m[1])
+			e.Msg = m[2]
+		}
+		errs = append(errs, e)
+	}
+	return errs
+}
+
+// checkIds checks the ids on the node tree before decoding, uuid.UUID
+// decoding errors don't carry a line
+func (c *NMOSNodeConfig) checkIds(n *yaml.Node) NMOSConfigErrors {
+	var errs NMOSConfigErrors
+	if n.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k, v := n.Content[i], n.Content[i+1]
+			if k.Value == "id" && v.Kind == yaml.ScalarNode && v.Tag != "!!null" {
+				if _, err := uuid.Parse(v.Value); err != nil {
+					errs = append(errs, &NMOSConfigError{File: c.file, Line: v.Line, Msg: fmt.Sprintf("invalid id %q", v.Value)})
+				}
+			}
+		}
+	}
+	for _, child := range n.Content {
+		errs = append(errs, c.checkIds(child)...)
+	}
+	return errs
+}
+
+// line returns the line of the value at path, given as map keys and
+// sequence indexes, or of its closest parent in the file
+func (c *NMOSNodeConfig) line(path ...interface{}) int {
+	n := c.root
+	if n == nil {
+		return 0
+	}
+	if n.Kind == yaml.DocumentNode && len(n.Content) > 0 {
+		n = n.Content[0]
+	}
+	for _, p := range path {
+		var next *yaml.Node
+		switch p := p.(type) {
+		case string:
+			if n.Kind == yaml.MappingNode {
+				for i := 0; i+1 < len(n.Content); i += 2 {
+					if n.Content[i].Value == p {
+						next = n.Content[i+1]
+						break
+					}
+				}
+			}
+		case int:
+			if n.Kind == yaml.SequenceNode && p < len(n.Content) {
+				next = n.Content[p]
+			}
+		}
+		if next == nil {
+			break
+		}
+		n = next
+	}
+	return n.Line
+}
+
+// validate checks references and required fields, ids must be unique
+// across the file. Missing ids are taken from the state or derived from the
+// key and labels.
+func (c *NMOSNodeConfig) validate() NMOSConfigErrors {
+	var errs NMOSConfigErrors
+	fail := func(path []interface{}, format string, args ...interface{}) {
+		errs = append(errs, &NMOSConfigError{File: c.file, Line: c.line(path...), Msg: fmt.Sprintf(format, args...)})
+	}
+	at := func(path ...interface{}) []interface{} {
+		return path
+	}
+	ids := make(map[uuid.UUID]bool)
+	key := c.Key
+	if key == "" {
+		key = c.state.Key
+	}
+	checkId := func(path []interface{}, id *uuid.UUID, label string, scope uuid.UUID, kind string, index int, labels []string) {
+		derived := false
+		if *id == uuid.Nil {
+			if label == "" {
+				fail(path, "id or label is required")
+				return
+			}
+			*id = c.state.id(key, stateResource{Scope: scope, Kind: kind, Index: index, Label: label}, labels)
+			derived = true
+		}
+		if ids[*id] {
+			if derived {
+				fail(append(path, "label"), "duplicate %s label %q, set an id", kind, label)
+			} else {
+				fail(append(path, "id"), "duplicate id %s", *id)
+			}
+		}
+		ids[*id] = true
+	}
+	if c.Port < 0 || c.Port > 65535 {
+		fail(at("port"), "invalid port %d", c.Port)
+	}
+	if c.Id == uuid.Nil {
+		c.Id = nmos.StableID(key, "node")
+	}
+	ids[c.Id] = true
+	if len(c.Devices) == 0 {
+		fail(at("devices"), "at least one device is required")
+	}
+	labels := func(n int, label func(int) string) []string {
+		l := make([]string, n)
+		for i := range l {
+			l[i] = label(i)
+		}
+		return l
+	}
+	deviceLabels := labels(len(c.Devices), func(i int) string { return c.Devices[i].Label })
+	for di := range c.Devices {
+		d := &c.Devices[di]
+		dp := at("devices", di)
+		checkId(dp, &d.Id, d.Label, c.Id, "device", di, deviceLabels)
+		for i, ctl := range d.Controls {
+			if ctl.Type == "" {
+				fail(append(dp[:2:2], "controls", i), "control type is required")
+			}
+		}
+		sourceLabels := labels(len(d.Sources), func(i int) string { return d.Sources[i].Label })
+		flowLabels := labels(len(d.Flows), func(i int) string { return d.Flows[i].Label })
+		senderLabels := labels(len(d.Senders), func(i int) string { return d.Senders[i].Label })
+		receiverLabels := labels(len(d.Receivers), func(i int) string { return d.Receivers[i].Label })
+		for i := range d.Sources {
+			s := &d.Sources[i]
+			p := append(dp[:2:2], "sources", i)
+			checkId(p, &s.Id, s.Label, d.Id, "source", i, sourceLabels)
+			switch s.Format {
+			case nmos.FormatVideo, nmos.FormatAudio, nmos.FormatData, nmos.FormatMux:
+			default:
+				fail(append(p, "format"), "unknown format %q", s.Format)
+			}
+			if s.Events != nil && s.Event_type == "" {
+				fail(append(p, "events"), "events requires an event_type")
+			}
+		}
+		for i := range d.Flows {
+			f := &d.Flows[i]
+			p := append(dp[:2:2], "flows", i)
+			checkId(p, &f.Id, f.Label, d.Id, "flow", i, flowLabels)
+			if f.source = d.findSource(f.Source); f.source == uuid.Nil {
+				fail(append(p, "source"), "no source %q on this device", f.Source)
+			}
+			if f.Media_type == "" {
+				fail(p, "media_type is required")
+			}
+		}
+		for i := range d.Senders {
+			s := &d.Senders[i]
+			p := append(dp[:2:2], "senders", i)
+			checkId(p, &s.Id, s.Label, d.Id, "sender", i, senderLabels)
+			if s.flow = d.findFlow(s.Flow); s.flow == uuid.Nil {
+				fail(append(p, "flow"), "no flow %q on this device", s.Flow)
+			}
+			if t, err := nmos.TransportFor(s.Transport); err != nil {
+				fail(append(p, "transport"), "%v", err)
+			} else {
+				c.checkLegs(p, s.NMOSLegsConfig, s.Interfaces, t.SenderLeg, t.Legs, fail)
+			}
+		}
+		for i := range d.Receivers {
+			r := &d.Receivers[i]
+			p := append(dp[:2:2], "receivers", i)
+			checkId(p, &r.Id, r.Label, d.Id, "receiver", i, receiverLabels)
+			switch r.Format {
+			case nmos.FormatVideo, nmos.FormatAudio, nmos.FormatData, nmos.FormatMux:
+			default:
+				fail(append(p, "format"), "unknown format %q", r.Format)
+			}
+			if t, err := nmos.TransportFor(r.Transport); err != nil {
+				fail(append(p, "transport"), "%v", err)
+			} else {
+				c.checkLegs(p, r.NMOSLegsConfig, r.Interfaces, t.ReceiverLeg, t.Legs, fail)
+			}
+			caps, err := r.NMOSCaps()
+			if err != nil {
+				fail(append(p, "caps"), "%v", err)
+			} else if caps.Constraint_sets != nil {
+				if err := (nmos.NMOSConstraintSets{Constraint_sets: caps.Constraint_sets}).Validate(); err != nil {
+					fail(append(p, "caps", "constraint_sets"), "%v", err)
+				}
+			}
+		}
+	}
+	return errs
+}
+
+// checkLegs checks the configured legs of a sender or receiver at path
+// against the legs of its transport. Interface addresses are those of
+// this host.
+func (c *NMOSNodeConfig) checkLegs(path []interface{}, lc NMOSLegsConfig, interfaces []string,
+	leg func(nmos.TransportHost, int) (nmos.NMOSConstraints, nmos.NMOSTransportParams), legs func(int) int,
+	fail func([]interface{}, string, ...interface{})) {
+	at := func(elem ...interface{}) []interface{} {
+		return append(path[:len(path):len(path)], elem...)
+	}
+	var constraints []nmos.NMOSConstraints
+	if err := jsonConvert(lc.Constraints, &constraints); err != nil {
+		fail(at("constraints"), "%v", err)
+		return
+	}
+	var params []nmos.NMOSTransportParams
+	if err := jsonConvert(lc.Transport_params, &params); err != nil {
+		fail(at("transport_params"), "%v", err)
+		return
+	}
+	// without interfaces the node's address is used, set them to configure
+	// source_ip or interface_ip
+	var host nmos.TransportHost
+	for _, name := range interfaces {
+		host.InterfaceIPs = append(host.InterfaceIPs, nmos.InterfaceIP(name))
+	}
+	if len(host.InterfaceIPs) == 0 {
+		host.InterfaceIPs = []string{""}
+	}
+	n := legs(len(host.InterfaceIPs))
+	if len(constraints) > n {
+		fail(at("constraints"), "%d legs given, the transport has %d", len(constraints), n)
+		return
+	}
+	if len(params) > n {
+		fail(at("transport_params"), "%d legs given, the transport has %d", len(params), n)
+		return
+	}
+	for i := 0; i < n; i++ {
+		lcs, lps := leg(host, i)
+		if i < len(constraints) {
+			if err := nmos.ConfigureLeg(lcs, lps, constraints[i], nil); err != nil {
+				fail(at("constraints", i), "%v", err)
+				continue
+			}
+		}
+		if i < len(params) {
+			if err := nmos.ConfigureLeg(lcs, lps, nil, params[i]); err != nil {
+				fail(at("transport_params", i), "%v", err)
+			}
+		}
+	}
+}
+
+// findSource returns the id of the source ref names by id or label
+func (d *NMOSDeviceConfig) findSource(ref string) uuid.UUID {
+	for _, s := range d.Sources {
+		if s.Id.String() == ref || s.Label == ref {
+			return s.Id
+		}
+	}
+	return uuid.Nil
+}
+
+// findFlow returns the id of the flow ref names by id or label
+func (d *NMOSDeviceConfig) findFlow(ref string) uuid.UUID {
+	for _, f := range d.Flows {
+		if f.Id.String() == ref || f.Label == ref {
+			return f.Id
+		}
+	}
+	return uuid.Nil
+}
+
+// Configure applies the node and registry settings to a, call it before
+// Start. Start then reloads the config when it changes.
+func (c *NMOSNodeConfig) Configure(a *NMOSNode) {
+	a.Id = c.Id
+	a.ConfigFile = c.file
+	a.Label = c.Label
+	a.Description = c.Description
+	a.Interfaces = c.Interfaces
+	a.Registry = c.Registry.URL
+	a.MQTTBroker = c.MQTT_broker
+	if c.Registry.CA != "" {
+		a.CAFile = c.Registry.CA
+	}
+	if c.Registry.Auth && a.AuthClient == nil {
+		a.AuthClient = &nmos.NMOSAuthClient{ClientName: c.Label}
+	}
+}
+
+// BuildDevices builds the devices to pass to Start
+func (c *NMOSNodeConfig) BuildDevices() ([]*nmos.NMOSDevice, error) {
+	var devices []*nmos.NMOSDevice
+	for di, dc := range c.Devices {
+		d := &nmos.NMOSDevice{
+			Id:          dc.Id,
+			Description: dc.Description,
+			Label:       dc.Label,
+			Tags:        nmos.NMOSTags{},
+			Type:        dc.Type,
+			Senders:     make([]nmos.NMOSSender, 0),
+			Receivers:   make([]nmos.NMOSReceiver, 0),
+			Controls:    append([]nmos.NMOSControl{}, dc.Controls...),
+		}
+		if d.Type == "" {
+			d.Type = "urn:x-nmos:device:generic"
+		}
+		for i, sc := range dc.Sources {
+			s := nmos.NMOSSource{
+				Id:          sc.Id,
+				Description: sc.Description,
+				Label:       sc.Label,
+				Tags:        nmos.NMOSTags{},
+				Format:      sc.Format,
+				Device_id:   d.Id,
+				Parents:     make([]uuid.UUID, 0),
+				Grain_rate:  sc.Grain_rate,
+				Channels:    sc.Channels,
+				Event_type:  sc.Event_type,
+			}
+			if s.Event_type != "" {
+				events := sc.Events
+				if events == nil {
+					events = &NMOSEventsConfig{}
+				}
+				if events.Type.Type == "" {
+					events.Type.Type = strings.SplitN(s.Event_type, "/", 2)[0]
+				}
+				initial := events.Initial
+				if initial == nil {
+					initial = zeroEvent(events.Type.Type)
+				}
+				if err := s.InitEvents(events.Type, initial); err != nil {
+					return nil, &NMOSConfigError{File: c.file, Line: c.line("devices", di, "sources", i, "events"), Msg: err.Error()}
+				}
+			}
+			d.Sources = append(d.Sources, s)
+		}
+		for _, fc := range dc.Flows {
+			source := d.FindSource(fc.source)
+			d.Flows = append(d.Flows, nmos.NMOSFlow{
+				Id:                      fc.Id,
+				Description:             fc.Description,
+				Label:                   fc.Label,
+				Tags:                    nmos.NMOSTags{},
+				Format:                  source.Format,
+				Source_id:               source.Id,
+				Device_id:               d.Id,
+				Parents:                 make([]uuid.UUID, 0),
+				Grain_rate:              fc.Grain_rate,
+				Media_type:              fc.Media_type,
+				Frame_width:             fc.Frame_width,
+				Frame_height:            fc.Frame_height,
+				Interlace_mode:          fc.Interlace_mode,
+				Colorspace:              fc.Colorspace,
+				Transfer_characteristic: fc.Transfer_characteristic,
+				Components:              fc.Components,
+				Sample_rate:             fc.Sample_rate,
+				Bit_depth:               fc.Bit_depth,
+				Event_type:              source.Event_type,
+			})
+		}
+		for _, sc := range dc.Senders {
+			constraints, params, err := sc.NMOSLegs()
+			if err != nil {
+				return nil, err
+			}
+			d.Senders = append(d.Senders, nmos.NMOSSender{
+				Id:                 sc.Id,
+				Description:        sc.Description,
+				Label:              sc.Label,
+				Tags:               nmos.NMOSTags{},
+				Flow_id:            sc.flow,
+				Transport:          sc.Transport,
+				Device_id:          d.Id,
+				Interface_bindings: append(make([]string, 0), sc.Interfaces...),
+				Constraints:        constraints,
+				TransportParams:    params,
+			})
+		}
+		for _, rc := range dc.Receivers {
+			caps, err := rc.NMOSCaps()
+			if err != nil {
+				return nil, err
+			}
+			constraints, params, err := rc.NMOSLegs()
+			if err != nil {
+				return nil, err
+			}
+			d.Receivers = append(d.Receivers, nmos.NMOSReceiver{
+				Id:                 rc.Id,
+				Description:        rc.Description,
+				Label:              rc.Label,
+				Tags:               nmos.NMOSTags{},
+				Format:             rc.Format,
+				Caps:               caps,
+				Device_id:          d.Id,
+				Transport:          rc.Transport,
+				Interface_bindings: append(make([]string, 0), rc.Interfaces...),
+				Constraints:        constraints,
+				TransportParams:    params,
+			})
+		}
+		devices = append(devices, d)
+	}
+	return devices, nil
+}
+
+// zeroEvent is the initial state of an event source of base type t
+func zeroEvent(t string) interface{} {
+	switch t {
+	case nmos.EventTypeBoolean:
+		return false
+	case nmos.EventTypeNumber:
+		return 0
+	}
+	return ""
+}
@@ -0,0 +1,255 @@
+package node
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/thyge/gonmos/pkg/nmos"
+)
+
+// configTestBase is a valid config with a video device, more devices and
+// senders are appended by the tests
+const configTestBase = `label: test
+devices:
+  - label: Camera
+    sources:
+      - label: Camera
+        format: urn:x-nmos:format:video
+    flows:
+      - label: Camera
+        source: Camera
+        media_type: video/raw
+`
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		// "line: message" of each error, empty if the config is valid
+		errs []string
+	}{
+		{name: "valid", data: configTestBase},
+		{
+			name: "sender legs",
+			data: configTestBase + `    senders:
+      - label: Camera
+        flow: Camera
+        transport: urn:x-nmos:transport:rtp.mcast
+        constraints:
+          - destination_port: {minimum: 5000, maximum: 5099}
+        transport_params:
+          - destination_port: 5004
+            destination_ip: 239.1.1.1
+`,
+		},
+		{
+			name: "receiver legs",
+			data: configTestBase + `    receivers:
+      - label: Monitor
+        format: urn:x-nmos:format:video
+        transport: urn:x-nmos:transport:rtp
+        transport_params:
+          - multicast_ip: 239.1.1.1
+            destination_port: 5004
+`,
+		},
+		{name: "not yaml", data: "label: [", errs: []string{"1: did not find expected node content"}},
+		{name: "unknown field", data: "labels: test\n" + configTestBase[12:], errs: []string{"1: field labels not found in type node.NMOSNodeConfig"}},
+		{name: "invalid id", data: "id: 1234\n" + configTestBase, errs: []string{`1: invalid id "1234"`}},
+		{name: "no devices", data: "label: test\n", errs: []string{"1: at least one device is required"}},
+		{
+			name: "bad references",
+			data: configTestBase + `      - label: Other
+        source: Nothing
+    senders:
+      - label: Camera
+        flow: Nothing
+        transport: urn:x-nmos:transport:srt
+`,
+			errs: []string{`12: no source "Nothing" on this device`, "11: media_type is required", `15: no flow "Nothing" on this device`, "16: unsupported transport urn:x-nmos:transport:srt"},
+		},
+		{
+			name: "duplicate label",
+			data: configTestBase + `      - label: Camera
+        source: Camera
+        media_type: video/raw
+`,
+			errs: []string{`11: duplicate flow label "Camera", set an id`},
+		},
+		{
+			name: "unknown constraint",
+			data: configTestBase + `    senders:
+      - label: Camera
+        flow: Camera
+        transport: urn:x-nmos:transport:rtp.mcast
+        constraints:
+          - multicast_ip: {enum: [239.1.1.1]}
+`,
+			errs: []string{"16: unsupported transport parameter multicast_ip"},
+		},
+		{
+			name: "misspelt constraint keyword",
+			data: configTestBase + `    senders:
+      - label: Camera
+        flow: Camera
+        transport: urn:x-nmos:transport:rtp.mcast
+        constraints:
+          - destination_port: {minimun: 5000}
+`,
+			errs: []string{`16: json: unknown field "minimun"`},
+		},
+		{
+			name: "parameter outside its constraint",
+			data: configTestBase + `    senders:
+      - label: Camera
+        flow: Camera
+        transport: urn:x-nmos:transport:rtp.mcast
+        constraints:
+          - destination_port: {minimum: 5000, maximum: 5099}
+        transport_params:
+          - destination_port: 6000
+`,
+			errs: []string{"18: destination_port: value 6000 above maximum 5099"},
+		},
+		{
+			name: "more legs than the transport",
+			data: configTestBase + `    senders:
+      - label: Tally
+        flow: Camera
+        transport: urn:x-nmos:transport:websocket
+        transport_params:
+          - connection_uri: ws://a
+          - connection_uri: ws://b
+`,
+			errs: []string{"16: 2 legs given, the transport has 1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := ParseConfig("node.yaml", []byte(tt.data))
+			if len(tt.errs) == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := c.BuildDevices(); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			errs, ok := err.(NMOSConfigErrors)
+			if !ok {
+				t.Fatalf("got %v, want NMOSConfigErrors", err)
+			}
+			var got []string
+			for _, e := range errs {
+				if e.File != "node.yaml" {
+					t.Errorf("file %q", e.File)
+				}
+				got = append(got, fmt.Sprintf("%d: %s", e.Line, e.Msg))
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.errs, "\n") {
+				t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.errs, "\n"))
+			}
+		})
+	}
+}
+
+func TestBuildDevicesLegs(t *testing.T) {
+	c, err := ParseConfig("node.yaml", []byte(configTestBase+`    senders:
+      - label: Camera
+        flow: Camera
+        transport: urn:x-nmos:transport:rtp.mcast
+        constraints:
+          - destination_port: {minimum: 5000, maximum: 5099}
+        transport_params:
+          - destination_port: 5004
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	devices, err := c.BuildDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := devices[0].Senders[0]
+	if err := s.InitConnection(nmos.TransportHost{InterfaceIPs: []string{"192.168.1.10"}}); err != nil {
+		t.Fatal(err)
+	}
+	if max := s.Connection.Constraints()[0]["destination_port"].Maximum; max != 5099.0 {
+		t.Errorf("destination_port maximum %v", max)
+	}
+	if port := s.Connection.Staged().TransportParams[0]["destination_port"]; port != 5004.0 {
+		t.Errorf("staged destination_port %v", port)
+	}
+}
+
+func TestConfigIds(t *testing.T) {
+	tests := []struct {
+		name string
+		// config before and after the change
+		before, after string
+		// the node and camera source keep their ids
+		sameNode, sameSource bool
+	}{
+		{
+			name:       "port changed",
+			before:     configTestBase,
+			after:      "port: 9000\n" + configTestBase,
+			sameNode:   true,
+			sameSource: true,
+		},
+		{
+			name:   "source renamed",
+			before: configTestBase,
+			after: strings.NewReplacer("      - label: Camera\n        format", "      - label: Camera A\n        format",
+				"source: Camera\n", "source: Camera A\n").Replace(configTestBase),
+			sameNode:   true,
+			sameSource: true,
+		},
+		{
+			name:       "source replaced by a new one",
+			before:     configTestBase,
+			after:      strings.Replace(configTestBase, "        format: urn:x-nmos:format:video\n", "        format: urn:x-nmos:format:video\n      - label: Camera A\n        format: urn:x-nmos:format:video\n", 1),
+			sameNode:   true,
+			sameSource: true,
+		},
+		{
+			name:     "key changed",
+			before:   "key: a\n" + configTestBase,
+			after:    "key: b\n" + configTestBase,
+			sameNode: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "node.yaml")
+			load := func(data string) *NMOSNodeConfig {
+				t.Helper()
+				if err := ioutil.WriteFile(file, []byte(data), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				c, err := LoadConfig(file)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := c.SaveState(); err != nil {
+					t.Fatal(err)
+				}
+				return c
+			}
+			before, after := load(tt.before), load(tt.after)
+			if (before.Id == after.Id) != tt.sameNode {
+				t.Errorf("node id %s, then %s", before.Id, after.Id)
+			}
+			if tt.sameNode && (before.Devices[0].Sources[0].Id == after.Devices[0].Sources[0].Id) != tt.sameSource {
+				t.Errorf("source id %s, then %s", before.Devices[0].Sources[0].Id, after.Devices[0].Sources[0].Id)
+			}
+			if len(after.Devices[0].Sources) > 1 && after.Devices[0].Sources[1].Id == before.Devices[0].Sources[0].Id {
+				t.Error("the new source took the id of the old one")
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package node
+
+import (
+	"github.com/google/uuid"
+	"github.com/thyge/gonmos/pkg/nmos"
+)
+
+// EventHandler receives the IS-07 state messages of websocket and MQTT
+// receivers, e.g. to drive tally lights
+type EventHandler interface {
+	OnEvent(receiverId uuid.UUID, msg nmos.NMOSEventMessage)
+}
+
+// eventClient is the IS-07 connection of a receiver, or the MQTT publisher
+// of a sender
+type eventClient interface {
+	Close()
+}
+
+// connectEvents follows the IS-05 active parameters of a websocket or MQTT
+// receiver, subscribing to the source given by ext_is_07_source_id or to
+// the broker_topic
+func (a *NMOSNode) connectEvents(id uuid.UUID, transport string, active nmos.NMOSReceiverParams) {
+	gen := a.closeEventClient(id)
+	if !active.MasterEnable || len(active.TransportParams) == 0 {
+		return
+	}
+	handler := func(msg nmos.NMOSEventMessage) {
+		if a.EventHandler != nil {
+			a.EventHandler.OnEvent(id, msg)
+		}
+	}
+	p := active.TransportParams[0]
+	switch transport {
+	case nmos.TransportWebSocket:
+		uri := p.String("connection_uri")
+		source, err := uuid.Parse(p.String("ext_is_07_source_id"))
+		if uri == "" || err != nil {
+			nmos.Errorln("receiver", id, "has no event source to subscribe to")
+			return
+		}
+		a.dialEvents(id, gen, uri, func() (eventClient, error) {
+			return nmos.DialEvents(uri, []uuid.UUID{source}, a.tlsConfig(), handler)
+		})
+	case nmos.TransportMQTT:
+		a.dialEvents(id, gen, p.String("source_host"), func() (eventClient, error) {
+			return nmos.DialMQTTEvents(p, id, a.tlsConfig(), handler)
+		})
+	}
+}
+
+// publishEvents follows the IS-05 active parameters of an MQTT sender,
+// publishing the state of its IS-07 source to the broker
+func (a *NMOSNode) publishEvents(id uuid.UUID, events *nmos.NMOSEventState, active nmos.NMOSSenderParams) {
+	gen := a.closeEventClient(id)
+	if !active.MasterEnable || len(active.TransportParams) == 0 {
+		return
+	}
+	if events == nil {
+		nmos.Errorln("sender", id, "has no event source to publish")
+		return
+	}
+	p := active.TransportParams[0]
+	a.dialEvents(id, gen, p.String("destination_host"), func() (eventClient, error) {
+		return nmos.PublishMQTTEvents(p, id, a.tlsConfig(), events)
+	})
+}
+
+// dialEvents connects in the background, activations hold the connection
+// lock. The client is dropped if id was activated or closed again while
+// dialing, gen being the generation closeEventClient returned.
+func (a *NMOSNode) dialEvents(id uuid.UUID, gen uint64, to string, dial func() (eventClient, error)) {
+	go func() {
+		c, err := dial()
+		if err != nil {
+			nmos.Errorln(id, "failed to connect to", to, err)
+			return
+		}
+		a.eventMu.Lock()
+		defer a.eventMu.Unlock()
+		if a.eventGen[id] != gen {
+			c.Close()
+			return
+		}
+		if a.eventClients == nil {
+			a.eventClients = make(map[uuid.UUID]eventClient)
+		}
+		a.eventClients[id] = c
+	}()
+}
+
+// closeEventClient drops the event connection of a sender or receiver and
+// any dial in progress, returning the generation for the next dial
+func (a *NMOSNode) closeEventClient(id uuid.UUID) uint64 {
+	a.eventMu.Lock()
+	defer a.eventMu.Unlock()
+	if c, ok := a.eventClients[id]; ok {
+		c.Close()
+		delete(a.eventClients, id)
+	}
+	if a.eventGen == nil {
+		a.eventGen = make(map[uuid.UUID]uint64)
+	}
+	a.eventGen[id]++
+	return a.eventGen[id]
+}
+
+func (a *NMOSNode) closeEvents() {
+	a.eventMu.Lock()
+	defer a.eventMu.Unlock()
+	for id, c := range a.eventClients {
+		c.Close()
+		delete(a.eventClients, id)
+	}
+	for id := range a.eventGen {
+		a.eventGen[id]++
+	}
+}
@@ -0,0 +1,72 @@
+package node
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type fakeEventClient struct {
+	mu     sync.Mutex
+	closed bool
+}
+
+func (c *fakeEventClient) Close() {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+}
+
+func (c *fakeEventClient) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+func TestDialEventsGeneration(t *testing.T) {
+	tests := []struct {
+		name string
+		// runs while the first dial is in progress
+		during func(a *NMOSNode, id uuid.UUID)
+		kept   bool
+	}{
+		{name: "current dial is kept", during: func(a *NMOSNode, id uuid.UUID) {}, kept: true},
+		{name: "activated again while dialing", during: func(a *NMOSNode, id uuid.UUID) { a.closeEventClient(id) }},
+		{name: "node stopped while dialing", during: func(a *NMOSNode, id uuid.UUID) { a.closeEvents() }},
+		{name: "other receiver activated", during: func(a *NMOSNode, id uuid.UUID) { a.closeEventClient(uuid.New()) }, kept: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &NMOSNode{}
+			id := uuid.New()
+			c := &fakeEventClient{}
+			dialing, release, done := make(chan struct{}), make(chan struct{}), make(chan struct{})
+			a.dialEvents(id, a.closeEventClient(id), "broker", func() (eventClient, error) {
+				close(dialing)
+				<-release
+				defer close(done)
+				return c, nil
+			})
+			<-dialing
+			tt.during(a, id)
+			close(release)
+			<-done
+			// the client is stored or closed just after dial returns
+			deadline := time.Now().Add(2 * time.Second)
+			for {
+				a.eventMu.Lock()
+				stored := a.eventClients[id] == eventClient(c)
+				a.eventMu.Unlock()
+				if stored || c.isClosed() || time.Now().After(deadline) {
+					if stored != tt.kept || c.isClosed() == tt.kept {
+						t.Errorf("stored %v, closed %v, want kept %v", stored, c.isClosed(), tt.kept)
+					}
+					return
+				}
+				time.Sleep(time.Millisecond)
+			}
+		})
+	}
+}
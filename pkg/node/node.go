@@ -8,16 +8,27 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/grandcat/zeroconf"
 	"github.com/thyge/gonmos/pkg/nmos"
 )
 
+// ActivationHandler lets an application embedding NMOSNode validate and
+// apply IS-05 changes, e.g. to join multicast groups in its media pipeline.
+// Hooks run before the parameters become active. Returning an
+// *nmos.ActivationError sends its code to the controller (400 for invalid
+// parameters), any other error is reported as a 500.
+type ActivationHandler interface {
+	OnSenderActivate(id uuid.UUID, active nmos.NMOSSenderParams) error
+	OnReceiverActivate(id uuid.UUID, active nmos.NMOSReceiverParams) error
+}
+
 type NMOSNode struct {
 	Registers               []zeroconf.ServiceEntry
-	Node                    nmos.NMOSNodeData
-	Device                  nmos.NMOSDevice
 	RegistryURI             string
 	RegisterHBURI           string
 	DeleteURI               string
@@ -25,12 +36,110 @@ type NMOSNode struct {
 	CancelRegistryDiscovery context.CancelFunc
 	Ctx                     context.Context
 	WSApi                   nmos.NMOSWebServer
+	// Optional, set before Start
+	ActivationHandler ActivationHandler
+	// host:port of the broker used by MQTT senders and receivers
+	MQTTBroker string
+	// Registry heartbeat interval, 5 seconds if zero. Set from the IS-09
+	// System API when one is found.
+	HeartbeatInterval time.Duration
+	// Optional, receives IS-07 events of websocket receivers
+	EventHandler EventHandler
+	// Optional, requires IS-10 tokens on the node's APIs
+	AuthConfig *nmos.NMOSAuthConfig
+	// Optional, gets tokens for registry calls. Created when the registry
+	// advertises api_auth=true, the server is discovered if not configured.
+	AuthClient *nmos.NMOSAuthClient
+	// Optional, serve the APIs over HTTPS as required by BCP-003-01
+	Certificates []nmos.NMOSCertificate
+	// PEM CA bundle to verify the registry and other servers the node
+	// calls, the system roots are used if empty
+	CAFile string
+	// Optional node settings, the hostname and an id derived from the key
+	// in DefaultKeyFile are used if empty
+	Id          uuid.UUID
+	Label       string
+	Description string
+	// Network interfaces to advertise, all if empty
+	Interfaces []string
+	// Registration API base URL, e.g. https://registry:8443. The registry
+	// is found over mDNS if empty.
+	Registry string
+	// IS-04 version used with the registry, v1.3 if empty
+	APIVersion string
+	// Optional, the config Start watches and reloads, see WatchConfig. Set
+	// by NMOSNodeConfig.Configure.
+	ConfigFile string
+
+	client *http.Client
+	// The node and device, created by Start. Use Snapshot to read them and
+	// the Add, Update and Remove methods to change them.
+	res *nmos.NMOSResources
+
+	eventMu      sync.Mutex
+	eventClients map[uuid.UUID]eventClient
+	// bumped by every activation and close, see dialEvents
+	eventGen map[uuid.UUID]uint64
+
+	// registry calls, in the order the changes were made
+	registrations registrationQueue
+	// guards HeartbeatInterval once Start runs
+	systemMu sync.Mutex
+	// guards the registry URIs, set when a registry is found
+	regMu sync.Mutex
+}
+
+// registryURI is the resource URI of the Registration API, empty until the
+// node registers
+func (a *NMOSNode) registryURI() string {
+	a.regMu.Lock()
+	defer a.regMu.Unlock()
+	return a.RegistryURI
+}
+
+// registrationQueue runs registry calls one at a time in order, so an
+// update posted in the background can't overtake a later one or a delete
+type registrationQueue struct {
+	mu      sync.Mutex
+	calls   []func()
+	running bool
+}
+
+// push queues call and returns a channel closed once it has run
+func (q *registrationQueue) push(call func()) <-chan struct{} {
+	done := make(chan struct{})
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.calls = append(q.calls, func() {
+		defer close(done)
+		call()
+	})
+	if !q.running {
+		q.running = true
+		go q.run()
+	}
+	return done
+}
+
+func (q *registrationQueue) run() {
+	for {
+		q.mu.Lock()
+		if len(q.calls) == 0 {
+			q.running = false
+			q.mu.Unlock()
+			return
+		}
+		call := q.calls[0]
+		q.calls = q.calls[1:]
+		q.mu.Unlock()
+		call()
+	}
 }
 
 func (a *NMOSNode) ProcessEntries(results <-chan *zeroconf.ServiceEntry, regFoundChan chan string) {
 	for entry := range results {
 		a.Registers = append(a.Registers, *entry)
-		fmt.Println("Found registry service:", entry.AddrIPv4, entry.Domain, entry.Port, entry.Text)
+		nmos.Infoln("Found registry service:", entry.AddrIPv4, entry.Domain, entry.Port, entry.Text)
 		a.AddNodeToReg(*entry)
 		regFoundChan <- "found reg"
 	}
@@ -53,147 +162,411 @@ func (a *NMOSNode) StartRegistryDiscovery(regFoundChan chan string) {
 }
 
 func (a *NMOSNode) AddNodeToReg(reg zeroconf.ServiceEntry) {
-	apiVersion := "v1.3"
-	regAddress := fmt.Sprintf("%s:%d", reg.AddrIPv4[0], reg.Port)
-	a.RegistryURI = fmt.Sprintf("http://%s/x-nmos/registration/%s/resource", regAddress, apiVersion)
-	a.RegisterHBURI = fmt.Sprintf("http://%s/x-nmos/registration/%s/health/nodes/%s", regAddress, apiVersion, a.Node.Id)
-	a.DeleteURI = fmt.Sprintf("%s/nodes/%s", a.RegistryURI, a.Node.Id)
+	proto := nmos.MdnsTextValue(reg.Text, "api_proto", "http")
+	a.registerAt(fmt.Sprintf("%s://%s:%d", proto, reg.AddrIPv4[0], reg.Port), reg.Text)
+}
+
+// registerAt registers the node with the registry at regAddress, txt is its
+// mDNS TXT record if it was discovered
+func (a *NMOSNode) registerAt(regAddress string, txt []string) {
+	apiVersion := a.APIVersion
+	if apiVersion == "" {
+		apiVersion = "v1.3"
+	}
+	node, devices := a.Snapshot()
+	a.regMu.Lock()
+	a.RegistryURI = fmt.Sprintf("%s/x-nmos/registration/%s/resource", regAddress, apiVersion)
+	a.RegisterHBURI = fmt.Sprintf("%s/x-nmos/registration/%s/health/nodes/%s", regAddress, apiVersion, node.Id)
+	a.DeleteURI = fmt.Sprintf("%s/nodes/%s", a.RegistryURI, node.Id)
+	hbURI := a.RegisterHBURI
+	a.regMu.Unlock()
+	a.setupAuth(txt)
 
 	// Send resources
-	a.SendResource(a.Node, "node")
-	// Check if Device is initialised
-	if len(a.Device.Label) > 0 {
-		a.SendResource(a.Device, "device")
-		for _, sender := range a.Device.Senders {
-			a.SendResource(sender, "sender")
-		}
-		for _, receiver := range a.Device.Receivers {
-			a.SendResource(receiver, "receiver")
-		}
+	a.register(node, "node")
+	for _, device := range devices {
+		a.registerDevice(device)
 	}
+	// the first heartbeat goes once the node is posted
+	<-a.registrations.push(func() {})
 
-	go RegisterHeartBeat(a.Ctx, a.RegisterHBURI)
+	go RegisterHeartBeat(a.Ctx, hbURI, a.heartbeatInterval, a.httpClient(), a.AuthClient, func() {
+		a.registrations.push(a.registerAll)
+	})
 }
 
 func (a *NMOSNode) RemoveFromRegistry() {
-	client := &http.Client{}
-	req, _ := http.NewRequest(http.MethodDelete, a.DeleteURI, nil)
-	resp, err := client.Do(req)
+	// after the updates still queued, which would register the node again
+	<-a.registrations.push(a.removeFromRegistry)
+}
+
+func (a *NMOSNode) removeFromRegistry() {
+	a.regMu.Lock()
+	deleteURI := a.DeleteURI
+	a.regMu.Unlock()
+	req, _ := http.NewRequest(http.MethodDelete, deleteURI, nil)
+	resp, err := a.AuthClient.Do(a.httpClient(), req)
 	if err != nil {
-		log.Println(err)
+		nmos.Errorln(err)
 		return
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode == 204 {
-		log.Println("Deleted resource from registry")
+		nmos.Infoln("Deleted resource from registry")
 	} else {
-		body, _ := ioutil.ReadAll(resp.Body)
-		var prettyJSON bytes.Buffer
-		error := json.Indent(&prettyJSON, body, "", "\t")
-		if error != nil {
-			log.Fatal("JSON parse error: ", error)
-		}
-		log.Println(resp, string(prettyJSON.Bytes()))
+		nmos.Errorln("failed to delete node", registryReply(resp))
 	}
 }
 
-func RegisterHeartBeat(ctx context.Context, uri string) {
-	hbclient := &http.Client{}
-	var connectioCounter int
+// RegisterHeartBeat keeps the node registered, auth may be nil if the
+// registry doesn't require tokens. interval is read after every heartbeat.
+// unknown is called when the registry has forgotten the node, e.g. after
+// missed heartbeats, to register it again.
+func RegisterHeartBeat(ctx context.Context, uri string, interval func() time.Duration, hbclient *http.Client, auth *nmos.NMOSAuthClient, unknown func()) {
 	for {
-		select {
-		case <-ctx.Done(): // if cancel() execute
-			log.Println("Stopping heartbeat")
+		req, reqerr := http.NewRequest(http.MethodPost, uri, nil)
+		if reqerr != nil {
+			nmos.Errorln("heartbeat", reqerr)
 			return
-		default:
-			req, reqerr := http.NewRequest(http.MethodPost, uri, nil)
-			if reqerr != nil {
-				panic(reqerr)
-			}
-			req.Header.Set("Content-Type", "application/json")
-			req.Close = true
-			resp, err := hbclient.Do(req)
-			if err != nil {
-				log.Println("error", err)
-				return
-			}
-			connectioCounter++
-			if resp.StatusCode != 200 {
-				body, err := ioutil.ReadAll(resp.Body)
-				if err != nil {
-					panic(err)
-				}
-				var prettyJSON bytes.Buffer
-				error := json.Indent(&prettyJSON, body, "", "\t")
-				if error != nil {
-					log.Fatal("JSON parse error: ", error)
-				}
-				log.Fatal(resp, string(prettyJSON.Bytes()))
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Close = true
+		resp, err := auth.Do(hbclient, req)
+		if err != nil {
+			nmos.Errorln("heartbeat failed", err)
+		} else {
+			switch resp.StatusCode {
+			case http.StatusOK:
+			case http.StatusNotFound:
+				nmos.Infoln("registry lost the node, registering again")
+				unknown()
+			default:
+				nmos.Errorln("heartbeat failed", registryReply(resp))
 			}
 			// defer resp.Body.Close() was not happening
 			// force close instead to prevent memory leak
 			resp.Body.Close()
-			time.Sleep(5 * time.Second)
+		}
+		select {
+		case <-ctx.Done(): // if cancel() execute
+			nmos.Infoln("Stopping heartbeat")
+			return
+		case <-time.After(interval()):
 		}
 	}
 }
 
-func (a *NMOSNode) SendResource(i interface{}, name string) {
+// registryError is a registry reply other than 200 or 201
+type registryError struct {
+	Status int
+	Body   string
+}
+
+func (e *registryError) Error() string {
+	return fmt.Sprintf("registry returned %d: %s", e.Status, e.Body)
+}
+
+func registryReply(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(resp.Body)
+	return &registryError{Status: resp.StatusCode, Body: strings.TrimSpace(string(body))}
+}
+
+// SendResource posts a resource to the Registration API. Errors are
+// *registryError if the registry replied.
+func (a *NMOSNode) SendResource(i interface{}, name string) error {
 	wrapped := nmos.MakeTransmission(i, name)
 	payloadBuf := new(bytes.Buffer)
 	enc := json.NewEncoder(payloadBuf)
 	enc.SetIndent("", "\t")
-	enc.Encode(wrapped)
+	if err := enc.Encode(wrapped); err != nil {
+		return err
+	}
 
-	resp, err := http.Post(a.RegistryURI, "application/json", payloadBuf)
+	req, err := http.NewRequest(http.MethodPost, a.registryURI(), bytes.NewReader(payloadBuf.Bytes()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := a.AuthClient.Do(a.httpClient(), req)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer resp.Body.Close()
-	if resp.StatusCode == 201 {
-		log.Println("Sent:", name)
-	} else {
-		enc.Encode(wrapped)
-		log.Println(payloadBuf)
-		body, _ := ioutil.ReadAll(resp.Body)
-		var prettyJSON bytes.Buffer
-		error := json.Indent(&prettyJSON, body, "", "\t")
-		if error != nil {
-			log.Fatal("JSON parse error: ", error)
+	// 201 for new resources, 200 when updating a registered one
+	if resp.StatusCode == 201 || resp.StatusCode == 200 {
+		nmos.Debugln("Sent:", name)
+		return nil
+	}
+	return registryReply(resp)
+}
+
+// Registry calls failing without a reply or with a 5xx are retried this
+// many times, the delay doubling from registryRetryDelay
+var (
+	registryRetries    = 3
+	registryRetryDelay = time.Second
+)
+
+// sendResource posts a resource from the registration queue. A resource
+// the registry refuses may be one whose parents it dropped, so the whole
+// node is registered again.
+func (a *NMOSNode) sendResource(i interface{}, name string) {
+	delay := registryRetryDelay
+	for attempt := 0; ; attempt++ {
+		err := a.SendResource(i, name)
+		if err == nil {
+			return
+		}
+		nmos.Errorln("failed to send", name, err)
+		if re, ok := err.(*registryError); ok && re.Status < 500 {
+			if name != "node" {
+				a.registrations.push(a.registerAll)
+			}
+			return
+		}
+		if attempt == registryRetries || a.stopping() {
+			return
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// registerAll posts the node and all its resources again, parents first
+func (a *NMOSNode) registerAll() {
+	node, devices := a.Snapshot()
+	send := func(i interface{}, name string) {
+		if err := a.SendResource(i, name); err != nil {
+			nmos.Errorln("failed to send", name, err)
 		}
-		log.Fatal(resp, string(prettyJSON.Bytes()))
 	}
+	send(node, "node")
+	for _, d := range devices {
+		eachResource(d, send)
+	}
+}
+
+func (a *NMOSNode) stopping() bool {
+	return a.Ctx != nil && a.Ctx.Err() != nil
 }
 
-func (a *NMOSNode) Start(ctx context.Context, port int, config *nmos.NMOSDevice) {
+// senderActivated passes an activation to the application and keeps the
+// IS-04 subscription of the sender in line with its IS-05 active parameters
+func (a *NMOSNode) senderActivated(id uuid.UUID) func(nmos.NMOSSenderParams) error {
+	return func(active nmos.NMOSSenderParams) error {
+		if a.ActivationHandler != nil {
+			if err := a.ActivationHandler.OnSenderActivate(id, active); err != nil {
+				return err
+			}
+		}
+		var sender *nmos.NMOSSender
+		var events *nmos.NMOSEventState
+		a.res.Update(func(node *nmos.NMOSNodeData, devices *nmos.NMOSDevices) {
+			if s := devices.FindSender(id); s != nil {
+				s.Subscription.Active = active.MasterEnable
+				s.Subscription.Receiver_id = active.ReceiverId
+				s.Version = nmos.NextVersion(s.Version)
+				res := *s
+				sender = &res
+				if f := devices.FindFlow(s.Flow_id); f != nil {
+					if source := devices.FindSource(f.Source_id); source != nil {
+						events = source.Events
+					}
+				}
+			}
+		})
+		if sender == nil {
+			return nil
+		}
+		if sender.Transport == nmos.TransportMQTT {
+			a.publishEvents(id, events, active)
+		}
+		a.register(*sender, "sender")
+		return nil
+	}
+}
+
+// receiverActivated passes an activation to the application and keeps the
+// IS-04 subscription of the receiver in line with its IS-05 active parameters
+func (a *NMOSNode) receiverActivated(id uuid.UUID) func(nmos.NMOSReceiverParams) error {
+	return func(active nmos.NMOSReceiverParams) error {
+		if a.ActivationHandler != nil {
+			if err := a.ActivationHandler.OnReceiverActivate(id, active); err != nil {
+				return err
+			}
+		}
+		var receiver *nmos.NMOSReceiver
+		a.res.Update(func(node *nmos.NMOSNodeData, devices *nmos.NMOSDevices) {
+			if r := devices.FindReceiver(id); r != nil {
+				r.Subscription.Active = active.MasterEnable
+				r.Subscription.Sender_id = active.SenderId
+				r.Version = nmos.NextVersion(r.Version)
+				res := *r
+				receiver = &res
+			}
+		})
+		if receiver == nil {
+			return nil
+		}
+		if receiver.Transport == nmos.TransportWebSocket || receiver.Transport == nmos.TransportMQTT {
+			a.connectEvents(id, receiver.Transport, active)
+		}
+		a.register(*receiver, "receiver")
+		return nil
+	}
+}
+
+// setControl advertises an API of this node on the device, filling in the
+// href of a control the config already lists
+func setControl(node *nmos.NMOSNodeData, d *nmos.NMOSDevice, controlType string, path string) {
+	href := node.Href + path
+	for i := range d.Controls {
+		if d.Controls[i].Type == controlType {
+			if d.Controls[i].Href == "" {
+				d.Controls[i].Href = href
+			}
+			return
+		}
+	}
+	d.Controls = append(d.Controls, nmos.NMOSControl{Type: controlType, Href: href})
+}
+
+// transportHost returns one IP per bound interface, or the node's first
+// endpoint for resources without interface bindings
+func (a *NMOSNode) transportHost(node *nmos.NMOSNodeData, bindings []string) nmos.TransportHost {
+	host := nmos.TransportHost{
+		APIPort:    a.WSApi.Port,
+		MQTTBroker: a.MQTTBroker,
+		Secure:     a.WSApi.Proto() == "https",
+	}
+	for _, name := range bindings {
+		ip := nmos.InterfaceIP(name)
+		if ip == "" {
+			ip = node.API.Endpoints[0].Host
+		}
+		host.InterfaceIPs = append(host.InterfaceIPs, ip)
+	}
+	if len(host.InterfaceIPs) == 0 {
+		host.InterfaceIPs = append(host.InterfaceIPs, node.API.Endpoints[0].Host)
+	}
+	return host
+}
+
+// Start serves the node APIs for the devices in configs and registers them
+// with the first registry found. It returns once ctx is done.
+func (a *NMOSNode) Start(ctx context.Context, port int, configs ...*nmos.NMOSDevice) {
 
 	a.Ctx, a.CancelHeartBeat = context.WithCancel(ctx)
-	a.Node.Init(port)
+	if a.Id == uuid.Nil {
+		key, err := nmos.NodeKey(DefaultKeyFile(port))
+		if err != nil {
+			log.Fatalln("node key", err)
+		}
+		a.Id = nmos.StableID(key, "node")
+	}
+	var node nmos.NMOSNodeData
+	node.Init(a.Id, port)
+	if err := a.applyNodeSettings(&node, port); err != nil {
+		log.Fatalln("interfaces", err)
+	}
+	if len(node.API.Endpoints) == 0 {
+		log.Fatalln("no IPv4 address to serve the node APIs on")
+	}
+	var err error
+	if a.client, err = nmos.NewHTTPClient(a.CAFile); err != nil {
+		log.Fatalln("ca bundle", err)
+	}
+	if len(a.Certificates) > 0 {
+		if err := a.WSApi.EnableTLS(a.Certificates...); err != nil {
+			log.Fatalln("tls", err)
+		}
+	}
+	node.SetProtocol(a.WSApi.Proto())
 	// start api and mdns
 	a.WSApi.Start(port)
-	a.WSApi.InitNode(&a.Node, &a.Device)
+	if a.AuthConfig != nil {
+		v, err := nmos.NewAuthValidator(*a.AuthConfig)
+		if err != nil {
+			log.Fatalln("auth", err)
+		}
+		a.WSApi.EnableAuth(v)
+		for i := range node.API.Endpoints {
+			node.API.Endpoints[i].Authorization = true
+		}
+	}
 
 	// Handle config
-	a.Device = *config
-	a.Device.Node_id = a.Node.Id
-	for i := 0; i < len(a.Device.Senders); i++ {
-		// This should be the actual IP if the IP interface
-		// Since we don't have one we just pick the first local
-		a.Device.Senders[i].InitHREF(a.Node.API.Endpoints[0].Host)
-	}
-
-	// brows for registry
-	regFoundChan := make(chan string)
-	a.StartRegistryDiscovery(regFoundChan)
-	// await registry to be discovered
-	<-regFoundChan
+	var devices nmos.NMOSDevices
+	for _, config := range configs {
+		device := *config
+		if err := a.initDevice(&node, devices, &device); err != nil {
+			log.Fatalln("device", device.Label, err)
+		}
+		devices = append(devices, device)
+	}
+	a.res = nmos.NewResources(node, devices)
+	a.WSApi.InitNode(a.res)
+	if a.ConfigFile != "" {
+		go a.WatchConfig(a.Ctx, a.ConfigFile)
+	}
+
+	// the System API may answer after the node registered, its heartbeat
+	// interval applies from the next heartbeat
+	go a.DiscoverSystem(2 * time.Second)
+	if a.Registry != "" {
+		a.registerAt(strings.TrimSuffix(a.Registry, "/"), nil)
+	} else {
+		// brows for registry
+		regFoundChan := make(chan string)
+		a.StartRegistryDiscovery(regFoundChan)
+		// await registry to be discovered
+		<-regFoundChan
+	}
 	// a.InitTestSendersAndRecievers()
 	// await external cancel, then cleanup
 	<-ctx.Done()
 	// cleanup
 	a.RemoveFromRegistry()
+	a.closeEvents()
 	a.WSApi.Stop()
-	log.Println("Stopping heartbeat")
+	nmos.Infoln("Stopping heartbeat")
 	a.CancelHeartBeat()
-	log.Println("stopping registry discovery")
-	a.CancelRegistryDiscovery()
+	if a.CancelRegistryDiscovery != nil {
+		nmos.Infoln("stopping registry discovery")
+		a.CancelRegistryDiscovery()
+	}
+}
+
+// applyNodeSettings overrides the defaults of node with the optional
+// settings of a. Configured interfaces must have an IPv4 address.
+func (a *NMOSNode) applyNodeSettings(node *nmos.NMOSNodeData, port int) error {
+	if a.Label != "" {
+		node.Label = a.Label
+	}
+	if a.Description != "" {
+		node.Description = a.Description
+	}
+	if len(a.Interfaces) == 0 {
+		return nil
+	}
+	interfaces := make([]nmos.NMOSInterface, 0)
+	for _, intf := range node.Interfaces {
+		for _, name := range a.Interfaces {
+			if intf.Name == name {
+				interfaces = append(interfaces, intf)
+			}
+		}
+	}
+	node.Interfaces = interfaces
+	var endpoints []nmos.NMOSEndpoint
+	for _, name := range a.Interfaces {
+		ip := nmos.InterfaceIP(name)
+		if ip == "" {
+			return fmt.Errorf("interface %s has no IPv4 address", name)
+		}
+		endpoints = append(endpoints, nmos.NMOSEndpoint{Host: ip, Port: port, Protocol: "http"})
+	}
+	node.API.Endpoints = endpoints
+	node.Href = endpoints[0].URL()
+	return nil
 }
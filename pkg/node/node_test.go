@@ -0,0 +1,343 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/thyge/gonmos/pkg/nmos"
+)
+
+// fakeRegistry records the registry calls of a node as "METHOD type version"
+type fakeRegistry struct {
+	mu    sync.Mutex
+	calls []string
+	// status codes to reply with, by resource type, before succeeding
+	fail map[string][]int
+}
+
+func (f *fakeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	call := r.Method + " " + r.URL.Path
+	if r.Method == http.MethodPost {
+		var body struct {
+			Type string `json:"type"`
+			Data struct {
+				Version string `json:"version"`
+			} `json:"data"`
+		}
+		json.NewDecoder(r.Body).Decode(&body)
+		call = fmt.Sprintf("POST %s %s", body.Type, body.Data.Version)
+	}
+	f.mu.Lock()
+	f.calls = append(f.calls, call)
+	typ := strings.Fields(call)[1]
+	if codes := f.fail[typ]; len(codes) > 0 {
+		f.fail[typ] = codes[1:]
+		f.mu.Unlock()
+		w.WriteHeader(codes[0])
+		w.Write([]byte(`{"code": 400, "error": "refused"}`))
+		return
+	}
+	f.mu.Unlock()
+	switch r.Method {
+	case http.MethodPost:
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("{}"))
+	case http.MethodDelete:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestRegistrationOrder(t *testing.T) {
+	id := uuid.MustParse("00000000-0000-4000-8000-000000000001")
+	sender := func(version string) nmos.NMOSSender {
+		return nmos.NMOSSender{Id: id, Version: version}
+	}
+	tests := []struct {
+		name string
+		run  func(a *NMOSNode)
+		want []string
+	}{
+		{
+			name: "updates keep their order",
+			run: func(a *NMOSNode) {
+				for i := 1; i <= 20; i++ {
+					a.register(sender(fmt.Sprintf("1:%d", i)), "sender")
+				}
+				a.register(sender("2:0"), "sender")
+			},
+			want: func() []string {
+				var calls []string
+				for i := 1; i <= 20; i++ {
+					calls = append(calls, fmt.Sprintf("POST sender 1:%d", i))
+				}
+				return append(calls, "POST sender 2:0")
+			}(),
+		},
+		{
+			name: "a delete waits for queued updates",
+			run: func(a *NMOSNode) {
+				a.register(sender("1:1"), "sender")
+				a.register(sender("1:2"), "sender")
+				a.unregister("sender", id)
+			},
+			want: []string{"POST sender 1:1", "POST sender 1:2", "DELETE /resource/senders/" + id.String()},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := &fakeRegistry{}
+			srv := httptest.NewServer(reg)
+			defer srv.Close()
+			a := &NMOSNode{RegistryURI: srv.URL + "/resource"}
+			tt.run(a)
+			<-a.registrations.push(func() {})
+			reg.mu.Lock()
+			defer reg.mu.Unlock()
+			if !reflect.DeepEqual(reg.calls, tt.want) {
+				t.Errorf("got %v\nwant %v", reg.calls, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegistryErrors(t *testing.T) {
+	registryRetryDelay = time.Millisecond
+	node := nmos.NMOSNodeData{Id: uuid.New(), Version: "1:0"}
+	sender := nmos.NMOSSender{Id: uuid.New(), Version: "1:1"}
+	device := nmos.NMOSDevice{Id: uuid.New(), Version: "1:0", Senders: []nmos.NMOSSender{sender}}
+	all := []string{"POST node 1:0", "POST device 1:0", "POST sender 1:1"}
+	tests := []struct {
+		name string
+		fail map[string][]int
+		want []string
+	}{
+		{name: "accepted", want: []string{"POST sender 1:1"}},
+		{
+			name: "server errors are retried",
+			fail: map[string][]int{"sender": {500, 503}},
+			want: []string{"POST sender 1:1", "POST sender 1:1", "POST sender 1:1"},
+		},
+		{
+			name: "retries give up",
+			fail: map[string][]int{"sender": {500, 500, 500, 500, 500}},
+			want: []string{"POST sender 1:1", "POST sender 1:1", "POST sender 1:1", "POST sender 1:1"},
+		},
+		{
+			name: "a refused resource registers the node again",
+			fail: map[string][]int{"sender": {400}},
+			want: append([]string{"POST sender 1:1"}, all...),
+		},
+		{
+			name: "a refused node isn't registered again",
+			fail: map[string][]int{"node": {409}},
+			want: []string{"POST node 1:0"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := &fakeRegistry{fail: tt.fail}
+			srv := httptest.NewServer(reg)
+			defer srv.Close()
+			a := &NMOSNode{RegistryURI: srv.URL + "/resource"}
+			a.res = nmos.NewResources(node, nmos.NMOSDevices{device})
+			if tt.fail["node"] != nil {
+				a.register(node, "node")
+			} else {
+				a.register(sender, "sender")
+			}
+			// wait for the call, then for a re-registration it queued
+			<-a.registrations.push(func() {})
+			<-a.registrations.push(func() {})
+			reg.mu.Lock()
+			defer reg.mu.Unlock()
+			if !reflect.DeepEqual(reg.calls, tt.want) {
+				t.Errorf("got %v\nwant %v", reg.calls, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemoveDependents(t *testing.T) {
+	source := nmos.NMOSSource{Id: uuid.New()}
+	flow := nmos.NMOSFlow{Id: uuid.New(), Source_id: source.Id}
+	other := nmos.NMOSFlow{Id: uuid.New(), Source_id: uuid.New()}
+	sender := nmos.NMOSSender{Id: uuid.New(), Flow_id: flow.Id}
+	tests := []struct {
+		name    string
+		remove  func(a *NMOSNode) error
+		flows   int
+		senders int
+		want    []string
+	}{
+		{
+			name:   "a source takes its flows and their senders",
+			remove: func(a *NMOSNode) error { return a.RemoveSource(source.Id) },
+			flows:  1,
+			want:   []string{"DELETE senders", "DELETE flows", "DELETE sources", "POST device"},
+		},
+		{
+			name:   "a flow takes its senders",
+			remove: func(a *NMOSNode) error { return a.RemoveFlow(flow.Id) },
+			flows:  1,
+			want:   []string{"DELETE senders", "DELETE flows", "POST device"},
+		},
+		{
+			name:    "a flow without senders",
+			remove:  func(a *NMOSNode) error { return a.RemoveFlow(other.Id) },
+			flows:   1,
+			senders: 1,
+			want:    []string{"DELETE flows"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := &fakeRegistry{}
+			srv := httptest.NewServer(reg)
+			defer srv.Close()
+			device := nmos.NMOSDevice{Id: uuid.New(), Sources: []nmos.NMOSSource{source},
+				Flows: []nmos.NMOSFlow{flow, other}, Senders: []nmos.NMOSSender{sender}}
+			a := &NMOSNode{RegistryURI: srv.URL + "/resource"}
+			a.res = nmos.NewResources(nmos.NMOSNodeData{Id: uuid.New()}, nmos.NMOSDevices{device})
+			if err := tt.remove(a); err != nil {
+				t.Fatal(err)
+			}
+			<-a.registrations.push(func() {})
+			if got := registryCalls(reg); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("registry calls %v, want %v", got, tt.want)
+			}
+			_, devices := a.Snapshot()
+			if len(devices[0].Flows) != tt.flows || len(devices[0].Senders) != tt.senders {
+				t.Errorf("%d flows and %d senders left, want %d and %d", len(devices[0].Flows), len(devices[0].Senders), tt.flows, tt.senders)
+			}
+			if err := tt.remove(a); err == nil {
+				t.Error("removing it again succeeded")
+			}
+		})
+	}
+}
+
+func TestHeartbeatUnknownNode(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		unknown bool
+	}{
+		{"registered", http.StatusOK, false},
+		{"expired", http.StatusNotFound, true},
+		{"registry error", http.StatusInternalServerError, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			beats := make(chan struct{}, 8)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				select {
+				case beats <- struct{}{}:
+				default:
+				}
+			}))
+			defer srv.Close()
+			ctx, cancel := context.WithCancel(context.Background())
+			unknown := make(chan struct{}, 8)
+			done := make(chan struct{})
+			go func() {
+				RegisterHeartBeat(ctx, srv.URL, func() time.Duration { return time.Millisecond }, srv.Client(), nil, func() {
+					unknown <- struct{}{}
+				})
+				close(done)
+			}()
+			// the heartbeat keeps going whatever the reply
+			for i := 0; i < 2; i++ {
+				select {
+				case <-beats:
+				case <-time.After(2 * time.Second):
+					t.Fatal("heartbeat stopped")
+				}
+			}
+			cancel()
+			<-done
+			if got := len(unknown) > 0; got != tt.unknown {
+				t.Errorf("re-registered %v, want %v", got, tt.unknown)
+			}
+		})
+	}
+}
+
+func TestApplyNodeSettings(t *testing.T) {
+	tests := []struct {
+		name       string
+		interfaces []string
+		href       string
+		wantErr    bool
+	}{
+		{name: "all interfaces"},
+		{name: "loopback", interfaces: []string{"lo"}, href: "http://127.0.0.1:3212"},
+		{name: "unknown interface", interfaces: []string{"lo", "nosuch0"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.href != "" && nmos.InterfaceIP("lo") != "127.0.0.1" {
+				t.Skip("no lo interface")
+			}
+			id := nmos.StableID("test", "node")
+			var node nmos.NMOSNodeData
+			node.Init(id, 3212)
+			if node.Id != id {
+				t.Fatalf("id %s, want %s", node.Id, id)
+			}
+			a := &NMOSNode{Interfaces: tt.interfaces}
+			err := a.applyNodeSettings(&node, 3212)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			// transportHost and initSender need an endpoint
+			if len(node.API.Endpoints) == 0 || node.Href != node.API.Endpoints[0].URL() {
+				t.Fatalf("endpoints %v, href %q", node.API.Endpoints, node.Href)
+			}
+			if tt.href != "" && node.Href != tt.href {
+				t.Errorf("href %q, want %q", node.Href, tt.href)
+			}
+		})
+	}
+}
+
+func TestApplySystemGlobal(t *testing.T) {
+	reg := &fakeRegistry{}
+	srv := httptest.NewServer(reg)
+	defer srv.Close()
+	node := nmos.NMOSNodeData{Id: uuid.New(), Version: "1:0", PTPDomain: 127}
+	a := &NMOSNode{RegistryURI: srv.URL + "/resource", res: nmos.NewResources(node, nil)}
+	var g nmos.NMOSSystemGlobal
+	g.Is04.Heartbeat_interval = 3
+	g.Ptp.Domain_number = 5
+	a.ApplySystemGlobal(&g)
+
+	got, _ := a.Snapshot()
+	if got.PTPDomain != 5 {
+		t.Errorf("ptp domain %d, want 5", got.PTPDomain)
+	}
+	if got.Version != node.Version {
+		t.Errorf("version %s, the node didn't change", got.Version)
+	}
+	if a.heartbeatInterval() != 3*time.Second {
+		t.Errorf("heartbeat interval %v, want 3s", a.heartbeatInterval())
+	}
+	<-a.registrations.push(func() {})
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if len(reg.calls) != 0 {
+		t.Errorf("registry calls %v, want none", reg.calls)
+	}
+}
@@ -0,0 +1,270 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/thyge/gonmos/pkg/nmos"
+)
+
+// WatchConfig reloads file on SIGHUP or when it changes on disk until ctx
+// is done. A config that fails to load is logged and the running one kept.
+// Start runs it for ConfigFile once the node is set up.
+func (a *NMOSNode) WatchConfig(ctx context.Context, file string) {
+	hup, stop := notifyReload()
+	defer stop()
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+	last := modTime(file)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			nmos.Infoln("SIGHUP, reloading", file)
+		case <-ticker.C:
+			t := modTime(file)
+			if t.Equal(last) {
+				continue
+			}
+			last = t
+			nmos.Infoln(file, "changed, reloading")
+		}
+		cfg, err := LoadConfig(file)
+		if err != nil {
+			nmos.Errorln("reload failed, keeping the running config:", err)
+			continue
+		}
+		if err := a.Reload(cfg); err != nil {
+			nmos.Errorln("reload failed:", err)
+			continue
+		}
+		if err := cfg.SaveState(); err != nil {
+			nmos.Errorln("reload: saving the config state:", err)
+		}
+	}
+}
+
+func modTime(file string) time.Time {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime()
+}
+
+// Reload applies a changed config to the running node without dropping its
+// registration. Settings that need a restart, such as the port, are logged
+// and left as they are. A config for another node id is refused.
+func (a *NMOSNode) Reload(cfg *NMOSNodeConfig) error {
+	if a.res == nil {
+		return errNotStarted
+	}
+	devices, err := cfg.BuildDevices()
+	if err != nil {
+		return err
+	}
+	node, _ := a.res.Snapshot()
+	if cfg.Id != node.Id {
+		// derived ids depend on the node id, nothing would match
+		return fmt.Errorf("node id changed to %s, restart to apply", cfg.Id)
+	}
+	if cfg.Port != a.WSApi.Port {
+		nmos.Infoln("reload: the port changes on restart")
+	}
+	if cfg.Registry.URL != a.Registry {
+		nmos.Infoln("reload: the registry changes on restart")
+	}
+	if cfg.MQTT_broker != a.MQTTBroker {
+		nmos.Infoln("reload: the MQTT broker changes on restart")
+	}
+	if strings.Join(cfg.Interfaces, ",") != strings.Join(a.Interfaces, ",") {
+		nmos.Infoln("reload: the interfaces change on restart")
+	}
+	label, description := node.Label, node.Description
+	if cfg.Label != "" {
+		label = cfg.Label
+	}
+	if cfg.Description != "" {
+		description = cfg.Description
+	}
+	if label != node.Label || description != node.Description {
+		a.Label, a.Description = cfg.Label, cfg.Description
+		if err := a.UpdateNode(func(n *nmos.NMOSNodeData) {
+			n.Label, n.Description = label, description
+		}); err != nil {
+			return err
+		}
+	}
+	return a.SyncDevices(devices)
+}
+
+// SyncDevices makes the node's devices match desired. Resources are matched
+// by id. Removed ones are deleted from the registry first, children before
+// parents, then new ones are added and changed ones updated, parents first.
+// Sources whose format changes are replaced with their flows and the
+// senders of those, senders and receivers whose transport or bindings
+// change are replaced.
+func (a *NMOSNode) SyncDevices(desired []*nmos.NMOSDevice) error {
+	if a.res == nil {
+		return errNotStarted
+	}
+	var errs []string
+	check := func(err error) {
+		if err != nil {
+			nmos.Errorln("reload:", err)
+			errs = append(errs, err.Error())
+		}
+	}
+	want := make(map[uuid.UUID]*nmos.NMOSDevice)
+	for _, d := range desired {
+		want[d.Id] = d
+	}
+
+	_, running := a.res.Snapshot()
+	for _, d := range running {
+		w := want[d.Id]
+		if w == nil {
+			check(a.RemoveDevice(d.Id))
+			continue
+		}
+		// a replaced source takes its flows and their senders with it, they
+		// are added again with the new one
+		sources := make(map[uuid.UUID]bool)
+		for _, s := range d.Sources {
+			if ns := w.FindSource(s.Id); ns == nil || ns.Format != s.Format || ns.Event_type != s.Event_type {
+				sources[s.Id] = true
+			}
+		}
+		for _, r := range d.Receivers {
+			if nr := w.FindReceiver(r.Id); nr == nil || replaceReceiver(&r, nr) {
+				check(a.RemoveReceiver(r.Id))
+			}
+		}
+		for _, s := range d.Senders {
+			if ns := w.FindSender(s.Id); ns == nil || replaceSender(&s, ns) {
+				check(a.RemoveSender(s.Id))
+			}
+		}
+		for _, f := range d.Flows {
+			if w.FindFlow(f.Id) == nil || sources[f.Source_id] {
+				check(a.RemoveFlow(f.Id))
+			}
+		}
+		for _, s := range d.Sources {
+			if sources[s.Id] {
+				check(a.RemoveSource(s.Id))
+			}
+		}
+	}
+
+	node, running := a.res.Snapshot()
+	for _, w := range desired {
+		d := running.FindDevice(w.Id)
+		if d == nil {
+			check(a.AddDevice(*w))
+			continue
+		}
+		// the controls w gets once set up, with those of the node's APIs
+		controls := *w
+		controls.Controls = append([]nmos.NMOSControl{}, w.Controls...)
+		setControls(&node, &controls)
+		if d.Label != w.Label || d.Description != w.Description || d.Type != w.Type || !sameJSON(d.Controls, controls.Controls) {
+			w := w
+			check(a.UpdateDevice(w.Id, func(d *nmos.NMOSDevice) {
+				d.Label, d.Description, d.Type = w.Label, w.Description, w.Type
+				d.Controls = controls.Controls
+			}))
+		}
+		for _, s := range w.Sources {
+			s := s
+			if old := d.FindSource(s.Id); old == nil {
+				check(a.AddSource(s))
+			} else if s.Version = old.Version; !sameJSON(*old, s) {
+				check(a.UpdateSource(s.Id, func(r *nmos.NMOSSource) {
+					r.Label, r.Description, r.Tags = s.Label, s.Description, s.Tags
+					r.Grain_rate, r.Channels = s.Grain_rate, s.Channels
+				}))
+			}
+		}
+		for _, f := range w.Flows {
+			f := f
+			if old := d.FindFlow(f.Id); old == nil {
+				check(a.AddFlow(f))
+			} else if f.Version = old.Version; !sameJSON(*old, f) {
+				check(a.UpdateFlow(f.Id, func(r *nmos.NMOSFlow) {
+					version := r.Version
+					*r = f
+					r.Version = version
+				}))
+			}
+		}
+		for _, s := range w.Senders {
+			s := s
+			old := d.FindSender(s.Id)
+			if old == nil {
+				check(a.AddSender(s))
+			} else if old.Label != s.Label || old.Description != s.Description {
+				check(a.UpdateSender(s.Id, func(r *nmos.NMOSSender) {
+					r.Label, r.Description = s.Label, s.Description
+				}))
+			}
+		}
+		for _, r := range w.Receivers {
+			r := r
+			old := d.FindReceiver(r.Id)
+			if old == nil {
+				check(a.AddReceiver(r))
+				continue
+			}
+			capsChanged := !sameCaps(old.Caps, r.Caps)
+			if old.Label != r.Label || old.Description != r.Description || capsChanged {
+				check(a.UpdateReceiver(r.Id, func(nr *nmos.NMOSReceiver) {
+					nr.Label, nr.Description = r.Label, r.Description
+					if capsChanged {
+						nr.Caps = r.Caps
+						if err := nr.InitCaps(); err != nil {
+							nmos.Errorln("reload: receiver", r.Id, err)
+						}
+					}
+				}))
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%d changes failed: %s", len(errs), strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// replaceSender is true if the IS-05 state of old can't carry over to s
+func replaceSender(old *nmos.NMOSSender, s *nmos.NMOSSender) bool {
+	return old.Transport != s.Transport || old.Flow_id != s.Flow_id ||
+		!reflect.DeepEqual(old.Interface_bindings, s.Interface_bindings) ||
+		!sameJSON(old.Constraints, s.Constraints) || !sameJSON(old.TransportParams, s.TransportParams)
+}
+
+// replaceReceiver is true if the IS-05 state of old can't carry over to r
+func replaceReceiver(old *nmos.NMOSReceiver, r *nmos.NMOSReceiver) bool {
+	return old.Transport != r.Transport || old.Format != r.Format ||
+		!reflect.DeepEqual(old.Interface_bindings, r.Interface_bindings) ||
+		!sameJSON(old.Constraints, r.Constraints) || !sameJSON(old.TransportParams, r.TransportParams)
+}
+
+// sameCaps compares caps ignoring their version
+func sameCaps(a, b nmos.NMOSCapabilities) bool {
+	a.Version, b.Version = "", ""
+	return sameJSON(a, b)
+}
+
+func sameJSON(a, b interface{}) bool {
+	ja, errA := json.Marshal(a)
+	jb, errB := json.Marshal(b)
+	return errA == nil && errB == nil && string(ja) == string(jb)
+}
@@ -0,0 +1,11 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package node
+
+import "os"
+
+// notifyReload returns a channel that never fires, there is no SIGHUP
+func notifyReload() (<-chan os.Signal, func()) {
+	return nil, func() {}
+}
@@ -0,0 +1,115 @@
+package node
+
+import (
+	"net/http/httptest"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/thyge/gonmos/pkg/nmos"
+)
+
+// reloadTestConfig is a config with a video source, its flow and a sender
+// with a fixed key so both loads derive the same ids
+const reloadTestConfig = `key: reload-test
+label: test
+devices:
+  - label: Camera
+    sources:
+      - label: Camera
+        format: urn:x-nmos:format:video
+    flows:
+      - label: Camera
+        source: Camera
+        media_type: video/raw
+    senders:
+      - label: Camera
+        flow: Camera
+        transport: urn:x-nmos:transport:rtp.mcast
+`
+
+// registryCalls drops the versions and ids of the calls of a fakeRegistry,
+// e.g. "POST flow" and "DELETE flows"
+func registryCalls(reg *fakeRegistry) []string {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	calls := []string{}
+	for _, call := range reg.calls {
+		f := strings.Fields(call)
+		if f[0] == "DELETE" {
+			f[1] = path.Base(path.Dir(f[1]))
+		}
+		calls = append(calls, f[0]+" "+f[1])
+	}
+	return calls
+}
+
+func TestSyncDevices(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   []string
+	}{
+		{name: "unchanged", config: reloadTestConfig, want: []string{}},
+		{
+			name:   "device description",
+			config: strings.Replace(reloadTestConfig, "    sources:\n", "    description: Main camera\n    sources:\n", 1),
+			want:   []string{"POST device"},
+		},
+		{
+			name:   "device controls",
+			config: strings.Replace(reloadTestConfig, "    sources:\n", "    controls:\n      - type: urn:x-manufacturer:control:generic\n        href: http://camera/api\n    sources:\n", 1),
+			want:   []string{"POST device"},
+		},
+		{
+			name:   "source format replaces the source, its flow and sender",
+			config: strings.Replace(reloadTestConfig, "format: urn:x-nmos:format:video", "format: urn:x-nmos:format:data", 1),
+			want: []string{"DELETE senders", "DELETE flows", "POST device", "DELETE sources",
+				"POST source", "POST flow", "POST sender", "POST device"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			load := func(data string) []*nmos.NMOSDevice {
+				t.Helper()
+				c, err := ParseConfig("node.yaml", []byte(data))
+				if err != nil {
+					t.Fatal(err)
+				}
+				devices, err := c.BuildDevices()
+				if err != nil {
+					t.Fatal(err)
+				}
+				return devices
+			}
+			node := nmos.NMOSNodeData{Id: uuid.New(), Version: "1:0"}
+			node.API.Endpoints = []nmos.NMOSEndpoint{{Host: "192.168.1.10", Port: 8889, Protocol: "http"}}
+			a := &NMOSNode{}
+			a.res = nmos.NewResources(node, nil)
+			for _, d := range load(reloadTestConfig) {
+				if err := a.AddDevice(*d); err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, before := a.Snapshot()
+
+			reg := &fakeRegistry{}
+			srv := httptest.NewServer(reg)
+			defer srv.Close()
+			a.RegistryURI = srv.URL + "/resource"
+			if err := a.SyncDevices(load(tt.config)); err != nil {
+				t.Fatal(err)
+			}
+			<-a.registrations.push(func() {})
+			if got := registryCalls(reg); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("registry calls %v, want %v", got, tt.want)
+			}
+			_, after := a.Snapshot()
+			if len(after[0].Flows) != 1 || after[0].Flows[0].Id != before[0].Flows[0].Id {
+				t.Errorf("flows %+v", after[0].Flows)
+			}
+		})
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package node
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyReload delivers SIGHUP on the returned channel until stop is called
+func notifyReload() (<-chan os.Signal, func()) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	return c, func() { signal.Stop(c) }
+}
@@ -0,0 +1,640 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/thyge/gonmos/pkg/nmos"
+)
+
+var errNotStarted = errors.New("node not started")
+
+// Snapshot returns a consistent copy of the node and its devices
+func (a *NMOSNode) Snapshot() (nmos.NMOSNodeData, nmos.NMOSDevices) {
+	if a.res == nil {
+		return nmos.NMOSNodeData{}, nil
+	}
+	return a.res.Snapshot()
+}
+
+// initVersions gives resources the config left without a version one
+func initVersions(d *nmos.NMOSDevice) {
+	if d.Version == "" {
+		d.Version = nmos.NewVersion()
+	}
+	for i := range d.Sources {
+		if d.Sources[i].Version == "" {
+			d.Sources[i].Version = nmos.NewVersion()
+		}
+	}
+	for i := range d.Flows {
+		if d.Flows[i].Version == "" {
+			d.Flows[i].Version = nmos.NewVersion()
+		}
+	}
+	for i := range d.Senders {
+		if d.Senders[i].Version == "" {
+			d.Senders[i].Version = nmos.NewVersion()
+		}
+	}
+	for i := range d.Receivers {
+		if d.Receivers[i].Version == "" {
+			d.Receivers[i].Version = nmos.NewVersion()
+		}
+	}
+}
+
+// initDevice sets up a device from config for node, others are the
+// devices the node already has
+func (a *NMOSNode) initDevice(node *nmos.NMOSNodeData, others nmos.NMOSDevices, d *nmos.NMOSDevice) error {
+	if others.FindDevice(d.Id) != nil {
+		return fmt.Errorf("device %s already exists", d.Id)
+	}
+	if d.ChannelMapping != nil && others.ChannelMapping() != nil {
+		return errors.New("only one device per node can have channel mapping")
+	}
+	d.Node_id = node.Id
+	initVersions(d)
+	// flows of the device and of the other devices
+	all := append(others[:len(others):len(others)], *d)
+	for i := range d.Sources {
+		d.Sources[i].Device_id = d.Id
+	}
+	for i := range d.Flows {
+		d.Flows[i].Device_id = d.Id
+	}
+	for i := range d.Senders {
+		d.Senders[i].Device_id = d.Id
+		if err := a.initSender(node, all, &d.Senders[i]); err != nil {
+			return fmt.Errorf("sender %s: %v", d.Senders[i].Label, err)
+		}
+	}
+	for i := range d.Receivers {
+		d.Receivers[i].Device_id = d.Id
+		if err := a.initReceiver(node, &d.Receivers[i]); err != nil {
+			return fmt.Errorf("receiver %s: %v", d.Receivers[i].Label, err)
+		}
+	}
+	for i := range d.Inputs {
+		if err := d.Inputs[i].InitEDID(); err != nil {
+			return fmt.Errorf("input %s: %v", d.Inputs[i].Id, err)
+		}
+	}
+	for i := range d.Outputs {
+		if err := d.Outputs[i].InitEDID(); err != nil {
+			return fmt.Errorf("output %s: %v", d.Outputs[i].Id, err)
+		}
+	}
+
+	setControls(node, d)
+	return nil
+}
+
+// setControls advertises the APIs of this node that serve d
+func setControls(node *nmos.NMOSNodeData, d *nmos.NMOSDevice) {
+	setControl(node, d, "urn:x-nmos:control:sr-ctrl/v1.1", "/x-nmos/connection/v1.1/")
+	setControl(node, d, "urn:x-nmos:control:stream-compat/v1.0", "/x-nmos/streamcompatibility/v1.0/")
+	if d.ChannelMapping != nil {
+		setControl(node, d, "urn:x-nmos:control:cm-ctrl/v1.0", "/x-nmos/channelmapping/v1.0/")
+	}
+	for _, s := range d.Sources {
+		if s.Events != nil {
+			setControl(node, d, "urn:x-nmos:control:events/v1.0", "/x-nmos/events/v1.0/")
+			break
+		}
+	}
+}
+
+// initSender sets up the IS-05 and IS-11 state of a sender, its flow is
+// looked up in devices
+func (a *NMOSNode) initSender(node *nmos.NMOSNodeData, devices nmos.NMOSDevices, s *nmos.NMOSSender) error {
+	// This should be the actual IP if the IP interface
+	// Since we don't have one we just pick the first local
+	s.InitHREF(node.API.Endpoints[0].URL())
+	host := a.transportHost(node, s.Interface_bindings)
+	if flow := devices.FindFlow(s.Flow_id); flow != nil && flow.Event_type != "" {
+		host.EventSource = &flow.Source_id
+	}
+	if err := s.InitConnection(host); err != nil {
+		return err
+	}
+	s.Connection.OnActivate = a.senderActivated(s.Id)
+	s.InitCompatibility()
+	return nil
+}
+
+// initReceiver sets up the caps and IS-05 state of a receiver
+func (a *NMOSNode) initReceiver(node *nmos.NMOSNodeData, r *nmos.NMOSReceiver) error {
+	if err := r.InitCaps(); err != nil {
+		return err
+	}
+	if err := r.InitConnection(a.transportHost(node, r.Interface_bindings)); err != nil {
+		return err
+	}
+	r.Connection.OnActivate = a.receiverActivated(r.Id)
+	return nil
+}
+
+// deviceFor returns the device with id, which may be left out if the node
+// has a single device
+func deviceFor(devices nmos.NMOSDevices, id uuid.UUID) (*nmos.NMOSDevice, error) {
+	if id == uuid.Nil {
+		if len(devices) == 1 {
+			return &devices[0], nil
+		}
+		return nil, errors.New("device_id is required on a node with several devices")
+	}
+	if d := devices.FindDevice(id); d != nil {
+		return d, nil
+	}
+	return nil, fmt.Errorf("no device %s", id)
+}
+
+// AddDevice sets up a device with its resources and registers them
+func (a *NMOSNode) AddDevice(d nmos.NMOSDevice) error {
+	if a.res == nil {
+		return errNotStarted
+	}
+	node, snap := a.res.Snapshot()
+	if err := a.initDevice(&node, snap, &d); err != nil {
+		return err
+	}
+	var err error
+	a.res.Update(func(node *nmos.NMOSNodeData, devices *nmos.NMOSDevices) {
+		if devices.FindDevice(d.Id) != nil {
+			err = fmt.Errorf("device %s already exists", d.Id)
+			return
+		}
+		*devices = append(*devices, d)
+	})
+	if err != nil {
+		return err
+	}
+	a.registerDevice(d)
+	return nil
+}
+
+// RemoveDevice removes a device and everything on it
+func (a *NMOSNode) RemoveDevice(id uuid.UUID) error {
+	if a.res == nil {
+		return errNotStarted
+	}
+	var removed *nmos.NMOSDevice
+	a.res.Update(func(node *nmos.NMOSNodeData, devices *nmos.NMOSDevices) {
+		for i := range *devices {
+			if (*devices)[i].Id == id {
+				d := (*devices)[i]
+				removed = &d
+				*devices = append((*devices)[:i], (*devices)[i+1:]...)
+				return
+			}
+		}
+	})
+	if removed == nil {
+		return fmt.Errorf("no device %s", id)
+	}
+	// children go first so the registry never holds orphans
+	for _, r := range removed.Receivers {
+		a.closeEventClient(r.Id)
+		a.unregister("receiver", r.Id)
+	}
+	for _, s := range removed.Senders {
+		a.closeEventClient(s.Id)
+		a.unregister("sender", s.Id)
+	}
+	for _, f := range removed.Flows {
+		a.unregister("flow", f.Id)
+	}
+	for _, s := range removed.Sources {
+		a.unregister("source", s.Id)
+	}
+	a.unregister("device", id)
+	return nil
+}
+
+// AddSource adds a source to the device given by its Device_id and
+// registers it
+func (a *NMOSNode) AddSource(s nmos.NMOSSource) error {
+	if a.res == nil {
+		return errNotStarted
+	}
+	var err error
+	a.res.Update(func(node *nmos.NMOSNodeData, devices *nmos.NMOSDevices) {
+		if devices.FindSource(s.Id) != nil {
+			err = fmt.Errorf("source %s already exists", s.Id)
+			return
+		}
+		var d *nmos.NMOSDevice
+		if d, err = deviceFor(*devices, s.Device_id); err != nil {
+			return
+		}
+		s.Device_id = d.Id
+		s.Version = nmos.NextVersion(s.Version)
+		d.Sources = append(d.Sources, s)
+	})
+	if err != nil {
+		return err
+	}
+	a.register(s, "source")
+	return nil
+}
+
+// AddFlow adds a flow to the device given by its Device_id and registers
+// it, its source should be added first
+func (a *NMOSNode) AddFlow(f nmos.NMOSFlow) error {
+	if a.res == nil {
+		return errNotStarted
+	}
+	var err error
+	a.res.Update(func(node *nmos.NMOSNodeData, devices *nmos.NMOSDevices) {
+		if devices.FindFlow(f.Id) != nil {
+			err = fmt.Errorf("flow %s already exists", f.Id)
+			return
+		}
+		var d *nmos.NMOSDevice
+		if d, err = deviceFor(*devices, f.Device_id); err != nil {
+			return
+		}
+		f.Device_id = d.Id
+		f.Version = nmos.NextVersion(f.Version)
+		d.Flows = append(d.Flows, f)
+	})
+	if err != nil {
+		return err
+	}
+	a.register(f, "flow")
+	return nil
+}
+
+// AddSender sets up the connection state of a sender, adds it to the device
+// given by its Device_id and registers both
+func (a *NMOSNode) AddSender(s nmos.NMOSSender) error {
+	if a.res == nil {
+		return errNotStarted
+	}
+	node, snap := a.res.Snapshot()
+	if snap.FindSender(s.Id) != nil {
+		return fmt.Errorf("sender %s already exists", s.Id)
+	}
+	if _, err := deviceFor(snap, s.Device_id); err != nil {
+		return err
+	}
+	if err := a.initSender(&node, snap, &s); err != nil {
+		return err
+	}
+	var device nmos.NMOSDevice
+	var err error
+	a.res.Update(func(node *nmos.NMOSNodeData, devices *nmos.NMOSDevices) {
+		if devices.FindSender(s.Id) != nil {
+			err = fmt.Errorf("sender %s already exists", s.Id)
+			return
+		}
+		var d *nmos.NMOSDevice
+		if d, err = deviceFor(*devices, s.Device_id); err != nil {
+			return
+		}
+		s.Device_id = d.Id
+		s.Version = nmos.NextVersion(s.Version)
+		d.Senders = append(d.Senders, s)
+		d.Version = nmos.NextVersion(d.Version)
+		device = *d
+	})
+	if err != nil {
+		return err
+	}
+	a.register(s, "sender")
+	a.register(device, "device")
+	return nil
+}
+
+// AddReceiver sets up the caps and connection state of a receiver, adds it
+// to the device given by its Device_id and registers both
+func (a *NMOSNode) AddReceiver(r nmos.NMOSReceiver) error {
+	if a.res == nil {
+		return errNotStarted
+	}
+	node, snap := a.res.Snapshot()
+	if snap.FindReceiver(r.Id) != nil {
+		return fmt.Errorf("receiver %s already exists", r.Id)
+	}
+	if _, err := deviceFor(snap, r.Device_id); err != nil {
+		return err
+	}
+	if err := a.initReceiver(&node, &r); err != nil {
+		return err
+	}
+	var device nmos.NMOSDevice
+	var err error
+	a.res.Update(func(node *nmos.NMOSNodeData, devices *nmos.NMOSDevices) {
+		if devices.FindReceiver(r.Id) != nil {
+			err = fmt.Errorf("receiver %s already exists", r.Id)
+			return
+		}
+		var d *nmos.NMOSDevice
+		if d, err = deviceFor(*devices, r.Device_id); err != nil {
+			return
+		}
+		r.Device_id = d.Id
+		r.Version = nmos.NextVersion(r.Version)
+		d.Receivers = append(d.Receivers, r)
+		d.Version = nmos.NextVersion(d.Version)
+		device = *d
+	})
+	if err != nil {
+		return err
+	}
+	a.register(r, "receiver")
+	a.register(device, "device")
+	return nil
+}
+
+// UpdateResource changes the node, device, source, flow, sender or receiver
+// with id, bumps its version and posts it to the registry. update gets a
+// pointer to the resource, e.g. *nmos.NMOSSender.
+func (a *NMOSNode) UpdateResource(id uuid.UUID, update func(resource interface{})) error {
+	return a.update(id, "", update)
+}
+
+func (a *NMOSNode) UpdateNode(update func(*nmos.NMOSNodeData)) error {
+	if a.res == nil {
+		return errNotStarted
+	}
+	node, _ := a.res.Snapshot()
+	return a.update(node.Id, "node", func(r interface{}) { update(r.(*nmos.NMOSNodeData)) })
+}
+
+func (a *NMOSNode) UpdateDevice(id uuid.UUID, update func(*nmos.NMOSDevice)) error {
+	return a.update(id, "device", func(r interface{}) { update(r.(*nmos.NMOSDevice)) })
+}
+
+func (a *NMOSNode) UpdateSource(id uuid.UUID, update func(*nmos.NMOSSource)) error {
+	return a.update(id, "source", func(r interface{}) { update(r.(*nmos.NMOSSource)) })
+}
+
+func (a *NMOSNode) UpdateFlow(id uuid.UUID, update func(*nmos.NMOSFlow)) error {
+	return a.update(id, "flow", func(r interface{}) { update(r.(*nmos.NMOSFlow)) })
+}
+
+// UpdateSender changes the IS-04 fields of a sender, its connection state
+// is kept
+func (a *NMOSNode) UpdateSender(id uuid.UUID, update func(*nmos.NMOSSender)) error {
+	return a.update(id, "sender", func(r interface{}) { update(r.(*nmos.NMOSSender)) })
+}
+
+// UpdateReceiver changes the IS-04 fields of a receiver, its connection
+// state is kept
+func (a *NMOSNode) UpdateReceiver(id uuid.UUID, update func(*nmos.NMOSReceiver)) error {
+	return a.update(id, "receiver", func(r interface{}) { update(r.(*nmos.NMOSReceiver)) })
+}
+
+// update runs f on the resource with id under the resource lock, kind
+// limits the search to one resource type if set
+func (a *NMOSNode) update(id uuid.UUID, kind string, f func(interface{})) error {
+	if a.res == nil {
+		return errNotStarted
+	}
+	want := func(k string) bool {
+		return kind == "" || kind == k
+	}
+	var res interface{}
+	var name string
+	a.res.Update(func(node *nmos.NMOSNodeData, devices *nmos.NMOSDevices) {
+		if want("node") && id == node.Id {
+			f(node)
+			node.Version = nmos.NextVersion(node.Version)
+			res, name = *node, "node"
+		} else if d := devices.FindDevice(id); want("device") && d != nil {
+			f(d)
+			d.Version = nmos.NextVersion(d.Version)
+			res, name = *d, "device"
+		} else if s := devices.FindSource(id); want("source") && s != nil {
+			f(s)
+			s.Version = nmos.NextVersion(s.Version)
+			res, name = *s, "source"
+		} else if fl := devices.FindFlow(id); want("flow") && fl != nil {
+			f(fl)
+			fl.Version = nmos.NextVersion(fl.Version)
+			res, name = *fl, "flow"
+		} else if s := devices.FindSender(id); want("sender") && s != nil {
+			f(s)
+			s.Version = nmos.NextVersion(s.Version)
+			res, name = *s, "sender"
+		} else if r := devices.FindReceiver(id); want("receiver") && r != nil {
+			f(r)
+			r.Version = nmos.NextVersion(r.Version)
+			res, name = *r, "receiver"
+		}
+	})
+	if res == nil {
+		if kind == "" {
+			kind = "resource"
+		}
+		return fmt.Errorf("no %s %s", kind, id)
+	}
+	a.register(res, name)
+	return nil
+}
+
+// RemoveSource removes a source with its flows and their senders
+func (a *NMOSNode) RemoveSource(id uuid.UUID) error {
+	return a.remove(id, "source")
+}
+
+// RemoveFlow removes a flow with its senders
+func (a *NMOSNode) RemoveFlow(id uuid.UUID) error {
+	return a.remove(id, "flow")
+}
+
+func (a *NMOSNode) RemoveSender(id uuid.UUID) error {
+	return a.remove(id, "sender")
+}
+
+func (a *NMOSNode) RemoveReceiver(id uuid.UUID) error {
+	return a.remove(id, "receiver")
+}
+
+// removal lists a resource with the resources referring to it
+type removal struct {
+	sources, flows, senders, receivers []uuid.UUID
+}
+
+// dependents returns the resource with id and, like RemoveDevice, what
+// would be left referring to it: the flows of a source and the senders of
+// those flows
+func dependents(devices nmos.NMOSDevices, id uuid.UUID, kind string) removal {
+	var r removal
+	switch kind {
+	case "source":
+		if devices.FindSource(id) == nil {
+			return r
+		}
+		r.sources = []uuid.UUID{id}
+		for _, f := range devices.Flows() {
+			if f.Source_id == id {
+				r.flows = append(r.flows, f.Id)
+			}
+		}
+	case "flow":
+		if devices.FindFlow(id) != nil {
+			r.flows = []uuid.UUID{id}
+		}
+	case "sender":
+		if devices.FindSender(id) != nil {
+			r.senders = []uuid.UUID{id}
+		}
+	case "receiver":
+		if devices.FindReceiver(id) != nil {
+			r.receivers = []uuid.UUID{id}
+		}
+	}
+	for _, s := range devices.Senders() {
+		if hasID(r.flows, s.Flow_id) {
+			r.senders = append(r.senders, s.Id)
+		}
+	}
+	return r
+}
+
+// removeFrom deletes the resources of r from d, true if d lost senders or
+// receivers, which it lists
+func (r removal) removeFrom(d *nmos.NMOSDevice) bool {
+	sources := d.Sources[:0]
+	for _, s := range d.Sources {
+		if !hasID(r.sources, s.Id) {
+			sources = append(sources, s)
+		}
+	}
+	d.Sources = sources
+	flows := d.Flows[:0]
+	for _, f := range d.Flows {
+		if !hasID(r.flows, f.Id) {
+			flows = append(flows, f)
+		}
+	}
+	d.Flows = flows
+	senders := d.Senders[:0]
+	for _, s := range d.Senders {
+		if !hasID(r.senders, s.Id) {
+			senders = append(senders, s)
+		}
+	}
+	receivers := d.Receivers[:0]
+	for _, rc := range d.Receivers {
+		if !hasID(r.receivers, rc.Id) {
+			receivers = append(receivers, rc)
+		}
+	}
+	changed := len(senders) != len(d.Senders) || len(receivers) != len(d.Receivers)
+	d.Senders, d.Receivers = senders, receivers
+	return changed
+}
+
+func hasID(ids []uuid.UUID, id uuid.UUID) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+// remove deletes a resource and its dependents from their device and the
+// registry. Devices list their senders and receivers so they are updated
+// when those go.
+func (a *NMOSNode) remove(id uuid.UUID, kind string) error {
+	if a.res == nil {
+		return errNotStarted
+	}
+	var r removal
+	var changed []nmos.NMOSDevice
+	a.res.Update(func(node *nmos.NMOSNodeData, devices *nmos.NMOSDevices) {
+		r = dependents(*devices, id, kind)
+		for i := range *devices {
+			d := &(*devices)[i]
+			if r.removeFrom(d) {
+				d.Version = nmos.NextVersion(d.Version)
+				changed = append(changed, *d)
+			}
+		}
+	})
+	if len(r.sources)+len(r.flows)+len(r.senders)+len(r.receivers) == 0 {
+		return fmt.Errorf("no %s %s", kind, id)
+	}
+	// dependents go first so the registry never holds dangling references
+	for _, id := range r.receivers {
+		a.closeEventClient(id)
+		a.unregister("receiver", id)
+	}
+	for _, id := range r.senders {
+		a.closeEventClient(id)
+		a.unregister("sender", id)
+	}
+	for _, id := range r.flows {
+		a.unregister("flow", id)
+	}
+	for _, id := range r.sources {
+		a.unregister("source", id)
+	}
+	for _, d := range changed {
+		a.register(d, "device")
+	}
+	return nil
+}
+
+// register queues a resource to post if the node is registered. It is
+// posted after the calls still queued, without waiting for the registry.
+func (a *NMOSNode) register(i interface{}, name string) {
+	if a.registryURI() == "" {
+		return
+	}
+	a.registrations.push(func() { a.sendResource(i, name) })
+}
+
+// registerDevice posts a device and its resources, parents first
+func (a *NMOSNode) registerDevice(d nmos.NMOSDevice) {
+	eachResource(d, a.register)
+}
+
+// eachResource calls f for a device and its resources, parents first
+func eachResource(d nmos.NMOSDevice, f func(i interface{}, name string)) {
+	f(d, "device")
+	for _, source := range d.Sources {
+		f(source, "source")
+	}
+	for _, flow := range d.Flows {
+		f(flow, "flow")
+	}
+	for _, sender := range d.Senders {
+		f(sender, "sender")
+	}
+	for _, receiver := range d.Receivers {
+		f(receiver, "receiver")
+	}
+}
+
+// unregister queues a delete of a resource if the node is registered
+func (a *NMOSNode) unregister(name string, id uuid.UUID) {
+	if a.registryURI() == "" {
+		return
+	}
+	a.registrations.push(func() { a.deleteResource(name, id) })
+}
+
+func (a *NMOSNode) deleteResource(name string, id uuid.UUID) {
+	req, _ := http.NewRequest(http.MethodDelete, fmt.Sprintf("%s/%ss/%s", a.registryURI(), name, id), nil)
+	resp, err := a.AuthClient.Do(a.httpClient(), req)
+	if err != nil {
+		nmos.Errorln("failed to delete", name, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		body, _ := ioutil.ReadAll(resp.Body)
+		nmos.Errorln("failed to delete", name, resp.Status, string(body))
+		return
+	}
+	nmos.Debugln("Deleted:", name)
+}
@@ -0,0 +1,121 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+
+	"github.com/google/uuid"
+	"github.com/thyge/gonmos/pkg/nmos"
+)
+
+// configState is kept next to a config file, in <file>.state. It holds the
+// node key if the config doesn't set one and the ids given to resources
+// without an id, so a renamed resource keeps its id.
+type configState struct {
+	Key       string          `json:"key"`
+	Resources []stateResource `json:"resources"`
+
+	file string
+	// the resources of the config just loaded
+	loaded []stateResource
+}
+
+// stateResource is a resource without a configured id, the index-th of its
+// kind in scope, its parent's id
+type stateResource struct {
+	Scope uuid.UUID `json:"scope"`
+	Kind  string    `json:"kind"`
+	Index int       `json:"index"`
+	Label string    `json:"label"`
+	Id    uuid.UUID `json:"id"`
+}
+
+// loadConfigState reads the state of a config file, a missing state file
+// gives a new random key
+func loadConfigState(file string) (*configState, error) {
+	st := &configState{file: file + ".state"}
+	data, err := ioutil.ReadFile(st.file)
+	if os.IsNotExist(err) {
+		st.Key = uuid.New().String()
+		return st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, fmt.Errorf("%s: %v", st.file, err)
+	}
+	if st.Key == "" {
+		st.Key = uuid.New().String()
+	}
+	return st, nil
+}
+
+// id returns the id of r, matching it with a known resource by label or,
+// if that label is gone from labels, by index as it was renamed. New
+// resources get an id derived from key.
+func (st *configState) id(key string, r stateResource, labels []string) uuid.UUID {
+	r.Id = uuid.Nil
+	for _, known := range st.Resources {
+		if known.Scope == r.Scope && known.Kind == r.Kind && known.Label == r.Label {
+			r.Id = known.Id
+			break
+		}
+	}
+	if r.Id == uuid.Nil {
+		for _, known := range st.Resources {
+			if known.Scope == r.Scope && known.Kind == r.Kind && known.Index == r.Index && !contains(labels, known.Label) {
+				r.Id = known.Id
+				break
+			}
+		}
+	}
+	if r.Id == uuid.Nil {
+		r.Id = nmos.StableID(key, r.Scope.String(), r.Kind, r.Label)
+	}
+	st.loaded = append(st.loaded, r)
+	return r.Id
+}
+
+// save writes the state if the loaded config changed it
+func (st *configState) save() error {
+	if st.loaded == nil {
+		st.loaded = []stateResource{}
+	}
+	if _, err := os.Stat(st.file); err == nil && reflect.DeepEqual(st.loaded, st.Resources) {
+		return nil
+	}
+	st.Resources = st.loaded
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := st.file + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, st.file)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultKeyFile keeps the key of a node started without an id, one per
+// API port so nodes on the same host differ
+func DefaultKeyFile(port int) string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "gonmos", fmt.Sprintf("node-%d.key", port))
+}
@@ -0,0 +1,13 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package node
+
+import (
+	"errors"
+	"io"
+)
+
+func dialSyslog(addr string) (io.Writer, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
@@ -0,0 +1,14 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package node
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// dialSyslog connects to an RFC 3164 syslog server over UDP
+func dialSyslog(addr string) (io.Writer, error) {
+	return syslog.Dial("udp", addr, syslog.LOG_INFO|syslog.LOG_DAEMON, "gonmos")
+}
@@ -0,0 +1,114 @@
+package node
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/grandcat/zeroconf"
+	"github.com/thyge/gonmos/pkg/nmos"
+)
+
+// DiscoverSystem browses for an IS-09 System API and applies the global
+// configuration of the first one that answers. The node keeps its defaults
+// if none is found within timeout.
+func (a *NMOSNode) DiscoverSystem(timeout time.Duration) {
+	resolver, err := zeroconf.NewResolver(nil)
+	if err != nil {
+		nmos.Errorln("Failed to initialize resolver:", err.Error())
+		return
+	}
+	entries := make(chan *zeroconf.ServiceEntry)
+	ctx, cancel := context.WithTimeout(a.Ctx, timeout)
+	defer cancel()
+	if err := resolver.Browse(ctx, "_nmos-system._tcp", "local", entries); err != nil {
+		nmos.Errorln("Failed to browse:", err.Error())
+		return
+	}
+	for {
+		select {
+		case entry, ok := <-entries:
+			if !ok {
+				nmos.Infoln("No system API found, using defaults")
+				return
+			}
+			if len(entry.AddrIPv4) == 0 {
+				continue
+			}
+			proto := nmos.MdnsTextValue(entry.Text, "api_proto", "http")
+			base := fmt.Sprintf("%s://%s:%d/x-nmos/system/v1.0", proto, entry.AddrIPv4[0], entry.Port)
+			global, err := nmos.GetSystemGlobal(a.httpClient(), base)
+			if err != nil {
+				nmos.Errorln("failed to get system global", err)
+				continue
+			}
+			a.ApplySystemGlobal(global)
+			return
+		case <-ctx.Done():
+			nmos.Infoln("No system API found, using defaults")
+			return
+		}
+	}
+}
+
+// ApplySystemGlobal applies the heartbeat interval, PTP domain and syslog
+// target of an IS-09 global configuration. The running heartbeat picks up
+// the new interval.
+func (a *NMOSNode) ApplySystemGlobal(g *nmos.NMOSSystemGlobal) {
+	a.systemMu.Lock()
+	a.HeartbeatInterval = time.Duration(g.Is04.Heartbeat_interval) * time.Second
+	a.systemMu.Unlock()
+	if a.res == nil {
+		nmos.Errorln("failed to set ptp domain", errNotStarted)
+	} else {
+		// the domain is only in the SDPs of the senders, the IS-04 node
+		// doesn't change and keeps its version
+		a.res.Update(func(n *nmos.NMOSNodeData, _ *nmos.NMOSDevices) { n.PTPDomain = g.Ptp.Domain_number })
+	}
+	nmos.Infoln("Applied system global", g.Label, "heartbeat", a.heartbeatInterval(), "ptp domain", g.Ptp.Domain_number)
+	if g.Syslog == nil || g.Syslog.Hostname == "" {
+		return
+	}
+	port := g.Syslog.Port
+	if port == 0 {
+		port = 514
+	}
+	w, err := dialSyslog(net.JoinHostPort(g.Syslog.Hostname, strconv.Itoa(port)))
+	if err != nil {
+		nmos.Errorln("failed to connect to syslog", err)
+		return
+	}
+	log.SetOutput(io.MultiWriter(os.Stderr, w))
+}
+
+func (a *NMOSNode) httpClient() *http.Client {
+	if a.client == nil {
+		return http.DefaultClient
+	}
+	return a.client
+}
+
+// tlsConfig is the TLS config of the node's HTTP client, for the other
+// connections the node makes. nil uses the system roots.
+func (a *NMOSNode) tlsConfig() *tls.Config {
+	if t, ok := a.httpClient().Transport.(*http.Transport); ok {
+		return t.TLSClientConfig
+	}
+	return nil
+}
+
+func (a *NMOSNode) heartbeatInterval() time.Duration {
+	a.systemMu.Lock()
+	defer a.systemMu.Unlock()
+	if a.HeartbeatInterval <= 0 {
+		return nmos.DefaultHeartbeatInterval * time.Second
+	}
+	return a.HeartbeatInterval
+}